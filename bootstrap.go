@@ -0,0 +1,135 @@
+package main
+
+import (
+	"a10000/store"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// importProgressInterval 导入时每隔多少个区块显示一次进度
+const importProgressInterval = 1000
+
+// exportChain 将高度 from 到 to 的区块导出到引导文件 path, to 小于 0 时导出到最新的区块
+// 先写入临时文件, 完成后再重命名
+func exportChain(opts *cliOptions, path string, from, to int64) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+	ch, err := opts.open()
+	if err != nil {
+		return err
+	}
+	height, err := ch.Height()
+	if err != nil {
+		return err
+	}
+	if to < 0 {
+		to = height
+	}
+	if to > height {
+		return fmt.Errorf("block %d is above chain height %d", to, height)
+	}
+	genesis, err := ch.BlockByHeight(0)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	header := store.BootstrapHeader{Network: opts.params().Name, Genesis: genesis.Hash, From: from, To: to}
+	bw, err := store.NewBootstrapWriter(w, header)
+	if err != nil {
+		return err
+	}
+	for h := from; h <= to; h++ {
+		b, err := ch.BlockByHeight(h)
+		if err != nil {
+			return err
+		}
+		if err := bw.WriteBlock(b); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	fmt.Printf("exported blocks %d-%d to %s\n", from, to, path)
+	return nil
+}
+
+// importChain 从引导文件 path 导入区块, 每个区块都通过 SubmitBlock 完整验证后连接
+// 已在区块链中的区块被跳过, 因此导入中断后再次导入同一个文件会从中断处继续
+func importChain(opts *cliOptions, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br, err := store.NewBootstrapReader(bufio.NewReader(f))
+	if err != nil {
+		return err
+	}
+	ch, err := opts.open()
+	if err != nil {
+		return err
+	}
+	genesis, err := ch.BlockByHeight(0)
+	if err != nil {
+		return err
+	}
+	if br.Header.Genesis != genesis.Hash {
+		return fmt.Errorf("%s belongs to network %s with genesis %s", path, br.Header.Network, br.Header.Genesis)
+	}
+	height, err := ch.Height()
+	if err != nil {
+		return err
+	}
+	if br.Header.From > height+1 {
+		return fmt.Errorf("%s starts at block %d, chain height is %d", path, br.Header.From, height)
+	}
+	if br.Header.To <= height {
+		fmt.Printf("chain height %d already includes blocks %d-%d\n", height, br.Header.From, br.Header.To)
+		return nil
+	}
+	if height >= br.Header.From && height > 0 {
+		fmt.Printf("skipping blocks %d-%d already in chain\n", br.Header.From, height)
+	}
+
+	imported := 0
+	for {
+		b, err := br.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if b.Index <= height {
+			continue
+		}
+		if err := ch.SubmitBlock(b); err != nil {
+			return fmt.Errorf("block %d: %v", b.Index, err)
+		}
+		imported++
+		if b.Index%importProgressInterval == 0 {
+			fmt.Printf("imported block %d/%d (%.1f%%)\n", b.Index, br.Header.To, float64(b.Index)*100/float64(br.Header.To))
+		}
+	}
+	fmt.Printf("imported %d blocks, height %d\n", imported, br.Header.To)
+	return nil
+}
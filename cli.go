@@ -0,0 +1,607 @@
+package main
+
+import (
+	"a10000/core"
+	"a10000/rpc"
+	"a10000/store"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// chainClient 命令行操作的区块链, 可以是本地的数据目录, 也可以是节点的 JSON-RPC
+type chainClient interface {
+	Height() (int64, error)
+	NextDifficulty() (int64, error)
+	BlockByHeight(height int64) (*core.Block, error)
+	BlockByHash(hash string) (*core.Block, error)
+	HeaderByHeight(height int64) (*core.BlockHeader, error)
+	HeaderByHash(hash string) (*core.BlockHeader, error)
+	FindUTXO(address string) (map[string]core.TxOutput, error)
+	FindSpendableUTXO(address string) (map[string]core.TxOutput, error)
+	PendingTransactions() ([]*core.Transaction, error)
+	SubmitTransaction(tx *core.Transaction) error
+	SubmitBlock(b *core.Block) error
+	Generate(count int, address string) ([]string, error)
+}
+
+// localChain 直接读写数据目录的区块链
+// 节点运行时会覆盖数据目录中的交易池, 因此只能在节点停止时使用
+type localChain struct {
+	store *store.BlockStore
+	chain *core.Blockchain
+}
+
+// openLocalChain 打开数据目录, 加载区块和交易池
+func openLocalChain(dir string, params *core.ChainParams) (*localChain, error) {
+	s, ch, err := openChain(dir, params)
+	if err != nil {
+		return nil, err
+	}
+	txs, err := s.Mempool()
+	if err != nil {
+		return nil, err
+	}
+	for _, tx := range txs {
+		if err := ch.AddTransaction(tx); err != nil {
+			log.Printf("drop saved transaction %s: %v", tx.ID, err)
+		}
+	}
+	return &localChain{store: s, chain: ch}, nil
+}
+
+func (c *localChain) Height() (int64, error) {
+	return c.chain.Height(), nil
+}
+
+func (c *localChain) NextDifficulty() (int64, error) {
+	return c.chain.NextDifficulty(), nil
+}
+
+func (c *localChain) BlockByHeight(height int64) (*core.Block, error) {
+	b := c.chain.BlockByHeight(height)
+	if b == nil && height > 0 && height <= c.chain.Pruned() {
+		return nil, fmt.Errorf("block %d has been pruned", height)
+	}
+	if b == nil {
+		return nil, fmt.Errorf("block %d not found", height)
+	}
+	return b, nil
+}
+
+func (c *localChain) BlockByHash(hash string) (*core.Block, error) {
+	b := c.chain.GetBlock(hash)
+	if b == nil {
+		return nil, fmt.Errorf("block %s not found", hash)
+	}
+	return b, nil
+}
+
+func (c *localChain) HeaderByHeight(height int64) (*core.BlockHeader, error) {
+	h := c.chain.HeaderByHeight(height)
+	if h == nil {
+		return nil, fmt.Errorf("block %d not found", height)
+	}
+	return h, nil
+}
+
+func (c *localChain) HeaderByHash(hash string) (*core.BlockHeader, error) {
+	h := c.chain.HeaderByHash(hash)
+	if h == nil {
+		return nil, fmt.Errorf("block %s not found", hash)
+	}
+	return h, nil
+}
+
+func (c *localChain) FindUTXO(address string) (map[string]core.TxOutput, error) {
+	return c.chain.FindUTXO(address), nil
+}
+
+func (c *localChain) FindSpendableUTXO(address string) (map[string]core.TxOutput, error) {
+	return c.chain.FindSpendableUTXO(address), nil
+}
+
+func (c *localChain) PendingTransactions() ([]*core.Transaction, error) {
+	return c.chain.PendingTransactions(), nil
+}
+
+func (c *localChain) SubmitTransaction(tx *core.Transaction) error {
+	if err := c.chain.AddTransaction(tx); err != nil {
+		return err
+	}
+	return c.store.PutMempool(c.chain.PendingTransactions())
+}
+
+func (c *localChain) SubmitBlock(b *core.Block) error {
+	if err := c.chain.AddBlock(b); err != nil {
+		return err
+	}
+	if err := c.store.SaveBlock(c.chain, b); err != nil {
+		return err
+	}
+	return c.store.PutMempool(c.chain.PendingTransactions())
+}
+
+func (c *localChain) Generate(count int, address string) ([]string, error) {
+	blocks, err := c.chain.Generate(count, address)
+	hashes := make([]string, 0, len(blocks))
+	for _, b := range blocks {
+		if err := c.store.SaveBlock(c.chain, b); err != nil {
+			return hashes, err
+		}
+		hashes = append(hashes, b.Hash)
+	}
+	if err != nil {
+		return hashes, err
+	}
+	return hashes, c.store.PutMempool(c.chain.PendingTransactions())
+}
+
+// rpcChain 通过节点的 JSON-RPC 操作的区块链
+type rpcChain struct {
+	client *rpc.Client
+}
+
+func (c *rpcChain) Height() (int64, error) {
+	return c.client.GetBlockCount()
+}
+
+func (c *rpcChain) NextDifficulty() (int64, error) {
+	return c.client.GetDifficulty()
+}
+
+func (c *rpcChain) BlockByHeight(height int64) (*core.Block, error) {
+	return c.client.GetBlockByHeight(height)
+}
+
+func (c *rpcChain) BlockByHash(hash string) (*core.Block, error) {
+	return c.client.GetBlock(hash)
+}
+
+func (c *rpcChain) HeaderByHeight(height int64) (*core.BlockHeader, error) {
+	return c.client.GetBlockHeaderByHeight(height)
+}
+
+func (c *rpcChain) HeaderByHash(hash string) (*core.BlockHeader, error) {
+	return c.client.GetBlockHeader(hash)
+}
+
+func (c *rpcChain) FindUTXO(address string) (map[string]core.TxOutput, error) {
+	return c.client.FindUTXO(address)
+}
+
+func (c *rpcChain) FindSpendableUTXO(address string) (map[string]core.TxOutput, error) {
+	return c.client.FindSpendableUTXO(address)
+}
+
+func (c *rpcChain) PendingTransactions() ([]*core.Transaction, error) {
+	return c.client.GetMempool()
+}
+
+func (c *rpcChain) SubmitTransaction(tx *core.Transaction) error {
+	_, err := c.client.SendRawTransaction(tx)
+	return err
+}
+
+func (c *rpcChain) SubmitBlock(b *core.Block) error {
+	_, err := c.client.SubmitBlock(b)
+	return err
+}
+
+func (c *rpcChain) Generate(count int, address string) ([]string, error) {
+	return c.client.Generate(count, address)
+}
+
+// cliOptions 命令的公共参数
+type cliOptions struct {
+	network     *string
+	dataDir     *string
+	rpcURL      *string
+	rpcUser     *string
+	rpcPassword *string
+	wallet      *string
+}
+
+func addCLIFlags(fs *flag.FlagSet) *cliOptions {
+	return &cliOptions{
+		network:     fs.String("network", core.MainNetParams.Name, "网络: mainnet, testnet, regtest 或私有网络的参数文件"),
+		dataDir:     fs.String("datadir", "", "数据目录, 未设置 -rpc 时直接读写其中的区块"),
+		rpcURL:      fs.String("rpc", "", "节点的 JSON-RPC 地址, 例如 http://127.0.0.1:6667"),
+		rpcUser:     fs.String("rpcuser", "", "JSON-RPC 认证的用户名"),
+		rpcPassword: fs.String("rpcpassword", "", "JSON-RPC 认证的密码, 为空时读取数据目录中的 cookie"),
+		wallet:      fs.String("wallet", "", "钱包文件, 默认为数据目录中的 wallet.json"),
+	}
+}
+
+// params 命令使用的网络参数
+func (o *cliOptions) params() *core.ChainParams {
+	params, err := loadParams(*o.network)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return params
+}
+
+// open 打开命令操作的区块链
+func (o *cliOptions) open() (chainClient, error) {
+	if *o.rpcURL == "" {
+		if *o.dataDir == "" {
+			return nil, errors.New("-datadir or -rpc is required")
+		}
+		return openLocalChain(*o.dataDir, o.params())
+	}
+	client, err := o.client()
+	if err != nil {
+		return nil, err
+	}
+	return &rpcChain{client: client}, nil
+}
+
+// client 连接 -rpc 指定的节点, 并检查节点与命令属于同一个网络
+func (o *cliOptions) client() (*rpc.Client, error) {
+	client := rpc.NewClient(*o.rpcURL, *o.rpcUser, *o.rpcPassword)
+	if *o.rpcPassword == "" && *o.dataDir != "" {
+		var err error
+		if client, err = rpc.NewCookieClient(*o.rpcURL, *o.dataDir); err != nil {
+			return nil, err
+		}
+	}
+	// 节点必须与命令属于同一个网络, 否则地址和区块奖励都不正确
+	genesis, err := client.GetBlockByHeight(0)
+	if err != nil {
+		return nil, err
+	}
+	if params := o.params(); genesis.Hash != params.GenesisBlock().Hash {
+		return nil, fmt.Errorf("node at %s does not belong to network %s", *o.rpcURL, params.Name)
+	}
+	return client, nil
+}
+
+// address 解析命令行输入的带有网络前缀的地址
+func (o *cliOptions) address(s string) (string, error) {
+	return o.params().DecodeAddress(s)
+}
+
+// walletPath 钱包文件的路径
+func (o *cliOptions) walletPath() string {
+	if *o.wallet != "" {
+		return *o.wallet
+	}
+	return filepath.Join(*o.dataDir, "wallet.json")
+}
+
+// loadWallet 读取钱包文件
+func (o *cliOptions) loadWallet() (*core.Wallet, error) {
+	var wallet core.Wallet
+	if err := store.ReadJSON(o.walletPath(), &wallet); err != nil {
+		return nil, fmt.Errorf("failed to load wallet: %v", err)
+	}
+	return &wallet, nil
+}
+
+// cliCommand 执行钱包, 转账, 挖矿和查询区块链的命令
+//
+//	wallet new [-scheme S]
+//	wallet address
+//	wallet balance [ADDR]
+//	send -to ADDR -amount N [-data D]
+//	mine [-to ADDR] [-count N]
+//	generate N [ADDR]
+//	chain show [-n N]
+//	block get HASH|HEIGHT
+//	export [-from N] [-to N] FILE
+//	import FILE
+//	snapshot dump [-height N] FILE
+//	snapshot load [-hash H] FILE
+func cliCommand(command string, args []string) {
+	switch command {
+	case "wallet", "chain", "block", "snapshot":
+		if len(args) == 0 {
+			usage()
+		}
+		command, args = command+" "+args[0], args[1:]
+	}
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	opts := addCLIFlags(fs)
+
+	var err error
+	switch command {
+	case "wallet new":
+		scheme := fs.String("scheme", core.SchemeECDSAP256, "签名算法")
+		fs.Parse(args)
+		err = walletNew(opts, *scheme)
+	case "wallet address":
+		fs.Parse(args)
+		var wallet *core.Wallet
+		if wallet, err = opts.loadWallet(); err == nil {
+			fmt.Println(opts.params().EncodeAddress(wallet.Address()))
+		}
+	case "wallet balance":
+		fs.Parse(args)
+		err = walletBalance(opts, fs.Arg(0))
+	case "send":
+		to := fs.String("to", "", "收款地址")
+		amount := fs.Int64("amount", 0, "转账金额")
+		data := fs.String("data", "", "交易附带的数据")
+		fs.Parse(args)
+		err = send(opts, *to, *amount, *data)
+	case "mine":
+		to := fs.String("to", "", "coinbase 奖励的地址, 默认为钱包地址")
+		count := fs.Int("count", 1, "挖出的区块数量")
+		fs.Parse(args)
+		err = mine(opts, *to, *count)
+	case "generate":
+		fs.Parse(args)
+		if fs.NArg() < 1 || fs.NArg() > 2 {
+			usage()
+		}
+		err = generate(opts, fs.Arg(0), fs.Arg(1))
+	case "chain show":
+		n := fs.Int64("n", 10, "显示的区块数量")
+		fs.Parse(args)
+		err = chainShow(opts, *n)
+	case "block get":
+		fs.Parse(args)
+		if fs.NArg() != 1 {
+			usage()
+		}
+		err = blockGet(opts, fs.Arg(0))
+	case "export":
+		from := fs.Int64("from", 0, "第一个区块的高度")
+		to := fs.Int64("to", -1, "最后一个区块的高度, 为 -1 时导出到最新的区块")
+		fs.Parse(args)
+		if fs.NArg() != 1 {
+			usage()
+		}
+		err = exportChain(opts, fs.Arg(0), *from, *to)
+	case "import":
+		fs.Parse(args)
+		if fs.NArg() != 1 {
+			usage()
+		}
+		err = importChain(opts, fs.Arg(0))
+	case "snapshot dump":
+		height := fs.Int64("height", -1, "快照的高度, 为 -1 时使用最新的区块")
+		fs.Parse(args)
+		if fs.NArg() != 1 {
+			usage()
+		}
+		err = snapshotDump(opts, *height, fs.Arg(0))
+	case "snapshot load":
+		hash := fs.String("hash", "", "可信的 UTXO 哈希, 快照不在网络参数中时必须设置")
+		fs.Parse(args)
+		if fs.NArg() != 1 {
+			usage()
+		}
+		err = snapshotLoad(opts, *hash, fs.Arg(0))
+	default:
+		usage()
+	}
+	if err != nil {
+		log.Fatalf("%s: %v", command, err)
+	}
+}
+
+func walletNew(opts *cliOptions, scheme string) error {
+	path := opts.walletPath()
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("wallet %s already exists", path)
+	}
+	wallet, err := core.NewWalletWithScheme(scheme)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(wallet)
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	// 钱包文件包含私钥, 只允许所有者读写
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return err
+	}
+	fmt.Println(opts.params().EncodeAddress(wallet.Address()))
+	return nil
+}
+
+func walletBalance(opts *cliOptions, address string) error {
+	if address == "" {
+		wallet, err := opts.loadWallet()
+		if err != nil {
+			return err
+		}
+		address = wallet.Address()
+	} else {
+		var err error
+		if address, err = opts.address(address); err != nil {
+			return err
+		}
+	}
+	ch, err := opts.open()
+	if err != nil {
+		return err
+	}
+	utxo, err := ch.FindUTXO(address)
+	if err != nil {
+		return err
+	}
+	balance := int64(0)
+	for _, output := range utxo {
+		balance += output.Amount
+	}
+	fmt.Println(balance)
+	return nil
+}
+
+func send(opts *cliOptions, to string, amount int64, data string) error {
+	if to == "" || amount <= 0 {
+		return errors.New("-to and a positive -amount are required")
+	}
+	to, err := opts.address(to)
+	if err != nil {
+		return err
+	}
+	wallet, err := opts.loadWallet()
+	if err != nil {
+		return err
+	}
+	ch, err := opts.open()
+	if err != nil {
+		return err
+	}
+	utxo, err := ch.FindSpendableUTXO(wallet.Address())
+	if err != nil {
+		return err
+	}
+	if balance := wallet.Balance(utxo); balance < amount {
+		return fmt.Errorf("insufficient spendable balance: %d < %d", balance, amount)
+	}
+	tx, err := wallet.NewTransaction(utxo, to, amount, data)
+	if err != nil {
+		return err
+	}
+	if err := ch.SubmitTransaction(tx); err != nil {
+		return err
+	}
+	fmt.Println(tx.ID)
+	return nil
+}
+
+func mine(opts *cliOptions, to string, count int) error {
+	if to == "" {
+		wallet, err := opts.loadWallet()
+		if err != nil {
+			return err
+		}
+		to = wallet.Address()
+	} else {
+		var err error
+		if to, err = opts.address(to); err != nil {
+			return err
+		}
+	}
+	params := opts.params()
+	ch, err := opts.open()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < count; i++ {
+		height, err := ch.Height()
+		if err != nil {
+			return err
+		}
+		// 从 UTXO 快照启动或修剪后最新区块可能只有区块头, 新区块只需要它的 Hash
+		tip, err := ch.HeaderByHeight(height)
+		if err != nil {
+			return err
+		}
+		pending, err := ch.PendingTransactions()
+		if err != nil {
+			return err
+		}
+		difficulty, err := ch.NextDifficulty()
+		if err != nil {
+			return err
+		}
+		// 交易池中交易的手续费不计入 coinbase, 只领取区块奖励
+		txs := append([]*core.Transaction{core.NewCoinbaseTX(height+1, to, params.Subsidy(height+1))}, pending...)
+		b := core.CreateBlock(height+1, txs, tip.Hash, difficulty)
+		if err := ch.SubmitBlock(b); err != nil {
+			return err
+		}
+		fmt.Printf("%d\t%s\n", b.Index, b.Hash)
+	}
+	return nil
+}
+
+// generate 在 regtest 等允许按需挖矿的网络上立即挖出区块, 未指定地址时区块奖励属于钱包
+func generate(opts *cliOptions, count string, to string) error {
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 {
+		return fmt.Errorf("invalid block count %s", count)
+	}
+	if to == "" {
+		wallet, err := opts.loadWallet()
+		if err != nil {
+			return err
+		}
+		to = wallet.Address()
+	} else if to, err = opts.address(to); err != nil {
+		return err
+	}
+	ch, err := opts.open()
+	if err != nil {
+		return err
+	}
+	hashes, err := ch.Generate(n, to)
+	for _, hash := range hashes {
+		fmt.Println(hash)
+	}
+	return err
+}
+
+func chainShow(opts *cliOptions, n int64) error {
+	ch, err := opts.open()
+	if err != nil {
+		return err
+	}
+	height, err := ch.Height()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("height %d\n", height)
+	for h := height; h >= 0 && h > height-n; h-- {
+		header, err := ch.HeaderByHeight(h)
+		if err != nil {
+			return err
+		}
+		// 区块头存在而区块不存在时, 区块体已被修剪
+		txs := "pruned"
+		if b, err := ch.BlockByHeight(h); err == nil {
+			txs = fmt.Sprintf("%d txs", len(b.Transactions))
+		}
+		fmt.Printf("%d\t%s\t%s\t%s\n", header.Index, header.Hash, time.UnixMilli(header.Timestamp).Format(time.RFC3339), txs)
+	}
+	return nil
+}
+
+func blockGet(opts *cliOptions, ref string) error {
+	ch, err := opts.open()
+	if err != nil {
+		return err
+	}
+	// 区块体已被修剪时只显示区块头
+	var b *core.Block
+	var h *core.BlockHeader
+	if height, parseErr := strconv.ParseInt(ref, 10, 64); parseErr == nil {
+		if b, err = ch.BlockByHeight(height); err != nil {
+			h, err = ch.HeaderByHeight(height)
+		}
+	} else if b, err = ch.BlockByHash(ref); err != nil {
+		h, err = ch.HeaderByHash(ref)
+	}
+	if err != nil {
+		return err
+	}
+	var v interface{} = b
+	if b == nil {
+		fmt.Fprintf(os.Stderr, "block %d has been pruned, showing its header\n", h.Index)
+		v = h
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
@@ -0,0 +1,69 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// VerifyState 在空的区块链上从创世区块开始重放所有区块, 重新验证工作量证明和全部交易(不使用签名缓存),
+// 并比较重建的 UTXO 和撤销记录与当前状态是否一致
+// 区块链已被修剪时, 从修剪高度的状态开始重放保留的区块. 重放期间不持有锁, 比较的是调用时的状态
+func (ch *Blockchain) VerifyState() error {
+	ch.mu.RLock()
+	var state *ChainState
+	if ch.pruned > 0 {
+		var err error
+		if state, err = ch.stateAt(ch.pruned); err != nil {
+			ch.mu.RUnlock()
+			return err
+		}
+	}
+	blocks := append([]*Block(nil), ch.blocks...)
+	undo := append([]*BlockUndo(nil), ch.undo...)
+	outputs := make(map[string]UTXOEntry, len(ch.outputs))
+	for key, entry := range ch.outputs {
+		outputs[key] = entry
+	}
+	ch.mu.RUnlock()
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	replay := CreateBlockchain(ch.Params)
+	replay.CoinbaseMaturity = ch.CoinbaseMaturity
+	replay.SchemeActivations = ch.SchemeActivations
+	replay.Verifier = NewSigVerifier(0, nil)
+	replay.Clock = ch.Clock
+	if state != nil {
+		if err := replay.RestoreState(blocks[0], state); err != nil {
+			return err
+		}
+		blocks = blocks[state.Height()+1:]
+	}
+	for _, b := range blocks {
+		var err error
+		if b.Index == 0 {
+			err = replay.ConnectGenesis(b)
+		} else {
+			err = replay.AddBlock(b)
+		}
+		if err != nil {
+			return fmt.Errorf("block %d: %w", b.Index, err)
+		}
+		if !reflect.DeepEqual(replay.undo[b.Index], undo[b.Index]) {
+			return fmt.Errorf("block %d: undo record does not match replay", b.Index)
+		}
+	}
+
+	for key, entry := range replay.outputs {
+		if stored, ok := outputs[key]; !ok || stored != entry {
+			return fmt.Errorf("utxo %s does not match replay", key)
+		}
+	}
+	for key := range outputs {
+		if _, ok := replay.outputs[key]; !ok {
+			return fmt.Errorf("utxo %s does not exist after replay", key)
+		}
+	}
+	return nil
+}
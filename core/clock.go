@@ -0,0 +1,57 @@
+package core
+
+import (
+	"a10000/utils"
+	"sync"
+	"time"
+)
+
+// Clock 时间戳的来源, 返回 Unix 毫秒时间戳
+// 区块链和钱包通过 Clock 获取时间, 测试中可以传入 FakeClock 使生成的区块和交易可以重现
+type Clock interface {
+	Now() int64
+}
+
+// ClockFunc 将函数转换为 Clock
+type ClockFunc func() int64
+
+// Now 调用函数获取时间戳
+func (f ClockFunc) Now() int64 {
+	return f()
+}
+
+// SystemClock 系统时钟, 返回当前的 UTC 时间戳
+var SystemClock Clock = ClockFunc(utils.GetUTCTimestamp)
+
+// FakeClock 测试用的时钟, 时间只在调用 Set 或 Advance 时改变
+// 可以在多个 goroutine 中使用
+type FakeClock struct {
+	mu  sync.Mutex
+	now int64
+}
+
+// NewFakeClock 创建时间为 now 的时钟
+func NewFakeClock(now int64) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now 当前的时间戳
+func (c *FakeClock) Now() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Set 将时间设置为 now
+func (c *FakeClock) Set(now int64) {
+	c.mu.Lock()
+	c.now = now
+	c.mu.Unlock()
+}
+
+// Advance 将时间向后调整 d
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now += d.Milliseconds()
+	c.mu.Unlock()
+}
@@ -1,29 +1,39 @@
 package core
 
 import (
-	"a10000/utils"
-	"errors"
 	"fmt"
+	"sync"
+	"time"
 )
 
 // Block 区块
 type Block struct {
-	Index        int64          // 区块高度
-	Timestamp    int64          // 区块创建时间戳
-	Transactions []*Transaction // 区块的数据
-	PreviousHash string         // 上一个区块的 Hash
-	Hash         string         // 当前区块的 Hash
+	Index        int64          `json:"index"`        // 区块高度
+	Timestamp    int64          `json:"timestamp"`    // 区块创建时间戳
+	Transactions []*Transaction `json:"transactions"` // 区块的数据
+	MerkleRoot   string         `json:"merkleroot"`   // 区块中所有交易 ID 的 Merkle 根
+	PreviousHash string         `json:"previoushash"` // 上一个区块的 Hash
+	Hash         string         `json:"hash"`         // 当前区块的 Hash
 	// 请编写PoW相关的字段
-	Nonce      int64 // 工作量证明的随机数
-	Difficulty int64 // 工作量证明的难度
+	Nonce      int64 `json:"nonce"`      // 工作量证明的随机数
+	Difficulty int64 `json:"difficulty"` // 工作量证明的难度
 }
 
-func (b *Block) Prefix() string {
-	prefix := ""
-	for i := int64(0); i < b.Difficulty; i++ {
-		prefix += "0"
+// Header 区块头
+func (b *Block) Header() *BlockHeader {
+	return &BlockHeader{
+		Index:        b.Index,
+		Timestamp:    b.Timestamp,
+		MerkleRoot:   b.MerkleRoot,
+		PreviousHash: b.PreviousHash,
+		Hash:         b.Hash,
+		Nonce:        b.Nonce,
+		Difficulty:   b.Difficulty,
 	}
-	return prefix
+}
+
+func (b *Block) Prefix() string {
+	return b.Header().Prefix()
 }
 
 // Mining 挖矿, 计算区块的 Nonce 和 Difficulty
@@ -32,6 +42,7 @@ func (b *Block) Prefix() string {
 // 直到找到一个满足条件的 Nonce，使得 Hash 的前 Difficulty 位为 0
 // 例如: Difficulty = 4 时，Hash 的前四位必须为 0000
 func (b *Block) Mining() {
+	b.MerkleRoot = ComputeMerkleRoot(b.Transactions)
 	prefix := b.Prefix()
 
 	for b.Hash == "" || b.Hash[:b.Difficulty] != prefix {
@@ -40,76 +51,326 @@ func (b *Block) Mining() {
 	}
 }
 
+// Verification 验证区块的工作量证明, 以及 MerkleRoot 是否与交易一致
 func (b *Block) Verification() error {
-	if b.Difficulty < 1 {
-		return errors.New("无效的区块: Difficulty 错误")
+	if err := b.Header().Verification(); err != nil {
+		return err
 	}
 
-	hast := b.CalculateHash()
-	if hast != b.Hash {
-		return errors.New("无效的区块: Hash 错误")
-	}
-
-	// 判断 hash 的前 Difficulty 位是否为 0
-	prefix := b.Prefix()
-
-	if b.Hash[:b.Difficulty] != prefix {
-		return errors.New("无效的区块: Hash 前缀错误")
+	if b.MerkleRoot != ComputeMerkleRoot(b.Transactions) {
+		return newError(SeverityFatal, "无效的区块: MerkleRoot 错误")
 	}
 
 	return nil
 }
 
 // CalculateHash 计算区块的 Hash
-// 计算方式为: sha256(区块的字符串表示)
-// 区块的字符串表示为: Index + Timestamp + Transactions + PreviousHash
+// 区块的 Hash 即区块头的 Hash, 交易通过 MerkleRoot 参与计算
 // 注意: 需要将计算结果转换为十六进制字符串
 func (b *Block) CalculateHash() string {
-	return utils.Hash(b.String())
+	return b.Header().CalculateHash()
 }
 
 func (b *Block) String() []byte {
-	formatStr := fmt.Sprintf("%d%d%v%s%d%d", b.Index, b.Timestamp, b.Transactions, b.PreviousHash, b.Nonce, b.Difficulty)
-	return []byte(formatStr)
+	return b.Header().String()
+}
+
+// MaxFutureBlockTime 区块时间戳最多可以超过当前时间的时长
+// 节点之间的时钟存在误差, 超过该时长的区块暂时不接受
+const MaxFutureBlockTime = 2 * time.Hour
+
+// DefaultCoinbaseMaturity 默认的 coinbase 成熟度
+// coinbase 交易的输出必须经过该数量的区块确认后才能被花费,
+// 避免创建 coinbase 的区块被回滚后, 所有花费了该 coinbase 的后续交易全部失效
+const DefaultCoinbaseMaturity = 100
+
+// UTXOEntry 未花费的交易输出
+// 除了输出本身, 还记录了创建该输出的区块高度, 以及是否为 coinbase 交易的输出
+type UTXOEntry struct {
+	TxOutput
+	Height   int64 `json:"height"`   // 创建该输出的区块高度
+	Coinbase bool  `json:"coinbase"` // 是否为 coinbase 交易的输出
 }
 
 // Blockchain 区块链
+// 区块, 交易池和 UTXO 只能通过方法访问, 所有方法都可以在多个 goroutine 中同时调用:
+// 修改状态的方法(AddTransaction, AddBlock, ConnectGenesis, DisconnectTip, Prune, RestoreState)持有写锁依次执行,
+// 查询方法持有读锁, 看到的总是某个区块连接前或连接后的完整状态.
+// 配置字段(Params, CoinbaseMaturity, SchemeActivations, Verifier, Clock)只能在区块链被共享之前修改
 type Blockchain struct {
-	Blocks              []*Block            // 区块链
-	PendingTransactions []*Transaction      // 待处理的交易
-	Outputs             map[string]TxOutput // 区块链中余额不是直接存储的，而是通过 UTXO 计算得出. key: txid:index => value: TxOutput
+	mu      sync.RWMutex
+	blocks  []*Block             // 区块链
+	pending []*Transaction       // 待处理的交易
+	outputs map[string]UTXOEntry // 区块链中余额不是直接存储的，而是通过 UTXO 计算得出. key: txid:index => value: UTXOEntry
+	undo    []*BlockUndo         // 每个区块的撤销记录, undo[i] 对应 blocks[i]
+	pruned  int64                // 区块体和撤销记录已被删除的最高高度, 为 0 时没有修剪. 创世区块不会被修剪
+	events  []Event              // 持有写锁期间产生, 释放写锁时发出的事件
+
+	notifyMu    sync.Mutex // 保证事件按顺序发出
+	subscribers []*subscriber
+
+	Params            *ChainParams     // 网络参数
+	CoinbaseMaturity  int64            // coinbase 输出可被花费前需要的确认数
+	SchemeActivations map[string]int64 // 签名算法的激活高度, 未列出的签名算法不可用. key: 签名算法标识 => value: 激活高度
+	Verifier          *SigVerifier     // 签名验证器
+	Clock             Clock            // 当前时间的来源, 用于生成区块和拒绝时间戳过于超前的区块
+}
+
+// Snapshot 区块链在某一时刻的一致状态
+// 快照中的数据是复制的, 之后区块链的变化不会影响快照
+type Snapshot struct {
+	Tip     *Block               // 最新的区块, 区块链为空时为 nil
+	Height  int64                // 区块链的高度, 区块链为空时为 -1
+	UTXO    map[string]UTXOEntry // 未花费的输出. key: txid:index => value: UTXOEntry
+	Mempool []*Transaction       // 交易池中的交易
+}
+
+// Snapshot 获取区块链当前状态的快照
+func (ch *Blockchain) Snapshot() *Snapshot {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	utxo := make(map[string]UTXOEntry, len(ch.outputs))
+	for key, entry := range ch.outputs {
+		utxo[key] = entry
+	}
+	return &Snapshot{
+		Tip:     ch.tip(),
+		Height:  ch.height(),
+		UTXO:    utxo,
+		Mempool: append([]*Transaction(nil), ch.pending...),
+	}
+}
+
+// Height 当前区块链的高度, 即最后一个区块的 Index
+// 区块链为空时返回 -1
+func (ch *Blockchain) Height() int64 {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	return ch.height()
+}
+
+func (ch *Blockchain) height() int64 {
+	if len(ch.blocks) == 0 {
+		return -1
+	}
+	return ch.blocks[len(ch.blocks)-1].Index
+}
+
+// Tip 最新的区块, 区块链为空时返回 nil
+func (ch *Blockchain) Tip() *Block {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	return ch.tip()
+}
+
+func (ch *Blockchain) tip() *Block {
+	if len(ch.blocks) == 0 {
+		return nil
+	}
+	return ch.blocks[len(ch.blocks)-1]
+}
+
+// BlockByHeight 高度为 height 的区块, 不存在或区块体已被修剪时返回 nil
+func (ch *Blockchain) BlockByHeight(height int64) *Block {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	if height < 0 || height >= int64(len(ch.blocks)) || ch.isPruned(height) {
+		return nil
+	}
+	return ch.blocks[height]
+}
+
+// Headers 从高度 from 开始最多 limit 个区块头
+func (ch *Blockchain) Headers(from int64, limit int) []*BlockHeader {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	headers := make([]*BlockHeader, 0)
+	for i := from; i >= 0 && i < int64(len(ch.blocks)) && len(headers) < limit; i++ {
+		headers = append(headers, ch.blocks[i].Header())
+	}
+	return headers
+}
+
+// GetBlock 根据 Hash 查找区块, 不存在或区块体已被修剪时返回 nil
+func (ch *Blockchain) GetBlock(hash string) *Block {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	if i := ch.find(hash); i >= 0 && !ch.isPruned(i) {
+		return ch.blocks[i]
+	}
+	return nil
+}
+
+// HeaderByHash 根据 Hash 查找区块头, 区块体被修剪的区块也能找到, 不存在时返回 nil
+func (ch *Blockchain) HeaderByHash(hash string) *BlockHeader {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	if i := ch.find(hash); i >= 0 {
+		return ch.blocks[i].Header()
+	}
+	return nil
+}
+
+// HeaderByHeight 高度为 height 的区块头, 区块体被修剪的区块也能找到, 不存在时返回 nil
+func (ch *Blockchain) HeaderByHeight(height int64) *BlockHeader {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	return ch.header(height)
+}
+
+// find 区块在区块链中的高度, 不存在时返回 -1
+func (ch *Blockchain) find(hash string) int64 {
+	// 从最新的区块开始查找, 最近的区块被查询的概率更高
+	for i := len(ch.blocks) - 1; i >= 0; i-- {
+		if ch.blocks[i].Hash == hash {
+			return int64(i)
+		}
+	}
+	return -1
+}
+
+// FindTransaction 根据交易 ID 查询区块链和交易池中的交易, 以及包含该交易的区块
+// 交易在交易池中时区块为 nil, 交易不存在时均为 nil
+func (ch *Blockchain) FindTransaction(id string) (*Transaction, *Block) {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	for _, tx := range ch.pending {
+		if tx.ID == id {
+			return tx, nil
+		}
+	}
+	// 没有交易索引, 从最新的区块开始查找
+	for i := len(ch.blocks) - 1; i >= 0; i-- {
+		for _, tx := range ch.blocks[i].Transactions {
+			if tx.ID == id {
+				return tx, ch.blocks[i]
+			}
+		}
+	}
+	return nil, nil
+}
+
+// PendingTransactions 交易池中的交易
+func (ch *Blockchain) PendingTransactions() []*Transaction {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	return append([]*Transaction(nil), ch.pending...)
+}
+
+// GetPendingTransaction 根据交易 ID 查找交易池中的交易, 不存在时返回 nil
+func (ch *Blockchain) GetPendingTransaction(id string) *Transaction {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	for _, tx := range ch.pending {
+		if tx.ID == id {
+			return tx
+		}
+	}
+	return nil
 }
 
 func (ch *Blockchain) OutputKey(txid string, vout int) string {
 	return fmt.Sprintf("%s:%d", txid, vout)
 }
 
-func (ch *Blockchain) AddTransaction(tx *Transaction) error {
-	// 验证交易签名
-	if err := tx.VerifySignature(); err != nil {
-		return err
+// checkMaturity 检查在高度 height 的区块中花费 entry 是否满足 coinbase 成熟度
+func (ch *Blockchain) checkMaturity(entry UTXOEntry, height int64) error {
+	if entry.Coinbase && height-entry.Height < ch.CoinbaseMaturity {
+		return errorf(SeverityMinor, "无效的交易: coinbase 输出未成熟, 需要 %d 个确认, 当前 %d 个", ch.CoinbaseMaturity, height-entry.Height)
+	}
+	return nil
+}
+
+// checkSchemes 检查交易使用的签名算法在高度 height 是否已激活
+func (ch *Blockchain) checkSchemes(tx *Transaction, height int64) error {
+	for _, input := range tx.Inputs {
+		scheme, err := input.Scheme()
+		if err != nil {
+			return withSeverity(err, SeverityMinor)
+		}
+		activation, ok := ch.SchemeActivations[scheme.Name()]
+		if !ok || height < activation {
+			return errorf(SeverityMinor, "无效的交易: 签名算法 %s 在高度 %d 未激活", scheme.Name(), height)
+		}
+	}
+	return nil
+}
+
+// checkCoinbaseHeight 检查 coinbase 交易中承诺的区块高度是否与区块高度一致
+func checkCoinbaseHeight(coinbaseTx *Transaction, height int64) error {
+	committed, err := coinbaseTx.CoinbaseHeight()
+	if err != nil {
+		return errorf(SeverityFatal, "无效的区块: coinbase 交易格式错误(03): %v", err)
+	}
+	if committed != height {
+		return newError(SeverityFatal, "无效的区块: coinbase 交易的高度与区块高度不一致(04)")
+	}
+	return nil
+}
+
+// checkOverwrite 检查交易的输出是否会覆盖尚未花费的输出
+func (ch *Blockchain) checkOverwrite(tx *Transaction) error {
+	for j := 0; j < len(tx.Outputs); j++ {
+		if _, ok := ch.outputs[ch.OutputKey(tx.ID, j)]; ok {
+			return newError(SeverityNone, "无效的交易: 交易 ID 与未花费的输出重复")
+		}
 	}
-	// 验证交易金额是否足够
+	return nil
+}
+
+// checkInputs 检查交易在高度 height 的区块中花费的输入是否合法:
+// 引用的输出必须存在, 属于输入的公钥, 满足 coinbase 成熟度, 且输入金额之和不小于输出金额之和
+func (ch *Blockchain) checkInputs(tx *Transaction, height int64) error {
 	inputAmount := int64(0)
-	for i := 0; i < len(tx.Inputs); i++ {
-		output := ch.Outputs[ch.OutputKey(tx.Inputs[i].Txid, tx.Inputs[i].Vout)]
-		inputAmount += output.Amount
+	for _, input := range tx.Inputs {
+		// 使用 ch.outputs 来判断交易是否合法
+		entry, ok := ch.outputs[ch.OutputKey(input.Txid, input.Vout)]
+		if !ok {
+			return newError(SeverityNone, "无效的交易: 交易引用了不存在的输出")
+		}
+		if !entry.IsFor(input.PubKey) {
+			return newError(SeverityFatal, "无效的交易: 交易引用了不属于自己的输出")
+		}
+		if err := ch.checkMaturity(entry, height); err != nil {
+			return err
+		}
+		inputAmount += entry.Amount
 	}
 	outputAmount := int64(0)
-	for i := 0; i < len(tx.Outputs); i++ {
-		outputAmount += tx.Outputs[i].Amount
+	for _, output := range tx.Outputs {
+		if output.Amount < 0 {
+			return newError(SeverityFatal, "无效的交易: 金额不能为负数")
+		}
+		outputAmount += output.Amount
 	}
 	if inputAmount < outputAmount {
-		return errors.New("无效的交易: 金额不足")
+		return newError(SeverityFatal, "无效的交易: 金额不足")
 	}
-	for _, input := range tx.Inputs {
-		// 使用 ch.Outputs 来判断交易是否合法
-		if _, ok := ch.Outputs[ch.OutputKey(input.Txid, input.Vout)]; !ok {
-			return errors.New("无效的交易: 交易引用了不存在的输出")
-		}
+	return nil
+}
 
+// AddTransaction 验证交易并加入交易池
+func (ch *Blockchain) AddTransaction(tx *Transaction) error {
+	// 验证交易签名, 验证通过的签名会被缓存, 区块到达时无需再次验证
+	// 签名验证不依赖区块链的状态, 在加锁之前完成
+	if err := ch.Verifier.VerifyTransactions([]*Transaction{tx}); err != nil {
+		return err
+	}
+	ch.mu.Lock()
+	defer ch.unlockAndNotify()
+	if err := ch.checkOverwrite(tx); err != nil {
+		return err
+	}
+	if err := ch.checkSchemes(tx, ch.height()+1); err != nil {
+		return err
+	}
+	// 交易最早被打包进下一个区块
+	if err := ch.checkInputs(tx, ch.height()+1); err != nil {
+		return err
+	}
+	for _, input := range tx.Inputs {
 		// 验证交易是否已经入链
-		// for _, block := range ch.Blocks {
+		// for _, block := range ch.blocks {
 		// 	for _, chainTx := range block.Transactions {
 		// 		if chainTx.Exist(input) {
 		// 			return errors.New("无效的交易: 交易已入链")
@@ -118,114 +379,360 @@ func (ch *Blockchain) AddTransaction(tx *Transaction) error {
 		// }
 
 		// 验证交易是否已经存在
-		for _, pendingTx := range ch.PendingTransactions {
+		for _, pendingTx := range ch.pending {
 			if pendingTx.Exist(input) {
-				return errors.New("无效的交易: 交易已存在")
+				return newError(SeverityNone, "无效的交易: 交易已存在")
 			}
 		}
 	}
-	ch.PendingTransactions = append(ch.PendingTransactions, tx)
+	ch.pending = append(ch.pending, tx)
+	ch.emit(Event{Type: EventTxAccepted, Tx: tx})
 	return nil
 }
 
 // GenesisBlock 创世区块
 // 创世区块的交易是 coinbase 交易
 func (ch *Blockchain) GenesisBlock(coinbaseTx *Transaction) error {
-	ch.Blocks = append(ch.Blocks, CreateBlock(0, []*Transaction{coinbaseTx}, "0"))
+	if err := checkCoinbaseHeight(coinbaseTx, 0); err != nil {
+		return err
+	}
+
+	return ch.ConnectGenesis(CreateBlockAt(0, []*Transaction{coinbaseTx}, GenesisPreviousHash, ch.Params.InitialDifficulty, ch.Clock.Now()))
+}
+
+// ConnectGenesis 将已有的创世区块作为空区块链的第一个区块
+// 连接同一个创世区块的节点才能组成同一条区块链
+func (ch *Blockchain) ConnectGenesis(b *Block) error {
+	ch.mu.Lock()
+	defer ch.unlockAndNotify()
+	if err := ch.connectGenesis(b); err != nil {
+		return err
+	}
+	ch.emit(Event{Type: EventBlockConnected, Block: b})
+	return nil
+}
+
+// connectGenesis 验证并连接创世区块, 调用时必须持有写锁
+func (ch *Blockchain) connectGenesis(b *Block) error {
+	if len(ch.blocks) != 0 {
+		return newError(SeverityNone, "无效的区块: 区块链已存在创世区块")
+	}
+	if b.Index != 0 {
+		return newError(SeverityFatal, "无效的区块: 创世区块的 Index 必须为 0")
+	}
+	if b.PreviousHash != GenesisPreviousHash || b.Difficulty != ch.Params.InitialDifficulty {
+		return newError(SeverityFatal, "无效的区块: 创世区块与网络参数不符")
+	}
+	if len(b.Transactions) != 1 || !b.Transactions[0].IsCoinbase() {
+		return newError(SeverityFatal, "无效的区块: 创世区块有且只有一个 coinbase 交易")
+	}
+	coinbaseTx := b.Transactions[0]
+	if err := checkCoinbaseHeight(coinbaseTx, 0); err != nil {
+		return err
+	}
+	if err := coinbaseTx.VerifyStructure(); err != nil {
+		return err
+	}
+	if err := b.Verification(); err != nil {
+		return err
+	}
+
+	ch.blocks = append(ch.blocks, b)
+	ch.undo = append(ch.undo, &BlockUndo{Hash: b.Hash, Spent: make([]SpentOutput, 0)})
 
 	for j := 0; j < len(coinbaseTx.Outputs); j++ {
-		ch.Outputs[ch.OutputKey(coinbaseTx.ID, j)] = *coinbaseTx.Outputs[j]
+		ch.outputs[ch.OutputKey(coinbaseTx.ID, j)] = UTXOEntry{TxOutput: *coinbaseTx.Outputs[j], Height: 0, Coinbase: true}
 	}
 
 	return nil
 }
 
+// CheckHeader 检查区块头 h 能否链接在区块头 prev 之后:
+// Index 连续, PreviousHash 正确, 时间戳不超过当前时间 MaxFutureBlockTime 以上, 难度符合要求且满足工作量证明
+// ancestor 返回 prev 所在链上指定高度的区块头, 用于计算难度调整
+func (ch *Blockchain) CheckHeader(prev *BlockHeader, h *BlockHeader, ancestor func(height int64) *BlockHeader) error {
+	if h.Index != prev.Index+1 {
+		return newError(SeverityNone, "无效的区块: Index 错误")
+	}
+
+	if h.PreviousHash != prev.Hash {
+		return newError(SeverityNone, "无效的区块: PreviousHash 错误")
+	}
+
+	// 时间戳超前的区块在时间到达后可能有效, 因此不惩罚发送方
+	if h.Timestamp > ch.Clock.Now()+MaxFutureBlockTime.Milliseconds() {
+		return newError(SeverityNone, "无效的区块: 时间戳超过当前时间")
+	}
+
+	if h.Difficulty != ch.Params.NextDifficulty(prev, ancestor) {
+		return newError(SeverityFatal, "无效的区块: Difficulty 不符合要求")
+	}
+
+	return h.Verification()
+}
+
 // AddBlock 向区块链中添加一个区块
 func (ch *Blockchain) AddBlock(b *Block) error {
-	lastBlock := ch.Blocks[len(ch.Blocks)-1]
-
-	if b.Index != lastBlock.Index+1 {
-		return errors.New("无效的区块: Index 错误")
+	ch.mu.Lock()
+	defer ch.unlockAndNotify()
+	if len(ch.blocks) == 0 {
+		return newError(SeverityNone, "无效的区块: 区块链没有创世区块")
 	}
+	lastBlock := ch.blocks[len(ch.blocks)-1]
 
-	if b.PreviousHash != lastBlock.Hash {
-		return errors.New("无效的区块: PreviousHash 错误")
+	if err := ch.CheckHeader(lastBlock.Header(), b.Header(), ch.header); err != nil {
+		return err
 	}
 
 	if len(b.Transactions) == 0 {
-		return errors.New("无效的区块: 交易数为 0")
+		return newError(SeverityFatal, "无效的区块: 交易数为 0")
 	}
 
 	coinbaseTx := b.Transactions[0]
-	inputs := coinbaseTx.Inputs
-	if (len(inputs) != 1) || coinbaseTx.Inputs[0].Txid != "" || coinbaseTx.Inputs[0].Vout != -1 {
-		return errors.New("无效的区块: 区块的第一个交易必须是 coinbase 交易(01)")
+	if !coinbaseTx.IsCoinbase() {
+		return newError(SeverityFatal, "无效的区块: 区块的第一个交易必须是 coinbase 交易(01)")
 	}
 
 	for _, tx := range b.Transactions[1:] {
-		if len(tx.Inputs) == 1 && tx.Inputs[0].Txid == "" && tx.Inputs[0].Vout == -1 {
-			return errors.New("无效的区块: 区块不允许存在多个 coinbase 交易(02)")
+		if tx.IsCoinbase() {
+			return newError(SeverityFatal, "无效的区块: 区块不允许存在多个 coinbase 交易(02)")
 		}
 	}
 
+	if err := checkCoinbaseHeight(coinbaseTx, b.Index); err != nil {
+		return err
+	}
+
+	// coinbase 交易不经过签名验证, 只能在这里检查交易 ID 与内容一致, 否则修改输出不会改变区块的 Hash
+	if err := coinbaseTx.VerifyStructure(); err != nil {
+		return errorf(SeverityFatal, "无效的区块: coinbase 交易结构错误: %v", err)
+	}
+
 	if err := b.Verification(); err != nil {
 		return err
 	}
 
+	// 交易 ID 不允许覆盖未花费的输出, 也不允许在区块内重复
+	txids := make(map[string]bool, len(b.Transactions))
+	for _, tx := range b.Transactions {
+		if txids[tx.ID] {
+			return newError(SeverityFatal, "无效的区块: 区块内存在重复的交易")
+		}
+		txids[tx.ID] = true
+		if err := ch.checkOverwrite(tx); err != nil {
+			return withSeverity(err, SeverityFatal)
+		}
+	}
+
+	// 并行验证除 coinbase 外所有交易的签名
+	if err := ch.Verifier.VerifyTransactions(b.Transactions[1:]); err != nil {
+		return err
+	}
+
+	// 验证签名算法是否激活, 以及交易输入是否合法
+	// 同一个输出在区块内只能被花费一次
+	// 交易池中的交易不合法可能是网络延迟导致的, 而区块中的交易不合法说明整个区块无效
+	spent := make(map[string]bool)
+	fees := int64(0)
+	for _, tx := range b.Transactions[1:] {
+		if err := ch.checkSchemes(tx, b.Index); err != nil {
+			return withSeverity(err, SeverityFatal)
+		}
+		if err := ch.checkInputs(tx, b.Index); err != nil {
+			return withSeverity(err, SeverityFatal)
+		}
+		for _, input := range tx.Inputs {
+			key := ch.OutputKey(input.Txid, input.Vout)
+			if spent[key] {
+				return newError(SeverityFatal, "无效的区块: 区块内存在双花的交易")
+			}
+			spent[key] = true
+			fees += ch.outputs[key].Amount
+		}
+		for _, output := range tx.Outputs {
+			fees -= output.Amount
+		}
+	}
+
+	// coinbase 交易最多获得区块奖励和区块内所有交易的手续费
+	reward := int64(0)
+	for _, output := range coinbaseTx.Outputs {
+		if output.Amount < 0 {
+			return newError(SeverityFatal, "无效的区块: coinbase 金额不能为负数")
+		}
+		reward += output.Amount
+	}
+	if limit := ch.Params.Subsidy(b.Index) + fees; reward > limit {
+		return errorf(SeverityFatal, "无效的区块: coinbase 金额 %d 超过区块奖励和手续费 %d", reward, limit)
+	}
+
+	// 删除已花费的输出之前记录到撤销记录中, 断开区块时据此恢复
+	undo := &BlockUndo{Hash: b.Hash, Spent: make([]SpentOutput, 0)}
 	for i := 0; i < len(b.Transactions); i++ {
 		tx := b.Transactions[i]
-		if tx.Inputs[0].Vout != -1 { // Not a coinbase transaction
+		coinbase := tx.IsCoinbase()
+		if !coinbase {
 			for _, input := range tx.Inputs {
-				delete(ch.Outputs, ch.OutputKey(input.Txid, input.Vout))
+				key := ch.OutputKey(input.Txid, input.Vout)
+				undo.Spent = append(undo.Spent, SpentOutput{Txid: input.Txid, Vout: input.Vout, UTXOEntry: ch.outputs[key]})
+				delete(ch.outputs, key)
 			}
 		}
 		for j := 0; j < len(tx.Outputs); j++ {
-			ch.Outputs[ch.OutputKey(tx.ID, j)] = *tx.Outputs[j]
-		}
-		for j := 0; j < len(ch.PendingTransactions); j++ {
-			pendingTx := ch.PendingTransactions[j]
-			if pendingTx.ID == tx.ID {
-				ch.PendingTransactions = append(ch.PendingTransactions[:j], ch.PendingTransactions[j+1:]...)
-			}
+			ch.outputs[ch.OutputKey(tx.ID, j)] = UTXOEntry{TxOutput: *tx.Outputs[j], Height: b.Index, Coinbase: coinbase}
 		}
+	}
 
+	// 移除交易池中已入链的交易, 以及与区块中的交易冲突(引用的输出已被花费)的交易
+	pending := ch.pending[:0]
+	removed := make([]Event, 0)
+	for _, pendingTx := range ch.pending {
+		if txids[pendingTx.ID] {
+			removed = append(removed, Event{Type: EventTxRemoved, Tx: pendingTx, Reason: RemovedInBlock})
+			continue
+		}
+		if ch.checkInputs(pendingTx, b.Index+1) != nil {
+			removed = append(removed, Event{Type: EventTxRemoved, Tx: pendingTx, Reason: RemovedConflict})
+			continue
+		}
+		pending = append(pending, pendingTx)
 	}
+	ch.pending = pending
 
-	ch.Blocks = append(ch.Blocks, b)
+	ch.blocks = append(ch.blocks, b)
+	ch.undo = append(ch.undo, undo)
+	ch.emit(Event{Type: EventBlockConnected, Block: b})
+	for _, event := range removed {
+		ch.emit(event)
+	}
 
 	return nil
 }
 
 // 查找地址的余额
 func (ch *Blockchain) FindUTXO(address string) map[string]TxOutput {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
 	utxo := make(map[string]TxOutput)
 	// 查找 Outputs
 	// 转换为 for range
-	for key, output := range ch.Outputs {
+	for key, output := range ch.outputs {
 		if output.IsFor(address) {
-			utxo[key] = output
+			utxo[key] = output.TxOutput
+		}
+	}
+	return utxo
+}
+
+// FindSpendableUTXO 查询地址在下一个区块中可以花费的输出
+// 与 FindUTXO 相比, 排除了未成熟的 coinbase 输出和已被交易池中的交易花费的输出
+func (ch *Blockchain) FindSpendableUTXO(address string) map[string]TxOutput {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	spent := make(map[string]bool)
+	for _, tx := range ch.pending {
+		for _, input := range tx.Inputs {
+			spent[ch.OutputKey(input.Txid, input.Vout)] = true
+		}
+	}
+	utxo := make(map[string]TxOutput)
+	for key, entry := range ch.outputs {
+		if entry.IsFor(address) && !spent[key] && ch.checkMaturity(entry, ch.height()+1) == nil {
+			utxo[key] = entry.TxOutput
 		}
 	}
 	return utxo
 }
 
-func CreateBlockchain() *Blockchain {
+// header 高度为 height 的区块头, 不存在时返回 nil
+func (ch *Blockchain) header(height int64) *BlockHeader {
+	if height < 0 || height >= int64(len(ch.blocks)) {
+		return nil
+	}
+	return ch.blocks[height].Header()
+}
+
+// NextDifficulty 下一个区块需要的工作量证明难度
+func (ch *Blockchain) NextDifficulty() int64 {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	return ch.nextDifficulty()
+}
+
+func (ch *Blockchain) nextDifficulty() int64 {
+	if len(ch.blocks) == 0 {
+		return ch.Params.InitialDifficulty
+	}
+	return ch.Params.NextDifficulty(ch.blocks[len(ch.blocks)-1].Header(), ch.header)
+}
+
+// NewBlock 以时间戳 timestamp 创建并挖出下一个区块, 打包交易池中的所有交易, 区块奖励属于 address
+// 交易池中交易的手续费不计入 coinbase. 挖矿时不持有锁, 期间连接了其他区块时, 挖出的区块无法连接
+func (ch *Blockchain) NewBlock(address string, timestamp int64) *Block {
+	ch.mu.RLock()
+	height := ch.height() + 1
+	prevHash := ch.tip().Hash
+	difficulty := ch.nextDifficulty()
+	pending := append([]*Transaction(nil), ch.pending...)
+	ch.mu.RUnlock()
+
+	coinbaseTx := NewCoinbaseTXAt(height, address, ch.Params.Subsidy(height), timestamp)
+	txs := append([]*Transaction{coinbaseTx}, pending...)
+	return CreateBlockAt(height, txs, prevHash, difficulty, timestamp)
+}
+
+// Generate 立即挖出 n 个区块并连接到区块链, 区块奖励属于 address, 时间戳来自 ch.Clock
+// 只能用于 MineOnDemand 的网络, 例如 regtest
+func (ch *Blockchain) Generate(n int, address string) ([]*Block, error) {
+	if !ch.Params.MineOnDemand {
+		return nil, fmt.Errorf("network %s does not support generating blocks on demand", ch.Params.Name)
+	}
+	if ch.Tip() == nil {
+		return nil, newError(SeverityNone, "无效的区块: 区块链没有创世区块")
+	}
+	blocks := make([]*Block, 0, n)
+	for i := 0; i < n; i++ {
+		b := ch.NewBlock(address, ch.Clock.Now())
+		if err := ch.AddBlock(b); err != nil {
+			return blocks, err
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks, nil
+}
+
+// CreateBlockchain 使用网络参数 params 创建空的区块链
+func CreateBlockchain(params *ChainParams) *Blockchain {
 	var ch Blockchain
-	ch.Blocks = make([]*Block, 0)
-	ch.PendingTransactions = make([]*Transaction, 0)
-	ch.Outputs = make(map[string]TxOutput)
+	ch.blocks = make([]*Block, 0)
+	ch.undo = make([]*BlockUndo, 0)
+	ch.pending = make([]*Transaction, 0)
+	ch.outputs = make(map[string]UTXOEntry)
+	ch.Params = params
+	ch.CoinbaseMaturity = params.CoinbaseMaturity
+	ch.SchemeActivations = make(map[string]int64, len(params.SchemeActivations))
+	for name, height := range params.SchemeActivations {
+		ch.SchemeActivations[name] = height
+	}
+	ch.Verifier = NewSigVerifier(0, NewSigCache(DefaultSigCacheSize))
+	ch.Clock = SystemClock
 	return &ch
 }
 
-// CreateBlock 创建一个区块
-func CreateBlock(index int64, transactions []*Transaction, previousHash string) *Block {
+// CreateBlock 创建一个区块, 并以难度 difficulty 计算工作量证明
+func CreateBlock(index int64, transactions []*Transaction, previousHash string, difficulty int64) *Block {
+	return CreateBlockAt(index, transactions, previousHash, difficulty, SystemClock.Now())
+}
+
+// CreateBlockAt 与 CreateBlock 相同, 区块的时间戳为 timestamp
+func CreateBlockAt(index int64, transactions []*Transaction, previousHash string, difficulty int64, timestamp int64) *Block {
 	var b Block
 
 	b.Index = index
-	b.Timestamp = utils.GetUTCTimestamp()
+	b.Timestamp = timestamp
 	b.Transactions = transactions
 	b.PreviousHash = previousHash
-	b.Difficulty = 2 // 设置工作量证明的难度
+	b.Difficulty = difficulty // 设置工作量证明的难度
 	b.Nonce = 0
 	b.Mining() // 计算 Nonce 和 Hash
 	// b.Hash = b.CalculateHash()
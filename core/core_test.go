@@ -2,7 +2,10 @@ package core_test
 
 import (
 	"a10000/core"
+	"errors"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestCreateBlock(t *testing.T) {
@@ -11,16 +14,16 @@ func TestCreateBlock(t *testing.T) {
 		t.Fatalf("Failed to generate tom: %v", err)
 	}
 
-	ch := core.CreateBlockchain()
-	genesisTx := core.NewCoinbaseTX(tom.Address(), 50)
+	ch := core.CreateBlockchain(core.RegtestParams)
+	genesisTx := core.NewCoinbaseTX(0, tom.Address(), 50)
 	err = ch.GenesisBlock(genesisTx)
 	if err != nil {
 		t.Fatalf("Failed to create genesis block: %v", err)
 	}
-	index := len(ch.Blocks)
-	previousHash := ch.Blocks[len(ch.Blocks)-1].Hash
-	tomCoinbaseTx := core.NewCoinbaseTX(tom.Address(), 50)
-	b := core.CreateBlock(int64(index), []*core.Transaction{tomCoinbaseTx}, previousHash)
+	index := ch.Height() + 1
+	previousHash := ch.Tip().Hash
+	tomCoinbaseTx := core.NewCoinbaseTX(index, tom.Address(), 50)
+	b := core.CreateBlock(index, []*core.Transaction{tomCoinbaseTx}, previousHash, ch.NextDifficulty())
 	err = ch.AddBlock(b)
 
 	t.Logf("Nonce: %d, Calculated Hash: %s, Expected Prefix: %d", b.Nonce, b.Hash, b.Difficulty)
@@ -30,6 +33,69 @@ func TestCreateBlock(t *testing.T) {
 	}
 }
 
+func TestGenerate(t *testing.T) {
+	tom, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate tom: %v", err)
+	}
+	// 同一个时钟在同一条链上生成的区块完全相同
+	generate := func(params *core.ChainParams) ([]*core.Block, error) {
+		timestamp := params.GenesisTimestamp
+		ch := core.CreateBlockchain(params)
+		ch.Clock = core.ClockFunc(func() int64 {
+			timestamp += 1000
+			return timestamp
+		})
+		if err := ch.ConnectGenesis(params.GenesisBlock()); err != nil {
+			t.Fatalf("Failed to connect genesis block: %v", err)
+		}
+		return ch.Generate(10, tom.Address())
+	}
+
+	first, err := generate(core.RegtestParams)
+	if err != nil {
+		t.Fatalf("Failed to generate blocks: %v", err)
+	}
+	second, _ := generate(core.RegtestParams)
+	if len(first) != 10 || first[9].Index != 10 {
+		t.Fatalf("Expected 10 blocks, got %d", len(first))
+	}
+	for i := range first {
+		if first[i].Hash != second[i].Hash || (i > 0 && first[i].Timestamp <= first[i-1].Timestamp) {
+			t.Fatalf("Block %d should be reproducible", first[i].Index)
+		}
+	}
+
+	if _, err := generate(core.TestNetParams); err == nil {
+		t.Fatal("Generating blocks should only be allowed on regtest")
+	}
+}
+
+func TestFutureBlock(t *testing.T) {
+	tom, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate tom: %v", err)
+	}
+	clock := core.NewFakeClock(core.RegtestParams.GenesisTimestamp)
+	ch := core.CreateBlockchain(core.RegtestParams)
+	ch.Clock = clock
+	if err := ch.ConnectGenesis(core.RegtestParams.GenesisBlock()); err != nil {
+		t.Fatalf("Failed to connect genesis block: %v", err)
+	}
+
+	// 时间戳超前当前时间过多的区块被拒绝, 但不惩罚发送方, 时间到达后可以接受
+	future := clock.Now() + core.MaxFutureBlockTime.Milliseconds() + 1
+	b := ch.NewBlock(tom.Address(), future)
+	err = ch.AddBlock(b)
+	if err == nil || core.SeverityOf(err) != core.SeverityNone {
+		t.Fatalf("Block from the future should be rejected without penalty: %v", err)
+	}
+	clock.Advance(time.Millisecond)
+	if err := ch.AddBlock(b); err != nil {
+		t.Fatalf("Block should be accepted once its time arrives: %v", err)
+	}
+}
+
 func TestCalculateNonceAndDifficulty(t *testing.T) {
 	// Create a block with difficulty 2
 	b := &core.Block{
@@ -61,3 +127,270 @@ func TestCalculateNonceAndDifficulty(t *testing.T) {
 		t.Error("Nonce should be greater than zero after PoW")
 	}
 }
+
+func TestCoinbaseMaturity(t *testing.T) {
+	tom, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate tom: %v", err)
+	}
+	alice, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate alice: %v", err)
+	}
+
+	ch := core.CreateBlockchain(core.RegtestParams)
+	ch.CoinbaseMaturity = 2
+	err = ch.GenesisBlock(core.NewCoinbaseTX(0, tom.Address(), 50))
+	if err != nil {
+		t.Fatalf("Failed to create genesis block: %v", err)
+	}
+
+	// 下一个区块的高度为 1, 创世 coinbase 只有 1 个确认
+	if utxo := ch.FindSpendableUTXO(tom.Address()); len(utxo) != 0 {
+		t.Fatalf("Immature coinbase output should not be listed as spendable: %v", utxo)
+	}
+	tx, err := tom.NewTransaction(ch.FindUTXO(tom.Address()), alice.Address(), 20, "")
+	if err != nil {
+		t.Fatalf("Failed to create transaction: %v", err)
+	}
+	if err = ch.AddTransaction(tx); err == nil {
+		t.Fatal("Immature coinbase output should not be spendable")
+	}
+
+	// 直接打包进区块同样应被拒绝
+	b := core.CreateBlock(1, []*core.Transaction{core.NewCoinbaseTX(1, alice.Address(), 50), tx}, ch.BlockByHeight(0).Hash, ch.NextDifficulty())
+	if err = ch.AddBlock(b); err == nil {
+		t.Fatal("Block spending immature coinbase output should be rejected")
+	}
+
+	b = core.CreateBlock(1, []*core.Transaction{core.NewCoinbaseTX(1, alice.Address(), 50)}, ch.BlockByHeight(0).Hash, ch.NextDifficulty())
+	if err = ch.AddBlock(b); err != nil {
+		t.Fatalf("Failed to add block: %v", err)
+	}
+
+	// 下一个区块的高度为 2, coinbase 已成熟
+	if utxo := ch.FindSpendableUTXO(tom.Address()); len(utxo) != 1 {
+		t.Fatalf("Mature coinbase output should be listed as spendable: %v", utxo)
+	}
+	if err = ch.AddTransaction(tx); err != nil {
+		t.Fatalf("Mature coinbase output should be spendable: %v", err)
+	}
+	// 已被交易池中的交易花费的输出不再可用
+	if utxo := ch.FindSpendableUTXO(tom.Address()); len(utxo) != 0 {
+		t.Fatalf("Output spent by pending transaction should not be spendable: %v", utxo)
+	}
+}
+
+func TestCoinbaseHeightCommitment(t *testing.T) {
+	tom, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate tom: %v", err)
+	}
+
+	ch := core.CreateBlockchain(core.RegtestParams)
+	if err = ch.GenesisBlock(core.NewCoinbaseTX(1, tom.Address(), 50)); err == nil {
+		t.Fatal("Genesis coinbase must commit to height 0")
+	}
+	if err = ch.GenesisBlock(core.NewCoinbaseTX(0, tom.Address(), 50)); err != nil {
+		t.Fatalf("Failed to create genesis block: %v", err)
+	}
+
+	// 相同参数但不同高度的 coinbase 交易 ID 不同
+	a := core.NewCoinbaseTX(1, tom.Address(), 50)
+	b := core.NewCoinbaseTX(2, tom.Address(), 50)
+	b.Timestamp = a.Timestamp
+	b.ID = b.Hash()
+	if a.ID == b.ID {
+		t.Fatal("Coinbase transactions at different heights should have distinct IDs")
+	}
+
+	block := core.CreateBlock(1, []*core.Transaction{b}, ch.BlockByHeight(0).Hash, ch.NextDifficulty())
+	if err = ch.AddBlock(block); err == nil {
+		t.Fatal("Block with mismatched coinbase height should be rejected")
+	}
+
+	ch.CoinbaseMaturity = 1
+	tx, err := tom.NewTransaction(ch.FindUTXO(tom.Address()), tom.Address(), 20, "")
+	if err != nil {
+		t.Fatalf("Failed to create transaction: %v", err)
+	}
+	block = core.CreateBlock(1, []*core.Transaction{a, tx}, ch.BlockByHeight(0).Hash, ch.NextDifficulty())
+	if err = ch.AddBlock(block); err != nil {
+		t.Fatalf("Failed to add block: %v", err)
+	}
+
+	// 重放已入链的交易会覆盖它尚未花费的输出, 必须被拒绝
+	block = core.CreateBlock(2, []*core.Transaction{core.NewCoinbaseTX(2, tom.Address(), 50), tx}, ch.BlockByHeight(1).Hash, ch.NextDifficulty())
+	if err = ch.AddBlock(block); err == nil {
+		t.Fatal("Block overwriting unspent outputs should be rejected")
+	}
+}
+
+func TestErrorSeverity(t *testing.T) {
+	tom, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate tom: %v", err)
+	}
+
+	ch := core.CreateBlockchain(core.RegtestParams)
+	ch.CoinbaseMaturity = 2
+	if err = ch.GenesisBlock(core.NewCoinbaseTX(0, tom.Address(), 50)); err != nil {
+		t.Fatalf("Failed to create genesis block: %v", err)
+	}
+	tx, err := tom.NewTransaction(ch.FindUTXO(tom.Address()), tom.Address(), 20, "")
+	if err != nil {
+		t.Fatalf("Failed to create transaction: %v", err)
+	}
+
+	check := func(what string, err error, expected core.Severity) {
+		t.Helper()
+		if err == nil {
+			t.Fatalf("%s should fail", what)
+		}
+		if severity := core.SeverityOf(err); severity != expected {
+			t.Fatalf("Severity of %s is incorrect, expected %s, got %s: %v", what, expected, severity, err)
+		}
+	}
+
+	// 交易池中的 coinbase 未成熟可能是高度差异导致的, 区块中则说明区块无效
+	check("immature transaction", ch.AddTransaction(tx), core.SeverityMinor)
+	b := core.CreateBlock(1, []*core.Transaction{core.NewCoinbaseTX(1, tom.Address(), 50), tx}, ch.BlockByHeight(0).Hash, ch.NextDifficulty())
+	check("block with immature transaction", ch.AddBlock(b), core.SeverityFatal)
+
+	// 不能连接到链尾的区块可能来自分叉
+	b = core.CreateBlock(1, []*core.Transaction{core.NewCoinbaseTX(1, tom.Address(), 50)}, "unknown", ch.NextDifficulty())
+	check("block with unknown parent", ch.AddBlock(b), core.SeverityNone)
+
+	// 被篡改的交易
+	tampered := *tx
+	tampered.Outputs = []*core.TxOutput{{Amount: 50, PubKeyHash: tx.Outputs[0].PubKeyHash}}
+	check("tampered transaction", ch.AddTransaction(&tampered), core.SeverityFatal)
+
+	// 非验证错误的严重程度为 SeverityNone
+	if core.SeverityOf(errors.New("other")) != core.SeverityNone {
+		t.Fatal("Severity of other errors should be none")
+	}
+}
+
+// TestConcurrentAccess 在多个 goroutine 中同时挖矿, 提交交易和查询, 使用 go test -race 运行时可以发现数据竞争
+func TestConcurrentAccess(t *testing.T) {
+	tom, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate tom: %v", err)
+	}
+	alice, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate alice: %v", err)
+	}
+	ch := core.CreateBlockchain(core.RegtestParams)
+	ch.CoinbaseMaturity = 1
+	if err := ch.GenesisBlock(core.NewCoinbaseTX(0, tom.Address(), 50)); err != nil {
+		t.Fatalf("Failed to create genesis block: %v", err)
+	}
+
+	const blocks = 50
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	// 写: 挖矿
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := 0; i < blocks; i++ {
+			if _, err := ch.Generate(1, tom.Address()); err != nil {
+				t.Errorf("Failed to generate block: %v", err)
+				return
+			}
+		}
+	}()
+
+	// 写: 提交交易, 与交易池中的交易冲突时会失败
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			tx, err := tom.NewTransaction(ch.FindSpendableUTXO(tom.Address()), alice.Address(), 1, "")
+			if err == nil {
+				ch.AddTransaction(tx)
+			}
+		}
+	}()
+
+	// 读: 快照中的区块链高度, 最新区块和 UTXO 必须一致
+	// 交易没有手续费, 所有输出的金额之和等于已发放的区块奖励
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				snapshot := ch.Snapshot()
+				if snapshot.Tip.Index != snapshot.Height {
+					t.Errorf("Snapshot tip %d does not match height %d", snapshot.Tip.Index, snapshot.Height)
+					return
+				}
+				total := int64(0)
+				for _, entry := range snapshot.UTXO {
+					total += entry.Amount
+				}
+				if total != 50*(snapshot.Height+1) {
+					t.Errorf("Snapshot at height %d has inconsistent UTXO total %d", snapshot.Height, total)
+					return
+				}
+				ch.Height()
+				ch.Tip()
+				ch.NextDifficulty()
+				ch.PendingTransactions()
+				ch.FindUTXO(alice.Address())
+				ch.Headers(0, 10)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ch.Height() != blocks {
+		t.Fatalf("Expected height %d, got %d", blocks, ch.Height())
+	}
+}
+
+func TestTamperedCoinbase(t *testing.T) {
+	tom, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate tom: %v", err)
+	}
+	mallory, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate mallory: %v", err)
+	}
+	ch := core.CreateBlockchain(core.RegtestParams)
+	if err = ch.ConnectGenesis(core.RegtestParams.GenesisBlock()); err != nil {
+		t.Fatalf("Failed to connect genesis block: %v", err)
+	}
+
+	// 修改 coinbase 的接收方不改变交易 ID, 因此区块的 Hash 和工作量证明仍然有效
+	block := ch.NewBlock(tom.Address(), time.Now().UnixMilli())
+	block.Transactions[0].Outputs[0].PubKeyHash = mallory.Address()
+	if err = block.Verification(); err != nil {
+		t.Fatalf("Tampered block should still pass proof of work: %v", err)
+	}
+	err = ch.AddBlock(block)
+	if err == nil {
+		t.Fatal("Block with a tampered coinbase should be rejected")
+	}
+	if core.SeverityOf(err) != core.SeverityFatal {
+		t.Fatalf("Tampered coinbase should be fatal, got %s", core.SeverityOf(err))
+	}
+	if ch.Height() != 0 || mallory.Balance(ch.FindUTXO(mallory.Address())) != 0 {
+		t.Fatal("Tampered block should not be connected")
+	}
+}
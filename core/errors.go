@@ -0,0 +1,75 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Severity 验证错误的严重程度
+// 用于判断发送无效数据的节点是否有过错
+type Severity int
+
+const (
+	// SeverityNone 不是对方的过错, 如交易已在交易池中, 引用的输出已被花费, 区块不能连接到当前链尾
+	// 这类错误可能由网络延迟或分叉引起
+	SeverityNone Severity = iota
+	// SeverityMinor 对方可能有过错, 如签名算法未激活, coinbase 输出未成熟
+	// 这类错误可能由节点之间的版本或高度差异引起
+	SeverityMinor
+	// SeverityFatal 诚实的节点不会发送这样的数据, 如签名错误, 工作量证明错误, 金额不足
+	SeverityFatal
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityNone:
+		return "none"
+	case SeverityMinor:
+		return "minor"
+	case SeverityFatal:
+		return "fatal"
+	default:
+		return fmt.Sprintf("severity(%d)", int(s))
+	}
+}
+
+// Error 区块或交易的验证错误
+type Error struct {
+	Severity Severity
+	Err      error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// newError 创建指定严重程度的验证错误
+func newError(severity Severity, msg string) error {
+	return &Error{Severity: severity, Err: errors.New(msg)}
+}
+
+// errorf 创建指定严重程度的验证错误, 使用格式化的信息
+func errorf(severity Severity, format string, args ...interface{}) error {
+	return &Error{Severity: severity, Err: fmt.Errorf(format, args...)}
+}
+
+// withSeverity 将 err 包装为指定严重程度的验证错误, err 已有的严重程度更高时保持不变
+func withSeverity(err error, severity Severity) error {
+	if err == nil || SeverityOf(err) >= severity {
+		return err
+	}
+	return &Error{Severity: severity, Err: err}
+}
+
+// SeverityOf 返回错误的严重程度, 不是验证错误时返回 SeverityNone
+func SeverityOf(err error) Severity {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Severity
+	}
+	return SeverityNone
+}
@@ -0,0 +1,100 @@
+package core
+
+// 区块链事件:
+//
+// 区块链状态变化后, 按照变化发生的顺序依次同步调用所有订阅者的处理函数.
+// 修改状态的方法在释放写锁之前取得通知锁, 因此并发修改产生的事件也不会乱序.
+// 处理函数调用时不持有写锁, 可以查询区块链, 但不能修改区块链或订阅, 否则会死锁.
+
+// EventType 区块链事件的类型
+type EventType int
+
+const (
+	EventBlockConnected    EventType = iota // 区块已连接到区块链
+	EventBlockDisconnected                  // 区块已从区块链上断开, 发生在切换分叉时
+	EventTxAccepted                         // 交易已加入交易池
+	EventTxRemoved                          // 交易已从交易池中移除
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventBlockConnected:
+		return "block connected"
+	case EventBlockDisconnected:
+		return "block disconnected"
+	case EventTxAccepted:
+		return "tx accepted"
+	case EventTxRemoved:
+		return "tx removed"
+	default:
+		return "unknown"
+	}
+}
+
+// RemoveReason 交易从交易池中移除的原因
+type RemoveReason int
+
+const (
+	RemovedInBlock  RemoveReason = iota // 交易已被打包进区块
+	RemovedConflict                     // 交易引用的输出已被其他交易花费, 或者不再满足入池条件
+)
+
+// Event 区块链事件
+type Event struct {
+	Type   EventType
+	Block  *Block       // EventBlockConnected, EventBlockDisconnected
+	Tx     *Transaction // EventTxAccepted, EventTxRemoved
+	Reason RemoveReason // EventTxRemoved
+}
+
+// EventHandler 事件的处理函数
+type EventHandler func(Event)
+
+// subscriber 订阅者, 使用指针区分重复注册的同一个处理函数
+type subscriber struct {
+	handler EventHandler
+}
+
+// Subscribe 注册事件的处理函数, 返回取消订阅的函数
+// 不能在处理函数中调用
+func (ch *Blockchain) Subscribe(handler EventHandler) (unsubscribe func()) {
+	s := &subscriber{handler: handler}
+	ch.notifyMu.Lock()
+	ch.subscribers = append(ch.subscribers, s)
+	ch.notifyMu.Unlock()
+
+	return func() {
+		ch.notifyMu.Lock()
+		defer ch.notifyMu.Unlock()
+		for i, sub := range ch.subscribers {
+			if sub == s {
+				ch.subscribers = append(ch.subscribers[:i:i], ch.subscribers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// emit 记录待发出的事件, 调用时必须持有写锁
+func (ch *Blockchain) emit(event Event) {
+	ch.events = append(ch.events, event)
+}
+
+// unlockAndNotify 释放写锁并依次发出持有写锁期间记录的事件
+// 释放写锁之前取得通知锁, 保证通知的顺序与状态变化的顺序一致
+func (ch *Blockchain) unlockAndNotify() {
+	events := ch.events
+	ch.events = nil
+	if len(events) == 0 {
+		ch.mu.Unlock()
+		return
+	}
+	ch.notifyMu.Lock()
+	ch.mu.Unlock()
+	defer ch.notifyMu.Unlock()
+	for _, event := range events {
+		for _, s := range ch.subscribers {
+			s.handler(event)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package core_test
+
+import (
+	"a10000/core"
+	"sync"
+	"testing"
+)
+
+func TestEvents(t *testing.T) {
+	tom, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate tom: %v", err)
+	}
+	alice, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate alice: %v", err)
+	}
+	anna, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate anna: %v", err)
+	}
+	ch := core.CreateBlockchain(core.RegtestParams)
+	ch.CoinbaseMaturity = 1
+
+	var events []core.Event
+	unsubscribe := ch.Subscribe(func(event core.Event) {
+		events = append(events, event)
+	})
+
+	if err := ch.GenesisBlock(core.NewCoinbaseTX(0, tom.Address(), 50)); err != nil {
+		t.Fatalf("Failed to create genesis block: %v", err)
+	}
+	utxo := ch.FindUTXO(tom.Address())
+	toAlice, _ := tom.NewTransaction(utxo, alice.Address(), 20, "")
+	toAnna, _ := tom.NewTransaction(utxo, anna.Address(), 10, "")
+	if err := ch.AddTransaction(toAlice); err != nil {
+		t.Fatalf("Failed to add transaction: %v", err)
+	}
+
+	// 区块中花费了同一个输出的另一笔交易, 交易池中的交易因冲突被移除
+	coinbaseTx := core.NewCoinbaseTX(1, tom.Address(), 50)
+	b := core.CreateBlock(1, []*core.Transaction{coinbaseTx, toAnna}, ch.Tip().Hash, ch.NextDifficulty())
+	if err := ch.AddBlock(b); err != nil {
+		t.Fatalf("Failed to add block: %v", err)
+	}
+
+	// 交易池中的交易被打包进区块
+	annaToAlice, _ := anna.NewTransaction(ch.FindUTXO(anna.Address()), alice.Address(), 4, "")
+	if err := ch.AddTransaction(annaToAlice); err != nil {
+		t.Fatalf("Failed to add transaction: %v", err)
+	}
+	blocks, err := ch.Generate(1, tom.Address())
+	if err != nil {
+		t.Fatalf("Failed to generate block: %v", err)
+	}
+
+	unsubscribe()
+	if _, err := ch.Generate(1, tom.Address()); err != nil {
+		t.Fatalf("Failed to generate block: %v", err)
+	}
+
+	expected := []core.Event{
+		{Type: core.EventBlockConnected, Block: ch.BlockByHeight(0)},
+		{Type: core.EventTxAccepted, Tx: toAlice},
+		{Type: core.EventBlockConnected, Block: b},
+		{Type: core.EventTxRemoved, Tx: toAlice, Reason: core.RemovedConflict},
+		{Type: core.EventTxAccepted, Tx: annaToAlice},
+		{Type: core.EventBlockConnected, Block: blocks[0]},
+		{Type: core.EventTxRemoved, Tx: annaToAlice, Reason: core.RemovedInBlock},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events, got %d", len(expected), len(events))
+	}
+	for i, event := range events {
+		if event != expected[i] {
+			t.Errorf("Event %d: expected %s, got %s", i, expected[i].Type, event.Type)
+		}
+	}
+}
+
+func TestEventOrder(t *testing.T) {
+	tom, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate tom: %v", err)
+	}
+	ch := core.CreateBlockchain(core.RegtestParams)
+	if err := ch.GenesisBlock(core.NewCoinbaseTX(0, tom.Address(), 50)); err != nil {
+		t.Fatalf("Failed to create genesis block: %v", err)
+	}
+
+	// 并发挖矿时, 事件的顺序与区块连接的顺序一致
+	var heights []int64
+	ch.Subscribe(func(event core.Event) {
+		if event.Type == core.EventBlockConnected {
+			heights = append(heights, event.Block.Index)
+		}
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				// 其他协程先连接了区块时, 挖出的区块无法连接
+				ch.Generate(1, tom.Address())
+			}
+		}()
+	}
+	wg.Wait()
+
+	if int64(len(heights)) != ch.Height() {
+		t.Fatalf("Expected %d events, got %d", ch.Height(), len(heights))
+	}
+	for i, height := range heights {
+		if height != int64(i+1) {
+			t.Fatalf("Event %d: expected height %d, got %d", i, i+1, height)
+		}
+	}
+}
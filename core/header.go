@@ -0,0 +1,102 @@
+package core
+
+import (
+	"a10000/utils"
+	"fmt"
+	"math/big"
+)
+
+// BlockHeader 区块头
+// 区块头不包含交易, 只通过 MerkleRoot 承诺区块中的交易,
+// 因此仅凭区块头即可验证区块之间的链接关系和工作量证明
+type BlockHeader struct {
+	Index        int64  `json:"index"`        // 区块高度
+	Timestamp    int64  `json:"timestamp"`    // 区块创建时间戳
+	MerkleRoot   string `json:"merkleroot"`   // 区块中所有交易 ID 的 Merkle 根
+	PreviousHash string `json:"previoushash"` // 上一个区块的 Hash
+	Hash         string `json:"hash"`         // 当前区块的 Hash
+	Nonce        int64  `json:"nonce"`        // 工作量证明的随机数
+	Difficulty   int64  `json:"difficulty"`   // 工作量证明的难度
+}
+
+func (h *BlockHeader) Prefix() string {
+	prefix := ""
+	for i := int64(0); i < h.Difficulty; i++ {
+		prefix += "0"
+	}
+	return prefix
+}
+
+// CalculateHash 计算区块的 Hash
+// 计算方式为: sha256(区块头的字符串表示)
+// 区块头的字符串表示为: Index + Timestamp + MerkleRoot + PreviousHash + Nonce + Difficulty
+func (h *BlockHeader) CalculateHash() string {
+	return utils.Hash(h.String())
+}
+
+func (h *BlockHeader) String() []byte {
+	formatStr := fmt.Sprintf("%d%d%s%s%d%d", h.Index, h.Timestamp, h.MerkleRoot, h.PreviousHash, h.Nonce, h.Difficulty)
+	return []byte(formatStr)
+}
+
+// Verification 验证区块头的 Hash 和工作量证明
+func (h *BlockHeader) Verification() error {
+	if h.Difficulty < 1 {
+		return newError(SeverityFatal, "无效的区块: Difficulty 错误")
+	}
+
+	hast := h.CalculateHash()
+	if hast != h.Hash {
+		return newError(SeverityFatal, "无效的区块: Hash 错误")
+	}
+
+	if h.Difficulty > int64(len(h.Hash)) {
+		return newError(SeverityFatal, "无效的区块: Difficulty 错误")
+	}
+
+	// 判断 hash 的前 Difficulty 位是否为 0
+	prefix := h.Prefix()
+
+	if h.Hash[:h.Difficulty] != prefix {
+		return newError(SeverityFatal, "无效的区块: Hash 前缀错误")
+	}
+
+	return nil
+}
+
+// Work 区块头的工作量, 即满足难度平均需要计算的 Hash 次数: Hash 的前 Difficulty 个十六进制位为 0 的概率为 16^-Difficulty
+func (h *BlockHeader) Work() *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(4*h.Difficulty))
+}
+
+// ChainWork 区块头的工作量之和, 分叉之间以工作量更大的为准
+func ChainWork(headers []*BlockHeader) *big.Int {
+	work := new(big.Int)
+	for _, h := range headers {
+		work.Add(work, h.Work())
+	}
+	return work
+}
+
+// ComputeMerkleRoot 计算交易 ID 的 Merkle 根
+// 每一层两两拼接后计算 Hash, 数量为奇数时复制最后一个, 直到只剩一个
+func ComputeMerkleRoot(transactions []*Transaction) string {
+	if len(transactions) == 0 {
+		return ""
+	}
+	level := make([]string, 0, len(transactions))
+	for _, tx := range transactions {
+		level = append(level, tx.ID)
+	}
+	for len(level) > 1 {
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+		next := make([]string, 0, len(level)/2)
+		for i := 0; i < len(level); i += 2 {
+			next = append(next, utils.Hash([]byte(level[i]+level[i+1])))
+		}
+		level = next
+	}
+	return level[0]
+}
@@ -0,0 +1,246 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// GenesisPreviousHash 创世区块的 PreviousHash
+const GenesisPreviousHash = "0"
+
+// MaxDifficulty 工作量证明难度的上限, 即区块 Hash 的十六进制长度
+const MaxDifficulty = 64
+
+// ChainParams 网络参数
+// 同一个网络中的节点必须使用相同的参数, 否则无法就区块链达成共识.
+// 私有网络的参数可以保存为 JSON 文件, 由 genesis 命令生成
+type ChainParams struct {
+	Name string `json:"name"` // 网络名称
+
+	// 创世区块由以下字段唯一确定, 写在代码或参数文件中, 启动时检查 Hash 是否一致
+	GenesisTimestamp int64  `json:"genesis_timestamp"` // 创世区块的时间戳, 单位毫秒
+	GenesisAddress   string `json:"genesis_address"`   // 创世 coinbase 的收款地址, 为空时无人可以花费
+	GenesisReward    int64  `json:"genesis_reward"`    // 创世 coinbase 的金额
+	GenesisNonce     int64  `json:"genesis_nonce"`     // 创世区块的工作量证明
+	GenesisHash      string `json:"genesis_hash"`      // 创世区块的 Hash
+
+	InitialDifficulty int64 `json:"initial_difficulty"` // 创世区块和第一个难度调整周期的工作量证明难度
+	MinDifficulty     int64 `json:"min_difficulty"`     // 难度调整的下限
+
+	// 难度调整: 每 RetargetWindow 个区块, 根据这段时间实际的出块间隔与 TargetSpacing 的比值调整难度.
+	// 难度每增加 1, 区块 Hash 需要多一位十六进制的 0, 挖矿的计算量增加 16 倍,
+	// 因此实际用时不足预期的 1/4 时难度加 1, 超过预期的 4 倍时难度减 1.
+	// RetargetWindow 为 0 时难度固定不变
+	TargetSpacing  time.Duration `json:"target_spacing"`  // 出块间隔的目标
+	RetargetWindow int64         `json:"retarget_window"` // 难度调整的周期, 单位区块
+
+	InitialSubsidy  int64 `json:"initial_subsidy"`  // 区块奖励的初始值
+	HalvingInterval int64 `json:"halving_interval"` // 区块奖励减半的周期, 单位区块, 0 表示不减半
+
+	CoinbaseMaturity  int64            `json:"coinbase_maturity"`  // coinbase 输出可被花费前需要的确认数
+	SchemeActivations map[string]int64 `json:"scheme_activations"` // 签名算法的激活高度
+
+	AddressPrefix string `json:"address_prefix"` // 展示地址时使用的网络前缀, 避免将一个网络的地址用于另一个网络
+	DefaultPort   int    `json:"default_port"`   // 节点默认的监听端口
+
+	// 种子节点的地址, 地址簿为空且启动时没有指定 -seeds 时连接这些节点获取其他节点的地址
+	Seeds []string `json:"seeds,omitempty"`
+
+	MineOnDemand bool `json:"mine_on_demand"` // 是否允许通过 generate 立即挖出区块, 只用于测试网络
+
+	AssumeUTXO []UTXOCheckpoint `json:"assume_utxo,omitempty"` // 可信的 UTXO 快照, 从这些快照启动的节点无需先重放之前的区块
+}
+
+// UTXOCheckpoint 可信的 UTXO 快照: 区块链在高度 Height 的区块 Hash 和 UTXO 哈希
+type UTXOCheckpoint struct {
+	Height    int64  `json:"height"`
+	BlockHash string `json:"block_hash"`
+	UTXOHash  string `json:"utxo_hash"`
+}
+
+// AssumedUTXO 快照 state 是否与网络参数中的可信快照一致
+func (p *ChainParams) AssumedUTXO(state *ChainState) bool {
+	for _, c := range p.AssumeUTXO {
+		if c.Height == state.Height() && c.BlockHash == state.Tip().Hash && c.UTXOHash == state.UTXOHash() {
+			return true
+		}
+	}
+	return false
+}
+
+// MainNetParams 主网
+var MainNetParams = &ChainParams{
+	Name:              "mainnet",
+	GenesisTimestamp:  1735689600000, // 2025-01-01T00:00:00Z
+	GenesisNonce:      1183927,
+	GenesisHash:       "000005b3b9a4704e2a11689985f1c91fcd66fbac880ebc5f21b494f1fc2254a5",
+	InitialDifficulty: 5,
+	MinDifficulty:     4,
+	TargetSpacing:     time.Minute,
+	RetargetWindow:    1440,
+	InitialSubsidy:    50,
+	HalvingInterval:   210000,
+	CoinbaseMaturity:  DefaultCoinbaseMaturity,
+	SchemeActivations: DefaultSchemeActivations(),
+	AddressPrefix:     "a1",
+	DefaultPort:       6666,
+}
+
+// TestNetParams 测试网, 难度较低, 调整更频繁
+var TestNetParams = &ChainParams{
+	Name:              "testnet",
+	GenesisTimestamp:  1735689600001,
+	GenesisNonce:      829,
+	GenesisHash:       "000d5fce71f788c8ff0ffafff237b511e5f7d7af8fd7db71312a4d98bb0c2e9a",
+	InitialDifficulty: 3,
+	MinDifficulty:     2,
+	TargetSpacing:     time.Minute,
+	RetargetWindow:    120,
+	InitialSubsidy:    50,
+	HalvingInterval:   210000,
+	CoinbaseMaturity:  DefaultCoinbaseMaturity,
+	SchemeActivations: DefaultSchemeActivations(),
+	AddressPrefix:     "ta1",
+	DefaultPort:       16666,
+}
+
+// RegtestParams 本地回归测试网络, 难度固定为最低值, 可以通过 generate 按需立即挖出区块
+var RegtestParams = &ChainParams{
+	Name:              "regtest",
+	GenesisTimestamp:  1735689600002,
+	GenesisNonce:      10,
+	GenesisHash:       "0460cad8cb382503d6a4c5c35cb68458b560addfcc33abd7148a4a46d1cedc26",
+	InitialDifficulty: 1,
+	MinDifficulty:     1,
+	TargetSpacing:     time.Minute,
+	RetargetWindow:    0,
+	InitialSubsidy:    50,
+	HalvingInterval:   150,
+	CoinbaseMaturity:  DefaultCoinbaseMaturity,
+	SchemeActivations: DefaultSchemeActivations(),
+	AddressPrefix:     "ra1",
+	DefaultPort:       26666,
+	MineOnDemand:      true,
+}
+
+var networks = []*ChainParams{MainNetParams, TestNetParams, RegtestParams}
+
+// ParamsForNetwork 根据名称获取网络参数
+func ParamsForNetwork(name string) (*ChainParams, error) {
+	for _, params := range networks {
+		if params.Name == name {
+			return params, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown network: %s", name)
+}
+
+// Copy 参数的深拷贝, 修改拷贝中的 map 和切片不会影响原参数
+func (p *ChainParams) Copy() *ChainParams {
+	params := *p
+	params.SchemeActivations = make(map[string]int64, len(p.SchemeActivations))
+	for scheme, height := range p.SchemeActivations {
+		params.SchemeActivations[scheme] = height
+	}
+	params.Seeds = append([]string(nil), p.Seeds...)
+	params.AssumeUTXO = append([]UTXOCheckpoint(nil), p.AssumeUTXO...)
+	return &params
+}
+
+// GenesisBlock 网络的创世区块, 由参数中的创世字段构造, 不需要重新计算工作量证明
+func (p *ChainParams) GenesisBlock() *Block {
+	b := p.genesisTemplate()
+	b.Nonce = p.GenesisNonce
+	b.Hash = b.CalculateHash()
+	return b
+}
+
+// genesisTemplate 尚未计算工作量证明的创世区块
+func (p *ChainParams) genesisTemplate() *Block {
+	coinbaseTx := NewCoinbaseTXAt(0, p.GenesisAddress, p.GenesisReward, p.GenesisTimestamp)
+
+	transactions := []*Transaction{coinbaseTx}
+	return &Block{
+		Index:        0,
+		Timestamp:    p.GenesisTimestamp,
+		Transactions: transactions,
+		MerkleRoot:   ComputeMerkleRoot(transactions),
+		PreviousHash: GenesisPreviousHash,
+		Difficulty:   p.InitialDifficulty,
+	}
+}
+
+// CheckGenesis 检查创世区块的 Hash 与参数中记录的一致, 且满足工作量证明
+func (p *ChainParams) CheckGenesis() error {
+	b := p.GenesisBlock()
+	if b.Hash != p.GenesisHash {
+		return fmt.Errorf("genesis block of network %s has hash %s, expected %s", p.Name, b.Hash, p.GenesisHash)
+	}
+	return b.Verification()
+}
+
+// MineGenesis 计算创世区块的工作量证明, 并记录 GenesisNonce 和 GenesisHash
+// 用于创建新的私有网络
+func (p *ChainParams) MineGenesis() *Block {
+	b := p.genesisTemplate()
+	b.Mining()
+	p.GenesisNonce, p.GenesisHash = b.Nonce, b.Hash
+	return b
+}
+
+// Subsidy 高度为 height 的区块的奖励
+func (p *ChainParams) Subsidy(height int64) int64 {
+	if p.HalvingInterval <= 0 {
+		return p.InitialSubsidy
+	}
+	halvings := height / p.HalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+	return p.InitialSubsidy >> halvings
+}
+
+// NextDifficulty 区块头 prev 之后的区块需要的工作量证明难度
+// ancestor 返回同一条链上指定高度的区块头, 只在需要调整难度时调用
+func (p *ChainParams) NextDifficulty(prev *BlockHeader, ancestor func(height int64) *BlockHeader) int64 {
+	height := prev.Index + 1
+	if p.RetargetWindow <= 0 || height%p.RetargetWindow != 0 {
+		return prev.Difficulty
+	}
+	first := ancestor(height - p.RetargetWindow)
+	if first == nil {
+		return prev.Difficulty
+	}
+	expected := (p.RetargetWindow - 1) * p.TargetSpacing.Milliseconds()
+	actual := prev.Timestamp - first.Timestamp
+
+	difficulty := prev.Difficulty
+	if actual < expected/4 {
+		difficulty++
+	} else if actual > expected*4 {
+		difficulty--
+	}
+	if difficulty < p.MinDifficulty {
+		difficulty = p.MinDifficulty
+	}
+	if difficulty > MaxDifficulty {
+		difficulty = MaxDifficulty
+	}
+	return difficulty
+}
+
+// EncodeAddress 为地址加上网络前缀, 用于展示和输入
+func (p *ChainParams) EncodeAddress(address string) string {
+	return p.AddressPrefix + ":" + address
+}
+
+// DecodeAddress 解析带有网络前缀的地址, 前缀不属于该网络时返回错误
+func (p *ChainParams) DecodeAddress(s string) (string, error) {
+	address, ok := strings.CutPrefix(s, p.AddressPrefix+":")
+	if !ok || address == "" {
+		return "", errors.New("address does not belong to network " + p.Name)
+	}
+	return address, nil
+}
@@ -0,0 +1,180 @@
+package core_test
+
+import (
+	"a10000/core"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestSubsidy(t *testing.T) {
+	params := core.RegtestParams
+	cases := map[int64]int64{
+		0:                           50,
+		params.HalvingInterval - 1:  50,
+		params.HalvingInterval:      25,
+		params.HalvingInterval * 2:  12,
+		params.HalvingInterval * 64: 0,
+	}
+	for height, expected := range cases {
+		if subsidy := params.Subsidy(height); subsidy != expected {
+			t.Fatalf("Subsidy at height %d should be %d, got %d", height, expected, subsidy)
+		}
+	}
+}
+
+func TestNextDifficulty(t *testing.T) {
+	params := &core.ChainParams{
+		InitialDifficulty: 3,
+		MinDifficulty:     2,
+		TargetSpacing:     time.Minute,
+		RetargetWindow:    10,
+	}
+	// headers 创建间隔为 spacing 的区块头链, 最后一个区块头的高度为 9
+	headers := func(spacing time.Duration, difficulty int64) []*core.BlockHeader {
+		hs := make([]*core.BlockHeader, 10)
+		for i := range hs {
+			hs[i] = &core.BlockHeader{Index: int64(i), Timestamp: int64(i) * spacing.Milliseconds(), Difficulty: difficulty}
+		}
+		return hs
+	}
+	next := func(hs []*core.BlockHeader) int64 {
+		return params.NextDifficulty(hs[len(hs)-1], func(height int64) *core.BlockHeader { return hs[height] })
+	}
+
+	if d := next(headers(time.Minute, 3)); d != 3 {
+		t.Fatalf("Difficulty should not change when blocks are on target, got %d", d)
+	}
+	if d := next(headers(10*time.Second, 3)); d != 4 {
+		t.Fatalf("Difficulty should increase when blocks are too fast, got %d", d)
+	}
+	if d := next(headers(10*time.Minute, 3)); d != 2 {
+		t.Fatalf("Difficulty should decrease when blocks are too slow, got %d", d)
+	}
+	if d := next(headers(10*time.Minute, 2)); d != 2 {
+		t.Fatalf("Difficulty should not drop below the minimum, got %d", d)
+	}
+	// 不在调整周期的边界上时难度不变
+	if d := next(headers(10*time.Second, 3)[:9]); d != 3 {
+		t.Fatalf("Difficulty should only change at retarget boundaries, got %d", d)
+	}
+	// 不调整难度的网络
+	if d := core.RegtestParams.NextDifficulty(headers(time.Second, 2)[9], nil); d != 2 {
+		t.Fatalf("Regtest difficulty should be fixed, got %d", d)
+	}
+}
+
+func TestGenesisBlock(t *testing.T) {
+	for _, params := range []*core.ChainParams{core.MainNetParams, core.TestNetParams, core.RegtestParams} {
+		if err := params.CheckGenesis(); err != nil {
+			t.Fatalf("Hardcoded genesis block is invalid: %v", err)
+		}
+		ch := core.CreateBlockchain(params)
+		if err := ch.ConnectGenesis(params.GenesisBlock()); err != nil {
+			t.Fatalf("Failed to connect %s genesis block: %v", params.Name, err)
+		}
+	}
+	// 创世区块的难度必须与网络参数一致
+	ch := core.CreateBlockchain(core.RegtestParams)
+	if err := ch.ConnectGenesis(core.TestNetParams.GenesisBlock()); err == nil {
+		t.Fatal("Genesis block of another network should be rejected")
+	}
+}
+
+func TestMineGenesis(t *testing.T) {
+	tom, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate tom: %v", err)
+	}
+	params := core.RegtestParams.Copy()
+	params.Name = "community"
+	params.GenesisAddress = tom.Address()
+	params.GenesisReward = 1000
+	if err := params.CheckGenesis(); err == nil {
+		t.Fatal("Changing genesis fields should invalidate the recorded hash")
+	}
+	genesis := params.MineGenesis()
+	if err := params.CheckGenesis(); err != nil {
+		t.Fatalf("Mined genesis block is invalid: %v", err)
+	}
+	if genesis.Hash == core.RegtestParams.GenesisHash {
+		t.Fatal("Private network should have its own genesis block")
+	}
+	params.SchemeActivations[core.SchemeECDSAP256] = 100
+	if core.RegtestParams.SchemeActivations[core.SchemeECDSAP256] == 100 || core.RegtestParams.Name != "regtest" {
+		t.Fatal("Changing copied params should not change the template")
+	}
+
+	// 参数保存为 JSON 后可以重建相同的创世区块
+	data, err := json.Marshal(params)
+	if err != nil {
+		t.Fatalf("Failed to encode params: %v", err)
+	}
+	var loaded core.ChainParams
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		t.Fatalf("Failed to decode params: %v", err)
+	}
+	if err := loaded.CheckGenesis(); err != nil || loaded.GenesisBlock().Hash != genesis.Hash {
+		t.Fatalf("Loaded params should rebuild the genesis block: %v", err)
+	}
+	ch := core.CreateBlockchain(&loaded)
+	if err := ch.ConnectGenesis(loaded.GenesisBlock()); err != nil {
+		t.Fatalf("Failed to connect genesis block: %v", err)
+	}
+	if tom.Balance(ch.FindUTXO(tom.Address())) != 1000 {
+		t.Fatal("Genesis reward should belong to the genesis address")
+	}
+}
+
+func TestAddressPrefix(t *testing.T) {
+	wallet, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate wallet: %v", err)
+	}
+	encoded := core.TestNetParams.EncodeAddress(wallet.Address())
+	if address, err := core.TestNetParams.DecodeAddress(encoded); err != nil || address != wallet.Address() {
+		t.Fatalf("Failed to decode address: %s %v", address, err)
+	}
+	if _, err := core.MainNetParams.DecodeAddress(encoded); err == nil {
+		t.Fatal("Address of another network should be rejected")
+	}
+	if _, err := core.MainNetParams.DecodeAddress(wallet.Address()); err == nil {
+		t.Fatal("Address without prefix should be rejected")
+	}
+}
+
+func TestCoinbaseReward(t *testing.T) {
+	tom, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate tom: %v", err)
+	}
+	alice, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate alice: %v", err)
+	}
+	ch := core.CreateBlockchain(core.RegtestParams)
+	ch.CoinbaseMaturity = 1
+	if err := ch.GenesisBlock(core.NewCoinbaseTX(0, tom.Address(), 50)); err != nil {
+		t.Fatalf("Failed to create genesis block: %v", err)
+	}
+
+	b := core.CreateBlock(1, []*core.Transaction{core.NewCoinbaseTX(1, alice.Address(), 51)}, ch.BlockByHeight(0).Hash, ch.NextDifficulty())
+	if err := ch.AddBlock(b); err == nil {
+		t.Fatal("Coinbase exceeding the subsidy should be rejected")
+	}
+
+	// 转账 20, 找零 25, 手续费 5 归矿工所有
+	tx, err := tom.NewTransaction(ch.FindUTXO(tom.Address()), alice.Address(), 20, "")
+	if err != nil {
+		t.Fatalf("Failed to create transaction: %v", err)
+	}
+	tx.Outputs[1].Amount = 25
+	if err := tom.SignTransaction(tx); err != nil {
+		t.Fatalf("Failed to sign transaction: %v", err)
+	}
+	tx.ID = tx.Hash()
+	b = core.CreateBlock(1, []*core.Transaction{core.NewCoinbaseTX(1, alice.Address(), 55), tx}, ch.BlockByHeight(0).Hash, ch.NextDifficulty())
+	if err := ch.AddBlock(b); err != nil {
+		t.Fatalf("Coinbase collecting fees should be accepted: %v", err)
+	}
+}
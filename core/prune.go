@@ -0,0 +1,118 @@
+package core
+
+import "fmt"
+
+// 区块修剪:
+//
+// 修剪后的区块链只保留全部区块头, UTXO 和最近区块的区块体及撤销记录.
+// 被修剪的区块只剩下区块头, 不能再查询其中的交易, 也不能被断开.
+// 修剪之前保存被修剪的最高区块处的状态(ChainState), 重启时从该状态恢复, 再依次连接之后保留的区块.
+
+// ChainState 区块链在某一高度的状态: 从创世区块到该高度的全部区块头, 以及连接该高度的区块之后的 UTXO
+type ChainState struct {
+	Headers []*BlockHeader       `json:"headers"`
+	UTXO    map[string]UTXOEntry `json:"utxo"` // key: txid:index => value: UTXOEntry
+}
+
+// Height 状态所在的高度
+func (s *ChainState) Height() int64 {
+	return int64(len(s.Headers)) - 1
+}
+
+// isPruned 高度为 height 的区块体是否已被修剪, 调用时必须持有锁
+func (ch *Blockchain) isPruned(height int64) bool {
+	return height > 0 && height <= ch.pruned
+}
+
+// Pruned 区块体已被修剪的最高高度, 为 0 时没有修剪
+func (ch *Blockchain) Pruned() int64 {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	return ch.pruned
+}
+
+// Prune 删除高度不超过 height 的区块的区块体和撤销记录, 只保留区块头. 创世区块和最新区块不会被修剪
+func (ch *Blockchain) Prune(height int64) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if height >= ch.height() {
+		return fmt.Errorf("cannot prune block %d at height %d", height, ch.height())
+	}
+	for i := ch.pruned + 1; i <= height; i++ {
+		ch.blocks[i] = headerOnly(ch.blocks[i].Header())
+		ch.undo[i] = nil
+	}
+	if height > ch.pruned {
+		ch.pruned = height
+	}
+	return nil
+}
+
+// headerOnly 只有区块头的区块, 用于表示区块体已被修剪的区块
+func headerOnly(h *BlockHeader) *Block {
+	return &Block{
+		Index:        h.Index,
+		Timestamp:    h.Timestamp,
+		MerkleRoot:   h.MerkleRoot,
+		PreviousHash: h.PreviousHash,
+		Hash:         h.Hash,
+		Nonce:        h.Nonce,
+		Difficulty:   h.Difficulty,
+	}
+}
+
+// StateAt 区块链在高度 height 的状态, 使用撤销记录从最新的区块回退得到
+// height 不能低于已修剪的高度
+func (ch *Blockchain) StateAt(height int64) (*ChainState, error) {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	return ch.stateAt(height)
+}
+
+func (ch *Blockchain) stateAt(height int64) (*ChainState, error) {
+	if height < ch.pruned || height > ch.height() {
+		return nil, fmt.Errorf("no state at height %d, pruned %d, height %d", height, ch.pruned, ch.height())
+	}
+	outputs := make(map[string]UTXOEntry, len(ch.outputs))
+	for key, entry := range ch.outputs {
+		outputs[key] = entry
+	}
+	for i := ch.height(); i > height; i-- {
+		ch.undoBlock(outputs, ch.blocks[i], ch.undo[i])
+	}
+	headers := make([]*BlockHeader, 0, height+1)
+	for i := int64(0); i <= height; i++ {
+		headers = append(headers, ch.blocks[i].Header())
+	}
+	return &ChainState{Headers: headers, UTXO: outputs}, nil
+}
+
+// RestoreState 在空的区块链上恢复状态 state, genesis 为创世区块
+// 区块头必须从创世区块开始依次链接, 并且满足难度和工作量证明. 恢复后, 创世区块以外的区块视为已修剪.
+// 恢复状态不发出事件
+func (ch *Blockchain) RestoreState(genesis *Block, state *ChainState) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if len(state.Headers) == 0 || state.Headers[0].Hash != genesis.Hash {
+		return newError(SeverityFatal, "无效的状态: 创世区块不符")
+	}
+	if err := ch.connectGenesis(genesis); err != nil {
+		return err
+	}
+	for _, h := range state.Headers[1:] {
+		if err := ch.CheckHeader(ch.blocks[len(ch.blocks)-1].Header(), h, ch.header); err != nil {
+			ch.blocks, ch.undo = ch.blocks[:0], ch.undo[:0]
+			ch.outputs = make(map[string]UTXOEntry)
+			return fmt.Errorf("header %d: %w", h.Index, err)
+		}
+		ch.blocks = append(ch.blocks, headerOnly(h))
+		ch.undo = append(ch.undo, nil)
+	}
+
+	ch.outputs = make(map[string]UTXOEntry, len(state.UTXO))
+	for key, entry := range state.UTXO {
+		ch.outputs[key] = entry
+	}
+	ch.pruned = state.Height()
+	return nil
+}
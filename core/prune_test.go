@@ -0,0 +1,104 @@
+package core_test
+
+import (
+	"a10000/core"
+	"reflect"
+	"testing"
+)
+
+func TestPrune(t *testing.T) {
+	tom, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate tom: %v", err)
+	}
+	alice, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate alice: %v", err)
+	}
+	ch := core.CreateBlockchain(core.RegtestParams)
+	ch.Clock = core.NewFakeClock(1735689600000)
+	ch.CoinbaseMaturity = 1
+	if err := ch.GenesisBlock(core.NewCoinbaseTX(0, tom.Address(), 50)); err != nil {
+		t.Fatalf("Failed to create genesis block: %v", err)
+	}
+	snapshots := []*core.Snapshot{ch.Snapshot()}
+	for i := 0; i < 20; i++ {
+		tx, err := tom.NewTransaction(ch.FindSpendableUTXO(tom.Address()), alice.Address(), 1, "")
+		if err != nil {
+			t.Fatalf("Failed to create transaction: %v", err)
+		}
+		if err := ch.AddTransaction(tx); err != nil {
+			t.Fatalf("Failed to add transaction: %v", err)
+		}
+		if _, err := ch.Generate(1, tom.Address()); err != nil {
+			t.Fatalf("Failed to generate block: %v", err)
+		}
+		snapshots = append(snapshots, ch.Snapshot())
+	}
+
+	// 通过撤销记录回退得到的状态与当时的快照一致
+	state, err := ch.StateAt(12)
+	if err != nil {
+		t.Fatalf("Failed to get state: %v", err)
+	}
+	if state.Height() != 12 || !reflect.DeepEqual(state.UTXO, snapshots[12].UTXO) {
+		t.Fatal("State at height 12 does not match the snapshot")
+	}
+
+	pruned := ch.BlockByHeight(5)
+	if err := ch.Prune(ch.Height()); err == nil {
+		t.Fatal("Tip should not be pruned")
+	}
+	if err := ch.Prune(12); err != nil {
+		t.Fatalf("Failed to prune: %v", err)
+	}
+	if ch.Pruned() != 12 || ch.BlockByHeight(5) != nil || ch.GetBlock(pruned.Hash) != nil || ch.Undo(5) != nil {
+		t.Fatal("Pruned block bodies should not be available")
+	}
+	if ch.BlockByHeight(0) == nil || ch.BlockByHeight(13) == nil {
+		t.Fatal("Genesis and recent blocks should be kept")
+	}
+	if h := ch.HeaderByHash(pruned.Hash); h == nil || h.Index != 5 || len(ch.Headers(0, 100)) != 21 {
+		t.Fatal("Headers of pruned blocks should be kept")
+	}
+	if _, err := ch.StateAt(11); err == nil {
+		t.Fatal("State below the pruned height should not be available")
+	}
+	if err := ch.VerifyState(); err != nil {
+		t.Fatalf("Pruned chain should verify: %v", err)
+	}
+
+	// 从修剪高度的状态恢复, 再连接之后的区块
+	restored := core.CreateBlockchain(core.RegtestParams)
+	restored.CoinbaseMaturity = 1
+	if err := restored.RestoreState(ch.BlockByHeight(0), state); err != nil {
+		t.Fatalf("Failed to restore state: %v", err)
+	}
+	for height := int64(13); height <= ch.Height(); height++ {
+		if err := restored.AddBlock(ch.BlockByHeight(height)); err != nil {
+			t.Fatalf("Failed to add block %d: %v", height, err)
+		}
+	}
+	if !reflect.DeepEqual(restored.Snapshot().UTXO, ch.Snapshot().UTXO) {
+		t.Fatal("Restored UTXO does not match")
+	}
+
+	// 已修剪的区块不能断开
+	for ch.Height() > 13 {
+		if _, err := ch.DisconnectTip(); err != nil {
+			t.Fatalf("Failed to disconnect block: %v", err)
+		}
+	}
+	if _, err := ch.DisconnectTip(); err != nil {
+		t.Fatalf("Failed to disconnect block 13: %v", err)
+	}
+	if _, err := ch.DisconnectTip(); err == nil {
+		t.Fatal("Pruned block should not be disconnected")
+	}
+
+	// 区块头被篡改的状态不能恢复
+	state.Headers[3] = state.Headers[4]
+	if err := core.CreateBlockchain(core.RegtestParams).RestoreState(ch.BlockByHeight(0), state); err == nil {
+		t.Fatal("State with broken headers should be rejected")
+	}
+}
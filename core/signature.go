@@ -0,0 +1,325 @@
+package core
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// 签名算法的标识
+const (
+	SchemeECDSAP256   = "ecdsa-p256"   // ECDSA over P-256, 系统最早使用的签名算法
+	SchemeEd25519     = "ed25519"      // Ed25519
+	SchemeSchnorrP256 = "schnorr-p256" // Schnorr over P-256
+)
+
+// SignatureScheme 签名算法
+//
+// 公钥(即地址)的字符串表示中携带了签名算法的标识, 格式为: 算法标识:公钥.
+// 为了兼容已有的地址, ECDSA P-256 的公钥不携带标识, 格式仍为: X:Y.
+// 验证签名时, 根据公钥中的标识选择对应的签名算法.
+type SignatureScheme interface {
+	Name() string                                              // 签名算法的标识
+	GenerateKey() (crypto.PrivateKey, crypto.PublicKey, error) // 生成新的公私钥
+	EncodePublicKey(pub crypto.PublicKey) (string, error)      // 公钥的字符串表示(不含算法标识)
+	Sign(priv crypto.PrivateKey, msg []byte) (string, error)   // 签名, 返回签名的字符串表示
+	Verify(pubKey string, msg []byte, signature string) error  // 使用公钥的字符串表示(不含算法标识)验证签名
+}
+
+var signatureSchemes = map[string]SignatureScheme{}
+
+// RegisterSignatureScheme 注册签名算法
+// 同名的签名算法会被覆盖
+func RegisterSignatureScheme(scheme SignatureScheme) {
+	signatureSchemes[scheme.Name()] = scheme
+}
+
+// GetSignatureScheme 根据标识获取签名算法
+func GetSignatureScheme(name string) (SignatureScheme, error) {
+	scheme, ok := signatureSchemes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown signature scheme: %s", name)
+	}
+	return scheme, nil
+}
+
+// EncodePublicKey 将公钥编码为携带签名算法标识的字符串, 即地址
+func EncodePublicKey(scheme SignatureScheme, pub crypto.PublicKey) (string, error) {
+	key, err := scheme.EncodePublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	if scheme.Name() == SchemeECDSAP256 {
+		return key, nil
+	}
+	return scheme.Name() + ":" + key, nil
+}
+
+// ParsePublicKey 解析公钥字符串, 返回对应的签名算法和不含标识的公钥
+func ParsePublicKey(pubKey string) (SignatureScheme, string, error) {
+	if i := strings.Index(pubKey, ":"); i > 0 {
+		if scheme, ok := signatureSchemes[pubKey[:i]]; ok {
+			return scheme, pubKey[i+1:], nil
+		}
+	}
+	// 不携带标识的公钥为 ECDSA P-256
+	scheme, err := GetSignatureScheme(SchemeECDSAP256)
+	if err != nil {
+		return nil, "", err
+	}
+	return scheme, pubKey, nil
+}
+
+// DefaultSchemeActivations 默认的签名算法激活高度
+// 新的签名算法可以通过设置激活高度软分叉上线, 激活高度之前的区块不允许使用该算法
+func DefaultSchemeActivations() map[string]int64 {
+	return map[string]int64{
+		SchemeECDSAP256:   0,
+		SchemeEd25519:     0,
+		SchemeSchnorrP256: 0,
+	}
+}
+
+func init() {
+	RegisterSignatureScheme(ecdsaP256{})
+	RegisterSignatureScheme(ed25519Scheme{})
+	RegisterSignatureScheme(schnorrP256{})
+}
+
+// parseHexPair 解析 a:b 格式的十六进制数对
+func parseHexPair(s string) (*big.Int, *big.Int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return nil, nil, errors.New("invalid format")
+	}
+	a, ok := new(big.Int).SetString(parts[0], 16)
+	if !ok {
+		return nil, nil, errors.New("invalid first value")
+	}
+	b, ok := new(big.Int).SetString(parts[1], 16)
+	if !ok {
+		return nil, nil, errors.New("invalid second value")
+	}
+	return a, b, nil
+}
+
+// parseP256PublicKey 解析 X:Y 格式的 P-256 公钥
+func parseP256PublicKey(pubKey string) (*ecdsa.PublicKey, error) {
+	x, y, err := parseHexPair(pubKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PublicKey: %v", err)
+	}
+	curve := elliptic.P256()
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.New("invalid PublicKey: point is not on curve")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func generateP256Key() (crypto.PrivateKey, crypto.PublicKey, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return privateKey, &privateKey.PublicKey, nil
+}
+
+func encodeP256PublicKey(pub crypto.PublicKey) (string, error) {
+	key, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return "", errors.New("invalid PublicKey type")
+	}
+	return key.X.Text(16) + ":" + key.Y.Text(16), nil
+}
+
+// ecdsaP256 ECDSA over P-256
+// 签名格式为: r:s
+type ecdsaP256 struct{}
+
+func (ecdsaP256) Name() string {
+	return SchemeECDSAP256
+}
+
+func (ecdsaP256) GenerateKey() (crypto.PrivateKey, crypto.PublicKey, error) {
+	return generateP256Key()
+}
+
+func (ecdsaP256) EncodePublicKey(pub crypto.PublicKey) (string, error) {
+	return encodeP256PublicKey(pub)
+}
+
+func (ecdsaP256) Sign(priv crypto.PrivateKey, msg []byte) (string, error) {
+	key, ok := priv.(*ecdsa.PrivateKey)
+	if !ok {
+		return "", errors.New("invalid PrivateKey type")
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, key, msg)
+	if err != nil {
+		return "", err
+	}
+	return r.Text(16) + ":" + s.Text(16), nil
+}
+
+func (ecdsaP256) Verify(pubKey string, msg []byte, signature string) error {
+	r, s, err := parseHexPair(signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	publicKey, err := parseP256PublicKey(pubKey)
+	if err != nil {
+		return err
+	}
+	if !ecdsa.Verify(publicKey, msg, r, s) {
+		return errors.New("signature verification failed")
+	}
+	return nil
+}
+
+// ed25519Scheme Ed25519
+// 公钥和签名均为十六进制字符串
+type ed25519Scheme struct{}
+
+func (ed25519Scheme) Name() string {
+	return SchemeEd25519
+}
+
+func (ed25519Scheme) GenerateKey() (crypto.PrivateKey, crypto.PublicKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return priv, pub, nil
+}
+
+func (ed25519Scheme) EncodePublicKey(pub crypto.PublicKey) (string, error) {
+	key, ok := pub.(ed25519.PublicKey)
+	if !ok {
+		return "", errors.New("invalid PublicKey type")
+	}
+	return hex.EncodeToString(key), nil
+}
+
+func (ed25519Scheme) Sign(priv crypto.PrivateKey, msg []byte) (string, error) {
+	key, ok := priv.(ed25519.PrivateKey)
+	if !ok {
+		return "", errors.New("invalid PrivateKey type")
+	}
+	return hex.EncodeToString(ed25519.Sign(key, msg)), nil
+}
+
+func (ed25519Scheme) Verify(pubKey string, msg []byte, signature string) error {
+	key, err := hex.DecodeString(pubKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("invalid PublicKey")
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return errors.New("invalid signature")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), msg, sig) {
+		return errors.New("signature verification failed")
+	}
+	return nil
+}
+
+// schnorrP256 Schnorr over P-256
+// 公钥格式与 ECDSA P-256 相同, 签名格式为: e:s
+//
+// 签名: k 由私钥和消息确定性地生成, R = kG, e = H(R || P || m), s = k + e*d
+// 验证: R' = sG - eP, 判断 H(R' || P || m) == e
+type schnorrP256 struct{}
+
+func (schnorrP256) Name() string {
+	return SchemeSchnorrP256
+}
+
+func (schnorrP256) GenerateKey() (crypto.PrivateKey, crypto.PublicKey, error) {
+	return generateP256Key()
+}
+
+func (schnorrP256) EncodePublicKey(pub crypto.PublicKey) (string, error) {
+	return encodeP256PublicKey(pub)
+}
+
+// schnorrChallenge 计算 e = H(Rx || Ry || Px || Py || m) mod n
+func schnorrChallenge(rx, ry *big.Int, pub *ecdsa.PublicKey, msg []byte) *big.Int {
+	h := sha256.New()
+	for _, v := range []*big.Int{rx, ry, pub.X, pub.Y} {
+		h.Write(v.FillBytes(make([]byte, 32)))
+	}
+	h.Write(msg)
+	e := new(big.Int).SetBytes(h.Sum(nil))
+	return e.Mod(e, pub.Curve.Params().N)
+}
+
+func (schnorrP256) Sign(priv crypto.PrivateKey, msg []byte) (string, error) {
+	key, ok := priv.(*ecdsa.PrivateKey)
+	if !ok {
+		return "", errors.New("invalid PrivateKey type")
+	}
+	curve := key.Curve
+	n := curve.Params().N
+
+	for counter := byte(0); ; counter++ {
+		// 确定性地生成 k, 避免随机数源缺陷导致私钥泄露
+		h := sha256.New()
+		h.Write(key.D.FillBytes(make([]byte, 32)))
+		h.Write(msg)
+		h.Write([]byte{counter})
+		k := new(big.Int).SetBytes(h.Sum(nil))
+		k.Mod(k, n)
+		if k.Sign() == 0 {
+			continue
+		}
+
+		rx, ry := curve.ScalarBaseMult(k.FillBytes(make([]byte, 32)))
+		e := schnorrChallenge(rx, ry, &key.PublicKey, msg)
+		if e.Sign() == 0 {
+			continue
+		}
+		s := new(big.Int).Mul(e, key.D)
+		s.Add(s, k)
+		s.Mod(s, n)
+		if s.Sign() == 0 {
+			continue
+		}
+		return e.Text(16) + ":" + s.Text(16), nil
+	}
+}
+
+func (schnorrP256) Verify(pubKey string, msg []byte, signature string) error {
+	e, s, err := parseHexPair(signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	publicKey, err := parseP256PublicKey(pubKey)
+	if err != nil {
+		return err
+	}
+	curve := publicKey.Curve
+	params := curve.Params()
+	if e.Sign() <= 0 || e.Cmp(params.N) >= 0 || s.Sign() <= 0 || s.Cmp(params.N) >= 0 {
+		return errors.New("invalid signature: value out of range")
+	}
+
+	sx, sy := curve.ScalarBaseMult(s.FillBytes(make([]byte, 32)))
+	ex, ey := curve.ScalarMult(publicKey.X, publicKey.Y, e.FillBytes(make([]byte, 32)))
+	ey.Sub(params.P, ey) // -eP
+	rx, ry := curve.Add(sx, sy, ex, ey)
+	if rx.Sign() == 0 && ry.Sign() == 0 {
+		return errors.New("signature verification failed")
+	}
+
+	if schnorrChallenge(rx, ry, publicKey, msg).Cmp(e) != 0 {
+		return errors.New("signature verification failed")
+	}
+	return nil
+}
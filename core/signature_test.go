@@ -0,0 +1,86 @@
+package core_test
+
+import (
+	"a10000/core"
+	"testing"
+)
+
+func TestSignatureSchemes(t *testing.T) {
+	for _, name := range []string{core.SchemeECDSAP256, core.SchemeEd25519, core.SchemeSchnorrP256} {
+		wallet, err := core.NewWalletWithScheme(name)
+		if err != nil {
+			t.Fatalf("Failed to generate %s wallet: %v", name, err)
+		}
+
+		scheme, pubKey, err := core.ParsePublicKey(wallet.Address())
+		if err != nil {
+			t.Fatalf("Failed to parse %s address: %v", name, err)
+		}
+		if scheme.Name() != name {
+			t.Fatalf("Address scheme mismatch, expected %s, got %s", name, scheme.Name())
+		}
+
+		msg := []byte("A10000")
+		signature, err := scheme.Sign(wallet.PrivateKey, msg)
+		if err != nil {
+			t.Fatalf("Failed to sign with %s: %v", name, err)
+		}
+		if err = scheme.Verify(pubKey, msg, signature); err != nil {
+			t.Fatalf("Failed to verify %s signature: %v", name, err)
+		}
+		if err = scheme.Verify(pubKey, []byte("A10001"), signature); err == nil {
+			t.Fatalf("%s signature should not verify for a different message", name)
+		}
+	}
+}
+
+func TestSchemeActivation(t *testing.T) {
+	tom, err := core.NewWalletWithScheme(core.SchemeEd25519)
+	if err != nil {
+		t.Fatalf("Failed to generate tom: %v", err)
+	}
+	alice, err := core.NewWalletWithScheme(core.SchemeSchnorrP256)
+	if err != nil {
+		t.Fatalf("Failed to generate alice: %v", err)
+	}
+
+	ch := core.CreateBlockchain(core.RegtestParams)
+	ch.CoinbaseMaturity = 1
+	ch.SchemeActivations[core.SchemeEd25519] = 2
+	if err = ch.GenesisBlock(core.NewCoinbaseTX(0, tom.Address(), 50)); err != nil {
+		t.Fatalf("Failed to create genesis block: %v", err)
+	}
+
+	tx, err := tom.NewTransaction(ch.FindUTXO(tom.Address()), alice.Address(), 20, "")
+	if err != nil {
+		t.Fatalf("Failed to create transaction: %v", err)
+	}
+	if err = ch.AddTransaction(tx); err == nil {
+		t.Fatal("Ed25519 transaction should be rejected before activation")
+	}
+
+	b := core.CreateBlock(1, []*core.Transaction{core.NewCoinbaseTX(1, alice.Address(), 50)}, ch.BlockByHeight(0).Hash, ch.NextDifficulty())
+	if err = ch.AddBlock(b); err != nil {
+		t.Fatalf("Failed to add block: %v", err)
+	}
+
+	if err = ch.AddTransaction(tx); err != nil {
+		t.Fatalf("Ed25519 transaction should be accepted after activation: %v", err)
+	}
+	b = core.CreateBlock(2, append([]*core.Transaction{core.NewCoinbaseTX(2, alice.Address(), 50)}, ch.PendingTransactions()...), ch.BlockByHeight(1).Hash, ch.NextDifficulty())
+	if err = ch.AddBlock(b); err != nil {
+		t.Fatalf("Failed to add block: %v", err)
+	}
+
+	if balance := alice.Balance(ch.FindUTXO(alice.Address())); balance != 120 {
+		t.Fatalf("Alice's balance is incorrect, expected 120, got %d", balance)
+	}
+
+	tx, err = alice.NewTransaction(ch.FindUTXO(alice.Address()), tom.Address(), 60, "")
+	if err != nil {
+		t.Fatalf("Failed to create transaction: %v", err)
+	}
+	if err = ch.AddTransaction(tx); err != nil {
+		t.Fatalf("Failed to add Schnorr transaction: %v", err)
+	}
+}
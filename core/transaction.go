@@ -2,25 +2,24 @@ package core
 
 import (
 	"a10000/utils"
-	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"math/big"
+	"strconv"
 	"strings"
 )
 
 type TxInput struct {
-	Txid      string `json:"txid"`      // 引用的交易ID
-	Vout      int    `json:"vout"`      // 引用的交易输出索引
-	Signature string `json:"signature"` // 签名
-	PubKey    string `json:"pubkey"`    // 公钥
+	Txid      string `json:"txid"`               // 引用的交易ID
+	Vout      int    `json:"vout"`               // 引用的交易输出索引
+	Signature string `json:"signature"`          // 签名
+	PubKey    string `json:"pubkey"`             // 公钥
+	Coinbase  string `json:"coinbase,omitempty"` // coinbase 数据, 格式为: 区块高度:额外随机数, 仅 coinbase 交易的输入使用
 }
 
 func (in *TxInput) String() string {
-	formatString := fmt.Sprintf("%s%d%s", in.Txid, in.Vout, in.PubKey)
+	formatString := fmt.Sprintf("%s%d%s%s", in.Txid, in.Vout, in.PubKey, in.Coinbase)
 	return formatString
 }
 
@@ -33,48 +32,21 @@ func (in *TxInput) Hash() string {
 	return hex.EncodeToString(bytes[:])
 }
 
+// VerifySignature 验证交易输入的签名
+// 根据公钥中携带的签名算法标识选择验证方式
 func (in *TxInput) VerifySignature(txHashed string) error {
 	hashed := txHashed + in.Hash()
-	sender := in.PubKey // 假设 sender 是公钥的字符串表示
-	// sender := w.PublicKey.X.Text(16) + w.PublicKey.Y.Text(16)
-	signature := in.Signature
-	// 	signature := r.Text(16) + ":" + s.Text(16)
-	parts := strings.Split(signature, ":")
-	if len(parts) != 2 {
-		return errors.New("invalid signature format") // 确保签名格式正确
-	}
-	r, err := new(big.Int).SetString(parts[0], 16)
-	if !err {
-		return errors.New("invalid signature r value") // 确保 r 值正确
-	}
-	s, err := new(big.Int).SetString(parts[1], 16)
-	if !err {
-		return errors.New("invalid signature s value") // 确保 s 值正确
-	}
-	// 将公钥字符串转换为 ecdsa.PublicKey
-	parts = strings.Split(sender, ":")
-	if len(parts) != 2 {
-		return errors.New("invalid PublicKey format") // 确保公钥格式正确
-	}
-	x, err := new(big.Int).SetString(parts[0], 16)
-	if !err {
-		return errors.New("invalid signature PublicKey.X value") // 确保 x 值正确
-	}
-	y, err := new(big.Int).SetString(parts[1], 16)
-	if !err {
-		return errors.New("invalid signature PublicKey.y value") // 确保 x 值正确
-	}
-	publicKey := &ecdsa.PublicKey{
-		Curve: elliptic.P256(),
-		X:     x,
-		Y:     y,
-	}
-	// 验证签名
-	ok := ecdsa.Verify(publicKey, []byte(hashed), r, s)
-	if !ok {
-		return errors.New("signature verification failed") // 验证失败
+	scheme, pubKey, err := ParsePublicKey(in.PubKey)
+	if err != nil {
+		return err
 	}
-	return nil
+	return scheme.Verify(pubKey, []byte(hashed), in.Signature)
+}
+
+// Scheme 交易输入使用的签名算法
+func (in *TxInput) Scheme() (SignatureScheme, error) {
+	scheme, _, err := ParsePublicKey(in.PubKey)
+	return scheme, err
 }
 
 type TxOutput struct {
@@ -134,6 +106,31 @@ func (tx *Transaction) Hash() string {
 	return hex.EncodeToString(bytes[:])
 }
 
+// IsCoinbase 判断是否为 coinbase 交易
+// coinbase 交易有且仅有一个输入, 且该输入不引用任何交易输出
+func (tx *Transaction) IsCoinbase() bool {
+	return len(tx.Inputs) == 1 && tx.Inputs[0].Txid == "" && tx.Inputs[0].Vout == -1
+}
+
+// CoinbaseHeight 解析 coinbase 交易中承诺的区块高度
+func (tx *Transaction) CoinbaseHeight() (int64, error) {
+	if !tx.IsCoinbase() {
+		return 0, errors.New("not a coinbase transaction")
+	}
+	parts := strings.Split(tx.Inputs[0].Coinbase, ":")
+	if len(parts) != 2 {
+		return 0, errors.New("invalid coinbase format")
+	}
+	height, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid coinbase height")
+	}
+	if _, err := strconv.ParseUint(parts[1], 10, 64); err != nil {
+		return 0, errors.New("invalid coinbase extra nonce")
+	}
+	return height, nil
+}
+
 func (tx *Transaction) Exist(in *TxInput) bool {
 	for _, input := range tx.Inputs {
 		if input.Txid == in.Txid && input.Vout == in.Vout {
@@ -143,18 +140,27 @@ func (tx *Transaction) Exist(in *TxInput) bool {
 	return false
 }
 
-// 验证签名
-func (tx *Transaction) VerifySignature() error {
+// VerifyStructure 验证交易的结构, 即输入输出不为空且交易 ID 正确
+// 不验证签名
+func (tx *Transaction) VerifyStructure() error {
 	if len(tx.Inputs) == 0 {
 		return errors.New("no inputs")
 	}
 	if len(tx.Outputs) == 0 {
 		return errors.New("no outputs")
 	}
-	hashed := tx.Hash()
-	if tx.ID != hashed {
+	if tx.ID != tx.Hash() {
 		return errors.New("invalid transaction hash")
 	}
+	return nil
+}
+
+// 验证签名
+func (tx *Transaction) VerifySignature() error {
+	if err := tx.VerifyStructure(); err != nil {
+		return err
+	}
+	hashed := tx.ID
 	for i := 0; i < len(tx.Inputs); i++ {
 		if err := tx.Inputs[i].VerifySignature(hashed); err != nil {
 			return err
@@ -164,7 +170,24 @@ func (tx *Transaction) VerifySignature() error {
 	return nil
 }
 
-func NewCoinbaseTX(minerAddress string, amount int64) *Transaction {
+// NewCoinbaseTX 创建高度为 height 的区块的 coinbase 交易
+// 区块高度被写入 coinbase 输入中, 保证不同区块的 coinbase 交易 ID 不会重复
+func NewCoinbaseTX(height int64, minerAddress string, amount int64) *Transaction {
+	return NewCoinbaseTXWithExtraNonce(height, minerAddress, amount, 0)
+}
+
+// NewCoinbaseTXAt 与 NewCoinbaseTX 相同, 交易的时间戳为 timestamp
+func NewCoinbaseTXAt(height int64, minerAddress string, amount int64, timestamp int64) *Transaction {
+	return newCoinbaseTX(height, minerAddress, amount, 0, timestamp)
+}
+
+// NewCoinbaseTXWithExtraNonce 创建带有额外随机数的 coinbase 交易
+// 同一高度需要多个不同的 coinbase 交易时(例如多个矿工), 可以通过 extraNonce 区分
+func NewCoinbaseTXWithExtraNonce(height int64, minerAddress string, amount int64, extraNonce uint64) *Transaction {
+	return newCoinbaseTX(height, minerAddress, amount, extraNonce, SystemClock.Now())
+}
+
+func newCoinbaseTX(height int64, minerAddress string, amount int64, extraNonce uint64, timestamp int64) *Transaction {
 	// 创建交易
 	inputs := make([]*TxInput, 0)
 	outputs := make([]*TxOutput, 0)
@@ -174,6 +197,7 @@ func NewCoinbaseTX(minerAddress string, amount int64) *Transaction {
 		Vout:      -1,
 		Signature: "",
 		PubKey:    "",
+		Coinbase:  fmt.Sprintf("%d:%d", height, extraNonce),
 	})
 
 	outputs = append(outputs, &TxOutput{
@@ -184,7 +208,7 @@ func NewCoinbaseTX(minerAddress string, amount int64) *Transaction {
 	transaction := &Transaction{
 		Inputs:    inputs,
 		Outputs:   outputs,
-		Timestamp: utils.GetUTCTimestamp(),
+		Timestamp: timestamp,
 	}
 
 	transaction.ID = transaction.Hash()
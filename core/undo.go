@@ -0,0 +1,80 @@
+package core
+
+// SpentOutput 被区块中的交易花费的输出, 以及创建该输出的区块高度
+type SpentOutput struct {
+	Txid string `json:"txid"` // 创建该输出的交易 ID
+	Vout int    `json:"vout"` // 输出在交易中的索引
+	UTXOEntry
+}
+
+// BlockUndo 区块的撤销记录
+// 连接区块时删除的输出按照交易输入的顺序保存, 断开区块时据此恢复 UTXO
+type BlockUndo struct {
+	Hash  string        `json:"hash"`  // 对应区块的 Hash
+	Spent []SpentOutput `json:"spent"` // 区块中的交易花费的输出
+}
+
+// Undo 高度为 height 的区块的撤销记录, 不存在时返回 nil
+func (ch *Blockchain) Undo(height int64) *BlockUndo {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	if height < 0 || height >= int64(len(ch.undo)) {
+		return nil
+	}
+	return ch.undo[height]
+}
+
+// DisconnectTip 从区块链上断开最新的区块, 并将 UTXO 恢复到连接该区块之前的状态
+// 区块中的交易(coinbase 除外)重新加入交易池, 交易池中不再合法的交易被移除. 创世区块不能断开
+func (ch *Blockchain) DisconnectTip() (*Block, error) {
+	ch.mu.Lock()
+	defer ch.unlockAndNotify()
+	if len(ch.blocks) <= 1 {
+		return nil, newError(SeverityNone, "无法断开区块: 区块链只有创世区块")
+	}
+	b := ch.blocks[len(ch.blocks)-1]
+	if ch.isPruned(b.Index) {
+		return nil, newError(SeverityNone, "无法断开区块: 区块已被修剪")
+	}
+	undo := ch.undo[len(ch.undo)-1]
+	if undo.Hash != b.Hash {
+		return nil, newError(SeverityFatal, "无法断开区块: 撤销记录与区块不符")
+	}
+
+	ch.undoBlock(ch.outputs, b, undo)
+	ch.blocks = ch.blocks[:len(ch.blocks)-1]
+	ch.undo = ch.undo[:len(ch.undo)-1]
+	ch.emit(Event{Type: EventBlockDisconnected, Block: b})
+
+	// 区块中的交易排在交易池的前面, 引用了被断开区块的输出的交易不再合法
+	pending := make([]*Transaction, 0, len(b.Transactions)-1+len(ch.pending))
+	for _, tx := range b.Transactions[1:] {
+		if ch.checkInputs(tx, b.Index) == nil {
+			pending = append(pending, tx)
+			ch.emit(Event{Type: EventTxAccepted, Tx: tx})
+		}
+	}
+	for _, tx := range ch.pending {
+		if ch.checkInputs(tx, b.Index) != nil {
+			ch.emit(Event{Type: EventTxRemoved, Tx: tx, Reason: RemovedConflict})
+			continue
+		}
+		pending = append(pending, tx)
+	}
+	ch.pending = pending
+
+	return b, nil
+}
+
+// undoBlock 将 outputs 恢复到连接区块 b 之前的状态: 删除区块创建的输出, 再恢复区块花费的输出
+func (ch *Blockchain) undoBlock(outputs map[string]UTXOEntry, b *Block, undo *BlockUndo) {
+	for i := len(b.Transactions) - 1; i >= 0; i-- {
+		tx := b.Transactions[i]
+		for j := 0; j < len(tx.Outputs); j++ {
+			delete(outputs, ch.OutputKey(tx.ID, j))
+		}
+	}
+	for _, spent := range undo.Spent {
+		outputs[ch.OutputKey(spent.Txid, spent.Vout)] = spent.UTXOEntry
+	}
+}
@@ -0,0 +1,108 @@
+package core_test
+
+import (
+	"a10000/core"
+	"reflect"
+	"testing"
+)
+
+func TestDisconnectTip(t *testing.T) {
+	tom, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate tom: %v", err)
+	}
+	alice, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate alice: %v", err)
+	}
+	ch := core.CreateBlockchain(core.RegtestParams)
+	ch.Clock = core.NewFakeClock(1735689600000)
+	ch.CoinbaseMaturity = 1
+	if err := ch.GenesisBlock(core.NewCoinbaseTX(0, tom.Address(), 50)); err != nil {
+		t.Fatalf("Failed to create genesis block: %v", err)
+	}
+	if _, err := ch.DisconnectTip(); err == nil {
+		t.Fatal("Genesis block should not be disconnected")
+	}
+
+	// 每个区块都花费之前的输出, 记录连接每个区块之前的 UTXO
+	snapshots := []*core.Snapshot{ch.Snapshot()}
+	var tx *core.Transaction
+	for i := 0; i < 5; i++ {
+		var err error
+		tx, err = tom.NewTransaction(ch.FindSpendableUTXO(tom.Address()), alice.Address(), 10, "")
+		if err != nil {
+			t.Fatalf("Failed to create transaction: %v", err)
+		}
+		if err := ch.AddTransaction(tx); err != nil {
+			t.Fatalf("Failed to add transaction: %v", err)
+		}
+		if _, err := ch.Generate(1, tom.Address()); err != nil {
+			t.Fatalf("Failed to generate block: %v", err)
+		}
+		snapshots = append(snapshots, ch.Snapshot())
+	}
+
+	// 交易池中花费了最新区块 coinbase 的交易在断开区块后不再合法
+	// 只提供 coinbase 和另一个输出, 交易必须同时花费两者
+	utxo := ch.FindSpendableUTXO(tom.Address())
+	coinbaseKey := ch.OutputKey(ch.Tip().Transactions[0].ID, 0)
+	inputs := map[string]core.TxOutput{coinbaseKey: utxo[coinbaseKey]}
+	for key, output := range utxo {
+		if key != coinbaseKey {
+			inputs[key] = output
+			break
+		}
+	}
+	spendCoinbase, _ := tom.NewTransaction(inputs, alice.Address(), utxo[coinbaseKey].Amount+1, "")
+	if err := ch.AddTransaction(spendCoinbase); err != nil {
+		t.Fatalf("Failed to add transaction: %v", err)
+	}
+
+	tip := ch.Tip()
+	b, err := ch.DisconnectTip()
+	if err != nil {
+		t.Fatalf("Failed to disconnect block: %v", err)
+	}
+	if b != tip || ch.Height() != 4 {
+		t.Fatalf("Expected to disconnect block 5, height is %d", ch.Height())
+	}
+	pending := ch.PendingTransactions()
+	if len(pending) != 1 || pending[0] != tx {
+		t.Fatalf("Block transactions should return to the mempool, got %d transactions", len(pending))
+	}
+
+	disconnected := []*core.Block{b}
+	for height := 4; height >= 1; height-- {
+		if !reflect.DeepEqual(ch.Snapshot().UTXO, snapshots[height].UTXO) {
+			t.Fatalf("UTXO at height %d is not restored", height)
+		}
+		b, err := ch.DisconnectTip()
+		if err != nil {
+			t.Fatalf("Failed to disconnect block: %v", err)
+		}
+		disconnected = append(disconnected, b)
+	}
+	if !reflect.DeepEqual(ch.Snapshot().UTXO, snapshots[0].UTXO) {
+		t.Fatal("UTXO at genesis is not restored")
+	}
+	if err := ch.VerifyState(); err != nil {
+		t.Fatalf("State after disconnecting should match replay: %v", err)
+	}
+	if ch.Undo(1) != nil {
+		t.Fatal("Undo record should be removed with the block")
+	}
+
+	// 断开的区块可以重新连接
+	for i := len(disconnected) - 1; i >= 0; i-- {
+		if err := ch.AddBlock(disconnected[i]); err != nil {
+			t.Fatalf("Failed to reconnect block: %v", err)
+		}
+	}
+	if !reflect.DeepEqual(ch.Snapshot().UTXO, snapshots[5].UTXO) || len(ch.PendingTransactions()) != 0 {
+		t.Fatal("Reconnected chain should have the original UTXO and an empty mempool")
+	}
+	if err := ch.VerifyState(); err != nil {
+		t.Fatalf("State after reconnecting should match replay: %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// UTXOHash 区块链在高度 height 的区块 blockHash 处的 UTXO 集合的哈希承诺
+// 先写入高度和区块 Hash, 再按 key 排序后依次写入每个输出的 key, 金额, 接收方, 创建高度和是否为 coinbase, 计算 sha256.
+// 相同的 UTXO 集合总是得到相同的哈希, 与 map 的遍历顺序无关. 区块头逐个链接到创世区块,
+// 因此哈希同时承诺了快照中的全部区块头, 可信的哈希不能与其他区块头链搭配使用
+func UTXOHash(height int64, blockHash string, utxo map[string]UTXOEntry) string {
+	keys := make([]string, 0, len(utxo))
+	for key := range utxo {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	fmt.Fprintf(h, "%d %s\n", height, blockHash)
+	for _, key := range keys {
+		entry := utxo[key]
+		fmt.Fprintf(h, "%s %d %s %d %t\n", key, entry.Amount, entry.PubKeyHash, entry.Height, entry.Coinbase)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// UTXOHash 状态中 UTXO 集合和所在区块的哈希承诺
+func (s *ChainState) UTXOHash() string {
+	tip := s.Tip()
+	return UTXOHash(tip.Index, tip.Hash, s.UTXO)
+}
+
+// Tip 状态所在高度的区块头
+func (s *ChainState) Tip() *BlockHeader {
+	return s.Headers[len(s.Headers)-1]
+}
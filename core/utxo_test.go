@@ -0,0 +1,61 @@
+package core_test
+
+import (
+	"a10000/core"
+	"testing"
+)
+
+func TestUTXOHash(t *testing.T) {
+	tom, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate tom: %v", err)
+	}
+	ch := core.CreateBlockchain(core.RegtestParams)
+	if err := ch.ConnectGenesis(core.RegtestParams.GenesisBlock()); err != nil {
+		t.Fatalf("Failed to connect genesis block: %v", err)
+	}
+	if _, err := ch.Generate(5, tom.Address()); err != nil {
+		t.Fatalf("Failed to generate blocks: %v", err)
+	}
+	state, err := ch.StateAt(3)
+	if err != nil {
+		t.Fatalf("Failed to get state: %v", err)
+	}
+
+	// 内容相同的 UTXO 集合得到相同的哈希
+	copied := make(map[string]core.UTXOEntry)
+	for key, entry := range state.UTXO {
+		copied[key] = entry
+	}
+	tip := ch.BlockByHeight(3)
+	hash := state.UTXOHash()
+	if core.UTXOHash(3, tip.Hash, copied) != hash {
+		t.Fatal("Equal UTXO sets should have the same hash")
+	}
+
+	// 哈希同时承诺快照所在的区块
+	if core.UTXOHash(3, ch.BlockByHeight(2).Hash, copied) == hash || core.UTXOHash(2, tip.Hash, copied) == hash {
+		t.Fatal("The same UTXO set at another block should have a different hash")
+	}
+	for key, entry := range copied {
+		entry.Amount++
+		copied[key] = entry
+		break
+	}
+	if core.UTXOHash(3, tip.Hash, copied) == hash || core.UTXOHash(3, tip.Hash, ch.Snapshot().UTXO) == hash {
+		t.Fatal("Different UTXO sets should have different hashes")
+	}
+
+	params := *core.RegtestParams
+	if params.AssumedUTXO(state) {
+		t.Fatal("Snapshot should not be trusted without a checkpoint")
+	}
+	params.AssumeUTXO = []core.UTXOCheckpoint{{Height: 3, BlockHash: ch.BlockByHeight(3).Hash, UTXOHash: hash}}
+	if !params.AssumedUTXO(state) {
+		t.Fatal("Snapshot matching the checkpoint should be trusted")
+	}
+	params.AssumeUTXO[0].BlockHash = ch.BlockByHeight(2).Hash
+	if params.AssumedUTXO(state) {
+		t.Fatal("Snapshot at a different block should not be trusted")
+	}
+}
@@ -0,0 +1,151 @@
+package core
+
+import (
+	"a10000/utils"
+	"runtime"
+	"sync"
+)
+
+// DefaultSigCacheSize 默认的签名缓存容量
+const DefaultSigCacheSize = 50000
+
+// SigCache 签名缓存
+// 记录已经验证通过的签名, 交易进入交易池时验证过的签名, 在区块到达时无需再次验证
+type SigCache struct {
+	mu       sync.RWMutex
+	entries  map[string]struct{}
+	capacity int
+}
+
+// NewSigCache 创建容量为 capacity 的签名缓存
+func NewSigCache(capacity int) *SigCache {
+	return &SigCache{
+		entries:  make(map[string]struct{}),
+		capacity: capacity,
+	}
+}
+
+// sigCacheKey 签名缓存的 key
+// 包含交易 Hash, 输入, 公钥和签名, 任意一项变化都会导致缓存失效
+func sigCacheKey(txHashed string, in *TxInput) string {
+	return utils.Hash([]byte(txHashed + in.Hash() + in.PubKey + in.Signature))
+}
+
+// Exists 判断签名是否已经验证通过
+func (c *SigCache) Exists(txHashed string, in *TxInput) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, ok := c.entries[sigCacheKey(txHashed, in)]
+	return ok
+}
+
+// Add 添加验证通过的签名
+// 缓存已满时, 随机淘汰一个已有的签名
+func (c *SigCache) Add(txHashed string, in *TxInput) {
+	if c.capacity <= 0 {
+		return
+	}
+	key := sigCacheKey(txHashed, in)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.capacity {
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = struct{}{}
+}
+
+// Len 缓存中的签名数量
+func (c *SigCache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.entries)
+}
+
+// SigVerifier 签名验证器
+// 将一批交易的所有输入签名分发给多个 worker 并行验证, 遇到第一个失败时停止
+type SigVerifier struct {
+	Workers int       // 并行验证的 worker 数量
+	Cache   *SigCache // 签名缓存, 为 nil 时不使用缓存
+}
+
+// NewSigVerifier 创建签名验证器, workers 小于 1 时使用 CPU 核数
+func NewSigVerifier(workers int, cache *SigCache) *SigVerifier {
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	return &SigVerifier{Workers: workers, Cache: cache}
+}
+
+// sigJob 一个待验证的签名
+type sigJob struct {
+	txHashed string
+	input    *TxInput
+}
+
+// VerifyTransactions 验证一批交易的结构和签名
+func (v *SigVerifier) VerifyTransactions(txs []*Transaction) error {
+	jobs := make([]sigJob, 0)
+	for _, tx := range txs {
+		if err := tx.VerifyStructure(); err != nil {
+			return withSeverity(err, SeverityFatal)
+		}
+		for _, input := range tx.Inputs {
+			if v.Cache != nil && v.Cache.Exists(tx.ID, input) {
+				continue
+			}
+			jobs = append(jobs, sigJob{txHashed: tx.ID, input: input})
+		}
+	}
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	workers := v.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+
+	queue := make(chan sigJob)
+	done := make(chan struct{})
+	var once sync.Once
+	var firstErr error
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				if err := job.input.VerifySignature(job.txHashed); err != nil {
+					once.Do(func() {
+						firstErr = err
+						close(done)
+					})
+					continue
+				}
+				if v.Cache != nil {
+					v.Cache.Add(job.txHashed, job.input)
+				}
+			}
+		}()
+	}
+
+dispatch:
+	for _, job := range jobs {
+		select {
+		case queue <- job:
+		case <-done:
+			break dispatch
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	return withSeverity(firstErr, SeverityFatal)
+}
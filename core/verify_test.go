@@ -0,0 +1,63 @@
+package core_test
+
+import (
+	"a10000/core"
+	"a10000/utils"
+	"fmt"
+	"testing"
+)
+
+// newSignedTransactions 创建 n 个由不同钱包签名的交易
+func newSignedTransactions(t *testing.T, n int) []*core.Transaction {
+	txs := make([]*core.Transaction, 0, n)
+	for i := 0; i < n; i++ {
+		wallet, err := core.NewWallet()
+		if err != nil {
+			t.Fatalf("Failed to generate wallet: %v", err)
+		}
+		utxo := map[string]core.TxOutput{
+			fmt.Sprintf("prev%d:0", i): {Amount: 10, PubKeyHash: utils.Hash([]byte(wallet.Address()))},
+		}
+		tx, err := wallet.NewTransaction(utxo, "recipient", 5, "")
+		if err != nil {
+			t.Fatalf("Failed to create transaction: %v", err)
+		}
+		txs = append(txs, tx)
+	}
+	return txs
+}
+
+func TestSigVerifier(t *testing.T) {
+	txs := newSignedTransactions(t, 16)
+
+	cache := core.NewSigCache(100)
+	verifier := core.NewSigVerifier(4, cache)
+	if err := verifier.VerifyTransactions(txs); err != nil {
+		t.Fatalf("Failed to verify transactions: %v", err)
+	}
+	if cache.Len() != len(txs) {
+		t.Fatalf("Signature cache size is incorrect, expected %d, got %d", len(txs), cache.Len())
+	}
+
+	// 篡改其中一个签名, 并行验证应当失败
+	txs[7].Inputs[0].Signature = txs[8].Inputs[0].Signature
+	if err := core.NewSigVerifier(4, nil).VerifyTransactions(txs); err == nil {
+		t.Fatal("Verification should fail with a tampered signature")
+	}
+	// 篡改后的签名不在缓存中
+	if cache.Exists(txs[7].ID, txs[7].Inputs[0]) {
+		t.Fatal("Tampered signature should not hit the cache")
+	}
+}
+
+func TestSigCacheEviction(t *testing.T) {
+	txs := newSignedTransactions(t, 4)
+
+	cache := core.NewSigCache(2)
+	if err := core.NewSigVerifier(1, cache).VerifyTransactions(txs); err != nil {
+		t.Fatalf("Failed to verify transactions: %v", err)
+	}
+	if cache.Len() != 2 {
+		t.Fatalf("Signature cache should be bounded, expected 2, got %d", cache.Len())
+	}
+}
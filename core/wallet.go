@@ -2,9 +2,10 @@ package core
 
 import (
 	"a10000/utils"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
+	"crypto"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"strconv"
 	"strings"
@@ -16,10 +17,56 @@ import (
 // 仅作测试使用
 // 实际应用中, 钱包应由独立的第三方服务提供
 // 例如, 使用 MetaMask 等钱包服务
-// 这里的 Wallet 仅用于演示如何使用 ecdsa 包进行签名
+// 这里的 Wallet 仅用于演示如何使用签名算法进行签名
 type Wallet struct {
-	PrivateKey *ecdsa.PrivateKey // 私钥
-	PublicKey  *ecdsa.PublicKey  // 公钥
+	Scheme     SignatureScheme   // 签名算法
+	PrivateKey crypto.PrivateKey // 私钥
+	PublicKey  crypto.PublicKey  // 公钥
+	Clock      Clock             // 交易时间戳的来源, 为 nil 时使用系统时钟, 不会保存到钱包文件
+}
+
+// walletJSON 钱包的 JSON 格式, 私钥为 PKCS #8 编码的十六进制字符串
+type walletJSON struct {
+	Scheme     string `json:"scheme"`
+	PrivateKey string `json:"private_key"`
+}
+
+// MarshalJSON 将钱包编码为 JSON, 结果包含私钥, 保存时需要注意文件权限
+func (w *Wallet) MarshalJSON() ([]byte, error) {
+	if w.Scheme == nil || w.PrivateKey == nil {
+		return nil, errors.New("wallet is not initialized")
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(w.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&walletJSON{Scheme: w.Scheme.Name(), PrivateKey: hex.EncodeToString(der)})
+}
+
+// UnmarshalJSON 从 JSON 中恢复钱包, 公钥由私钥推导
+func (w *Wallet) UnmarshalJSON(data []byte) error {
+	var v walletJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	scheme, err := GetSignatureScheme(v.Scheme)
+	if err != nil {
+		return err
+	}
+	der, err := hex.DecodeString(v.PrivateKey)
+	if err != nil {
+		return errors.New("invalid wallet private key")
+	}
+	privateKey, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return err
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return errors.New("invalid wallet private key")
+	}
+	w.Scheme, w.PrivateKey, w.PublicKey = scheme, privateKey, signer.Public()
+	return nil
 }
 
 func (w *Wallet) Balance(uouto map[string]TxOutput) int64 {
@@ -32,8 +79,21 @@ func (w *Wallet) Balance(uouto map[string]TxOutput) int64 {
 	return balance
 }
 
+// Address 钱包地址, 即携带签名算法标识的公钥字符串
 func (w *Wallet) Address() string {
-	return w.PublicKey.X.Text(16) + ":" + w.PublicKey.Y.Text(16)
+	address, err := EncodePublicKey(w.Scheme, w.PublicKey)
+	if err != nil {
+		return ""
+	}
+	return address
+}
+
+// now 交易的时间戳
+func (w *Wallet) now() int64 {
+	if w.Clock == nil {
+		return SystemClock.Now()
+	}
+	return w.Clock.Now()
 }
 
 func (w *Wallet) SignTransaction(tx *Transaction) error {
@@ -45,20 +105,18 @@ func (w *Wallet) SignTransaction(tx *Transaction) error {
 		// 确保交易不会被修改
 		hashed := tx.Hash() + input.Hash()
 
-		// 使用私钥签名
-		r, s, err := ecdsa.Sign(rand.Reader, w.PrivateKey, []byte(hashed))
+		// 使用私钥签名, 并将签名转换为字符串
+		signature, err := w.Scheme.Sign(w.PrivateKey, []byte(hashed))
 		if err != nil {
 			return err
 		}
-
-		// 将签名转换为字符串
-		input.Signature = r.Text(16) + ":" + s.Text(16)
+		input.Signature = signature
 	}
 	return nil
 }
 
 func (w *Wallet) NewTransaction(uouto map[string]TxOutput, to string, amount int64, data string) (*Transaction, error) {
-	if w.PrivateKey == nil || w.PublicKey == nil {
+	if w.Scheme == nil || w.PrivateKey == nil || w.PublicKey == nil {
 		return nil, errors.New("wallet is not initialized")
 	}
 
@@ -102,7 +160,7 @@ func (w *Wallet) NewTransaction(uouto map[string]TxOutput, to string, amount int
 	transaction := &Transaction{
 		Inputs:    inputs,
 		Outputs:   outputs,
-		Timestamp: utils.GetUTCTimestamp(),
+		Timestamp: w.now(),
 	}
 
 	// 签名交易
@@ -115,14 +173,24 @@ func (w *Wallet) NewTransaction(uouto map[string]TxOutput, to string, amount int
 	return transaction, nil
 }
 
-// 生成一个新的钱包
+// 生成一个新的钱包, 使用 ECDSA P-256 签名算法
 func NewWallet() (*Wallet, error) {
-	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	return NewWalletWithScheme(SchemeECDSAP256)
+}
+
+// NewWalletWithScheme 使用指定的签名算法生成一个新的钱包
+func NewWalletWithScheme(name string) (*Wallet, error) {
+	scheme, err := GetSignatureScheme(name)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, publicKey, err := scheme.GenerateKey()
 	if err != nil {
 		return nil, err
 	}
 	return &Wallet{
+		Scheme:     scheme,
 		PrivateKey: privateKey,
-		PublicKey:  &privateKey.PublicKey,
+		PublicKey:  publicKey,
 	}, nil
 }
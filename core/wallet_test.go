@@ -2,6 +2,7 @@ package core_test
 
 import (
 	"a10000/core"
+	"encoding/json"
 	"testing"
 )
 
@@ -19,6 +20,40 @@ func TestCreateWallet(t *testing.T) {
 
 }
 
+func TestWalletJSON(t *testing.T) {
+	for _, name := range []string{core.SchemeECDSAP256, core.SchemeEd25519, core.SchemeSchnorrP256} {
+		wallet, err := core.NewWalletWithScheme(name)
+		if err != nil {
+			t.Fatalf("Failed to generate %s wallet: %v", name, err)
+		}
+		data, err := json.Marshal(wallet)
+		if err != nil {
+			t.Fatalf("Failed to encode %s wallet: %v", name, err)
+		}
+		var restored core.Wallet
+		if err := json.Unmarshal(data, &restored); err != nil {
+			t.Fatalf("Failed to decode %s wallet: %v", name, err)
+		}
+		if restored.Scheme.Name() != name || restored.Address() != wallet.Address() {
+			t.Fatalf("Restored %s wallet is incorrect: %s", name, restored.Address())
+		}
+
+		// 恢复的钱包可以签名原钱包的交易
+		ch := core.CreateBlockchain(core.RegtestParams)
+		ch.CoinbaseMaturity = 1
+		if err := ch.GenesisBlock(core.NewCoinbaseTX(0, wallet.Address(), 50)); err != nil {
+			t.Fatalf("Failed to create genesis block: %v", err)
+		}
+		tx, err := restored.NewTransaction(ch.FindUTXO(wallet.Address()), wallet.Address(), 10, "")
+		if err != nil {
+			t.Fatalf("Failed to create transaction: %v", err)
+		}
+		if err := ch.AddTransaction(tx); err != nil {
+			t.Fatalf("Transaction signed by restored %s wallet is invalid: %v", name, err)
+		}
+	}
+}
+
 func TestSignTransaction(t *testing.T) {
 	tom, err := core.NewWallet()
 	if err != nil {
@@ -33,37 +68,34 @@ func TestSignTransaction(t *testing.T) {
 		t.Fatalf("Failed to generate anna: %v", err)
 	}
 
-	// 该测试存在一个特殊 case:
-	// 即在快速创建交易和打包区块时, 由于打包难度(block.Difficulty)比较低,
-	// 所以会快速打包, 并开始下一次交易并打包,
-	// 于是会导致 genesisTx 和 tomCoinbaseTx 的参数值(ID) 完全一致(inputs 一致, outputs 一致, 时间间隔极短, 所以时间戳也一致),
-	// 这样会导致 ch.Outputs 的 key 已存在, 进而覆盖 genesisTx 而非新增键值对(tomCoinbaseTx.ID, tomCoinbaseTx).
-	// 解决方案是增加挖矿难度或增加交易时间间隔, 以避免该问题.
-	ch := core.CreateBlockchain()
-	genesisTx := core.NewCoinbaseTX(tom.Address(), 50)
+	// 使用固定的时钟生成区块, 不同区块的 coinbase 交易只有承诺的区块高度不同,
+	// 高度保证了它们的交易 ID 不会重复, 从而不会覆盖 ch.Outputs 中已有的输出.
+	ch := core.CreateBlockchain(core.RegtestParams)
+	ch.Clock = core.NewFakeClock(1735689600000)
+	// 测试中需要在下一个区块立即花费创世区块的 coinbase 输出
+	ch.CoinbaseMaturity = 1
+	genesisTx := core.NewCoinbaseTX(0, tom.Address(), 50)
 	err = ch.GenesisBlock(genesisTx)
 	if err != nil {
 		t.Fatalf("Failed to create genesis block: %v", err)
 	}
 
+	tom.Clock = ch.Clock
 	utxo := ch.FindUTXO(tom.Address())
 	transactionTom2Alice, err := tom.NewTransaction(utxo, alice.Address(), 20, "test data")
 	if err != nil {
 		t.Fatalf("Failed to create transaction: %v", err)
 	}
+	if transactionTom2Alice.Timestamp != ch.Clock.Now() {
+		t.Fatalf("Transaction timestamp should come from the wallet clock, got %d", transactionTom2Alice.Timestamp)
+	}
 
 	err = ch.AddTransaction(transactionTom2Alice)
 	if err != nil {
 		t.Fatalf("Failed to add transaction(tom to alice): %v", err)
 	}
 
-	index := len(ch.Blocks)
-	previousHash := ch.Blocks[len(ch.Blocks)-1].Hash
-	tomCoinbaseTx := core.NewCoinbaseTX(tom.Address(), 50)
-	transactions := append([]*core.Transaction{tomCoinbaseTx}, ch.PendingTransactions...)
-	b := core.CreateBlock(int64(index), transactions, previousHash)
-	err = ch.AddBlock(b)
-	if err != nil {
+	if _, err = ch.Generate(1, tom.Address()); err != nil {
 		t.Fatalf("Failed to add block: %v", err)
 	}
 
@@ -79,13 +111,7 @@ func TestSignTransaction(t *testing.T) {
 		t.Logf("Cann't add transaction(tom to anna): %v", err)
 	}
 
-	index = len(ch.Blocks)
-	previousHash = ch.Blocks[len(ch.Blocks)-1].Hash
-	tomCoinbaseTx = core.NewCoinbaseTX(tom.Address(), 50)
-	transactions = append([]*core.Transaction{tomCoinbaseTx}, ch.PendingTransactions...)
-	b = core.CreateBlock(int64(index), transactions, previousHash)
-	err = ch.AddBlock(b)
-	if err != nil {
+	if _, err = ch.Generate(1, tom.Address()); err != nil {
 		t.Fatalf("Failed to add block: %v", err)
 	}
 
@@ -120,7 +146,7 @@ func TestSignTransactionNoInputs(t *testing.T) {
 		t.Fatalf("Failed to generate key pair: %v", err)
 	}
 
-	ch := core.CreateBlockchain()
+	ch := core.CreateBlockchain(core.RegtestParams)
 	uxto := ch.FindUTXO(wallet.Address())
 
 	transaction, err := wallet.NewTransaction(uxto, "recipient_public_key", 100, "test data")
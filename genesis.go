@@ -0,0 +1,80 @@
+package main
+
+import (
+	"a10000/core"
+	"a10000/store"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// genesisCommand 为私有网络生成参数文件, 参数以 -base 网络为模板, 创世区块使用当前时间并重新计算工作量证明.
+// 生成的文件通过 -network 传给网络中的所有节点和命令
+//
+//	genesis -name NAME [-base NET] [-prefix P] [-port N] [-difficulty N] [-wallet FILE -reward N] [-seeds ADDRS] [-out FILE]
+func genesisCommand(args []string) {
+	fs := flag.NewFlagSet("genesis", flag.ExitOnError)
+	name := fs.String("name", "", "私有网络的名称")
+	base := fs.String("base", core.RegtestParams.Name, "作为模板的内置网络")
+	prefix := fs.String("prefix", "", "地址前缀, 默认为网络名称")
+	port := fs.Int("port", 0, "节点默认的监听端口, 为 0 时使用模板网络的端口")
+	difficulty := fs.Int64("difficulty", 0, "初始难度, 为 0 时使用模板网络的难度")
+	wallet := fs.String("wallet", "", "获得创世奖励的钱包文件")
+	reward := fs.Int64("reward", 0, "创世奖励的金额")
+	seeds := fs.String("seeds", "", "种子节点地址, 多个地址使用逗号分隔")
+	out := fs.String("out", "", "参数文件的路径, 默认为 NAME.json")
+	fs.Parse(args)
+	if *name == "" {
+		log.Fatal("-name is required")
+	}
+
+	template, err := core.ParamsForNetwork(*base)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// 深拷贝模板, 不修改内置网络的参数. 模板网络的种子节点和可信快照不属于新的网络
+	params := template.Copy()
+	params.AssumeUTXO = nil
+	params.Name = *name
+	params.AddressPrefix = *name
+	if *prefix != "" {
+		params.AddressPrefix = *prefix
+	}
+	if *port != 0 {
+		params.DefaultPort = *port
+	}
+	params.Seeds = splitAddrs(*seeds)
+	if *difficulty != 0 {
+		params.InitialDifficulty = *difficulty
+		if params.MinDifficulty > *difficulty {
+			params.MinDifficulty = *difficulty
+		}
+	}
+	params.GenesisTimestamp = time.Now().UnixMilli()
+	params.GenesisAddress, params.GenesisReward = "", 0
+	if *reward > 0 {
+		if *wallet == "" {
+			log.Fatal("-wallet is required for a genesis reward")
+		}
+		var w core.Wallet
+		if err := store.ReadJSON(*wallet, &w); err != nil {
+			log.Fatalf("failed to load wallet: %v", err)
+		}
+		params.GenesisAddress, params.GenesisReward = w.Address(), *reward
+	}
+
+	genesis := params.MineGenesis()
+	if *out == "" {
+		*out = *name + ".json"
+	}
+	if _, err := os.Stat(*out); err == nil {
+		log.Fatalf("%s already exists", *out)
+	}
+	if err := store.WriteJSON(*out, params); err != nil {
+		log.Fatalf("failed to write params: %v", err)
+	}
+	fmt.Printf("genesis %s nonce %d\n", genesis.Hash, genesis.Nonce)
+	fmt.Printf("start nodes with -network %s\n", *out)
+}
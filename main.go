@@ -1,5 +1,349 @@
 package main
 
+import (
+	"a10000/core"
+	"a10000/p2p"
+	"a10000/rpc"
+	"a10000/store"
+	"crypto/ed25519"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
 func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command, args := os.Args[1], os.Args[2:]
+		switch command {
+		case "ban", "unban", "banlist":
+			banCommand(command, args)
+		case "node":
+			if len(args) == 0 || args[0] != "start" {
+				usage()
+			}
+			startNode(args[1:])
+		case "wallet", "send", "mine", "generate", "chain", "block", "export", "import", "snapshot":
+			cliCommand(command, args)
+		case "genesis":
+			genesisCommand(args)
+		case "verify":
+			verifyCommand(args)
+		default:
+			usage()
+		}
+		return
+	}
+	// 不带子命令时与 node start 相同
+	startNode(os.Args[1:])
+}
+
+// usage 打印子命令的用法并退出
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: %[1]s <command> [flags] [args]
+
+commands:
+  node start              启动节点
+  wallet new              创建钱包
+  wallet address          显示钱包地址
+  wallet balance [ADDR]   查询钱包或地址的余额
+  send -to ADDR -amount N 向地址转账
+  mine [-count N]         挖出区块
+  generate N [ADDR]       在 regtest 上立即挖出 N 个区块
+  chain show [-n N]       显示区块链的高度和最近的区块
+  block get HASH|HEIGHT   查询区块
+  export [-from N] FILE   将区块导出到引导文件
+  import FILE             从引导文件导入区块, 中断后可以继续
+  snapshot dump FILE      将 UTXO 快照写入文件
+  snapshot load FILE      从 UTXO 快照启动空的数据目录
+  ban|unban|banlist       管理封禁列表
+  genesis -name NAME      为私有网络生成参数文件和创世区块
+  verify [-reindex]       检查数据目录中的区块和派生数据是否一致
+
+除 node start 外, 命令默认操作 -datadir 中的数据(节点需要停止), 设置 -rpc 时通过节点的 JSON-RPC 操作.
+使用 -network 选择 mainnet, testnet, regtest 或私有网络的参数文件, 命令行中的地址带有网络前缀.
+使用 %[1]s <command> -h 查看命令的参数.
+`, os.Args[0])
+	os.Exit(2)
+}
+
+// startNode 启动节点, 直到收到退出信号
+func startNode(args []string) {
+	fs := flag.NewFlagSet("node start", flag.ExitOnError)
+	network := fs.String("network", core.MainNetParams.Name, "网络: mainnet, testnet, regtest 或私有网络的参数文件")
+	port := fs.Int("port", 0, "监听端口, 为 0 时使用网络的默认端口")
+	name := fs.String("name", "", "节点名称")
+	public := fs.Bool("public", false, "是否为公开节点")
+	relay := fs.Bool("relay", false, "是否为其他节点提供中继服务")
+	relayBandwidth := fs.Int("relay-bandwidth", p2p.DefaultRelayBandwidth, "中继服务为每个私有节点转发的带宽, 单位字节/秒")
+	peers := fs.String("peers", "", "启动时连接的节点地址, 多个地址使用逗号分隔")
+	seeds := fs.String("seeds", "", "种子节点地址, 地址簿为空时使用, 多个地址使用逗号分隔, 为空时使用网络参数中的种子节点")
+	external := fs.String("external", "", "对外公开的地址, 为空时根据其他节点看到的地址推断")
+	dataDir := fs.String("datadir", "", "数据目录, 为空时不保存区块")
+	pins := fs.String("pin", "", "固定的节点身份, 格式为 名称=节点ID, 多个使用逗号分隔")
+	rpcAddr := fs.String("rpcaddr", "", "JSON-RPC 服务的监听地址, 为空时不启动")
+	rpcUser := fs.String("rpcuser", "", "JSON-RPC 认证的用户名")
+	rpcPassword := fs.String("rpcpassword", "", "JSON-RPC 认证的密码, 为空时在数据目录中生成 cookie 文件")
+	banDuration := fs.Duration("ban-duration", p2p.DefaultBanDuration, "惩罚分数过高的节点的封禁时长")
+	reindex := fs.Bool("reindex", false, "启动前根据区块重新生成撤销记录和区块头链")
+	prune := fs.Int64("prune", 0, fmt.Sprintf("只保留最近的区块数量(至少 %d), 为 0 时保留全部区块", store.MinPruneWindow))
+	fs.Parse(args)
+
+	if *name == "" {
+		hostname, _ := os.Hostname()
+		*name = hostname
+	}
+
+	params, err := loadParams(*network)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *port == 0 {
+		*port = params.DefaultPort
+	}
+	if *prune != 0 && (*dataDir == "" || *prune < store.MinPruneWindow) {
+		log.Fatalf("-prune requires -datadir and at least %d blocks", store.MinPruneWindow)
+	}
+	blockStore, ch, err := openChain(*dataDir, params)
+	if err != nil {
+		log.Fatalf("failed to open data directory: %v", err)
+	}
+	if blockStore != nil {
+		log.Printf("loaded %s chain at height %d from %s", params.Name, ch.Height(), *dataDir)
+		if *reindex {
+			if err := blockStore.Reindex(ch); err != nil {
+				log.Fatalf("failed to reindex: %v", err)
+			}
+			log.Printf("reindexed %d blocks", ch.Height()+1)
+		}
+		if *prune > 0 {
+			count, err := blockStore.Prune(ch, *prune)
+			if err != nil {
+				log.Fatalf("failed to prune blocks: %v", err)
+			}
+			log.Printf("pruned %d blocks, keeping blocks after %d", count, ch.Pruned())
+		}
+	}
+	var nodeKey ed25519.PrivateKey
+	if *dataDir != "" {
+		var err error
+		if nodeKey, err = p2p.LoadOrCreateNodeKey(p2p.NodeKeyPath(*dataDir)); err != nil {
+			log.Fatalf("failed to load node key: %v", err)
+		}
+	}
+	pinnedIDs := make(map[string]string)
+	for _, pin := range splitAddrs(*pins) {
+		name, id, ok := strings.Cut(pin, "=")
+		if !ok {
+			log.Fatalf("invalid pin %q, expected name=id", pin)
+		}
+		pinnedIDs[name] = id
+	}
+
+	seedAddrs := splitAddrs(*seeds)
+	if len(seedAddrs) == 0 {
+		seedAddrs = params.Seeds
+	}
+	cfg := p2p.Config{
+		Name:           *name,
+		ListenAddr:     fmt.Sprintf(":%d", *port),
+		Public:         *public,
+		Relay:          *relay,
+		RelayBandwidth: *relayBandwidth,
+		BanDuration:    *banDuration,
+		NodeKey:        nodeKey,
+		PinnedIDs:      pinnedIDs,
+		Store:          blockStore,
+		Peers:          splitAddrs(*peers),
+		Seeds:          seedAddrs,
+		ExternalAddr:   *external,
+		PruneWindow:    *prune,
+	}
+
+	node := p2p.NewNode(cfg, ch)
+	var server *rpc.Server
+	if *rpcAddr != "" {
+		server = rpc.NewServer(rpc.Config{ListenAddr: *rpcAddr, User: *rpcUser, Password: *rpcPassword, DataDir: *dataDir}, node)
+	}
+	if err := node.Start(); err != nil {
+		log.Fatalf("failed to start node: %v", err)
+	}
+	if server != nil {
+		if err := server.Start(); err != nil {
+			log.Fatalf("failed to start rpc server: %v", err)
+		}
+	}
+
+	// 等待退出信号, 节点遇到无法恢复的错误时也退出
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case <-sig:
+	case <-node.Failed():
+	}
+
+	if server != nil {
+		server.Stop()
+	}
+	node.Stop()
+	if err := node.Err(); err != nil {
+		log.Fatalf("node stopped: %v", err)
+	}
+}
+
+// loadParams 根据名称获取内置网络的参数, 不是内置网络时从 JSON 文件读取私有网络的参数
+func loadParams(network string) (*core.ChainParams, error) {
+	if params, err := core.ParamsForNetwork(network); err == nil {
+		return params, nil
+	}
+	var params core.ChainParams
+	if err := store.ReadJSON(network, &params); err != nil {
+		return nil, fmt.Errorf("unknown network %s: %v", network, err)
+	}
+	return &params, nil
+}
+
+// openChain 使用网络参数 params 创建区块链, dir 不为空时锁定数据目录并加载保存的区块
+// 创世区块必须与参数中记录的 Hash 一致, 数据目录中的创世区块必须属于该网络
+func openChain(dir string, params *core.ChainParams) (*store.BlockStore, *core.Blockchain, error) {
+	if err := params.CheckGenesis(); err != nil {
+		return nil, nil, err
+	}
+	ch := core.CreateBlockchain(params)
+	if dir == "" {
+		if err := ch.ConnectGenesis(params.GenesisBlock()); err != nil {
+			return nil, nil, err
+		}
+		return nil, ch, nil
+	}
+
+	blockStore, err := store.Open(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := blockStore.Lock(); err != nil {
+		return nil, nil, err
+	}
+	if err := blockStore.CheckSnapshot(); err != nil {
+		return nil, nil, err
+	}
+	if _, err := blockStore.Load(ch); err != nil {
+		return nil, nil, err
+	}
+	if ch.Tip() == nil {
+		if err := ch.ConnectGenesis(params.GenesisBlock()); err != nil {
+			return nil, nil, err
+		}
+		if err := blockStore.SaveBlock(ch, ch.BlockByHeight(0)); err != nil {
+			return nil, nil, err
+		}
+	} else if ch.BlockByHeight(0).Hash != params.GenesisBlock().Hash {
+		return nil, nil, fmt.Errorf("%s does not belong to network %s", dir, params.Name)
+	}
+	return blockStore, ch, nil
+}
+
+// splitAddrs 解析逗号分隔的地址列表
+func splitAddrs(s string) []string {
+	addrs := make([]string, 0)
+	for _, addr := range strings.Split(s, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// banCommand 管理封禁列表. 设置 -rpc 时修改运行中节点的封禁列表, 并立即断开被封禁的连接;
+// 否则修改 -datadir 中的封禁列表, 节点运行时数据目录被锁定, 命令会失败
+//
+//	ban [-duration D] [-reason R] ADDR
+//	unban ADDR
+//	banlist
+func banCommand(command string, args []string) {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	opts := addCLIFlags(fs)
+	duration := fs.Duration("duration", p2p.DefaultBanDuration, "封禁时长")
+	reason := fs.String("reason", "manual", "封禁原因")
+	fs.Parse(args)
+	if (command == "banlist") != (fs.NArg() == 0) || fs.NArg() > 1 {
+		log.Fatalf("usage: %s ban [-duration D] [-reason R] ADDR | unban ADDR | banlist", os.Args[0])
+	}
+
+	var err error
+	if *opts.rpcURL != "" {
+		err = banRemote(opts, command, fs.Arg(0), *duration, *reason)
+	} else {
+		err = banLocal(opts, command, fs.Arg(0), *duration, *reason)
+	}
+	if err != nil {
+		log.Fatalf("%s: %v", command, err)
+	}
+}
+
+// banRemote 通过 JSON-RPC 修改节点的封禁列表
+func banRemote(opts *cliOptions, command, addr string, duration time.Duration, reason string) error {
+	client, err := opts.client()
+	if err != nil {
+		return err
+	}
+	switch command {
+	case "banlist":
+		entries, err := client.ListBanned()
+		if err != nil {
+			return err
+		}
+		printBans(entries)
+		return nil
+	case "ban":
+		return client.Ban(addr, duration, reason)
+	default:
+		return client.Unban(addr)
+	}
+}
+
+// banLocal 修改数据目录中的封禁列表, 需要锁定数据目录, 避免节点退出时覆盖修改
+func banLocal(opts *cliOptions, command, addr string, duration time.Duration, reason string) error {
+	if *opts.dataDir == "" {
+		return errors.New("-datadir or -rpc is required")
+	}
+	blockStore, err := store.Open(*opts.dataDir)
+	if err != nil {
+		return err
+	}
+	if err := blockStore.Lock(); err != nil {
+		if errors.Is(err, store.ErrLocked) {
+			return fmt.Errorf("%v, use -rpc to change the ban list of the running node", err)
+		}
+		return err
+	}
+
+	bans := p2p.NewBanList(p2p.BanListPath(*opts.dataDir))
+	if err := bans.Load(); err != nil {
+		return fmt.Errorf("failed to load ban list: %v", err)
+	}
+	switch command {
+	case "banlist":
+		printBans(bans.Entries())
+		return nil
+	case "ban":
+		bans.Ban(p2p.BanKey(addr), duration, reason)
+	default:
+		if !bans.Unban(p2p.BanKey(addr)) {
+			return fmt.Errorf("%s is not banned", addr)
+		}
+	}
+	return bans.Save()
+}
 
+// printBans 打印封禁列表
+func printBans(entries []p2p.BanEntry) {
+	for _, entry := range entries {
+		fmt.Printf("%s\tuntil %s\t%s\n", entry.Addr, time.UnixMilli(entry.Until).Format(time.RFC3339), entry.Reason)
+	}
 }
@@ -0,0 +1,278 @@
+package p2p
+
+import (
+	"a10000/store"
+	"a10000/utils"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// 地址簿的容量
+//
+// 地址分为两个表: new 表保存从其他节点得知但尚未成功连接过的地址,
+// tried 表保存成功连接过的地址. 地址根据 Hash 分散到各个桶中,
+// 桶满时淘汰最久未见的地址, 避免单个来源的大量地址占满地址簿.
+const (
+	NewBucketCount   = 64
+	TriedBucketCount = 16
+	BucketSize       = 64
+)
+
+// AddrHorizon 超过该时间未见的地址不再分享给其他节点
+const AddrHorizon = 7 * 24 * time.Hour
+
+// KnownAddress 地址簿中的地址
+type KnownAddress struct {
+	Addr      string `json:"addr"`       // 节点地址, 格式为 host:port
+	Source    string `json:"source"`     // 得知该地址的来源
+	LastSeen  int64  `json:"last_seen"`  // 最后一次得知该地址在线的时间戳, 单位毫秒
+	LastTried int64  `json:"last_tried"` // 最后一次尝试连接的时间戳, 单位毫秒
+	Attempts  int    `json:"attempts"`   // 连续连接失败的次数
+	Tried     bool   `json:"tried"`      // 是否成功连接过, 即是否在 tried 表中
+}
+
+// AddrBook 地址簿
+type AddrBook struct {
+	mu    sync.Mutex
+	path  string                   // 保存地址簿的文件, 为空时不保存
+	addrs map[string]*KnownAddress // key: 地址
+	new   [NewBucketCount]map[string]*KnownAddress
+	tried [TriedBucketCount]map[string]*KnownAddress
+}
+
+// NewAddrBook 创建地址簿, path 为保存地址簿的文件
+func NewAddrBook(path string) *AddrBook {
+	book := &AddrBook{
+		path:  path,
+		addrs: make(map[string]*KnownAddress),
+	}
+	for i := range book.new {
+		book.new[i] = make(map[string]*KnownAddress)
+	}
+	for i := range book.tried {
+		book.tried[i] = make(map[string]*KnownAddress)
+	}
+	return book
+}
+
+// bucket 计算地址所在的桶
+func bucket(addr string, salt string, count int) int {
+	sum, _ := hex.DecodeString(utils.Hash([]byte(salt + "/" + addr)))
+	return int(binary.BigEndian.Uint32(sum) % uint32(count))
+}
+
+func (book *AddrBook) newBucket(ka *KnownAddress) map[string]*KnownAddress {
+	// new 表的桶由来源和地址共同决定, 同一来源的地址只能占据有限的桶
+	return book.new[bucket(ka.Addr, ka.Source, NewBucketCount)]
+}
+
+func (book *AddrBook) triedBucket(ka *KnownAddress) map[string]*KnownAddress {
+	return book.tried[bucket(ka.Addr, "tried", TriedBucketCount)]
+}
+
+// evictOldest 淘汰桶中最久未见的地址
+func (book *AddrBook) evictOldest(b map[string]*KnownAddress) {
+	var oldest *KnownAddress
+	for _, ka := range b {
+		if oldest == nil || ka.LastSeen < oldest.LastSeen {
+			oldest = ka
+		}
+	}
+	if oldest != nil {
+		delete(b, oldest.Addr)
+		delete(book.addrs, oldest.Addr)
+	}
+}
+
+func (book *AddrBook) insert(ka *KnownAddress) {
+	b := book.newBucket(ka)
+	if ka.Tried {
+		b = book.triedBucket(ka)
+	}
+	if len(b) >= BucketSize {
+		book.evictOldest(b)
+	}
+	b[ka.Addr] = ka
+	book.addrs[ka.Addr] = ka
+}
+
+// AddAddress 添加从 source 得知的地址, 已存在时更新最后在线时间
+func (book *AddrBook) AddAddress(addr string, source string, lastSeen int64) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	if ka, ok := book.addrs[addr]; ok {
+		if lastSeen > ka.LastSeen {
+			ka.LastSeen = lastSeen
+		}
+		return
+	}
+	book.insert(&KnownAddress{Addr: addr, Source: source, LastSeen: lastSeen})
+}
+
+// MarkAttempt 记录一次连接尝试
+func (book *AddrBook) MarkAttempt(addr string) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	if ka, ok := book.addrs[addr]; ok {
+		ka.LastTried = time.Now().UnixMilli()
+		ka.Attempts++
+	}
+}
+
+// MarkGood 记录一次成功的连接, 地址被移入 tried 表
+func (book *AddrBook) MarkGood(addr string) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	ka, ok := book.addrs[addr]
+	if !ok {
+		ka = &KnownAddress{Addr: addr, Source: addr}
+		book.addrs[addr] = ka
+	}
+	now := time.Now().UnixMilli()
+	ka.LastSeen = now
+	ka.LastTried = now
+	ka.Attempts = 0
+	if ka.Tried {
+		return
+	}
+	delete(book.newBucket(ka), addr)
+	ka.Tried = true
+	book.insert(ka)
+}
+
+// Remove 从地址簿中删除地址
+func (book *AddrBook) Remove(addr string) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	ka, ok := book.addrs[addr]
+	if !ok {
+		return
+	}
+	if ka.Tried {
+		delete(book.triedBucket(ka), addr)
+	} else {
+		delete(book.newBucket(ka), addr)
+	}
+	delete(book.addrs, addr)
+}
+
+// Size 地址簿中的地址数量
+func (book *AddrBook) Size() int {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	return len(book.addrs)
+}
+
+// Get 查询地址
+func (book *AddrBook) Get(addr string) (KnownAddress, bool) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	ka, ok := book.addrs[addr]
+	if !ok {
+		return KnownAddress{}, false
+	}
+	return *ka, true
+}
+
+// Addresses 随机返回最多 max 个近期在线的地址, 用于分享给其他节点
+func (book *AddrBook) Addresses(max int) []KnownAddress {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	horizon := time.Now().Add(-AddrHorizon).UnixMilli()
+	result := make([]KnownAddress, 0)
+	for _, ka := range book.addrs {
+		if ka.LastSeen >= horizon {
+			result = append(result, *ka)
+		}
+	}
+	rand.Shuffle(len(result), func(i, j int) { result[i], result[j] = result[j], result[i] })
+	if len(result) > max {
+		result = result[:max]
+	}
+	return result
+}
+
+// Pick 随机选择一个可以连接的地址, exclude 中的地址会被跳过
+// tried 表和 new 表各有一半的概率被选中, 连续失败次数越多的地址被选中的概率越低
+func (book *AddrBook) Pick(exclude func(addr string) bool) (string, bool) {
+	book.mu.Lock()
+	defer book.mu.Unlock()
+
+	tried := make([]*KnownAddress, 0)
+	fresh := make([]*KnownAddress, 0)
+	for _, ka := range book.addrs {
+		if exclude != nil && exclude(ka.Addr) {
+			continue
+		}
+		// 失败后按指数退避, 最长间隔约 1 小时
+		if ka.Attempts > 0 {
+			backoff := time.Second << uint(minInt(ka.Attempts, 12))
+			if time.Since(time.UnixMilli(ka.LastTried)) < backoff {
+				continue
+			}
+		}
+		if ka.Tried {
+			tried = append(tried, ka)
+		} else {
+			fresh = append(fresh, ka)
+		}
+	}
+
+	candidates := fresh
+	if len(fresh) == 0 || (len(tried) > 0 && rand.Intn(2) == 0) {
+		candidates = tried
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+	return candidates[rand.Intn(len(candidates))].Addr, true
+}
+
+// Save 保存地址簿
+func (book *AddrBook) Save() error {
+	if book.path == "" {
+		return nil
+	}
+	book.mu.Lock()
+	addrs := make([]*KnownAddress, 0, len(book.addrs))
+	for _, ka := range book.addrs {
+		copied := *ka
+		addrs = append(addrs, &copied)
+	}
+	book.mu.Unlock()
+	return store.WriteJSON(book.path, addrs)
+}
+
+// Load 读取保存的地址簿, 文件不存在时忽略
+func (book *AddrBook) Load() error {
+	if book.path == "" {
+		return nil
+	}
+	addrs := make([]*KnownAddress, 0)
+	if err := store.ReadJSON(book.path, &addrs); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	book.mu.Lock()
+	defer book.mu.Unlock()
+	for _, ka := range addrs {
+		if _, ok := book.addrs[ka.Addr]; !ok {
+			book.insert(ka)
+		}
+	}
+	return nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,235 @@
+package p2p
+
+import (
+	"a10000/core"
+	"a10000/store"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 节点惩罚:
+//
+// 处理消息时返回的错误按严重程度累计为对方的惩罚分数. 区块和交易的验证错误按 core.Severity 计分,
+// 协议错误通过 misbehavior 指定分数. 分数达到 BanThreshold 时断开连接, 并在一段时间内拒绝该地址的连接.
+//
+// 封禁以 IP 为单位. 通过中继地址连接的节点以中继地址为单位, 避免因为私有节点的过错封禁中继节点.
+// 封禁列表保存在数据目录中, 也可以手动封禁和解封.
+
+const (
+	BanThreshold        = 100            // 惩罚分数达到该值时封禁
+	DefaultBanDuration  = 24 * time.Hour // 默认的封禁时长
+	MinorMisbehavior    = 10             // core.SeverityMinor 的验证错误的分数
+	ProtocolMisbehavior = 20             // 不符合协议的消息的分数, 如消息过多, 区块头不连续
+)
+
+// misbehaviorError 计入惩罚分数的协议错误
+type misbehaviorError struct {
+	score int
+	err   error
+}
+
+func (e *misbehaviorError) Error() string {
+	return e.err.Error()
+}
+
+func (e *misbehaviorError) Unwrap() error {
+	return e.err
+}
+
+// misbehavior 将 err 标记为分数为 score 的协议错误
+func misbehavior(score int, err error) error {
+	return &misbehaviorError{score: score, err: err}
+}
+
+// scoreOf 返回错误的惩罚分数
+func scoreOf(err error) int {
+	var e *misbehaviorError
+	if errors.As(err, &e) {
+		return e.score
+	}
+	switch core.SeverityOf(err) {
+	case core.SeverityFatal:
+		return BanThreshold
+	case core.SeverityMinor:
+		return MinorMisbehavior
+	default:
+		return 0
+	}
+}
+
+// BanEntry 被封禁的地址
+type BanEntry struct {
+	Addr   string `json:"addr"`   // IP 或中继地址
+	Until  int64  `json:"until"`  // 解封的时间戳, 单位毫秒
+	Reason string `json:"reason"` // 封禁的原因
+}
+
+// BanList 封禁列表
+type BanList struct {
+	mu   sync.Mutex
+	path string               // 保存封禁列表的文件, 为空时不保存
+	bans map[string]*BanEntry // key: 地址
+}
+
+// NewBanList 创建封禁列表, path 为保存封禁列表的文件
+func NewBanList(path string) *BanList {
+	return &BanList{path: path, bans: make(map[string]*BanEntry)}
+}
+
+// Ban 封禁地址 duration 时长, 已封禁时延长到两者中较晚的时间
+func (list *BanList) Ban(addr string, duration time.Duration, reason string) {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	until := time.Now().Add(duration).UnixMilli()
+	if entry, ok := list.bans[addr]; ok && entry.Until > until {
+		return
+	}
+	list.bans[addr] = &BanEntry{Addr: addr, Until: until, Reason: reason}
+}
+
+// Unban 解封地址, 地址未被封禁时返回 false
+func (list *BanList) Unban(addr string) bool {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	entry, ok := list.bans[addr]
+	delete(list.bans, addr)
+	return ok && entry.Until > time.Now().UnixMilli()
+}
+
+// IsBanned 判断地址是否被封禁, 过期的封禁会被移除
+func (list *BanList) IsBanned(addr string) bool {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	entry, ok := list.bans[addr]
+	if !ok {
+		return false
+	}
+	if entry.Until <= time.Now().UnixMilli() {
+		delete(list.bans, addr)
+		return false
+	}
+	return true
+}
+
+// Entries 所有未过期的封禁, 按地址排序
+func (list *BanList) Entries() []BanEntry {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	now := time.Now().UnixMilli()
+	entries := make([]BanEntry, 0, len(list.bans))
+	for _, entry := range list.bans {
+		if entry.Until > now {
+			entries = append(entries, *entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Addr < entries[j].Addr })
+	return entries
+}
+
+// Save 保存封禁列表, 过期的封禁不会被保存
+func (list *BanList) Save() error {
+	if list.path == "" {
+		return nil
+	}
+	return store.WriteJSON(list.path, list.Entries())
+}
+
+// Load 读取保存的封禁列表, 文件不存在时忽略
+func (list *BanList) Load() error {
+	if list.path == "" {
+		return nil
+	}
+	entries := make([]*BanEntry, 0)
+	if err := store.ReadJSON(list.path, &entries); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	for _, entry := range entries {
+		list.bans[entry.Addr] = entry
+	}
+	return nil
+}
+
+// BanListPath 数据目录 dir 中封禁列表的保存路径
+func BanListPath(dir string) string {
+	return filepath.Join(dir, "banned.json")
+}
+
+// banListPath 节点封禁列表的保存路径
+func (n *Node) banListPath() string {
+	if n.cfg.Store == nil {
+		return ""
+	}
+	return BanListPath(n.cfg.Store.Dir())
+}
+
+// BanKey 地址对应的封禁单位: 中继地址本身, 或 host:port 中的 host
+func BanKey(addr string) string {
+	if _, _, ok := splitRelayAddr(addr); ok {
+		return addr
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// peerBanKey 节点对应的封禁单位
+func peerBanKey(p *Peer) string {
+	if _, _, ok := splitRelayAddr(p.dialAddr); ok {
+		return p.dialAddr
+	}
+	return BanKey(p.Addr())
+}
+
+// BanList 节点的封禁列表
+func (n *Node) BanList() *BanList {
+	return n.bans
+}
+
+// isBanned 判断地址是否被封禁
+func (n *Node) isBanned(addr string) bool {
+	return n.bans.IsBanned(BanKey(addr))
+}
+
+// Ban 封禁地址并断开与其的连接, addr 可以是 IP, host:port 或中继地址
+func (n *Node) Ban(addr string, duration time.Duration, reason string) error {
+	key := BanKey(addr)
+	n.bans.Ban(key, duration, reason)
+	n.logf("banned %s for %s: %s", key, duration, reason)
+	for _, p := range n.Peers() {
+		if peerBanKey(p) == key {
+			p.Close()
+		}
+	}
+	return n.bans.Save()
+}
+
+// Unban 解封地址
+func (n *Node) Unban(addr string) error {
+	if !n.bans.Unban(BanKey(addr)) {
+		return errors.New("address is not banned")
+	}
+	return n.bans.Save()
+}
+
+// misbehaving 增加节点的惩罚分数, 达到 BanThreshold 时封禁
+func (n *Node) misbehaving(p *Peer, score int, reason string) {
+	total := p.addMisbehavior(score)
+	n.logf("misbehavior of %s: +%d = %d (%s)", p.Name(), score, total, reason)
+	if total < BanThreshold {
+		return
+	}
+	if err := n.Ban(peerBanKey(p), n.cfg.BanDuration, reason); err != nil {
+		n.logf("save ban list: %v", err)
+	}
+}
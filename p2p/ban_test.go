@@ -0,0 +1,175 @@
+package p2p_test
+
+import (
+	"a10000/core"
+	"a10000/p2p"
+	"a10000/store"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// rawPeer 直接使用协议与节点通信的测试连接, 可以发送任意消息
+type rawPeer struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func (r *rawPeer) send(command string, payload interface{}) {
+	r.t.Helper()
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		r.t.Fatalf("Failed to encode payload: %v", err)
+	}
+	data, err := json.Marshal(&p2p.Message{Command: command, Payload: raw})
+	if err != nil {
+		r.t.Fatalf("Failed to encode message: %v", err)
+	}
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	if _, err := r.conn.Write(frame); err != nil {
+		r.t.Fatalf("Failed to send %s: %v", command, err)
+	}
+}
+
+func (r *rawPeer) read() (*p2p.Message, error) {
+	r.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var header [4]byte
+	if _, err := io.ReadFull(r.conn, header[:]); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := io.ReadFull(r.conn, data); err != nil {
+		return nil, err
+	}
+	var msg p2p.Message
+	return &msg, json.Unmarshal(data, &msg)
+}
+
+// waitClosed 等待节点断开连接
+func (r *rawPeer) waitClosed() {
+	r.t.Helper()
+	for {
+		if _, err := r.read(); err != nil {
+			return
+		}
+	}
+}
+
+// dialRaw 连接节点并完成加密握手和 version 握手
+func dialRaw(t *testing.T, node *p2p.Node) *rawPeer {
+	t.Helper()
+	conn, err := net.Dial("tcp", node.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	key, err := p2p.GenerateNodeKey()
+	if err != nil {
+		t.Fatalf("Failed to generate node key: %v", err)
+	}
+	secure, err := p2p.SecureHandshake(conn, key, true)
+	if err != nil {
+		t.Fatalf("Secure handshake failed: %v", err)
+	}
+	r := &rawPeer{t: t, conn: secure}
+	r.send(p2p.CmdVersion, &p2p.VersionPayload{
+		Version:   p2p.ProtocolVersion,
+		Network:   core.RegtestParams.Name,
+		Genesis:   node.BlockByHeight(0).Hash,
+		Name:      "Mallory",
+		Nonce:     42,
+		Timestamp: time.Now().UnixMilli(),
+	})
+	for _, expected := range []string{p2p.CmdVersion, p2p.CmdVerack} {
+		msg, err := r.read()
+		if err != nil || msg.Command != expected {
+			t.Fatalf("Handshake failed, expected %s: %v", expected, err)
+		}
+	}
+	r.send(p2p.CmdVerack, struct{}{})
+	return r
+}
+
+func TestBanMisbehavingPeer(t *testing.T) {
+	dir := t.TempDir()
+	blockStore, err := store.Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	genesis := newGenesis(t, newTestWallet(t))
+	v := startNode(t, p2p.Config{Name: "V", Store: blockStore}, newTestChain(t, genesis))
+
+	// 消息过多是较轻的过错, 只累计分数
+	mallory := dialRaw(t, v)
+	addrs := make([]p2p.NetAddress, p2p.MaxAddrPerMessage+1)
+	for i := range addrs {
+		addrs[i] = p2p.NetAddress{Addr: fmt.Sprintf("10.0.%d.%d:6666", i/256, i%256)}
+	}
+	mallory.send(p2p.CmdAddr, &p2p.AddrPayload{Addrs: addrs})
+	waitFor(t, "misbehavior to be recorded", func() bool {
+		peers := v.Peers()
+		return len(peers) == 1 && peers[0].Misbehavior() == p2p.ProtocolMisbehavior
+	})
+
+	// 工作量证明错误的区块, 诚实的节点不会发送
+	b := core.CreateBlock(1, []*core.Transaction{core.NewCoinbaseTX(1, "mallory", 50)}, genesis.Hash, core.RegtestParams.InitialDifficulty)
+	b.Nonce++
+	mallory.send(p2p.CmdBlock, b)
+	mallory.waitClosed()
+	if !v.BanList().IsBanned("127.0.0.1") {
+		t.Fatal("Misbehaving peer should be banned")
+	}
+
+	// 封禁期间的连接被直接断开
+	conn, err := net.Dial("tcp", v.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	(&rawPeer{t: t, conn: conn}).waitClosed()
+	conn.Close()
+
+	// 封禁列表被保存到数据目录
+	saved := p2p.NewBanList(p2p.BanListPath(dir))
+	if err := saved.Load(); err != nil {
+		t.Fatalf("Failed to load ban list: %v", err)
+	}
+	if entries := saved.Entries(); len(entries) != 1 || entries[0].Addr != "127.0.0.1" {
+		t.Fatalf("Saved ban list is incorrect: %+v", entries)
+	}
+
+	// 解封后可以重新连接
+	if err := v.Unban("127.0.0.1"); err != nil {
+		t.Fatalf("Failed to unban: %v", err)
+	}
+	if err := v.Unban("127.0.0.1"); err == nil {
+		t.Fatal("Unbanning an address that is not banned should fail")
+	}
+	dialRaw(t, v)
+	waitFor(t, "peer to reconnect", func() bool { return len(v.Peers()) == 1 })
+
+	// 手动封禁会断开已有的连接
+	if err := v.Ban("127.0.0.1:1", time.Hour, "manual"); err != nil {
+		t.Fatalf("Failed to ban: %v", err)
+	}
+	waitFor(t, "banned peer to disconnect", func() bool { return len(v.Peers()) == 0 })
+}
+
+func TestBanListExpiry(t *testing.T) {
+	list := p2p.NewBanList("")
+	list.Ban("10.0.0.1", time.Hour, "test")
+	list.Ban("10.0.0.2", -time.Second, "expired")
+	if !list.IsBanned("10.0.0.1") || list.IsBanned("10.0.0.2") {
+		t.Fatal("Ban list state is incorrect")
+	}
+	// 已有更长的封禁时不会缩短
+	list.Ban("10.0.0.1", time.Minute, "shorter")
+	if entries := list.Entries(); len(entries) != 1 || entries[0].Reason != "test" {
+		t.Fatalf("Ban should not be shortened: %+v", entries)
+	}
+}
@@ -0,0 +1,284 @@
+package p2p
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// 节点发现:
+//
+// 节点之间通过 getaddr/addr 交换地址簿中的地址, 地址簿只保存公开节点的地址.
+// 公开节点(-public)握手后会向对方通告自己的地址, 对方再将新鲜的通告转发给少量其他节点,
+// 私有节点因此可以发现公开节点并主动连接.
+// 节点会持续从地址簿中选择地址建立出站连接, 直到达到 MaxOutbound 个, 地址簿为空时使用种子地址.
+
+const (
+	DefaultMaxOutbound    = 8                // 默认的最大出站连接数
+	DefaultDialInterval   = 5 * time.Second  // 默认的建立出站连接的检查间隔
+	AdvertiseInterval     = 10 * time.Minute // 公开节点通告自己地址的间隔
+	AddrBookSaveInterval  = time.Minute      // 保存地址簿的间隔
+	MaxAddrPerMessage     = 1000             // 单条 addr 消息最多包含的地址数量
+	AddrRelayFreshness    = 10 * time.Minute // 只转发该时间内的地址通告
+	AddrRelayFanout       = 2                // 地址通告转发的节点数量
+	AddrRelayMaxAddresses = 10               // 超过该数量的 addr 消息视为 getaddr 的回复, 不再转发
+)
+
+// NetAddress addr 消息中的地址
+type NetAddress struct {
+	Addr     string `json:"addr"`      // 节点地址, 格式为 host:port
+	LastSeen int64  `json:"last_seen"` // 最后在线的时间戳, 单位毫秒
+}
+
+// AddrPayload addr 消息的内容
+type AddrPayload struct {
+	Addrs []NetAddress `json:"addrs"`
+}
+
+// addrBookPath 地址簿的保存路径
+func (n *Node) addrBookPath() string {
+	if n.cfg.Store == nil {
+		return ""
+	}
+	return filepath.Join(n.cfg.Store.Dir(), "peers.json")
+}
+
+// AddrBook 节点的地址簿
+func (n *Node) AddrBook() *AddrBook {
+	return n.book
+}
+
+// ExternalAddr 本节点对外公开的地址, 未知时返回空
+func (n *Node) ExternalAddr() string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.externalAddr
+}
+
+// learnExternalAddr 根据对方看到的地址推断本节点的公开地址
+func (n *Node) learnExternalAddr(yourAddr string) {
+	port := n.listenPort()
+	if port == 0 || yourAddr == "" {
+		return
+	}
+	host, _, err := net.SplitHostPort(yourAddr)
+	if err != nil {
+		return
+	}
+	n.mu.Lock()
+	if n.externalAddr == "" {
+		n.externalAddr = net.JoinHostPort(host, strconv.Itoa(port))
+		n.mu.Unlock()
+		n.logf("external address %s", n.externalAddr)
+		return
+	}
+	n.mu.Unlock()
+}
+
+// reachableAddr 其他节点可以连接本节点的地址: 公开节点的公开地址, 或私有节点的中继地址
+func (n *Node) reachableAddr() string {
+	if n.cfg.Public {
+		return n.ExternalAddr()
+	}
+	return n.RelayAddr()
+}
+
+// advertise 向节点通告本节点的地址, 仅公开节点和通过中继注册的私有节点会通告
+func (n *Node) advertise(p *Peer) {
+	addr := n.reachableAddr()
+	if addr == "" {
+		return
+	}
+	p.known.Add("addr:" + addr)
+	payload := &AddrPayload{Addrs: []NetAddress{{Addr: addr, LastSeen: time.Now().UnixMilli()}}}
+	if err := p.Send(CmdAddr, payload); err != nil {
+		n.logf("advertise to %s: %v", p.Name(), err)
+	}
+}
+
+// peerHandshaked 握手完成后交换地址
+func (n *Node) peerHandshaked(p *Peer) {
+	if n.cfg.Public && n.cfg.ExternalAddr == "" {
+		n.learnExternalAddr(p.Version().YourAddr)
+	}
+	// 对方是公开节点, 记录它的地址
+	if addr := p.ListenAddr(); addr != "" && p.Version().Public {
+		n.book.AddAddress(addr, p.Addr(), time.Now().UnixMilli())
+		if !p.Inbound() {
+			n.book.MarkGood(addr)
+		}
+	}
+	if !p.Inbound() {
+		if err := p.Send(CmdGetAddr, struct{}{}); err != nil {
+			n.logf("send getaddr to %s: %v", p.Name(), err)
+		}
+	}
+	n.advertise(p)
+	n.maybeRegisterRelay(p)
+}
+
+func (n *Node) handleGetAddr(p *Peer, msg *Message) error {
+	addrs := make([]NetAddress, 0)
+	if addr := n.reachableAddr(); addr != "" {
+		addrs = append(addrs, NetAddress{Addr: addr, LastSeen: time.Now().UnixMilli()})
+	}
+	for _, ka := range n.book.Addresses(MaxAddrPerMessage - len(addrs)) {
+		addrs = append(addrs, NetAddress{Addr: ka.Addr, LastSeen: ka.LastSeen})
+	}
+	return p.Send(CmdAddr, &AddrPayload{Addrs: addrs})
+}
+
+func (n *Node) handleAddr(p *Peer, msg *Message) error {
+	var payload AddrPayload
+	if err := msg.Decode(&payload); err != nil {
+		return err
+	}
+	if len(payload.Addrs) > MaxAddrPerMessage {
+		return misbehavior(ProtocolMisbehavior, errors.New("too many addresses"))
+	}
+
+	now := time.Now().UnixMilli()
+	self := n.reachableAddr()
+	relay := make([]NetAddress, 0)
+	for _, addr := range payload.Addrs {
+		if !validAddr(addr.Addr) || addr.Addr == self {
+			continue
+		}
+		p.known.Add("addr:" + addr.Addr)
+		// 不信任来自未来的时间戳
+		if addr.LastSeen > now {
+			addr.LastSeen = now
+		}
+		n.book.AddAddress(addr.Addr, p.Addr(), addr.LastSeen)
+		if time.Duration(now-addr.LastSeen)*time.Millisecond < AddrRelayFreshness {
+			relay = append(relay, addr)
+		}
+	}
+
+	// 转发新鲜的地址通告, getaddr 的回复不转发
+	if len(payload.Addrs) <= AddrRelayMaxAddresses && len(relay) > 0 {
+		n.relayAddrs(relay, p)
+	}
+	return nil
+}
+
+// relayAddrs 将地址转发给少量随机的其他节点
+func (n *Node) relayAddrs(addrs []NetAddress, from *Peer) {
+	peers := n.Peers()
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	sent := 0
+	for _, p := range peers {
+		if p == from || sent >= AddrRelayFanout {
+			continue
+		}
+		unknown := make([]NetAddress, 0, len(addrs))
+		for _, addr := range addrs {
+			if p.known.Add("addr:" + addr.Addr) {
+				unknown = append(unknown, addr)
+			}
+		}
+		if len(unknown) == 0 {
+			continue
+		}
+		if err := p.Send(CmdAddr, &AddrPayload{Addrs: unknown}); err != nil {
+			n.logf("relay addr to %s: %v", p.Name(), err)
+		}
+		sent++
+	}
+}
+
+// isConnected 判断是否已经连接或正在连接该地址
+func (n *Node) isConnected(addr string) bool {
+	if addr == n.ExternalAddr() || addr == n.RelayAddr() {
+		return true
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.dialing[addr] {
+		return true
+	}
+	for p := range n.peers {
+		if p.dialAddr == addr || p.ListenAddr() == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// outboundCount 出站连接数
+func (n *Node) outboundCount() int {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	count := len(n.dialing)
+	for p := range n.peers {
+		if !p.Inbound() {
+			count++
+		}
+	}
+	return count
+}
+
+// dial 连接地址簿中的地址, 并记录结果
+func (n *Node) dial(addr string) {
+	defer n.wg.Done()
+	defer func() {
+		n.mu.Lock()
+		delete(n.dialing, addr)
+		n.mu.Unlock()
+	}()
+
+	n.book.MarkAttempt(addr)
+	if _, err := n.Connect(addr); err != nil {
+		if errors.Is(err, errConnectedToSelf) {
+			n.book.Remove(addr)
+		}
+		return
+	}
+	n.book.MarkGood(addr)
+}
+
+// discoveryLoop 维持出站连接, 定期通告本节点的地址并保存地址簿
+func (n *Node) discoveryLoop() {
+	defer n.wg.Done()
+	dialTicker := time.NewTicker(n.cfg.DialInterval)
+	defer dialTicker.Stop()
+	advertiseTicker := time.NewTicker(AdvertiseInterval)
+	defer advertiseTicker.Stop()
+	saveTicker := time.NewTicker(AddrBookSaveInterval)
+	defer saveTicker.Stop()
+
+	for {
+		select {
+		case <-n.quit:
+			return
+		case <-advertiseTicker.C:
+			for _, p := range n.Peers() {
+				n.advertise(p)
+			}
+		case <-saveTicker.C:
+			if err := n.book.Save(); err != nil {
+				n.logf("save address book: %v", err)
+			}
+		case <-dialTicker.C:
+			if n.book.Size() == 0 && len(n.Peers()) == 0 {
+				for _, seed := range n.cfg.Seeds {
+					n.book.AddAddress(seed, "seed", time.Now().UnixMilli())
+				}
+			}
+			for n.outboundCount() < n.cfg.MaxOutbound {
+				addr, ok := n.book.Pick(func(addr string) bool { return n.isConnected(addr) || n.isBanned(addr) })
+				if !ok {
+					break
+				}
+				n.mu.Lock()
+				n.dialing[addr] = true
+				n.mu.Unlock()
+				n.wg.Add(1)
+				go n.dial(addr)
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package p2p_test
+
+import (
+	"a10000/p2p"
+	"a10000/store"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPeerDiscovery(t *testing.T) {
+	genesis := newGenesis(t, newTestWallet(t))
+	discovery := func(name string, public bool, seeds ...string) p2p.Config {
+		return p2p.Config{Name: name, Public: public, Seeds: seeds, DialInterval: 50 * time.Millisecond}
+	}
+
+	p := startNode(t, discovery("P", true), newTestChain(t, genesis))
+	q := startNode(t, discovery("Q", true, p.Addr().String()), newTestChain(t, genesis))
+	waitFor(t, "Q to connect P", func() bool { return len(q.Peers()) == 1 })
+
+	// 私有节点 X 只知道 P, 通过 P 发现公开节点 Q
+	x := startNode(t, discovery("X", false, p.Addr().String()), newTestChain(t, genesis))
+	waitFor(t, "X to discover Q", func() bool {
+		for _, peer := range x.Peers() {
+			if peer.Name() == "Q" {
+				return true
+			}
+		}
+		return false
+	})
+
+	// 私有节点不会出现在其他节点的地址簿中
+	y := startNode(t, discovery("Y", false, p.Addr().String()), newTestChain(t, genesis))
+	waitFor(t, "Y to connect", func() bool { return len(y.Peers()) >= 1 })
+	if _, ok := p.AddrBook().Get(x.Addr().String()); ok {
+		t.Fatal("Private node should not be added to the address book")
+	}
+	if p.AddrBook().Size() != 1 {
+		t.Fatalf("P should only know Q, got %d addresses", p.AddrBook().Size())
+	}
+}
+
+func TestAddrBookPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.json")
+	book := p2p.NewAddrBook(path)
+	now := time.Now().UnixMilli()
+	book.AddAddress("10.0.0.1:6666", "seed", now)
+	book.AddAddress("10.0.0.2:6666", "10.0.0.1:6666", now-1000)
+	book.MarkGood("10.0.0.1:6666")
+	book.MarkAttempt("10.0.0.2:6666")
+	if err := book.Save(); err != nil {
+		t.Fatalf("Failed to save address book: %v", err)
+	}
+
+	loaded := p2p.NewAddrBook(path)
+	if err := loaded.Load(); err != nil {
+		t.Fatalf("Failed to load address book: %v", err)
+	}
+	if loaded.Size() != 2 {
+		t.Fatalf("Address book size is incorrect, expected 2, got %d", loaded.Size())
+	}
+	tried, _ := loaded.Get("10.0.0.1:6666")
+	fresh, _ := loaded.Get("10.0.0.2:6666")
+	if !tried.Tried || fresh.Tried || fresh.Attempts != 1 || fresh.LastSeen != now-1000 {
+		t.Fatalf("Address book entries are incorrect: %+v %+v", tried, fresh)
+	}
+
+	// 刚刚失败过的地址不会被立即选中
+	addr, ok := loaded.Pick(nil)
+	if !ok || addr != "10.0.0.1:6666" {
+		t.Fatalf("Pick should return the tried address, got %q", addr)
+	}
+}
+
+func TestAddrBookInStore(t *testing.T) {
+	dir := t.TempDir()
+	blockStore, err := store.Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	genesis := newGenesis(t, newTestWallet(t))
+	p := startNode(t, p2p.Config{Name: "P", Public: true}, newTestChain(t, genesis))
+	x := startNode(t, p2p.Config{Name: "X", Store: blockStore, Peers: []string{p.Addr().String()}}, newTestChain(t, genesis))
+	waitFor(t, "X to learn P", func() bool { return x.AddrBook().Size() == 1 })
+	x.Stop()
+
+	book := p2p.NewAddrBook(filepath.Join(dir, "peers.json"))
+	if err = book.Load(); err != nil || book.Size() != 1 {
+		t.Fatalf("Address book should be saved in the data directory: %v", err)
+	}
+}
@@ -0,0 +1,245 @@
+package p2p
+
+import (
+	"a10000/core"
+	"fmt"
+)
+
+// 交易和区块的广播协议:
+//
+// 节点收到新的交易或区块并验证通过后, 向所有不知道该对象的节点发送 inv,
+// 收到 inv 的节点向发送方请求(getdata)自己没有的对象, 发送方回复 tx 或 block.
+// 每个节点记录对方已知的对象, 同一个对象只会向同一个节点广播一次, 避免广播风暴.
+
+// SubmitTransaction 将本地创建的交易加入交易池, 并广播给其他节点
+func (n *Node) SubmitTransaction(tx *core.Transaction) error {
+	if err := n.acceptTransaction(tx); err != nil {
+		return err
+	}
+	n.announce(InvItem{Type: InvTx, Hash: tx.ID}, nil)
+	return nil
+}
+
+// SubmitBlock 将本地挖出的区块加入区块链, 并广播给其他节点
+func (n *Node) SubmitBlock(b *core.Block) error {
+	if err := n.acceptBlock(b); err != nil {
+		return err
+	}
+	n.announce(InvItem{Type: InvBlock, Hash: b.Hash}, nil)
+	return nil
+}
+
+// Generate 立即挖出 count 个区块, 区块奖励属于 address, 每个区块都会保存并广播给其他节点
+// 只能用于 MineOnDemand 的网络, 例如 regtest
+func (n *Node) Generate(count int, address string) ([]*core.Block, error) {
+	if params := n.chain.Params; !params.MineOnDemand {
+		return nil, fmt.Errorf("network %s does not support generating blocks on demand", params.Name)
+	}
+	blocks := make([]*core.Block, 0, count)
+	for i := 0; i < count; i++ {
+		b := n.chain.NewBlock(address, n.clock.Now())
+		if err := n.SubmitBlock(b); err != nil {
+			return blocks, err
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks, nil
+}
+
+func (n *Node) acceptTransaction(tx *core.Transaction) error {
+	if err := n.Err(); err != nil {
+		return err
+	}
+	return n.chain.AddTransaction(tx)
+}
+
+// acceptBlock 连接区块, 并保存到区块存储
+func (n *Node) acceptBlock(b *core.Block) error {
+	if err := n.Err(); err != nil {
+		return err
+	}
+	if err := n.chain.AddBlock(b); err != nil {
+		return err
+	}
+	if n.cfg.Store != nil {
+		if err := n.cfg.Store.SaveBlock(n.chain, b); err != nil {
+			n.logf("save block %d: %v", b.Index, err)
+		}
+		if n.cfg.PruneWindow > 0 {
+			if _, err := n.cfg.Store.Prune(n.chain, n.cfg.PruneWindow); err != nil {
+				n.logf("prune blocks: %v", err)
+			}
+		}
+	}
+	n.blockConnected(b)
+	return nil
+}
+
+// hasInventory 判断本地是否已经拥有该对象
+func (n *Node) hasInventory(item InvItem) bool {
+	switch item.Type {
+	case InvTx:
+		return n.chain.GetPendingTransaction(item.Hash) != nil
+	case InvBlock:
+		return n.chain.HeaderByHash(item.Hash) != nil
+	}
+	return false
+}
+
+// announce 向所有不知道该对象的节点发送 inv, from 为对象的来源节点
+func (n *Node) announce(item InvItem, from *Peer) {
+	for _, p := range n.Peers() {
+		if p == from || !p.known.Add(item.key()) {
+			continue
+		}
+		if err := p.Send(CmdInv, &InvPayload{Items: []InvItem{item}}); err != nil {
+			n.logf("send inv to %s: %v", p.Name(), err)
+		}
+	}
+}
+
+func (n *Node) handleInv(p *Peer, msg *Message) error {
+	var inv InvPayload
+	if err := msg.Decode(&inv); err != nil {
+		return err
+	}
+	request := make([]InvItem, 0, len(inv.Items))
+	for _, item := range inv.Items {
+		p.known.Add(item.key())
+		if n.hasInventory(item) || n.rejected.Has(item.key()) {
+			continue
+		}
+		// 同一个对象同时只向一个节点请求
+		if !n.requested.Add(item.key()) {
+			continue
+		}
+		request = append(request, item)
+	}
+	if len(request) == 0 {
+		return nil
+	}
+	return p.Send(CmdGetData, &InvPayload{Items: request})
+}
+
+func (n *Node) handleGetData(p *Peer, msg *Message) error {
+	var getData InvPayload
+	if err := msg.Decode(&getData); err != nil {
+		return err
+	}
+	notFound := make([]InvItem, 0)
+	for _, item := range getData.Items {
+		var err error
+		switch item.Type {
+		case InvTx:
+			tx := n.chain.GetPendingTransaction(item.Hash)
+			if tx == nil {
+				notFound = append(notFound, item)
+				continue
+			}
+			err = p.Send(CmdTx, tx)
+		case InvBlock:
+			b := n.chain.GetBlock(item.Hash)
+			if b == nil {
+				notFound = append(notFound, item)
+				continue
+			}
+			err = p.Send(CmdBlock, b)
+		default:
+			notFound = append(notFound, item)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		p.known.Add(item.key())
+	}
+	if len(notFound) > 0 {
+		return p.Send(CmdNotFound, &InvPayload{Items: notFound})
+	}
+	return nil
+}
+
+func (n *Node) handleNotFound(p *Peer, msg *Message) error {
+	var inv InvPayload
+	if err := msg.Decode(&inv); err != nil {
+		return err
+	}
+	for _, item := range inv.Items {
+		n.requested.Remove(item.key())
+	}
+	return nil
+}
+
+func (n *Node) handleTx(p *Peer, msg *Message) error {
+	var tx core.Transaction
+	if err := msg.Decode(&tx); err != nil {
+		return err
+	}
+	item := InvItem{Type: InvTx, Hash: tx.ID}
+	p.known.Add(item.key())
+	defer n.requested.Remove(item.key())
+
+	if n.hasInventory(item) {
+		return nil
+	}
+	// 先验证, 验证通过后再转发
+	if err := n.acceptTransaction(&tx); err != nil {
+		// 严重错误说明交易本身无效, 不再请求; 其他错误(如引用的输出尚未同步)以后可能不再出现.
+		// 交易 ID 与内容不一致时无效的只是收到的内容, 不能据此拒绝这个 ID
+		if core.SeverityOf(err) == core.SeverityFatal && tx.ID == tx.Hash() {
+			n.rejected.Add(item.key())
+		}
+		return err
+	}
+	n.announce(item, p)
+	return nil
+}
+
+func (n *Node) handleBlock(p *Peer, msg *Message) error {
+	var b core.Block
+	if err := msg.Decode(&b); err != nil {
+		return err
+	}
+	item := InvItem{Type: InvBlock, Hash: b.Hash}
+	p.known.Add(item.key())
+	defer n.requested.Remove(item.key())
+
+	// 先验证工作量证明和 MerkleRoot, 之后区块的内容与 Hash 一致, 才能据此更新对方的高度和记录拒绝的区块
+	if err := b.Verification(); err != nil {
+		return err
+	}
+	p.SetHeight(b.Index)
+
+	// 快照之前的区块交给后台验证
+	if n.snapshot != nil && n.snapshot.addBlock(&b) {
+		return nil
+	}
+	if n.hasInventory(item) {
+		return nil
+	}
+
+	// 区块头链上的区块(同步中下载的区块, 或者工作量更大的分叉上的区块)先缓存, 再按高度连接
+	if n.bufferBlock(&b) {
+		n.connectBuffered()
+		n.scheduleDownloads()
+		return nil
+	}
+	// 其他区块只有直接链接在链尾之后才连接, 否则可能属于未知的分叉, 向对方请求区块头
+	if tip := n.chain.Tip(); b.Index != tip.Index+1 || b.PreviousHash != tip.Hash || b.Index <= n.HeaderHeight() {
+		return n.requestHeaders(p)
+	}
+
+	// 先验证, 验证通过后再转发
+	if err := n.acceptBlock(&b); err != nil {
+		// 严重错误说明区块本身无效, 不再请求; 其他错误(如不能连接到当前链尾)以后可能不再出现
+		if core.SeverityOf(err) == core.SeverityFatal {
+			n.rejected.Add(item.key())
+		}
+		return err
+	}
+	n.logf("accepted block %d (%s) from %s", b.Index, b.Hash, p.Name())
+	n.announce(item, p)
+	n.connectBuffered()
+	n.scheduleDownloads()
+	return nil
+}
@@ -0,0 +1,221 @@
+package p2p_test
+
+import (
+	"a10000/core"
+	"a10000/p2p"
+	"sync"
+	"testing"
+)
+
+func TestGossip(t *testing.T) {
+	tom := newTestWallet(t)
+	alice := newTestWallet(t)
+	genesis := newGenesis(t, tom)
+
+	// 三个节点两两相连, 广播不应形成循环
+	a := newTestNode(t, "A", genesis)
+	b := newTestNode(t, "B", genesis, a.Addr().String())
+	c := newTestNode(t, "C", genesis, a.Addr().String(), b.Addr().String())
+	waitFor(t, "all nodes to connect", func() bool {
+		return len(a.Peers()) == 2 && len(b.Peers()) == 2 && len(c.Peers()) == 2
+	})
+
+	// A 上创建的交易传播到 B 和 C 的交易池
+	ch := newTestChain(t, genesis)
+	tx, err := tom.NewTransaction(ch.FindUTXO(tom.Address()), alice.Address(), 20, "")
+	if err != nil {
+		t.Fatalf("Failed to create transaction: %v", err)
+	}
+	if err = a.SubmitTransaction(tx); err != nil {
+		t.Fatalf("Failed to submit transaction: %v", err)
+	}
+	waitFor(t, "transaction to reach B", func() bool { return len(b.PendingTransactions()) == 1 })
+	waitFor(t, "transaction to reach C", func() bool { return len(c.PendingTransactions()) == 1 })
+
+	// C 上挖出的区块传播到 A 和 B, 并清空它们的交易池
+	if err = ch.AddTransaction(tx); err != nil {
+		t.Fatalf("Failed to add transaction: %v", err)
+	}
+	transactions := append([]*core.Transaction{core.NewCoinbaseTX(1, alice.Address(), 50)}, ch.PendingTransactions()...)
+	block := core.CreateBlock(1, transactions, genesis.Hash, core.RegtestParams.InitialDifficulty)
+	if err = c.SubmitBlock(block); err != nil {
+		t.Fatalf("Failed to submit block: %v", err)
+	}
+	waitFor(t, "block to reach A", func() bool { return a.Height() == 1 && len(a.PendingTransactions()) == 0 })
+	waitFor(t, "block to reach B", func() bool { return b.Height() == 1 && len(b.PendingTransactions()) == 0 })
+
+	// 重复提交已有的区块会被拒绝
+	if err = a.SubmitBlock(block); err == nil {
+		t.Fatal("Resubmitting a connected block should fail")
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	tom := newTestWallet(t)
+	genesis := newGenesis(t, tom)
+	a := newTestNode(t, "A", genesis)
+	b := newTestNode(t, "B", genesis, a.Addr().String())
+	waitFor(t, "nodes to connect", func() bool { return len(a.Peers()) == 1 })
+
+	blocks, err := a.Generate(5, tom.Address())
+	if err != nil {
+		t.Fatalf("Failed to generate blocks: %v", err)
+	}
+	if len(blocks) != 5 || a.Height() != 5 {
+		t.Fatalf("Expected 5 generated blocks, got %d", len(blocks))
+	}
+	waitFor(t, "generated blocks to reach B", func() bool { return b.Height() == 5 })
+}
+
+// TestConcurrentNode 节点同时挖矿, 接受交易, 处理其他节点的消息和响应查询, 使用 go test -race 运行
+func TestConcurrentNode(t *testing.T) {
+	tom := newTestWallet(t)
+	alice := newTestWallet(t)
+	genesis := newGenesis(t, tom)
+	a := newTestNode(t, "A", genesis)
+	b := newTestNode(t, "B", genesis, a.Addr().String())
+	waitFor(t, "nodes to connect", func() bool { return len(a.Peers()) == 1 })
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			if _, err := a.Generate(1, tom.Address()); err != nil {
+				t.Errorf("Failed to generate block: %v", err)
+				return
+			}
+		}
+	}()
+	for _, node := range []*p2p.Node{a, b} {
+		node := node
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if tx, err := tom.NewTransaction(node.FindSpendableUTXO(tom.Address()), alice.Address(), 1, ""); err == nil {
+					node.SubmitTransaction(tx)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for _, tx := range node.PendingTransactions() {
+					node.Transaction(tx.ID)
+				}
+				node.BlockByHeight(node.Height())
+				node.FindUTXO(alice.Address())
+			}
+		}()
+	}
+	wg.Wait()
+	waitFor(t, "B to catch up", func() bool { return b.Height() == 20 })
+}
+
+// readGetData 读取节点发送的消息, 直到收到 getdata
+func readGetData(t *testing.T, r *rawPeer) *p2p.InvPayload {
+	t.Helper()
+	for {
+		msg, err := r.read()
+		if err != nil {
+			t.Fatalf("Failed to read getdata: %v", err)
+		}
+		if msg.Command == p2p.CmdGetData {
+			var inv p2p.InvPayload
+			if err := msg.Decode(&inv); err != nil {
+				t.Fatalf("Failed to decode getdata: %v", err)
+			}
+			return &inv
+		}
+	}
+}
+
+func TestRejectedBlocks(t *testing.T) {
+	tom := newTestWallet(t)
+	genesis := newGenesis(t, tom)
+	ch := newTestChain(t, genesis)
+	mineBlocks(t, ch, tom, 1)
+	v := startNode(t, p2p.Config{Name: "V"}, ch)
+
+	// 不能连接到链尾的有效区块不是对方的过错, 之后仍然可以请求
+	mallory := dialRaw(t, v)
+	side := core.CreateBlock(1, []*core.Transaction{core.NewCoinbaseTX(1, "mallory", 50)}, genesis.Hash, core.RegtestParams.InitialDifficulty)
+	mallory.send(p2p.CmdBlock, side)
+	sideItem := p2p.InvItem{Type: p2p.InvBlock, Hash: side.Hash}
+	mallory.send(p2p.CmdInv, &p2p.InvPayload{Items: []p2p.InvItem{sideItem}})
+	if inv := readGetData(t, mallory); len(inv.Items) != 1 || inv.Items[0] != sideItem {
+		t.Fatalf("Side chain block should be requested again: %+v", inv.Items)
+	}
+	mallory.send(p2p.CmdBlock, side)
+
+	// coinbase 金额超过区块奖励的区块本身无效, 发送者被封禁, 区块不再请求
+	invalid := core.CreateBlock(2, []*core.Transaction{core.NewCoinbaseTX(2, "mallory", 5000)}, ch.Tip().Hash, ch.NextDifficulty())
+	mallory.send(p2p.CmdBlock, invalid)
+	mallory.waitClosed()
+	// dialRaw 的 nonce 固定, 需要等节点移除旧连接
+	waitFor(t, "V to drop the banned peer", func() bool { return len(v.Peers()) == 0 })
+	if err := v.Unban("127.0.0.1"); err != nil {
+		t.Fatalf("Failed to unban: %v", err)
+	}
+	mallory = dialRaw(t, v)
+	mallory.send(p2p.CmdInv, &p2p.InvPayload{Items: []p2p.InvItem{{Type: p2p.InvBlock, Hash: invalid.Hash}, sideItem}})
+	if inv := readGetData(t, mallory); len(inv.Items) != 1 || inv.Items[0] != sideItem {
+		t.Fatalf("Invalid block should not be requested again: %+v", inv.Items)
+	}
+	if v.Height() != 1 {
+		t.Fatalf("Invalid block should not be connected, height %d", v.Height())
+	}
+}
+
+func TestRejectedTransactions(t *testing.T) {
+	tom := newTestWallet(t)
+	genesis := newGenesis(t, tom)
+	v := startNode(t, p2p.Config{Name: "V"}, newTestChain(t, genesis))
+
+	// 引用的输出尚不存在(例如还在同步)不是对方的过错, 之后仍然可以请求
+	mallory := dialRaw(t, v)
+	output := *genesis.Transactions[0].Outputs[0]
+	missing, err := tom.NewTransaction(map[string]core.TxOutput{"unknown:0": output}, tom.Address(), 10, "")
+	if err != nil {
+		t.Fatalf("Failed to create transaction: %v", err)
+	}
+	mallory.send(p2p.CmdTx, missing)
+	missingItem := p2p.InvItem{Type: p2p.InvTx, Hash: missing.ID}
+	mallory.send(p2p.CmdInv, &p2p.InvPayload{Items: []p2p.InvItem{missingItem}})
+	if inv := readGetData(t, mallory); len(inv.Items) != 1 || inv.Items[0] != missingItem {
+		t.Fatalf("Transaction with missing inputs should be requested again: %+v", inv.Items)
+	}
+	mallory.send(p2p.CmdTx, missing)
+
+	// 输出金额超过输入的交易本身无效, 发送者被封禁, 交易不再请求
+	output.Amount = 500
+	invalid, err := tom.NewTransaction(map[string]core.TxOutput{genesis.Transactions[0].ID + ":0": output}, tom.Address(), 100, "")
+	if err != nil {
+		t.Fatalf("Failed to create transaction: %v", err)
+	}
+	mallory.send(p2p.CmdTx, invalid)
+	mallory.waitClosed()
+	// dialRaw 的 nonce 固定, 需要等节点移除旧连接
+	waitFor(t, "V to drop the banned peer", func() bool { return len(v.Peers()) == 0 })
+	if err := v.Unban("127.0.0.1"); err != nil {
+		t.Fatalf("Failed to unban: %v", err)
+	}
+	mallory = dialRaw(t, v)
+	mallory.send(p2p.CmdInv, &p2p.InvPayload{Items: []p2p.InvItem{{Type: p2p.InvTx, Hash: invalid.ID}, missingItem}})
+	if inv := readGetData(t, mallory); len(inv.Items) != 1 || inv.Items[0] != missingItem {
+		t.Fatalf("Invalid transaction should not be requested again: %+v", inv.Items)
+	}
+}
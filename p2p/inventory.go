@@ -0,0 +1,82 @@
+package p2p
+
+import "sync"
+
+// 库存对象的类型
+const (
+	InvTx    = "tx"    // 交易
+	InvBlock = "block" // 区块
+)
+
+// InvItem 库存对象, 通过类型和 Hash 标识一个交易或区块
+type InvItem struct {
+	Type string `json:"type"` // 对象类型
+	Hash string `json:"hash"` // 交易 ID 或区块 Hash
+}
+
+func (item InvItem) key() string {
+	return item.Type + ":" + item.Hash
+}
+
+// InvPayload inv, getdata 和 notfound 消息的内容
+type InvPayload struct {
+	Items []InvItem `json:"items"`
+}
+
+// DefaultKnownInventorySize 每个节点记录的已知库存对象的数量
+const DefaultKnownInventorySize = 10000
+
+// boundedSet 容量有限的集合, 超出容量时淘汰最早加入的元素
+type boundedSet struct {
+	mu    sync.Mutex
+	max   int
+	items map[string]struct{}
+	order []string
+}
+
+func newBoundedSet(max int) *boundedSet {
+	return &boundedSet{
+		max:   max,
+		items: make(map[string]struct{}),
+	}
+}
+
+// Add 添加元素, 元素已存在时返回 false
+func (s *boundedSet) Add(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.items[key]; ok {
+		return false
+	}
+	if len(s.order) >= s.max {
+		delete(s.items, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.items[key] = struct{}{}
+	s.order = append(s.order, key)
+	return true
+}
+
+// Has 判断元素是否存在
+func (s *boundedSet) Has(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.items[key]
+	return ok
+}
+
+// Remove 删除元素
+func (s *boundedSet) Remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.items[key]; !ok {
+		return
+	}
+	delete(s.items, key)
+	for i, k := range s.order {
+		if k == key {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
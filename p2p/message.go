@@ -0,0 +1,132 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ProtocolVersion 网络协议版本
+const ProtocolVersion = 1
+
+// MaxMessageSize 单条消息的最大字节数
+const MaxMessageSize = 32 * 1024 * 1024
+
+// maxHandshakeSize 握手消息(hello, relayconnect, version 和 verack)的最大字节数.
+// 握手完成前对方的身份未知, 不能让它使接收方按 MaxMessageSize 分配内存
+const maxHandshakeSize = 4 * 1024
+
+// 消息类型
+const (
+	CmdVersion = "version" // 握手: 交换协议版本, 节点名称和区块高度
+	CmdVerack  = "verack"  // 握手: 确认收到 version
+	CmdPing    = "ping"    // 心跳
+	CmdPong    = "pong"    // 心跳应答
+
+	CmdInv      = "inv"      // 广播: 通知对方自己拥有的交易或区块
+	CmdGetData  = "getdata"  // 广播: 请求交易或区块
+	CmdNotFound = "notfound" // 广播: 请求的交易或区块不存在
+	CmdTx       = "tx"       // 广播: 交易
+	CmdBlock    = "block"    // 广播: 区块
+
+	CmdGetHeaders = "getheaders" // 同步: 请求区块头
+	CmdHeaders    = "headers"    // 同步: 区块头
+
+	CmdGetAddr = "getaddr" // 发现: 请求地址
+	CmdAddr    = "addr"    // 发现: 地址
+
+	CmdRelayRegister = "relayregister" // 中继: 私有节点注册
+	CmdRelayAccept   = "relayaccept"   // 中继: 注册成功, 返回中继地址
+	CmdRelayConnect  = "relayconnect"  // 中继: 通过中继连接私有节点, 作为连接的第一条消息
+	CmdRelayOpen     = "relayopen"     // 中继: 通知私有节点有新的转发连接
+	CmdRelayData     = "relaydata"     // 中继: 转发的数据
+	CmdRelayClose    = "relayclose"    // 中继: 关闭转发的连接
+)
+
+// Message 节点之间传输的消息
+// 在连接上的编码为: 4 字节大端序的长度 + JSON
+type Message struct {
+	Command string          `json:"command"` // 消息类型
+	Payload json.RawMessage `json:"payload"` // 消息内容
+}
+
+// Decode 将消息内容解析到 v
+func (m *Message) Decode(v interface{}) error {
+	if err := json.Unmarshal(m.Payload, v); err != nil {
+		return misbehavior(BanThreshold, fmt.Errorf("invalid %s payload: %v", m.Command, err))
+	}
+	return nil
+}
+
+// VersionPayload version 消息的内容
+type VersionPayload struct {
+	Version     int    `json:"version"`      // 协议版本
+	Network     string `json:"network"`      // 网络名称
+	Genesis     string `json:"genesis"`      // 创世区块的 Hash, 不同的创世区块属于不同的区块链
+	Name        string `json:"name"`         // 节点名称
+	Nonce       uint64 `json:"nonce"`        // 节点随机数, 用于识别连接到自己的情况
+	Height      int64  `json:"height"`       // 区块高度
+	ListenPort  int    `json:"listen_port"`  // 监听端口, 0 表示不接受连接
+	Public      bool   `json:"public"`       // 是否为公开节点
+	Relay       bool   `json:"relay"`        // 是否提供中继服务
+	Timestamp   int64  `json:"timestamp"`    // 发送时间戳
+	YourAddr    string `json:"your_addr"`    // 发送方看到的接收方地址, 用于接收方推断自己的公开地址
+	PruneWindow int64  `json:"prune_window"` // 发送方只提供最近的区块数量, 为 0 时提供全部区块
+	Pruned      int64  `json:"pruned"`       // 发送方区块体已被删除的最高高度, 例如从 UTXO 快照启动的节点没有快照之前的区块
+}
+
+// PingPayload ping/pong 消息的内容
+type PingPayload struct {
+	Nonce uint64 `json:"nonce"`
+}
+
+// encodeMessage 将消息编码为带长度前缀的字节
+func encodeMessage(command string, payload interface{}) ([]byte, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(&Message{Command: command, Payload: raw})
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxMessageSize {
+		return nil, errors.New("message too large")
+	}
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	return frame, nil
+}
+
+// readFrame 读取一个带长度前缀的帧, 先检查长度不超过 limit 再分配内存
+func readFrame(r io.Reader, limit int) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if uint64(size) > uint64(limit) {
+		return nil, fmt.Errorf("frame of %d bytes exceeds limit %d", size, limit)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readMessage 读取一条不超过 limit 字节的消息
+func readMessage(r io.Reader, limit int) (*Message, error) {
+	data, err := readFrame(r, limit)
+	if err != nil {
+		return nil, err
+	}
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, fmt.Errorf("invalid message: %v", err)
+	}
+	return &msg, nil
+}
@@ -0,0 +1,625 @@
+package p2p
+
+import (
+	"a10000/core"
+	"a10000/store"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultHandshakeTimeout 默认的握手超时时间
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// Config 节点配置
+type Config struct {
+	Name             string             // 节点名称
+	ListenAddr       string             // 监听地址, 例如 ":6666", 为空时不接受连接
+	Peers            []string           // 启动时主动连接的节点地址
+	Public           bool               // 是否为公开节点, 公开节点可以被其他节点直接连接
+	Relay            bool               // 是否为其他节点提供中继服务
+	HandshakeTimeout time.Duration      // 握手超时时间
+	Store            *store.BlockStore  // 区块存储, 为 nil 时不保存区块和地址簿
+	Seeds            []string           // 种子地址, 地址簿为空时使用
+	MaxOutbound      int                // 最大出站连接数
+	DialInterval     time.Duration      // 建立出站连接的检查间隔
+	ExternalAddr     string             // 对外公开的地址, 为空时根据其他节点看到的地址推断
+	RelayBandwidth   int                // 中继服务为每个私有节点转发的带宽, 单位字节/秒
+	MaxRelayClients  int                // 中继服务最多服务的私有节点数量
+	BanDuration      time.Duration      // 惩罚分数达到 BanThreshold 的节点的封禁时长
+	NodeKey          ed25519.PrivateKey // 节点密钥, 为空时随机生成
+	PinnedIDs        map[string]string  // 固定的节点身份, 使用这些名称的节点必须持有对应的节点密钥. key: 节点名称 => value: 节点 ID
+	Clock            core.Clock         // 本地时钟, 为 nil 时使用系统时钟
+	PruneWindow      int64              // 只保留最近的区块数量, 为 0 时保留全部区块. 需要设置 Store
+}
+
+var errConnectedToSelf = errors.New("connected to self")
+
+// Handler 消息处理函数
+// 返回错误时, 错误会被记录到日志
+type Handler func(p *Peer, msg *Message) error
+
+// Node 网络节点
+// 节点持有一条区块链, 通过网络与其他节点交换数据
+type Node struct {
+	cfg   Config
+	nonce uint64 // 随机数, 用于识别连接到自己的情况
+
+	chain    *core.Blockchain
+	clock    *AdjustedClock     // 根据其他节点的时间校正后的时钟
+	snapshot *snapshotValidator // 起点快照的后台验证, 不需要验证时为 nil
+
+	listener    net.Listener
+	handlers    map[string]Handler
+	subscribers []NotificationHandler
+	reorg       *Reorg // 已断开区块但尚未连接新区块的分叉切换, 只在区块链的事件通知中访问
+
+	requested *boundedSet // 已经请求但尚未收到的交易和区块
+	rejected  *boundedSet // 验证失败的交易和区块, 不再请求
+
+	sync  *syncState
+	relay *relayState
+
+	mu           sync.RWMutex
+	peers        map[*Peer]struct{}
+	dialing      map[string]bool // 正在连接的地址
+	externalAddr string          // 对外公开的地址
+
+	book *AddrBook
+	bans *BanList
+
+	failure error         // 使节点停止工作的错误, 由 mu 保护
+	failed  chan struct{} // 节点停止工作时关闭
+
+	quit     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewNode 创建节点, 区块链的时钟被替换为节点根据其他节点校正后的时钟
+func NewNode(cfg Config, chain *core.Blockchain) *Node {
+	if cfg.HandshakeTimeout <= 0 {
+		cfg.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+	if cfg.MaxOutbound <= 0 {
+		cfg.MaxOutbound = DefaultMaxOutbound
+	}
+	if cfg.DialInterval <= 0 {
+		cfg.DialInterval = DefaultDialInterval
+	}
+	if cfg.RelayBandwidth <= 0 {
+		cfg.RelayBandwidth = DefaultRelayBandwidth
+	}
+	if cfg.MaxRelayClients <= 0 {
+		cfg.MaxRelayClients = DefaultMaxRelayClients
+	}
+	if cfg.BanDuration <= 0 {
+		cfg.BanDuration = DefaultBanDuration
+	}
+	if cfg.NodeKey == nil {
+		cfg.NodeKey, _ = GenerateNodeKey()
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = core.SystemClock
+	}
+	n := &Node{
+		cfg:          cfg,
+		nonce:        rand.Uint64(),
+		chain:        chain,
+		clock:        NewAdjustedClock(cfg.Clock),
+		handlers:     make(map[string]Handler),
+		requested:    newBoundedSet(DefaultKnownInventorySize),
+		rejected:     newBoundedSet(DefaultKnownInventorySize),
+		sync:         newSyncState(),
+		relay:        newRelayState(),
+		peers:        make(map[*Peer]struct{}),
+		dialing:      make(map[string]bool),
+		externalAddr: cfg.ExternalAddr,
+		failed:       make(chan struct{}),
+		quit:         make(chan struct{}),
+	}
+	// 区块链使用网络调整时间检查区块时间戳
+	chain.Clock = n.clock
+	chain.Subscribe(n.chainEvent)
+	n.book = NewAddrBook(n.addrBookPath())
+	n.bans = NewBanList(n.banListPath())
+	n.Handle(CmdPing, n.handlePing)
+	n.Handle(CmdPong, func(p *Peer, msg *Message) error { return nil })
+	n.Handle(CmdInv, n.handleInv)
+	n.Handle(CmdGetData, n.handleGetData)
+	n.Handle(CmdNotFound, n.handleNotFound)
+	n.Handle(CmdTx, n.handleTx)
+	n.Handle(CmdBlock, n.handleBlock)
+	n.Handle(CmdGetHeaders, n.handleGetHeaders)
+	n.Handle(CmdHeaders, n.handleHeaders)
+	n.Handle(CmdGetAddr, n.handleGetAddr)
+	n.Handle(CmdAddr, n.handleAddr)
+	n.Handle(CmdRelayRegister, n.handleRelayRegister)
+	n.Handle(CmdRelayAccept, n.handleRelayAccept)
+	n.Handle(CmdRelayOpen, n.handleRelayOpen)
+	n.Handle(CmdRelayData, n.handleRelayData)
+	n.Handle(CmdRelayClose, n.handleRelayClose)
+	return n
+}
+
+// Handle 注册消息处理函数
+// 必须在 Start 之前调用
+func (n *Node) Handle(command string, handler Handler) {
+	n.handlers[command] = handler
+}
+
+// Name 节点名称
+func (n *Node) Name() string {
+	return n.cfg.Name
+}
+
+// Addr 节点的监听地址, 未监听时返回 nil
+func (n *Node) Addr() net.Addr {
+	if n.listener == nil {
+		return nil
+	}
+	return n.listener.Addr()
+}
+
+// ID 节点 ID, 即节点公钥
+func (n *Node) ID() string {
+	return NodeID(n.cfg.NodeKey.Public().(ed25519.PublicKey))
+}
+
+// Height 节点的区块高度
+func (n *Node) Height() int64 {
+	return n.chain.Height()
+}
+
+// Clock 根据其他节点的时间校正后的时钟, 区块链使用该时钟检查区块时间戳
+func (n *Node) Clock() *AdjustedClock {
+	return n.clock
+}
+
+// genesisHash 创世区块的 Hash
+func (n *Node) genesisHash() string {
+	return n.chain.BlockByHeight(0).Hash
+}
+
+// NextDifficulty 下一个区块需要的工作量证明难度
+func (n *Node) NextDifficulty() int64 {
+	return n.chain.NextDifficulty()
+}
+
+// PendingTransactions 交易池中的交易
+func (n *Node) PendingTransactions() []*core.Transaction {
+	return n.chain.PendingTransactions()
+}
+
+// BlockByHeight 查询高度为 height 的区块, 不存在时返回 nil
+func (n *Node) BlockByHeight(height int64) *core.Block {
+	return n.chain.BlockByHeight(height)
+}
+
+// BlockByHash 根据 Hash 查询区块, 不存在时返回 nil
+func (n *Node) BlockByHash(hash string) *core.Block {
+	return n.chain.GetBlock(hash)
+}
+
+// HeaderByHeight 根据高度查询区块头, 区块体被修剪的区块也能找到, 不存在时返回 nil
+func (n *Node) HeaderByHeight(height int64) *core.BlockHeader {
+	return n.chain.HeaderByHeight(height)
+}
+
+// HeaderByHash 根据 Hash 查询区块头, 区块体被修剪的区块也能找到, 不存在时返回 nil
+func (n *Node) HeaderByHash(hash string) *core.BlockHeader {
+	return n.chain.HeaderByHash(hash)
+}
+
+// Transaction 根据交易 ID 查询区块链和交易池中的交易, 以及包含该交易的区块
+// 交易在交易池中时区块为 nil, 交易不存在时均为 nil
+func (n *Node) Transaction(id string) (*core.Transaction, *core.Block) {
+	return n.chain.FindTransaction(id)
+}
+
+// FindUTXO 查询属于 address 的未花费输出
+func (n *Node) FindUTXO(address string) map[string]core.TxOutput {
+	return n.chain.FindUTXO(address)
+}
+
+// FindSpendableUTXO 查询 address 在下一个区块中可以花费的输出
+func (n *Node) FindSpendableUTXO(address string) map[string]core.TxOutput {
+	return n.chain.FindSpendableUTXO(address)
+}
+
+// Start 启动节点: 监听端口, 并连接配置中的节点
+func (n *Node) Start() error {
+	if n.cfg.Store != nil && !n.cfg.Store.HasBlock(0) {
+		if err := n.cfg.Store.SaveBlock(n.chain, n.chain.BlockByHeight(0)); err != nil {
+			return err
+		}
+	}
+	if err := n.initHeaders(); err != nil {
+		return err
+	}
+	if err := n.startSnapshotValidation(); err != nil {
+		return err
+	}
+	if status := n.SyncProgress(); !status.Synced() {
+		n.logf("resume sync: %s", status)
+	}
+	if err := n.loadMempool(); err != nil {
+		n.logf("load mempool: %v", err)
+	}
+
+	if err := n.book.Load(); err != nil {
+		n.logf("load address book: %v", err)
+	}
+	if err := n.bans.Load(); err != nil {
+		n.logf("load ban list: %v", err)
+	}
+	now := time.Now().UnixMilli()
+	for _, seed := range n.cfg.Seeds {
+		n.book.AddAddress(seed, "seed", now)
+	}
+
+	n.wg.Add(2)
+	go n.syncLoop()
+	go n.discoveryLoop()
+
+	if n.cfg.ListenAddr != "" {
+		listener, err := net.Listen("tcp", n.cfg.ListenAddr)
+		if err != nil {
+			return err
+		}
+		n.listener = listener
+		n.logf("listening on %s, node id %s", listener.Addr(), n.ID())
+
+		n.wg.Add(1)
+		go n.acceptLoop()
+	}
+
+	for _, addr := range n.cfg.Peers {
+		addr := addr
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			if _, err := n.Connect(addr); err != nil {
+				n.logf("failed to connect %s: %v", addr, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// Stop 停止节点, 断开所有连接
+func (n *Node) Stop() {
+	n.shutdown()
+	n.wg.Wait()
+	if err := n.book.Save(); err != nil {
+		n.logf("save address book: %v", err)
+	}
+	if err := n.bans.Save(); err != nil {
+		n.logf("save ban list: %v", err)
+	}
+	if n.cfg.Store != nil {
+		if err := n.cfg.Store.PutMempool(n.PendingTransactions()); err != nil {
+			n.logf("save mempool: %v", err)
+		}
+	}
+}
+
+// shutdown 通知所有 goroutine 退出并断开所有连接, 不等待退出完成
+func (n *Node) shutdown() {
+	n.stopOnce.Do(func() {
+		close(n.quit)
+		if n.listener != nil {
+			n.listener.Close()
+		}
+		for _, p := range n.Peers() {
+			p.Close()
+		}
+	})
+}
+
+// fail 节点遇到无法恢复的错误: 断开所有连接, 不再接受区块和交易. 调用者仍需调用 Stop
+func (n *Node) fail(err error) {
+	n.mu.Lock()
+	if n.failure != nil {
+		n.mu.Unlock()
+		return
+	}
+	n.failure = err
+	n.mu.Unlock()
+	n.logf("node failed: %v", err)
+	close(n.failed)
+	n.shutdown()
+}
+
+// Failed 返回节点因无法恢复的错误停止工作时关闭的 channel, 原因通过 Err 获取
+func (n *Node) Failed() <-chan struct{} {
+	return n.failed
+}
+
+// Err 返回使节点停止工作的错误, 节点正常工作时返回 nil
+func (n *Node) Err() error {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.failure
+}
+
+// loadMempool 将区块存储中保存的交易重新加入交易池, 已失效的交易被丢弃
+func (n *Node) loadMempool() error {
+	if n.cfg.Store == nil {
+		return nil
+	}
+	txs, err := n.cfg.Store.Mempool()
+	if err != nil {
+		return err
+	}
+	for _, tx := range txs {
+		if err := n.chain.AddTransaction(tx); err != nil {
+			n.logf("drop saved transaction %s: %v", tx.ID, err)
+		}
+	}
+	return nil
+}
+
+// Peers 所有已完成握手的节点
+func (n *Node) Peers() []*Peer {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	peers := make([]*Peer, 0, len(n.peers))
+	for p := range n.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// Connect 主动连接节点并完成握手
+// 地址为中继地址时, 通过中继节点连接
+func (n *Node) Connect(addr string) (*Peer, error) {
+	if n.isBanned(addr) {
+		return nil, errors.New("address is banned")
+	}
+	if relayHost, id, ok := splitRelayAddr(addr); ok {
+		conn, err := n.dialRelayed(relayHost, id)
+		if err != nil {
+			return nil, err
+		}
+		return n.setupPeer(conn, addr, nil)
+	}
+	conn, err := net.DialTimeout("tcp", addr, n.cfg.HandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return n.setupPeer(conn, addr, nil)
+}
+
+func (n *Node) acceptLoop() {
+	defer n.wg.Done()
+	for {
+		conn, err := n.listener.Accept()
+		if err != nil {
+			select {
+			case <-n.quit:
+				return
+			default:
+			}
+			n.logf("accept error: %v", err)
+			continue
+		}
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			n.handleInbound(conn)
+		}()
+	}
+}
+
+// handleInbound 处理对方主动发起的连接
+// 第一条消息为 hello 时是普通的连接, 为 relayconnect 时是请求中继到本节点服务的其他节点
+func (n *Node) handleInbound(conn net.Conn) {
+	if n.isBanned(conn.RemoteAddr().String()) {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(n.cfg.HandshakeTimeout))
+	first, err := readMessage(conn, maxHandshakeSize)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if first.Command == CmdRelayConnect {
+		conn.SetReadDeadline(time.Time{})
+		n.relayConnect(conn, first)
+		return
+	}
+	if _, err := n.setupPeer(conn, "", first); err != nil {
+		n.logf("handshake with %s failed: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// listenPort 监听的端口, 未监听时返回 0
+func (n *Node) listenPort() int {
+	if addr, ok := n.Addr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
+// localVersion 发送给 p 的 version
+func (n *Node) localVersion(p *Peer) VersionPayload {
+	return VersionPayload{
+		Version:     ProtocolVersion,
+		Network:     n.chain.Params.Name,
+		Genesis:     n.genesisHash(),
+		Name:        n.cfg.Name,
+		Nonce:       n.nonce,
+		Height:      n.Height(),
+		ListenPort:  n.listenPort(),
+		Public:      n.cfg.Public,
+		Relay:       n.cfg.Relay,
+		Timestamp:   n.cfg.Clock.Now(),
+		PruneWindow: n.cfg.PruneWindow,
+		Pruned:      n.chain.Pruned(),
+		YourAddr:    p.Addr(),
+	}
+}
+
+// handshake 在加密的连接上交换 version 和 verack
+// 发起连接的一方先发送 version, 接受连接的一方收到 version 后回复自己的 version, 然后双方交换 verack.
+func (n *Node) handshake(p *Peer) error {
+	p.conn.SetDeadline(time.Now().Add(n.cfg.HandshakeTimeout))
+	defer p.conn.SetDeadline(time.Time{})
+
+	if !p.inbound {
+		if err := p.Send(CmdVersion, n.localVersion(p)); err != nil {
+			return err
+		}
+	}
+
+	msg, err := readMessage(p.conn, maxHandshakeSize)
+	if err != nil {
+		return err
+	}
+	if msg.Command != CmdVersion {
+		return fmt.Errorf("expected %s, got %s", CmdVersion, msg.Command)
+	}
+	var version VersionPayload
+	if err := msg.Decode(&version); err != nil {
+		return err
+	}
+	if version.Version != ProtocolVersion {
+		return fmt.Errorf("unsupported protocol version %d", version.Version)
+	}
+	if version.Network != n.chain.Params.Name || version.Genesis != n.genesisHash() {
+		return fmt.Errorf("peer belongs to network %s with genesis %s", version.Network, version.Genesis)
+	}
+	if version.Nonce == n.nonce || p.ID() == n.ID() {
+		return errConnectedToSelf
+	}
+	if id, ok := n.cfg.PinnedIDs[version.Name]; ok && id != p.ID() {
+		return fmt.Errorf("identity of %s does not match the pinned node ID", version.Name)
+	}
+	p.mu.Lock()
+	p.version = version
+	p.height = version.Height
+	p.mu.Unlock()
+	n.clock.AddSample(timeSource(p), version.Timestamp)
+
+	if p.inbound {
+		if err := p.Send(CmdVersion, n.localVersion(p)); err != nil {
+			return err
+		}
+	}
+	if err := p.Send(CmdVerack, struct{}{}); err != nil {
+		return err
+	}
+	if msg, err = readMessage(p.conn, maxHandshakeSize); err != nil {
+		return err
+	}
+	if msg.Command != CmdVerack {
+		return fmt.Errorf("expected %s, got %s", CmdVerack, msg.Command)
+	}
+	return nil
+}
+
+// setupPeer 完成握手并开始处理消息, dialAddr 为空表示对方主动发起的连接
+// first 为接受连接时已经读取的 hello
+func (n *Node) setupPeer(conn net.Conn, dialAddr string, first *Message) (*Peer, error) {
+	conn.SetDeadline(time.Now().Add(n.cfg.HandshakeTimeout))
+	secure, err := secureHandshake(conn, n.cfg.NodeKey, dialAddr != "", first)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p := newPeer(n, secure, dialAddr == "")
+	p.dialAddr = dialAddr
+	p.id = NodeID(secure.RemoteKey())
+	if err := n.handshake(p); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	n.mu.Lock()
+	select {
+	case <-n.quit:
+		n.mu.Unlock()
+		conn.Close()
+		return nil, errors.New("node stopped")
+	default:
+	}
+	// 双方同时连接对方时, 只保留一个连接
+	for other := range n.peers {
+		if other.Version().Nonce == p.Version().Nonce {
+			n.mu.Unlock()
+			conn.Close()
+			return nil, errors.New("already connected")
+		}
+	}
+	n.peers[p] = struct{}{}
+	n.mu.Unlock()
+
+	n.logf("connected to %s (%s), height %d", p.Name(), p.Addr(), p.Height())
+
+	n.peerHandshaked(p)
+
+	n.wg.Add(1)
+	go n.readLoop(p)
+
+	// 对方的区块更多时, 开始同步
+	if p.Height() > n.HeaderHeight() {
+		if err := n.requestHeaders(p); err != nil {
+			n.logf("request headers from %s: %v", p.Name(), err)
+		}
+	} else {
+		n.scheduleDownloads()
+	}
+	return p, nil
+}
+
+func (n *Node) readLoop(p *Peer) {
+	defer n.wg.Done()
+	defer n.removePeer(p)
+
+	for {
+		msg, err := readMessage(p.conn, MaxMessageSize)
+		if err != nil {
+			return
+		}
+		handler, ok := n.handlers[msg.Command]
+		if !ok {
+			n.logf("unknown command %q from %s", msg.Command, p.Name())
+			continue
+		}
+		if err := handler(p, msg); err != nil {
+			n.logf("handle %s from %s: %v", msg.Command, p.Name(), err)
+			if score := scoreOf(err); score > 0 {
+				n.misbehaving(p, score, err.Error())
+			}
+		}
+	}
+}
+
+func (n *Node) removePeer(p *Peer) {
+	p.Close()
+	n.mu.Lock()
+	delete(n.peers, p)
+	n.mu.Unlock()
+	n.releaseDownloads(p)
+	n.relayPeerDisconnected(p)
+	n.logf("disconnected from %s (%s)", p.Name(), p.Addr())
+}
+
+func (n *Node) handlePing(p *Peer, msg *Message) error {
+	var ping PingPayload
+	if err := msg.Decode(&ping); err != nil {
+		return err
+	}
+	return p.Send(CmdPong, &ping)
+}
+
+func (n *Node) logf(format string, args ...interface{}) {
+	log.Printf("[%s] %s", n.cfg.Name, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,98 @@
+package p2p_test
+
+import (
+	"a10000/core"
+	"a10000/p2p"
+	"testing"
+	"time"
+)
+
+// newGenesis 创建测试用的创世区块, 创世 coinbase 属于 wallet
+func newGenesis(t *testing.T, wallet *core.Wallet) *core.Block {
+	ch := core.CreateBlockchain(core.RegtestParams)
+	if err := ch.GenesisBlock(core.NewCoinbaseTX(0, wallet.Address(), 50)); err != nil {
+		t.Fatalf("Failed to create genesis block: %v", err)
+	}
+	return ch.BlockByHeight(0)
+}
+
+// newTestChain 创建以 genesis 为创世区块的区块链
+func newTestChain(t *testing.T, genesis *core.Block) *core.Blockchain {
+	ch := core.CreateBlockchain(core.RegtestParams)
+	ch.CoinbaseMaturity = 1
+	if err := ch.ConnectGenesis(genesis); err != nil {
+		t.Fatalf("Failed to connect genesis block: %v", err)
+	}
+	return ch
+}
+
+// newTestNode 创建并启动一个监听在本地随机端口的节点
+func newTestNode(t *testing.T, name string, genesis *core.Block, peers ...string) *p2p.Node {
+	ch := newTestChain(t, genesis)
+	node := p2p.NewNode(p2p.Config{Name: name, ListenAddr: "127.0.0.1:0", Peers: peers}, ch)
+	if err := node.Start(); err != nil {
+		t.Fatalf("Failed to start node %s: %v", name, err)
+	}
+	t.Cleanup(node.Stop)
+	return node
+}
+
+// waitFor 等待条件成立, 超时则测试失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// newTestWallet 创建测试用的钱包
+func newTestWallet(t *testing.T) *core.Wallet {
+	wallet, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate wallet: %v", err)
+	}
+	return wallet
+}
+
+func TestHandshake(t *testing.T) {
+	genesis := newGenesis(t, newTestWallet(t))
+	alice := newTestNode(t, "Alice", genesis)
+	bob := newTestNode(t, "Bob", genesis, alice.Addr().String())
+	carol := newTestNode(t, "Carol", genesis, alice.Addr().String(), bob.Addr().String())
+
+	waitFor(t, "Alice to accept both peers", func() bool { return len(alice.Peers()) == 2 })
+	waitFor(t, "Carol to connect both peers", func() bool { return len(carol.Peers()) == 2 })
+	waitFor(t, "Bob to connect both peers", func() bool { return len(bob.Peers()) == 2 })
+
+	names := make(map[string]bool)
+	for _, p := range alice.Peers() {
+		names[p.Name()] = true
+		if !p.Inbound() {
+			t.Errorf("Connection from %s should be inbound", p.Name())
+		}
+		if p.Height() != 0 {
+			t.Errorf("Height of %s is incorrect, expected 0, got %d", p.Name(), p.Height())
+		}
+	}
+	if !names["Bob"] || !names["Carol"] {
+		t.Fatalf("Alice should know Bob and Carol, got %v", names)
+	}
+}
+
+func TestConnectSelf(t *testing.T) {
+	alice := newTestNode(t, "Alice", newGenesis(t, newTestWallet(t)))
+	if _, err := alice.Connect(alice.Addr().String()); err == nil {
+		t.Fatal("Connecting to self should fail")
+	}
+}
+
+func TestConnectOtherChain(t *testing.T) {
+	alice := newTestNode(t, "Alice", newGenesis(t, newTestWallet(t)))
+	bob := newTestNode(t, "Bob", newGenesis(t, newTestWallet(t)))
+	if _, err := alice.Connect(bob.Addr().String()); err == nil {
+		t.Fatal("Nodes with different genesis blocks should not connect")
+	}
+}
@@ -0,0 +1,75 @@
+package p2p
+
+import (
+	"a10000/core"
+)
+
+// NotificationType 通知的类型
+type NotificationType int
+
+const (
+	NotifyBlockConnected    NotificationType = iota // 区块已连接到区块链
+	NotifyTxAccepted                                // 交易已加入交易池
+	NotifyReorg                                     // 区块链切换到了另一个分叉
+	NotifyBlockDisconnected                         // 区块已从区块链上断开
+	NotifyTxRemoved                                 // 交易已从交易池中移除
+)
+
+// Reorg 区块链切换分叉的信息
+// 断开一个或多个区块后连接新的区块时产生, 在新区块的 NotifyBlockConnected 之前通知.
+// 新分叉之后的区块只通过 NotifyBlockConnected 通知
+type Reorg struct {
+	ForkHeight   int64         // 两条分叉共同的最后一个区块的高度
+	Disconnected []*core.Block // 从区块链上断开的区块, 按高度从高到低
+	Connected    []*core.Block // 连接到区块链上的区块, 按高度从低到高
+}
+
+// Notification 节点状态变化的通知
+type Notification struct {
+	Type   NotificationType
+	Block  *core.Block       // NotifyBlockConnected, NotifyBlockDisconnected
+	Tx     *core.Transaction // NotifyTxAccepted, NotifyTxRemoved
+	Reason core.RemoveReason // NotifyTxRemoved
+	Reorg  *Reorg            // NotifyReorg
+}
+
+// NotificationHandler 通知的处理函数
+type NotificationHandler func(Notification)
+
+// Subscribe 注册通知的处理函数
+// 必须在 Start 之前调用. 通知按照区块链状态变化的顺序同步调用, 处理函数不能阻塞, 也不能修改区块链
+func (n *Node) Subscribe(handler NotificationHandler) {
+	n.subscribers = append(n.subscribers, handler)
+}
+
+// chainEvent 将区块链事件转换为节点的通知
+func (n *Node) chainEvent(event core.Event) {
+	switch event.Type {
+	case core.EventBlockConnected:
+		if reorg := n.reorg; reorg != nil {
+			n.reorg = nil
+			reorg.Connected = append(reorg.Connected, event.Block)
+			n.notify(Notification{Type: NotifyReorg, Reorg: reorg})
+		}
+		n.notify(Notification{Type: NotifyBlockConnected, Block: event.Block})
+	case core.EventBlockDisconnected:
+		// 连续断开的区块属于同一次分叉切换, 直到连接新的区块
+		if n.reorg == nil {
+			n.reorg = &Reorg{}
+		}
+		n.reorg.Disconnected = append(n.reorg.Disconnected, event.Block)
+		n.reorg.ForkHeight = event.Block.Index - 1
+		n.notify(Notification{Type: NotifyBlockDisconnected, Block: event.Block})
+	case core.EventTxAccepted:
+		n.notify(Notification{Type: NotifyTxAccepted, Tx: event.Tx})
+	case core.EventTxRemoved:
+		n.notify(Notification{Type: NotifyTxRemoved, Tx: event.Tx, Reason: event.Reason})
+	}
+}
+
+// notify 依次调用所有处理函数, 由区块链的事件通知按顺序调用
+func (n *Node) notify(notification Notification) {
+	for _, handler := range n.subscribers {
+		handler(notification)
+	}
+}
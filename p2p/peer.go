@@ -0,0 +1,149 @@
+package p2p
+
+import (
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Peer 已完成握手的对等节点
+type Peer struct {
+	node     *Node
+	conn     net.Conn
+	inbound  bool        // 是否为对方主动发起的连接
+	dialAddr string      // 主动连接时使用的地址
+	id       string      // 对方的节点 ID, 由加密握手验证
+	known    *boundedSet // 对方已知的交易和区块, 避免重复广播
+
+	writeMu sync.Mutex
+
+	mu      sync.RWMutex
+	version VersionPayload // 对方在握手时发送的 version
+	height  int64          // 对方已知的最新区块高度
+	score   int            // 惩罚分数
+
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPeer(node *Node, conn net.Conn, inbound bool) *Peer {
+	return &Peer{
+		node:    node,
+		conn:    conn,
+		inbound: inbound,
+		known:   newBoundedSet(DefaultKnownInventorySize),
+		quit:    make(chan struct{}),
+	}
+}
+
+// ID 对方的节点 ID
+func (p *Peer) ID() string {
+	return p.id
+}
+
+// Name 对方的节点名称
+func (p *Peer) Name() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.version.Name
+}
+
+// Version 对方在握手时发送的 version
+func (p *Peer) Version() VersionPayload {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.version
+}
+
+// Height 对方已知的最新区块高度
+func (p *Peer) Height() int64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.height
+}
+
+// SetHeight 更新对方的区块高度, 仅在高度增加时更新
+func (p *Peer) SetHeight(height int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if height > p.height {
+		p.height = height
+	}
+}
+
+// CanServe 对方能否提供高度为 height 的区块
+// 修剪节点只能提供创世区块和最近的区块, 从 UTXO 快照启动的节点不能提供快照之前的区块
+func (p *Peer) CanServe(height int64) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if height == 0 {
+		return true
+	}
+	if height > p.height || height <= p.version.Pruned {
+		return false
+	}
+	return p.version.PruneWindow == 0 || height > p.height-p.version.PruneWindow
+}
+
+// Misbehavior 对方的惩罚分数
+func (p *Peer) Misbehavior() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.score
+}
+
+// addMisbehavior 增加惩罚分数, 返回增加后的分数
+func (p *Peer) addMisbehavior(score int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.score += score
+	return p.score
+}
+
+// Inbound 是否为对方主动发起的连接
+func (p *Peer) Inbound() bool {
+	return p.inbound
+}
+
+// ListenAddr 对方接受连接的地址, 对方不接受连接时返回空
+func (p *Peer) ListenAddr() string {
+	version := p.Version()
+	if version.ListenPort == 0 {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr())
+	if err != nil {
+		return ""
+	}
+	return net.JoinHostPort(host, strconv.Itoa(version.ListenPort))
+}
+
+// Addr 对方的网络地址
+func (p *Peer) Addr() string {
+	return p.conn.RemoteAddr().String()
+}
+
+// Send 向对方发送一条消息
+func (p *Peer) Send(command string, payload interface{}) error {
+	frame, err := encodeMessage(command, payload)
+	if err != nil {
+		return err
+	}
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	_, err = p.conn.Write(frame)
+	return err
+}
+
+// Close 断开连接
+func (p *Peer) Close() {
+	p.closeOnce.Do(func() {
+		close(p.quit)
+		p.conn.Close()
+	})
+}
+
+// Done 连接断开时关闭
+func (p *Peer) Done() <-chan struct{} {
+	return p.quit
+}
@@ -0,0 +1,542 @@
+package p2p
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 中继:
+//
+// 位于 NAT 之后的私有节点无法接受连接. 私有节点连接到提供中继服务(-relay)的公开节点后,
+// 发送 relayregister 注册, 中继节点回复 relayaccept, 其中包含私有节点的中继地址: 中继地址#ID.
+// 私有节点随后像公开节点一样通告自己的中继地址.
+//
+// 其他节点连接中继地址时, 先连接中继节点并发送 relayconnect, 中继节点通过与私有节点之间已有的连接,
+// 用 relayopen, relaydata 和 relayclose 转发这条连接的数据. 之后双方在转发的连接上进行正常的握手.
+// 中继节点对每个注册的私有节点限制转发带宽.
+//
+// 收到的 relaydata 先加入所属连接的写队列, 由单独的 goroutine 限速并写入连接, 处理消息的 readLoop 不会被阻塞.
+// 对方读取过慢导致队列已满时, 关闭这条转发的连接.
+
+const (
+	DefaultRelayBandwidth  = 256 * 1024 // 默认每个被中继节点的转发带宽, 单位字节/秒
+	DefaultMaxRelayClients = 32         // 默认最多为多少个私有节点提供中继
+	relayChunkSize         = 16 * 1024  // 单条 relaydata 消息最多转发的字节数
+	relayQueueSize         = 64         // 每条转发的连接最多排队等待写入的 relaydata 消息数
+)
+
+// RelayRegisterPayload relayregister 消息的内容
+type RelayRegisterPayload struct{}
+
+// RelayAcceptPayload relayaccept 消息的内容
+type RelayAcceptPayload struct {
+	Addr string `json:"addr"` // 分配的中继地址
+}
+
+// RelayConnectPayload relayconnect 消息的内容
+type RelayConnectPayload struct {
+	Target string `json:"target"` // 目标节点的中继 ID
+}
+
+// RelayStreamPayload relayopen, relaydata 和 relayclose 消息的内容
+type RelayStreamPayload struct {
+	Stream uint64 `json:"stream"`         // 转发的连接 ID
+	From   string `json:"from,omitempty"` // relayopen: 发起连接的节点地址
+	Data   []byte `json:"data,omitempty"` // relaydata: 转发的数据
+}
+
+// splitRelayAddr 解析中继地址, 格式为: 中继节点地址#ID
+func splitRelayAddr(addr string) (string, string, bool) {
+	i := strings.LastIndex(addr, "#")
+	if i <= 0 || i == len(addr)-1 {
+		return "", "", false
+	}
+	return addr[:i], addr[i+1:], true
+}
+
+// validAddr 判断地址是否为合法的 host:port 或中继地址
+func validAddr(addr string) bool {
+	if relayHost, _, ok := splitRelayAddr(addr); ok {
+		addr = relayHost
+	}
+	_, _, err := net.SplitHostPort(addr)
+	return err == nil
+}
+
+// rateLimiter 令牌桶限速器
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // 每秒产生的令牌数
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// Wait 等待直到可以发送 size 字节, cancel 关闭时停止等待并返回 false
+// 不足的令牌计为欠额, 之后的调用需要等待欠额补足. 等待时不持有锁, 多个连接可以同时等待
+func (l *rateLimiter) Wait(size int, cancel <-chan struct{}) bool {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(size)
+	wait := time.Duration(0)
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+// relayQueue 转发的连接的写队列
+type relayQueue struct {
+	writes chan []byte // 待写入的数据
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newRelayQueue() *relayQueue {
+	return &relayQueue{writes: make(chan []byte, relayQueueSize), closed: make(chan struct{})}
+}
+
+// push 将数据加入队列, 不会阻塞. 队列已满时返回 false
+func (q *relayQueue) push(data []byte) bool {
+	select {
+	case q.writes <- data:
+		return true
+	case <-q.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// run 依次将队列中的数据写入 conn, limiter 不为 nil 时先限速. 队列关闭时返回 nil, 写入失败时返回错误
+func (q *relayQueue) run(conn net.Conn, limiter *rateLimiter) error {
+	for {
+		select {
+		case data := <-q.writes:
+			if limiter != nil && !limiter.Wait(len(data), q.closed) {
+				return nil
+			}
+			if _, err := conn.Write(data); err != nil {
+				return err
+			}
+		case <-q.closed:
+			return nil
+		}
+	}
+}
+
+func (q *relayQueue) close() {
+	q.once.Do(func() { close(q.closed) })
+}
+
+// relayClient 在中继节点上注册的私有节点
+type relayClient struct {
+	id      string
+	peer    *Peer
+	limiter *rateLimiter
+}
+
+// relayedConn 中继节点上, 其他节点为连接私有节点而发起的连接
+type relayedConn struct {
+	client *relayClient
+	conn   net.Conn
+	queue  *relayQueue // 私有节点发出, 待写回发起连接的节点的数据
+}
+
+// relayStream 私有节点上, 经中继转发的连接
+type relayStream struct {
+	relay  *Peer
+	local  net.Conn    // 本节点一端, 交给 setupPeer 处理
+	remote net.Conn    // 中继一端, 读写中继转发的数据
+	queue  *relayQueue // 中继转发来, 待写入连接的数据
+	once   sync.Once
+}
+
+// relayState 中继状态
+type relayState struct {
+	mu sync.Mutex
+
+	// 中继节点
+	clients  map[string]*relayClient // 注册的私有节点. key: 中继 ID
+	conns    map[uint64]*relayedConn // 转发的连接. key: 连接 ID
+	nextConn uint64
+
+	// 私有节点
+	relay     *Peer                   // 提供中继服务的节点
+	relayAddr string                  // 本节点的中继地址
+	streams   map[uint64]*relayStream // 经中继转发的连接. key: 连接 ID
+}
+
+func newRelayState() *relayState {
+	return &relayState{
+		clients: make(map[string]*relayClient),
+		conns:   make(map[uint64]*relayedConn),
+		streams: make(map[uint64]*relayStream),
+	}
+}
+
+// RelayAddr 本节点的中继地址, 未通过中继注册时返回空
+func (n *Node) RelayAddr() string {
+	n.relay.mu.Lock()
+	defer n.relay.mu.Unlock()
+	return n.relay.relayAddr
+}
+
+// RelayClients 在本节点注册的私有节点数量
+func (n *Node) RelayClients() int {
+	n.relay.mu.Lock()
+	defer n.relay.mu.Unlock()
+	return len(n.relay.clients)
+}
+
+// maybeRegisterRelay 私有节点连接到中继节点后注册
+func (n *Node) maybeRegisterRelay(p *Peer) {
+	if n.cfg.Public || p.Inbound() || !p.Version().Relay {
+		return
+	}
+	n.relay.mu.Lock()
+	registered := n.relay.relay != nil
+	if !registered {
+		n.relay.relay = p
+	}
+	n.relay.mu.Unlock()
+	if registered {
+		return
+	}
+	if err := p.Send(CmdRelayRegister, &RelayRegisterPayload{}); err != nil {
+		n.logf("register relay on %s: %v", p.Name(), err)
+	}
+}
+
+func (n *Node) handleRelayRegister(p *Peer, msg *Message) error {
+	if !n.cfg.Relay {
+		return misbehavior(MinorMisbehavior, errors.New("relay service is disabled"))
+	}
+	addr := n.ExternalAddr()
+	if addr == "" {
+		return errors.New("external address is unknown")
+	}
+
+	n.relay.mu.Lock()
+	for _, client := range n.relay.clients {
+		if client.peer == p {
+			n.relay.mu.Unlock()
+			return p.Send(CmdRelayAccept, &RelayAcceptPayload{Addr: addr + "#" + client.id})
+		}
+	}
+	if len(n.relay.clients) >= n.cfg.MaxRelayClients {
+		n.relay.mu.Unlock()
+		return errors.New("too many relay clients")
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	client := &relayClient{id: hex.EncodeToString(id), peer: p, limiter: newRateLimiter(n.cfg.RelayBandwidth)}
+	n.relay.clients[client.id] = client
+	n.relay.mu.Unlock()
+
+	n.logf("relaying for %s as %s", p.Name(), client.id)
+	return p.Send(CmdRelayAccept, &RelayAcceptPayload{Addr: addr + "#" + client.id})
+}
+
+func (n *Node) handleRelayAccept(p *Peer, msg *Message) error {
+	var payload RelayAcceptPayload
+	if err := msg.Decode(&payload); err != nil {
+		return err
+	}
+	if !validAddr(payload.Addr) {
+		return misbehavior(MinorMisbehavior, errors.New("invalid relay address"))
+	}
+	n.relay.mu.Lock()
+	if n.relay.relay != p {
+		n.relay.mu.Unlock()
+		return misbehavior(MinorMisbehavior, errors.New("unexpected relayaccept"))
+	}
+	n.relay.relayAddr = payload.Addr
+	n.relay.mu.Unlock()
+
+	n.logf("reachable through relay %s", payload.Addr)
+	// 通告中继地址
+	for _, peer := range n.Peers() {
+		n.advertise(peer)
+	}
+	return nil
+}
+
+// dialRelayed 通过中继节点连接注册在其上的私有节点
+func (n *Node) dialRelayed(relayHost string, id string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", relayHost, n.cfg.HandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	frame, err := encodeMessage(CmdRelayConnect, &RelayConnectPayload{Target: id})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := conn.Write(frame); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// relayConnect 中继节点处理 relayconnect: 将连接转发给目标私有节点
+func (n *Node) relayConnect(conn net.Conn, msg *Message) {
+	var payload RelayConnectPayload
+	if err := msg.Decode(&payload); err != nil || !n.cfg.Relay {
+		conn.Close()
+		return
+	}
+
+	n.relay.mu.Lock()
+	client, ok := n.relay.clients[payload.Target]
+	if !ok {
+		n.relay.mu.Unlock()
+		conn.Close()
+		return
+	}
+	n.relay.nextConn++
+	id := n.relay.nextConn
+	rc := &relayedConn{client: client, conn: conn, queue: newRelayQueue()}
+	n.relay.conns[id] = rc
+	n.relay.mu.Unlock()
+
+	defer n.closeRelayedConn(id, true)
+	// 私有节点发出的数据限速后写回发起连接的节点
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		if err := rc.queue.run(conn, client.limiter); err != nil {
+			n.closeRelayedConn(id, true)
+		}
+	}()
+	if err := client.peer.Send(CmdRelayOpen, &RelayStreamPayload{Stream: id, From: conn.RemoteAddr().String()}); err != nil {
+		return
+	}
+
+	buf := make([]byte, relayChunkSize)
+	for {
+		size, err := conn.Read(buf)
+		if size > 0 {
+			if !client.limiter.Wait(size, rc.queue.closed) {
+				return
+			}
+			data := append([]byte(nil), buf[:size]...)
+			if err := client.peer.Send(CmdRelayData, &RelayStreamPayload{Stream: id, Data: data}); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// closeRelayedConn 中继节点关闭转发的连接, notify 为 true 时通知私有节点
+func (n *Node) closeRelayedConn(id uint64, notify bool) {
+	n.relay.mu.Lock()
+	rc, ok := n.relay.conns[id]
+	delete(n.relay.conns, id)
+	n.relay.mu.Unlock()
+	if !ok {
+		return
+	}
+	rc.queue.close()
+	rc.conn.Close()
+	if notify {
+		rc.client.peer.Send(CmdRelayClose, &RelayStreamPayload{Stream: id})
+	}
+}
+
+// relayPeerDisconnected 连接断开后清理中继状态
+func (n *Node) relayPeerDisconnected(p *Peer) {
+	n.relay.mu.Lock()
+	conns := make([]uint64, 0)
+	for id, client := range n.relay.clients {
+		if client.peer == p {
+			delete(n.relay.clients, id)
+		}
+	}
+	for id, rc := range n.relay.conns {
+		if rc.client.peer == p {
+			conns = append(conns, id)
+		}
+	}
+	streams := make([]*relayStream, 0)
+	if n.relay.relay == p {
+		n.relay.relay = nil
+		n.relay.relayAddr = ""
+		for id, stream := range n.relay.streams {
+			streams = append(streams, stream)
+			delete(n.relay.streams, id)
+		}
+	}
+	n.relay.mu.Unlock()
+
+	for _, id := range conns {
+		n.closeRelayedConn(id, false)
+	}
+	for _, stream := range streams {
+		stream.close()
+	}
+}
+
+// handleRelayOpen 私有节点处理 relayopen: 建立经中继转发的连接
+func (n *Node) handleRelayOpen(p *Peer, msg *Message) error {
+	var payload RelayStreamPayload
+	if err := msg.Decode(&payload); err != nil {
+		return err
+	}
+	n.relay.mu.Lock()
+	if n.relay.relay != p {
+		n.relay.mu.Unlock()
+		return misbehavior(MinorMisbehavior, errors.New("unexpected relayopen"))
+	}
+	local, remote := net.Pipe()
+	from, err := net.ResolveTCPAddr("tcp", payload.From)
+	if err != nil {
+		from = &net.TCPAddr{}
+	}
+	stream := &relayStream{
+		relay:  p,
+		local:  &streamConn{Conn: local, remoteAddr: from},
+		remote: remote,
+		queue:  newRelayQueue(),
+	}
+	n.relay.streams[payload.Stream] = stream
+	n.relay.mu.Unlock()
+
+	id := payload.Stream
+	n.wg.Add(3)
+	// 中继转发来的数据写入连接
+	go func() {
+		defer n.wg.Done()
+		if err := stream.queue.run(remote, nil); err != nil {
+			n.closeStream(id, true)
+		}
+	}()
+	// 连接写出的数据交给中继转发
+	go func() {
+		defer n.wg.Done()
+		buf := make([]byte, relayChunkSize)
+		for {
+			size, err := remote.Read(buf)
+			if size > 0 {
+				data := append([]byte(nil), buf[:size]...)
+				if err := p.Send(CmdRelayData, &RelayStreamPayload{Stream: id, Data: data}); err != nil {
+					n.closeStream(id, false)
+					return
+				}
+			}
+			if err != nil {
+				n.closeStream(id, true)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer n.wg.Done()
+		n.handleInbound(stream.local)
+	}()
+	return nil
+}
+
+func (n *Node) handleRelayData(p *Peer, msg *Message) error {
+	var payload RelayStreamPayload
+	if err := msg.Decode(&payload); err != nil {
+		return err
+	}
+	n.relay.mu.Lock()
+	stream, isStream := n.relay.streams[payload.Stream]
+	rc, isConn := n.relay.conns[payload.Stream]
+	n.relay.mu.Unlock()
+
+	switch {
+	case isConn && rc.client.peer == p:
+		// 中继节点: 私有节点发出的数据写回发起连接的节点
+		if !rc.queue.push(payload.Data) {
+			n.logf("relayed connection %d is not reading, closing it", payload.Stream)
+			n.closeRelayedConn(payload.Stream, true)
+		}
+	case isStream && stream.relay == p:
+		// 私有节点: 中继转发来的数据
+		if !stream.queue.push(payload.Data) {
+			n.logf("relayed stream %d is not reading, closing it", payload.Stream)
+			n.closeStream(payload.Stream, true)
+		}
+	}
+	return nil
+}
+
+func (n *Node) handleRelayClose(p *Peer, msg *Message) error {
+	var payload RelayStreamPayload
+	if err := msg.Decode(&payload); err != nil {
+		return err
+	}
+	n.relay.mu.Lock()
+	rc, isConn := n.relay.conns[payload.Stream]
+	n.relay.mu.Unlock()
+	if isConn && rc.client.peer == p {
+		n.closeRelayedConn(payload.Stream, false)
+		return nil
+	}
+	n.closeStream(payload.Stream, false)
+	return nil
+}
+
+// closeStream 私有节点关闭经中继转发的连接, notify 为 true 时通知中继节点
+func (n *Node) closeStream(id uint64, notify bool) {
+	n.relay.mu.Lock()
+	stream, ok := n.relay.streams[id]
+	delete(n.relay.streams, id)
+	n.relay.mu.Unlock()
+	if !ok {
+		return
+	}
+	stream.close()
+	if notify {
+		stream.relay.Send(CmdRelayClose, &RelayStreamPayload{Stream: id})
+	}
+}
+
+func (s *relayStream) close() {
+	s.once.Do(func() {
+		s.queue.close()
+		s.local.Close()
+		s.remote.Close()
+	})
+}
+
+// streamConn 经中继转发的连接, 远端地址为发起连接的节点地址
+type streamConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
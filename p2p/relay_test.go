@@ -0,0 +1,80 @@
+package p2p_test
+
+import (
+	"a10000/p2p"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRelay(t *testing.T) {
+	genesis := newGenesis(t, newTestWallet(t))
+
+	r := startNode(t, p2p.Config{Name: "R", Public: true, Relay: true}, newTestChain(t, genesis))
+
+	// 私有节点 C 连接中继节点 R 后获得中继地址
+	c := startNode(t, p2p.Config{Name: "C", Peers: []string{r.Addr().String()}}, newTestChain(t, genesis))
+	waitFor(t, "C to register on R", func() bool { return c.RelayAddr() != "" })
+	if !strings.HasPrefix(c.RelayAddr(), r.ExternalAddr()+"#") {
+		t.Fatalf("Relay address of C is incorrect: %s", c.RelayAddr())
+	}
+	if r.RelayClients() != 1 {
+		t.Fatalf("R should relay for 1 node, got %d", r.RelayClients())
+	}
+
+	// 私有节点 D 通过 R 发现 C 的中继地址, 并经 R 连接 C
+	d := startNode(t, p2p.Config{Name: "D", Seeds: []string{r.Addr().String()}, DialInterval: 50 * time.Millisecond}, newTestChain(t, genesis))
+	waitFor(t, "D to connect C through R", func() bool {
+		for _, peer := range d.Peers() {
+			if peer.Name() == "C" {
+				return true
+			}
+		}
+		return false
+	})
+	waitFor(t, "C to accept D", func() bool {
+		for _, peer := range c.Peers() {
+			if peer.Name() == "D" && peer.Inbound() {
+				return true
+			}
+		}
+		return false
+	})
+
+	// 经中继转发的连接可以正常传输区块
+	ch := newTestChain(t, genesis)
+	mineBlocks(t, ch, newTestWallet(t), 1)
+	if err := d.SubmitBlock(ch.BlockByHeight(1)); err != nil {
+		t.Fatalf("Failed to submit block: %v", err)
+	}
+	waitFor(t, "block to reach C", func() bool { return c.Height() == 1 })
+}
+
+func TestThrottledRelay(t *testing.T) {
+	genesis := newGenesis(t, newTestWallet(t))
+
+	// R 的转发带宽很低: D 的第一条握手消息可以立即转发, C 的回复(约 280 字节)需要等待 1 秒以上
+	r := startNode(t, p2p.Config{Name: "R", Public: true, Relay: true, RelayBandwidth: 200}, newTestChain(t, genesis))
+	c := startNode(t, p2p.Config{Name: "C", Peers: []string{r.Addr().String()}}, newTestChain(t, genesis))
+	waitFor(t, "C to register on R", func() bool { return c.RelayAddr() != "" })
+	startNode(t, p2p.Config{Name: "D", Peers: []string{c.RelayAddr()}}, newTestChain(t, genesis))
+	time.Sleep(200 * time.Millisecond)
+
+	// 等待转发的数据不影响 R 处理 C 的其他消息
+	blocks, err := c.Generate(1, newTestWallet(t).Address())
+	if err != nil {
+		t.Fatalf("Failed to generate block: %v", err)
+	}
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for r.Height() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("Throttled relay data should not delay other messages from C")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if r.BlockByHeight(1).Hash != blocks[0].Hash {
+		t.Fatal("R should accept the block of C")
+	}
+	// 先停止 R, 关闭转发的连接, D 不必等待握手超时
+	r.Stop()
+}
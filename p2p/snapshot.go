@@ -0,0 +1,188 @@
+package p2p
+
+import (
+	"a10000/core"
+	"a10000/store"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 快照的后台验证:
+//
+// 从 UTXO 快照启动的节点立即验证并连接快照之后的区块, 同时在后台向其他节点请求快照之前的区块,
+// 在独立的区块链上从创世区块开始重放. 到达快照高度后比较区块 Hash 和 UTXO 哈希, 并将结果记录到区块存储.
+// 重放的区块链边连接边修剪, 只保留 UTXO 和区块头.
+
+// SnapshotBatchSize 后台验证每次请求的区块数量
+const SnapshotBatchSize = 16
+
+// snapshotValidator 快照的后台验证状态
+type snapshotValidator struct {
+	base    *store.SnapshotBase
+	headers []*core.BlockHeader // 创世区块到快照高度的区块头, 下载的区块必须与之一致
+	replay  *core.Blockchain    // 从创世区块开始重放的区块链
+
+	mu       sync.Mutex
+	buffered map[int64]*core.Block // 已下载但尚未重放的区块. key: 高度
+	arrived  chan struct{}
+}
+
+// startSnapshotValidation 数据目录从尚未验证的快照启动时, 开始后台验证
+func (n *Node) startSnapshotValidation() error {
+	if n.cfg.Store == nil {
+		return nil
+	}
+	if err := n.cfg.Store.CheckSnapshot(); err != nil {
+		return err
+	}
+	base, err := n.cfg.Store.SnapshotBase()
+	if err != nil || base == nil || base.Validated {
+		return err
+	}
+	headers := n.chain.Headers(0, int(base.Height)+1)
+	if int64(len(headers)) != base.Height+1 || headers[base.Height].Hash != base.Hash {
+		return fmt.Errorf("snapshot at height %d does not match the chain", base.Height)
+	}
+
+	replay := core.CreateBlockchain(n.chain.Params)
+	replay.CoinbaseMaturity = n.chain.CoinbaseMaturity
+	replay.SchemeActivations = n.chain.SchemeActivations
+	replay.Clock = n.chain.Clock
+	if err := replay.ConnectGenesis(n.chain.BlockByHeight(0)); err != nil {
+		return err
+	}
+	n.snapshot = &snapshotValidator{
+		base:     base,
+		headers:  headers,
+		replay:   replay,
+		buffered: make(map[int64]*core.Block),
+		arrived:  make(chan struct{}, 1),
+	}
+	n.logf("validating snapshot at height %d in the background", base.Height)
+	n.wg.Add(1)
+	go n.snapshotLoop()
+	return nil
+}
+
+// addBlock 缓存后台验证需要的区块, 区块不属于快照之前的区块链或已经重放过时返回 false
+func (v *snapshotValidator) addBlock(b *core.Block) bool {
+	if b.Index <= v.replay.Height() || b.Index >= int64(len(v.headers)) || v.headers[b.Index].Hash != b.Hash {
+		return false
+	}
+	v.mu.Lock()
+	v.buffered[b.Index] = b
+	v.mu.Unlock()
+	select {
+	case v.arrived <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// connectBuffered 按高度依次重放已缓存的区块
+func (v *snapshotValidator) connectBuffered() error {
+	for {
+		next := v.replay.Height() + 1
+		v.mu.Lock()
+		b, ok := v.buffered[next]
+		delete(v.buffered, next)
+		v.mu.Unlock()
+		if !ok {
+			return nil
+		}
+		if err := v.replay.AddBlock(b); err != nil {
+			return fmt.Errorf("block %d: %v", b.Index, err)
+		}
+		if next > 1 {
+			if err := v.replay.Prune(next - 1); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// snapshotLoop 依次请求快照之前的区块并重放, 直到到达快照高度
+func (n *Node) snapshotLoop() {
+	defer n.wg.Done()
+	v := n.snapshot
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for v.replay.Height() < v.base.Height {
+		next := v.replay.Height() + 1
+		last := next + SnapshotBatchSize - 1
+		if last > v.base.Height {
+			last = v.base.Height
+		}
+		if !n.requestSnapshotBlocks(next, last) {
+			select {
+			case <-n.quit:
+				return
+			case <-ticker.C:
+			}
+			continue
+		}
+
+		// 等待这一批区块到达, 超时后重新请求
+		timeout := time.After(BlockDownloadTimeout)
+	wait:
+		for v.replay.Height() < last {
+			select {
+			case <-n.quit:
+				return
+			case <-timeout:
+				break wait
+			case <-v.arrived:
+			}
+			if err := v.connectBuffered(); err != nil {
+				n.finishSnapshot(err)
+				return
+			}
+		}
+	}
+
+	var err error
+	if tip := v.replay.Tip(); tip.Hash != v.base.Hash {
+		err = fmt.Errorf("block %d is %s, snapshot has %s", tip.Index, tip.Hash, v.base.Hash)
+	} else if hash := core.UTXOHash(tip.Index, tip.Hash, v.replay.Snapshot().UTXO); hash != v.base.UTXOHash {
+		err = fmt.Errorf("utxo hash is %s, snapshot has %s", hash, v.base.UTXOHash)
+	}
+	n.finishSnapshot(err)
+}
+
+// requestSnapshotBlocks 向一个能提供这些区块的节点请求高度 from 到 to 的区块
+func (n *Node) requestSnapshotBlocks(from, to int64) bool {
+	v := n.snapshot
+	for _, p := range n.Peers() {
+		if !p.CanServe(to) || !p.CanServe(from) {
+			continue
+		}
+		items := make([]InvItem, 0, to-from+1)
+		for i := from; i <= to; i++ {
+			items = append(items, InvItem{Type: InvBlock, Hash: v.headers[i].Hash})
+		}
+		if err := p.Send(CmdGetData, &InvPayload{Items: items}); err != nil {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// finishSnapshot 记录后台验证的结果
+// 快照无效时区块链的 UTXO 是错误的, 节点停止工作, 之后也不能再从这个数据目录启动
+func (n *Node) finishSnapshot(err error) {
+	base := *n.snapshot.base
+	if err != nil {
+		base.Error = err.Error()
+	} else {
+		base.Validated = true
+		n.logf("snapshot at height %d validated", base.Height)
+	}
+	if err := n.cfg.Store.PutSnapshotBase(&base); err != nil {
+		n.logf("save snapshot status: %v", err)
+	}
+	if err != nil {
+		n.fail(fmt.Errorf("snapshot at height %d is invalid: %v", base.Height, err))
+	}
+}
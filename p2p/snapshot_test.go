@@ -0,0 +1,83 @@
+package p2p_test
+
+import (
+	"a10000/core"
+	"a10000/p2p"
+	"a10000/store"
+	"testing"
+	"time"
+)
+
+// loadSnapshot 创建从 source 在高度 height 的快照启动的数据目录, 返回存储和加载后的区块链
+func loadSnapshot(t *testing.T, source *core.Blockchain, height int64) (*store.BlockStore, *core.Blockchain) {
+	state, err := source.StateAt(height)
+	if err != nil {
+		t.Fatalf("Failed to get state: %v", err)
+	}
+	blockStore, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	ch := core.CreateBlockchain(core.RegtestParams)
+	ch.CoinbaseMaturity = 1
+	if err := blockStore.LoadSnapshot(ch, source.BlockByHeight(0), state); err != nil {
+		t.Fatalf("Failed to load snapshot: %v", err)
+	}
+	return blockStore, ch
+}
+
+func TestSnapshotNode(t *testing.T) {
+	tom := newTestWallet(t)
+	source := newTestChain(t, newGenesis(t, tom))
+	mineBlocks(t, source, tom, 40)
+	a := startNode(t, p2p.Config{Name: "A"}, copyChain(t, source, source.Height()))
+
+	// 从快照启动的节点先同步快照之后的区块, 再在后台验证快照
+	blockStore, ch := loadSnapshot(t, source, 20)
+	s := startNode(t, p2p.Config{Name: "S", Peers: []string{a.Addr().String()}, Store: blockStore}, ch)
+	waitFor(t, "S to sync", func() bool { return s.Height() == 40 })
+	waitFor(t, "S to validate the snapshot", func() bool {
+		base, _ := blockStore.SnapshotBase()
+		return base != nil && base.Validated
+	})
+	if base, _ := blockStore.SnapshotBase(); base.Error != "" || ch.Pruned() != 20 {
+		t.Fatalf("Unexpected snapshot status %+v", base)
+	}
+
+	// 快照之前的区块不可用, 其他节点不会向它请求
+	c := startNode(t, p2p.Config{Name: "C", Peers: []string{s.Addr().String()}}, copyChain(t, source, 0))
+	waitFor(t, "C to connect", func() bool { return len(c.Peers()) == 1 })
+	if peer := c.Peers()[0]; peer.Version().Pruned != 20 || peer.CanServe(20) {
+		t.Fatal("Snapshot node should advertise its pruned height")
+	}
+
+	// UTXO 哈希与重放结果不一致的快照被标记为无效, 节点停止工作
+	blockStore, ch = loadSnapshot(t, source, 30)
+	base, _ := blockStore.SnapshotBase()
+	base.UTXOHash = core.UTXOHash(0, "", nil)
+	blockStore.PutSnapshotBase(base)
+	b := startNode(t, p2p.Config{Name: "B", Peers: []string{a.Addr().String()}, Store: blockStore}, ch)
+	select {
+	case <-b.Failed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for B to reject the snapshot")
+	}
+	if base, _ := blockStore.SnapshotBase(); base.Validated || base.Error == "" || b.Err() == nil {
+		t.Fatalf("Invalid snapshot should be recorded: %+v", base)
+	}
+	if _, err := b.Generate(1, tom.Address()); err == nil {
+		t.Fatal("Failed node should not accept blocks")
+	}
+	waitFor(t, "B to disconnect", func() bool { return len(b.Peers()) == 0 })
+
+	// 数据目录不能再启动节点
+	b.Stop()
+	restored := core.CreateBlockchain(core.RegtestParams)
+	restored.CoinbaseMaturity = 1
+	if _, err := blockStore.Load(restored); err != nil {
+		t.Fatalf("Failed to load blocks: %v", err)
+	}
+	if err := p2p.NewNode(p2p.Config{Name: "B", ListenAddr: "127.0.0.1:0", Store: blockStore}, restored).Start(); err == nil {
+		t.Fatal("Node should not start from an invalid snapshot")
+	}
+}
@@ -0,0 +1,521 @@
+package p2p
+
+import (
+	"a10000/core"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// 区块同步(先同步区块头):
+//
+// 1. 节点向高度更高的节点发送 getheaders, 携带本地区块头链的定位器(locator),
+//    对方找到双方共同的区块后, 回复其后最多 MaxHeadersPerMessage 个区块头.
+// 2. 节点验证区块头的链接关系, 难度和工作量证明, 并追加到本地的区块头链.
+// 3. 根据区块头链, 同时向多个节点请求区块, 每个节点同时最多下载 MaxBlocksInFlightPerPeer 个区块.
+// 4. 下载的区块按高度依次通过 AddBlock 连接到区块链, 超时未收到的区块会重新分配给其他节点.
+//
+// 收到与区块头链分叉的区块头时, 以工作量(core.ChainWork)更大的分叉为准: 切换区块头链后下载新分叉的区块,
+// 新分叉上工作量超过本地分叉的区块都下载后, 通过 DisconnectTip 断开本地区块直到分叉点, 再连接新分叉的区块.
+//
+// 区块头链和已连接的区块都会被保存, 节点重启后从中断处继续同步.
+
+const (
+	MaxHeadersPerMessage     = 2000             // 单条 headers 消息最多包含的区块头数量
+	MaxBlocksInFlightPerPeer = 16               // 每个节点同时下载的最大区块数
+	BlockDownloadWindow      = 1024             // 领先于已连接区块的最大下载范围
+	BlockDownloadTimeout     = 10 * time.Second // 区块下载超时时间
+)
+
+// GetHeadersPayload getheaders 消息的内容
+type GetHeadersPayload struct {
+	Locator []string `json:"locator"` // 区块头链的定位器, 从最新的区块开始, 间隔按指数增长, 最后是创世区块
+}
+
+// HeadersPayload headers 消息的内容
+type HeadersPayload struct {
+	Headers []*core.BlockHeader `json:"headers"`
+}
+
+// SyncStatus 同步进度
+type SyncStatus struct {
+	HeaderHeight int64 // 已验证的区块头高度
+	BlockHeight  int64 // 已连接的区块高度
+	InFlight     int   // 正在下载的区块数量
+	Buffered     int   // 已下载但尚未连接的区块数量
+}
+
+// Synced 区块是否已同步到区块头的高度
+func (s SyncStatus) Synced() bool {
+	return s.BlockHeight >= s.HeaderHeight
+}
+
+func (s SyncStatus) String() string {
+	percent := 100.0
+	if s.HeaderHeight > 0 {
+		percent = float64(s.BlockHeight) * 100 / float64(s.HeaderHeight)
+	}
+	return fmt.Sprintf("blocks %d/%d (%.1f%%), in flight %d, buffered %d", s.BlockHeight, s.HeaderHeight, percent, s.InFlight, s.Buffered)
+}
+
+// blockRequest 正在下载的区块
+type blockRequest struct {
+	peer *Peer
+	hash string
+	time time.Time
+}
+
+// syncState 同步状态
+type syncState struct {
+	mu       sync.Mutex
+	headers  []*core.BlockHeader           // 已验证的区块头链, headers[i].Index == i
+	inflight map[int64]*blockRequest       // 正在下载的区块. key: 高度
+	buffered map[int64]*core.Block         // 已下载但尚未连接的区块. key: 高度
+	forks    map[*Peer][]*core.BlockHeader // 节点发送的工作量尚未超过区块头链的分叉, 继续请求该分叉之后的区块头
+
+	connect sync.Mutex // 保证已缓存的区块按顺序连接, 切换分叉时不会交错
+}
+
+func newSyncState() *syncState {
+	return &syncState{
+		headers:  make([]*core.BlockHeader, 0),
+		inflight: make(map[int64]*blockRequest),
+		buffered: make(map[int64]*core.Block),
+		forks:    make(map[*Peer][]*core.BlockHeader),
+	}
+}
+
+// initHeaders 使用已连接的区块和保存的区块头初始化区块头链
+func (n *Node) initHeaders() error {
+	headers := n.chain.Headers(0, int(n.chain.Height())+1)
+
+	if n.cfg.Store != nil {
+		stored, err := n.cfg.Store.Headers()
+		if err != nil {
+			return err
+		}
+		for _, h := range stored {
+			if h.Index < int64(len(headers)) {
+				continue
+			}
+			if len(headers) == 0 || n.checkHeader(headers, h) != nil {
+				break
+			}
+			headers = append(headers, h)
+		}
+	}
+
+	n.sync.mu.Lock()
+	n.sync.headers = headers
+	n.sync.mu.Unlock()
+	return nil
+}
+
+// checkHeader 检查区块头 h 能否链接在区块头链 headers 之后
+func (n *Node) checkHeader(headers []*core.BlockHeader, h *core.BlockHeader) error {
+	ancestor := func(height int64) *core.BlockHeader {
+		if height < 0 || height >= int64(len(headers)) {
+			return nil
+		}
+		return headers[height]
+	}
+	return n.chain.CheckHeader(headers[len(headers)-1], h, ancestor)
+}
+
+// HeaderHeight 已验证的区块头高度
+func (n *Node) HeaderHeight() int64 {
+	n.sync.mu.Lock()
+	defer n.sync.mu.Unlock()
+	return int64(len(n.sync.headers)) - 1
+}
+
+// SyncProgress 同步进度
+func (n *Node) SyncProgress() SyncStatus {
+	n.sync.mu.Lock()
+	defer n.sync.mu.Unlock()
+	return SyncStatus{
+		HeaderHeight: int64(len(n.sync.headers)) - 1,
+		BlockHeight:  n.Height(),
+		InFlight:     len(n.sync.inflight),
+		Buffered:     len(n.sync.buffered),
+	}
+}
+
+// locator 区块头链 headers 的定位器
+func locator(headers []*core.BlockHeader) []string {
+	locator := make([]string, 0)
+	step := 1
+	for i := len(headers) - 1; i > 0; i -= step {
+		locator = append(locator, headers[i].Hash)
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+	if len(headers) > 0 {
+		locator = append(locator, headers[0].Hash)
+	}
+	return locator
+}
+
+// requestHeaders 向节点请求区块头, 对方之前发送的分叉尚未超过区块头链的工作量时, 请求该分叉之后的区块头
+func (n *Node) requestHeaders(p *Peer) error {
+	n.sync.mu.Lock()
+	headers := n.sync.headers
+	if fork, ok := n.sync.forks[p]; ok {
+		headers = fork
+	}
+	payload := &GetHeadersPayload{Locator: locator(headers)}
+	n.sync.mu.Unlock()
+	return p.Send(CmdGetHeaders, payload)
+}
+
+func (n *Node) handleGetHeaders(p *Peer, msg *Message) error {
+	var getHeaders GetHeadersPayload
+	if err := msg.Decode(&getHeaders); err != nil {
+		return err
+	}
+
+	start := int64(-1)
+	for _, hash := range getHeaders.Locator {
+		if h := n.chain.HeaderByHash(hash); h != nil {
+			start = h.Index + 1
+			break
+		}
+	}
+	headers := make([]*core.BlockHeader, 0)
+	if start >= 0 {
+		headers = n.chain.Headers(start, MaxHeadersPerMessage)
+	}
+
+	return p.Send(CmdHeaders, &HeadersPayload{Headers: headers})
+}
+
+func (n *Node) handleHeaders(p *Peer, msg *Message) error {
+	var payload HeadersPayload
+	if err := msg.Decode(&payload); err != nil {
+		return err
+	}
+	if len(payload.Headers) == 0 {
+		return nil
+	}
+
+	n.sync.mu.Lock()
+	// 继续对方之前发送的分叉, 或者从区块头链开始
+	headers, forked := n.sync.forks[p]
+	if !forked || payload.Headers[0].PreviousHash != headers[len(headers)-1].Hash {
+		headers, forked = n.sync.headers, false
+	}
+	added := 0
+	var err error
+	for _, h := range payload.Headers {
+		if h.Index < 0 || h.Index > int64(len(headers)) {
+			err = misbehavior(ProtocolMisbehavior, errors.New("headers do not connect"))
+			break
+		}
+		if h.Index < int64(len(headers)) {
+			if headers[h.Index].Hash == h.Hash {
+				continue
+			}
+			// 分叉: 复制分叉点之前的区块头, 不修改原来的区块头链. 已修剪的区块无法断开, 不能在此之前分叉
+			if h.Index <= n.chain.Pruned() {
+				err = fmt.Errorf("header %d forks below pruned height %d", h.Index, n.chain.Pruned())
+				break
+			}
+			headers = append(make([]*core.BlockHeader, 0, h.Index+1), headers[:h.Index]...)
+			forked = true
+		}
+		if err = n.checkHeader(headers, h); err != nil {
+			break
+		}
+		headers = append(headers, h)
+		added++
+	}
+	delete(n.sync.forks, p)
+	changed := added > 0
+	if !forked {
+		n.sync.headers = headers
+	} else if fork := forkHeight(headers, n.sync.headers); core.ChainWork(headers[fork+1:]).Cmp(core.ChainWork(n.sync.headers[fork+1:])) > 0 {
+		n.logf("switching to fork from %s at height %d, header height %d", p.Name(), fork, int64(len(headers))-1)
+		n.switchHeaders(headers, fork)
+	} else {
+		// 工作量不超过区块头链的分叉: 对方还有更多的区块头时继续请求, 否则忽略
+		if err == nil && len(payload.Headers) >= MaxHeadersPerMessage {
+			n.sync.forks[p] = headers
+		}
+		changed = false
+	}
+	headers = n.sync.headers
+	n.sync.mu.Unlock()
+
+	last := payload.Headers[len(payload.Headers)-1]
+	if err == nil {
+		p.SetHeight(last.Index)
+	}
+	if changed {
+		n.logf("received %d headers from %s, header height %d", added, p.Name(), int64(len(headers))-1)
+		if n.cfg.Store != nil {
+			if err := n.cfg.Store.PutHeaders(headers); err != nil {
+				n.logf("save headers: %v", err)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// 对方可能还有更多的区块头
+	if len(payload.Headers) >= MaxHeadersPerMessage {
+		if err := n.requestHeaders(p); err != nil {
+			return err
+		}
+	}
+	n.scheduleDownloads()
+	n.connectBuffered()
+	return nil
+}
+
+// forkHeight 区块头链 a 和 b 共同的最后一个区块的高度
+func forkHeight(a, b []*core.BlockHeader) int64 {
+	height := int64(len(a)) - 1
+	if last := int64(len(b)) - 1; last < height {
+		height = last
+	}
+	for height > 0 && a[height].Hash != b[height].Hash {
+		height--
+	}
+	return height
+}
+
+// switchHeaders 切换到工作量更大的区块头链 headers, fork 为与原区块头链共同的最后一个区块的高度
+// 分叉点之后的区块属于原区块头链, 取消这些区块的下载和缓存. 调用时需持有 n.sync.mu
+func (n *Node) switchHeaders(headers []*core.BlockHeader, fork int64) {
+	n.sync.headers = headers
+	for height, req := range n.sync.inflight {
+		if height > fork {
+			delete(n.sync.inflight, height)
+			n.requested.Remove(InvItem{Type: InvBlock, Hash: req.hash}.key())
+		}
+	}
+	for height := range n.sync.buffered {
+		if height > fork {
+			delete(n.sync.buffered, height)
+		}
+	}
+}
+
+// connectedFork 已连接的区块链与区块头链共同的最后一个区块的高度, 调用时需持有 n.sync.mu
+// 没有分叉时即已连接的区块高度
+func (n *Node) connectedFork() int64 {
+	height := n.Height()
+	if last := int64(len(n.sync.headers)) - 1; last < height {
+		height = last
+	}
+	for height > 0 && n.chain.HeaderByHash(n.sync.headers[height].Hash) == nil {
+		height--
+	}
+	return height
+}
+
+// scheduleDownloads 将尚未下载的区块分配给各个节点
+// 已连接的区块链与区块头链分叉时, 从分叉点之后开始下载
+func (n *Node) scheduleDownloads() {
+	peers := n.Peers()
+
+	n.sync.mu.Lock()
+	height := n.connectedFork()
+	load := make(map[*Peer]int, len(peers))
+	for _, req := range n.sync.inflight {
+		load[req.peer]++
+	}
+	requests := make(map[*Peer][]InvItem)
+	for i := height + 1; i < int64(len(n.sync.headers)) && i <= height+BlockDownloadWindow; i++ {
+		if _, ok := n.sync.inflight[i]; ok {
+			continue
+		}
+		if _, ok := n.sync.buffered[i]; ok {
+			continue
+		}
+		// 选择拥有该区块且负载最低的节点
+		var best *Peer
+		for _, p := range peers {
+			if !p.CanServe(i) || load[p] >= MaxBlocksInFlightPerPeer {
+				continue
+			}
+			if best == nil || load[p] < load[best] {
+				best = p
+			}
+		}
+		if best == nil {
+			break
+		}
+		hash := n.sync.headers[i].Hash
+		n.sync.inflight[i] = &blockRequest{peer: best, hash: hash, time: time.Now()}
+		load[best]++
+		requests[best] = append(requests[best], InvItem{Type: InvBlock, Hash: hash})
+	}
+	n.sync.mu.Unlock()
+
+	for p, items := range requests {
+		for _, item := range items {
+			n.requested.Add(item.key())
+		}
+		if err := p.Send(CmdGetData, &InvPayload{Items: items}); err != nil {
+			n.logf("request blocks from %s: %v", p.Name(), err)
+		}
+	}
+}
+
+// bufferBlock 缓存提前下载的区块, 区块必须与区块头链一致
+func (n *Node) bufferBlock(b *core.Block) bool {
+	n.sync.mu.Lock()
+	defer n.sync.mu.Unlock()
+	if b.Index >= int64(len(n.sync.headers)) || n.sync.headers[b.Index].Hash != b.Hash {
+		return false
+	}
+	delete(n.sync.inflight, b.Index)
+	n.sync.buffered[b.Index] = b
+	return true
+}
+
+// connectBuffered 按高度依次连接已缓存的区块, 需要时先切换到区块头链所在的分叉
+func (n *Node) connectBuffered() {
+	n.sync.connect.Lock()
+	defer n.sync.connect.Unlock()
+	connected := 0
+	defer func() {
+		if connected > 0 {
+			n.logf("sync progress: %s", n.SyncProgress())
+		}
+	}()
+	for {
+		if !n.reorganize() {
+			return
+		}
+		next := n.Height() + 1
+		n.sync.mu.Lock()
+		b, ok := n.sync.buffered[next]
+		delete(n.sync.buffered, next)
+		n.sync.mu.Unlock()
+		if !ok {
+			return
+		}
+		if err := n.acceptBlock(b); err != nil {
+			n.logf("connect block %d: %v", b.Index, err)
+			return
+		}
+		connected++
+		n.announce(InvItem{Type: InvBlock, Hash: b.Hash}, nil)
+	}
+}
+
+// reorganize 已连接的区块链与区块头链分叉时, 断开本地分叉上的区块直到分叉点
+// 新分叉上工作量超过本地分叉的区块都已下载后才断开, 避免因为下载失败停留在工作量更小的链上.
+// 返回 false 表示需要等待下载或者无法断开
+func (n *Node) reorganize() bool {
+	n.sync.mu.Lock()
+	height := n.Height()
+	fork := n.connectedFork()
+	ready := fork == height
+	if !ready {
+		local := core.ChainWork(n.chain.Headers(fork+1, int(height-fork)))
+		work := new(big.Int)
+		for i := fork + 1; i < int64(len(n.sync.headers)); i++ {
+			if _, ok := n.sync.buffered[i]; !ok {
+				break
+			}
+			if work.Add(work, n.sync.headers[i].Work()).Cmp(local) > 0 {
+				ready = true
+				break
+			}
+		}
+	}
+	n.sync.mu.Unlock()
+	if !ready || fork == height {
+		return ready
+	}
+
+	n.logf("reorganize: disconnecting %d blocks back to height %d", height-fork, fork)
+	for n.Height() > fork {
+		if err := n.disconnectTip(); err != nil {
+			n.logf("disconnect block %d: %v", n.Height(), err)
+			return false
+		}
+	}
+	return true
+}
+
+// disconnectTip 断开最新的区块, 并从区块存储中删除
+func (n *Node) disconnectTip() error {
+	if err := n.Err(); err != nil {
+		return err
+	}
+	b, err := n.chain.DisconnectTip()
+	if err != nil {
+		return err
+	}
+	if n.cfg.Store != nil {
+		if err := n.cfg.Store.RemoveBlock(b.Index); err != nil {
+			n.logf("remove block %d: %v", b.Index, err)
+		}
+	}
+	return nil
+}
+
+// blockConnected 区块连接后更新同步状态
+func (n *Node) blockConnected(b *core.Block) {
+	n.sync.mu.Lock()
+	delete(n.sync.inflight, b.Index)
+	headers := n.sync.headers
+	if b.Index < int64(len(headers)) && headers[b.Index].Hash != b.Hash {
+		// 连接的区块与区块头链不一致, 以已连接的区块为准
+		headers = headers[:b.Index]
+	}
+	if b.Index == int64(len(headers)) {
+		headers = append(headers, b.Header())
+	}
+	n.sync.headers = headers
+	syncing := int64(len(headers))-1 > b.Index
+	n.sync.mu.Unlock()
+
+	if syncing && b.Index%100 == 0 {
+		n.logf("sync progress: %s", n.SyncProgress())
+	}
+}
+
+// syncLoop 定期检查下载超时的区块, 并重新分配
+func (n *Node) syncLoop() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.quit:
+			return
+		case <-ticker.C:
+		}
+		n.sync.mu.Lock()
+		for height, req := range n.sync.inflight {
+			if time.Since(req.time) > BlockDownloadTimeout {
+				delete(n.sync.inflight, height)
+				n.requested.Remove(InvItem{Type: InvBlock, Hash: req.hash}.key())
+			}
+		}
+		n.sync.mu.Unlock()
+		n.scheduleDownloads()
+	}
+}
+
+// releaseDownloads 节点断开后, 释放分配给它的下载任务
+func (n *Node) releaseDownloads(p *Peer) {
+	n.sync.mu.Lock()
+	delete(n.sync.forks, p)
+	for height, req := range n.sync.inflight {
+		if req.peer == p {
+			delete(n.sync.inflight, height)
+			n.requested.Remove(InvItem{Type: InvBlock, Hash: req.hash}.key())
+		}
+	}
+	n.sync.mu.Unlock()
+}
@@ -0,0 +1,233 @@
+package p2p_test
+
+import (
+	"a10000/core"
+	"a10000/p2p"
+	"a10000/store"
+	"testing"
+)
+
+// mineBlocks 在 ch 上连续挖出 n 个只包含 coinbase 交易的区块
+func mineBlocks(t *testing.T, ch *core.Blockchain, wallet *core.Wallet, n int) {
+	for i := 0; i < n; i++ {
+		height := ch.Height() + 1
+		b := core.CreateBlock(height, []*core.Transaction{core.NewCoinbaseTX(height, wallet.Address(), 50)}, ch.Tip().Hash, ch.NextDifficulty())
+		if err := ch.AddBlock(b); err != nil {
+			t.Fatalf("Failed to add block %d: %v", height, err)
+		}
+	}
+}
+
+// copyChain 复制 src 中高度不超过 height 的区块到新的区块链
+func copyChain(t *testing.T, src *core.Blockchain, height int64) *core.Blockchain {
+	ch := newTestChain(t, src.BlockByHeight(0))
+	for h := int64(1); h <= height; h++ {
+		b := src.BlockByHeight(h)
+		if err := ch.AddBlock(b); err != nil {
+			t.Fatalf("Failed to copy block %d: %v", b.Index, err)
+		}
+	}
+	return ch
+}
+
+func startNode(t *testing.T, cfg p2p.Config, ch *core.Blockchain) *p2p.Node {
+	cfg.ListenAddr = "127.0.0.1:0"
+	node := p2p.NewNode(cfg, ch)
+	if err := node.Start(); err != nil {
+		t.Fatalf("Failed to start node %s: %v", cfg.Name, err)
+	}
+	t.Cleanup(node.Stop)
+	return node
+}
+
+func TestInitialBlockDownload(t *testing.T) {
+	tom := newTestWallet(t)
+	source := newTestChain(t, newGenesis(t, tom))
+	mineBlocks(t, source, tom, 60)
+
+	a := startNode(t, p2p.Config{Name: "A"}, copyChain(t, source, source.Height()))
+	b := startNode(t, p2p.Config{Name: "B"}, copyChain(t, source, source.Height()))
+
+	dir := t.TempDir()
+	blockStore, err := store.Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	c := startNode(t, p2p.Config{
+		Name:  "C",
+		Peers: []string{a.Addr().String(), b.Addr().String()},
+		Store: blockStore,
+	}, copyChain(t, source, 0))
+
+	waitFor(t, "C to sync", func() bool { return c.Height() == 60 })
+	status := c.SyncProgress()
+	if !status.Synced() || status.HeaderHeight != 60 {
+		t.Fatalf("Sync status is incorrect: %s", status)
+	}
+
+	// 区块已保存, 可以从存储中恢复
+	c.Stop()
+	restored := core.CreateBlockchain(core.RegtestParams)
+	restored.CoinbaseMaturity = 1
+	count, err := blockStore.Load(restored)
+	if err != nil {
+		t.Fatalf("Failed to load blocks: %v", err)
+	}
+	if count != 61 || restored.BlockByHeight(60).Hash != source.BlockByHeight(60).Hash {
+		t.Fatalf("Restored chain is incorrect, loaded %d blocks", count)
+	}
+}
+
+func TestResumeSync(t *testing.T) {
+	tom := newTestWallet(t)
+	source := newTestChain(t, newGenesis(t, tom))
+	mineBlocks(t, source, tom, 30)
+
+	// 模拟同步中断: 已保存全部区块头和前 10 个区块
+	blockStore, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	headers := source.Headers(0, int(source.Height())+1)
+	if err = blockStore.PutHeaders(headers); err != nil {
+		t.Fatalf("Failed to save headers: %v", err)
+	}
+	for height := int64(0); height <= 10; height++ {
+		if err = blockStore.PutBlock(source.BlockByHeight(height)); err != nil {
+			t.Fatalf("Failed to save block: %v", err)
+		}
+	}
+
+	ch := core.CreateBlockchain(core.RegtestParams)
+	ch.CoinbaseMaturity = 1
+	if _, err = blockStore.Load(ch); err != nil {
+		t.Fatalf("Failed to load blocks: %v", err)
+	}
+	c := startNode(t, p2p.Config{Name: "C", Store: blockStore}, ch)
+	if status := c.SyncProgress(); status.HeaderHeight != 30 || status.BlockHeight != 10 {
+		t.Fatalf("Sync should resume from stored state: %s", status)
+	}
+
+	a := startNode(t, p2p.Config{Name: "A"}, copyChain(t, source, source.Height()))
+	if _, err = c.Connect(a.Addr().String()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	waitFor(t, "C to finish sync", func() bool { return c.Height() == 30 })
+}
+
+func TestPrunedNode(t *testing.T) {
+	tom := newTestWallet(t)
+	source := newTestChain(t, newGenesis(t, tom))
+	mineBlocks(t, source, tom, 40)
+	a := startNode(t, p2p.Config{Name: "A"}, copyChain(t, source, source.Height()))
+
+	// 修剪节点同步时只保留最近的区块
+	blockStore, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	pruned := copyChain(t, source, 0)
+	p := startNode(t, p2p.Config{
+		Name:        "P",
+		Peers:       []string{a.Addr().String()},
+		Store:       blockStore,
+		PruneWindow: store.MinPruneWindow,
+	}, pruned)
+	// 区块连接后才修剪, 因此等待修剪完成
+	waitFor(t, "P to sync", func() bool { return p.Height() == 40 && pruned.Pruned() == 30 })
+	if pruned.Pruned() != 30 || pruned.BlockByHeight(30) != nil || pruned.BlockByHeight(31) == nil {
+		t.Fatalf("Expected blocks up to 30 to be pruned, pruned %d", pruned.Pruned())
+	}
+	if blockStore.HasBlock(30) || !blockStore.HasBlock(0) || !blockStore.HasBlock(31) {
+		t.Fatal("Pruned block files should be deleted")
+	}
+
+	// 只连接修剪节点时可以同步区块头, 但不会向它请求已修剪的区块
+	c := startNode(t, p2p.Config{Name: "C", Peers: []string{p.Addr().String()}}, copyChain(t, source, 0))
+	waitFor(t, "C to sync headers", func() bool { return c.HeaderHeight() == 40 })
+	if peers := c.Peers(); len(peers) != 1 || peers[0].Version().PruneWindow != store.MinPruneWindow || peers[0].CanServe(30) {
+		t.Fatal("Pruned peer should advertise its prune window")
+	}
+	if status := c.SyncProgress(); status.InFlight != 0 || status.BlockHeight != 0 {
+		t.Fatalf("Blocks should not be requested from the pruned peer: %s", status)
+	}
+	if _, err = c.Connect(a.Addr().String()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	waitFor(t, "C to sync from the full node", func() bool { return c.Height() == 40 })
+
+	// 修剪的数据目录从保存的状态恢复
+	p.Stop()
+	restored := core.CreateBlockchain(core.RegtestParams)
+	restored.CoinbaseMaturity = 1
+	count, err := blockStore.Load(restored)
+	if err != nil {
+		t.Fatalf("Failed to load blocks: %v", err)
+	}
+	if count != 10 || restored.Tip().Hash != source.Tip().Hash || restored.Pruned() != 30 {
+		t.Fatalf("Restored chain is incorrect, loaded %d blocks", count)
+	}
+	if err := restored.VerifyState(); err != nil {
+		t.Fatalf("Restored state should verify: %v", err)
+	}
+}
+
+func TestForkChoice(t *testing.T) {
+	tom := newTestWallet(t)
+	alice := newTestWallet(t)
+	source := newTestChain(t, newGenesis(t, tom))
+	mineBlocks(t, source, tom, 5)
+
+	// 两个节点在共同的 5 个区块之后各自挖矿, B 的分叉工作量更大
+	blockStore, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	for height := int64(0); height <= source.Height(); height++ {
+		if err = blockStore.PutBlock(source.BlockByHeight(height)); err != nil {
+			t.Fatalf("Failed to save block: %v", err)
+		}
+	}
+	a := startNode(t, p2p.Config{Name: "A", Store: blockStore}, copyChain(t, source, source.Height()))
+	b := startNode(t, p2p.Config{Name: "B"}, copyChain(t, source, source.Height()))
+	if _, err = a.Generate(3, tom.Address()); err != nil {
+		t.Fatalf("Failed to generate blocks: %v", err)
+	}
+	if _, err = b.Generate(5, alice.Address()); err != nil {
+		t.Fatalf("Failed to generate blocks: %v", err)
+	}
+
+	// 连接后 A 断开自己的 3 个区块, 切换到 B 的分叉
+	if _, err = a.Connect(b.Addr().String()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	tip := b.BlockByHeight(10)
+	waitFor(t, "A to switch to the fork of B", func() bool {
+		h := a.BlockByHeight(10)
+		return h != nil && h.Hash == tip.Hash
+	})
+	if len(a.FindUTXO(tom.Address())) != 6 {
+		t.Fatal("Coinbase outputs of the disconnected blocks should be removed")
+	}
+
+	// 之后的区块在两个节点之间正常广播
+	blocks, err := a.Generate(1, tom.Address())
+	if err != nil {
+		t.Fatalf("Failed to generate block: %v", err)
+	}
+	waitFor(t, "B to accept the new block", func() bool {
+		h := b.BlockByHeight(11)
+		return h != nil && h.Hash == blocks[0].Hash
+	})
+
+	// 区块存储与切换后的区块链一致
+	a.Stop()
+	restored := core.CreateBlockchain(core.RegtestParams)
+	restored.CoinbaseMaturity = 1
+	if _, err = blockStore.Load(restored); err != nil {
+		t.Fatalf("Failed to load blocks: %v", err)
+	}
+	if restored.Tip().Hash != blocks[0].Hash {
+		t.Fatalf("Stored blocks should follow the new fork, tip %d", restored.Height())
+	}
+}
@@ -0,0 +1,106 @@
+package p2p
+
+import (
+	"a10000/core"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 网络调整时间:
+//
+// 握手时根据对方 version 中的时间戳计算双方时钟的偏差. 节点身份可以任意生成, 因此样本按对方的
+// 网络地址记录(IPv6 按 /64 网段), 同一来源只保留最新的样本, 并且只保留最近 MaxTimeSamples 个来源的样本,
+// 时钟偏差随时间变化时旧的样本会被替换. 样本足够多时使用偏差的中位数校正本地时钟, 少数节点报告错误的时间无法影响结果.
+// 中位数超过 MaxTimeOffset 时说明本地时钟或网络存在问题, 不做校正.
+
+const (
+	MinTimeSamples = 5                // 使用偏差校正时钟所需的最少样本数
+	MaxTimeSamples = 200              // 最多记录的样本数
+	MaxTimeOffset  = 70 * time.Minute // 允许校正的最大偏差
+)
+
+// AdjustedClock 根据其他节点的时间校正后的时钟
+type AdjustedClock struct {
+	base core.Clock
+
+	mu      sync.Mutex
+	offsets map[string]int64 // key: 样本来源 => value: 对方时间减去本地时间, 单位毫秒
+	sources []string         // 样本来源, 按记录时间从早到晚排列
+	offset  int64            // 当前使用的校正值
+}
+
+// NewAdjustedClock 创建以 base 为本地时钟的网络调整时钟
+func NewAdjustedClock(base core.Clock) *AdjustedClock {
+	return &AdjustedClock{base: base, offsets: make(map[string]int64)}
+}
+
+// AddSample 记录来源 source 报告的时间戳 timestamp, 替换同一来源之前的样本.
+// 样本超过 MaxTimeSamples 个时移除最早的样本
+func (c *AdjustedClock) AddSample(source string, timestamp int64) {
+	offset := timestamp - c.base.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.offsets[source]; ok {
+		for i, s := range c.sources {
+			if s == source {
+				c.sources = append(c.sources[:i], c.sources[i+1:]...)
+				break
+			}
+		}
+	} else if len(c.sources) >= MaxTimeSamples {
+		delete(c.offsets, c.sources[0])
+		c.sources = append(c.sources[:0], c.sources[1:]...)
+	}
+	c.offsets[source] = offset
+	c.sources = append(c.sources, source)
+	if len(c.offsets) < MinTimeSamples {
+		return
+	}
+
+	offsets := make([]int64, 0, len(c.offsets))
+	for _, o := range c.offsets {
+		offsets = append(offsets, o)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	median := offsets[len(offsets)/2]
+	if median < -MaxTimeOffset.Milliseconds() || median > MaxTimeOffset.Milliseconds() {
+		median = 0
+	}
+	c.offset = median
+}
+
+// Offset 当前的校正值, 单位毫秒
+func (c *AdjustedClock) Offset() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.offset
+}
+
+// Now 校正后的当前时间戳
+func (c *AdjustedClock) Now() int64 {
+	return c.base.Now() + c.Offset()
+}
+
+// timeSource 节点时间样本的来源: 对方的 IP 地址, IPv6 地址按 /64 网段.
+// 经中继转发的节点无法确认真实地址, 按中继节点的地址计算
+func timeSource(p *Peer) string {
+	addr := p.Addr()
+	if relayHost, _, ok := splitRelayAddr(p.dialAddr); ok {
+		addr = relayHost
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip.To4() != nil {
+		return ip.String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
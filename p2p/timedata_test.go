@@ -0,0 +1,91 @@
+package p2p_test
+
+import (
+	"a10000/core"
+	"a10000/p2p"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAdjustedClock(t *testing.T) {
+	base := core.NewFakeClock(1735689600000)
+	clock := p2p.NewAdjustedClock(base)
+	minute := time.Minute.Milliseconds()
+
+	// 样本不足时不校正
+	for i := 0; i < p2p.MinTimeSamples-1; i++ {
+		clock.AddSample(fmt.Sprintf("peer%d", i), base.Now()+minute)
+	}
+	if clock.Offset() != 0 {
+		t.Fatalf("Clock should not be adjusted with too few samples, got %d", clock.Offset())
+	}
+	// 同一来源只保留最新的样本
+	clock.AddSample("peer0", base.Now()+minute)
+	if clock.Offset() != 0 {
+		t.Fatal("Repeated samples from the same source should replace the old one")
+	}
+
+	// 一个报告错误时间的节点不影响中位数
+	clock.AddSample("liar", base.Now()+time.Hour.Milliseconds())
+	if clock.Offset() != minute || clock.Now() != base.Now()+minute {
+		t.Fatalf("Clock should use the median offset, got %d", clock.Offset())
+	}
+	base.Advance(time.Second)
+	if clock.Now() != base.Now()+minute {
+		t.Fatal("Adjusted clock should follow the local clock")
+	}
+
+	// 只保留最近的样本, 时钟偏差变化后旧的样本被替换
+	for i := 0; i < 2*p2p.MaxTimeSamples; i++ {
+		offset := 2 * minute
+		if i >= p2p.MaxTimeSamples {
+			offset = 3 * minute
+		}
+		clock.AddSample(fmt.Sprintf("new%d", i), base.Now()+offset)
+	}
+	if clock.Offset() != 3*minute {
+		t.Fatalf("Old samples should be evicted, got %d", clock.Offset())
+	}
+
+	// 中位数超过上限时不校正
+	far := p2p.NewAdjustedClock(base)
+	for i := 0; i < p2p.MinTimeSamples; i++ {
+		far.AddSample(fmt.Sprintf("peer%d", i), base.Now()+2*p2p.MaxTimeOffset.Milliseconds())
+	}
+	if far.Offset() != 0 {
+		t.Fatalf("Offsets beyond the limit should be ignored, got %d", far.Offset())
+	}
+}
+
+func TestNodeClock(t *testing.T) {
+	genesis := newGenesis(t, newTestWallet(t))
+	clock := core.NewFakeClock(time.Now().UnixMilli())
+	ch := newTestChain(t, genesis)
+	a := startNode(t, p2p.Config{Name: "A", Clock: clock}, ch)
+	if ch.Clock != a.Clock() || a.Clock().Now() != clock.Now() {
+		t.Fatal("Chain should use the node clock")
+	}
+
+	// 生成的区块使用节点的时钟
+	blocks, err := a.Generate(1, "")
+	if err != nil {
+		t.Fatalf("Failed to generate block: %v", err)
+	}
+	if blocks[0].Timestamp != clock.Now() {
+		t.Fatalf("Generated block should use the node clock, got %d", blocks[0].Timestamp)
+	}
+
+	// 样本按地址记录, 同一地址的多个节点身份只计一个样本
+	for i := 0; i < p2p.MinTimeSamples; i++ {
+		skewed := core.NewFakeClock(clock.Now() + time.Minute.Milliseconds())
+		b := startNode(t, p2p.Config{Name: fmt.Sprintf("B%d", i), Clock: skewed}, newTestChain(t, genesis))
+		if _, err := b.Connect(a.Addr().String()); err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+	}
+	waitFor(t, "A to accept all peers", func() bool { return len(a.Peers()) == p2p.MinTimeSamples })
+	if offset := a.Clock().Offset(); offset != 0 {
+		t.Fatalf("Peers from one address should count as one sample, got offset %d", offset)
+	}
+}
@@ -0,0 +1,250 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// 加密传输:
+//
+// 每个节点有一个长期的 ed25519 节点密钥, 公钥即节点 ID. 连接建立后双方先以明文交换 hello,
+// 其中包含节点公钥和临时的 X25519 公钥. 双方用临时密钥协商出共享密钥, 与两条 hello 的 Hash 一起
+// 派生出两个方向的 AES-256-GCM 密钥. 之后的所有数据都加密传输: 双方首先发送各自的节点密钥
+// 对握手 Hash 的签名, 证明自己持有节点公钥对应的私钥. 临时密钥保证了前向安全.
+//
+// 经中继转发的连接在 relayconnect 之后进行同样的握手, 中继节点无法读取或篡改转发的数据.
+
+const (
+	CmdHello = "hello" // 加密握手: 交换节点公钥和临时公钥
+
+	maxSecureChunk = 64 * 1024 // 单个加密帧最多包含的明文字节数
+	handshakeLabel = "a10000 secure handshake v1"
+)
+
+// HelloPayload hello 消息的内容
+type HelloPayload struct {
+	NodeKey      string `json:"node_key"`      // 节点公钥, 十六进制
+	EphemeralKey string `json:"ephemeral_key"` // 临时 X25519 公钥, 十六进制
+}
+
+// NodeID 节点公钥对应的节点 ID
+func NodeID(key ed25519.PublicKey) string {
+	return hex.EncodeToString(key)
+}
+
+// GenerateNodeKey 生成新的节点密钥
+func GenerateNodeKey() (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	return key, err
+}
+
+// LoadOrCreateNodeKey 读取保存在 path 中的节点密钥, 文件不存在时生成并保存
+func LoadOrCreateNodeKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		seed, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid node key in %s", path)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key, err := GenerateNodeKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(key.Seed())+"\n"), 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// NodeKeyPath 数据目录 dir 中节点密钥的保存路径
+func NodeKeyPath(dir string) string {
+	return filepath.Join(dir, "nodekey")
+}
+
+// SecureConn 加密的连接
+type SecureConn struct {
+	net.Conn
+	remoteKey ed25519.PublicKey
+
+	readMu    sync.Mutex
+	recv      cipher.AEAD
+	recvNonce uint64
+	pending   []byte // 已解密但尚未读取的数据
+
+	writeMu   sync.Mutex
+	send      cipher.AEAD
+	sendNonce uint64
+}
+
+// RemoteKey 对方的节点公钥
+func (c *SecureConn) RemoteKey() ed25519.PublicKey {
+	return c.remoteKey
+}
+
+func nonceOf(counter uint64, size int) []byte {
+	nonce := make([]byte, size)
+	binary.BigEndian.PutUint64(nonce[size-8:], counter)
+	return nonce
+}
+
+func (c *SecureConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for len(c.pending) == 0 {
+		frame, err := readFrame(c.Conn, maxSecureChunk+c.recv.Overhead())
+		if err != nil {
+			return 0, err
+		}
+		plain, err := c.recv.Open(frame[:0], nonceOf(c.recvNonce, c.recv.NonceSize()), frame, nil)
+		if err != nil {
+			return 0, errors.New("message authentication failed")
+		}
+		c.recvNonce++
+		c.pending = plain
+	}
+	size := copy(b, c.pending)
+	c.pending = c.pending[size:]
+	return size, nil
+}
+
+func (c *SecureConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if len(chunk) > maxSecureChunk {
+			chunk = chunk[:maxSecureChunk]
+		}
+		sealed := c.send.Seal(nil, nonceOf(c.sendNonce, c.send.NonceSize()), chunk, nil)
+		c.sendNonce++
+		frame := make([]byte, 4+len(sealed))
+		binary.BigEndian.PutUint32(frame, uint32(len(sealed)))
+		copy(frame[4:], sealed)
+		if _, err := c.Conn.Write(frame); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// SecureHandshake 在 conn 上完成加密握手, initiator 表示是否为发起连接的一方
+func SecureHandshake(conn net.Conn, key ed25519.PrivateKey, initiator bool) (*SecureConn, error) {
+	return secureHandshake(conn, key, initiator, nil)
+}
+
+// secureHandshake 在 conn 上完成加密握手, first 为接受连接时已经读取的 hello
+func secureHandshake(conn net.Conn, key ed25519.PrivateKey, initiator bool, first *Message) (*SecureConn, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	local := HelloPayload{
+		NodeKey:      NodeID(key.Public().(ed25519.PublicKey)),
+		EphemeralKey: hex.EncodeToString(ephemeral.PublicKey().Bytes()),
+	}
+	frame, err := encodeMessage(CmdHello, &local)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(frame); err != nil {
+		return nil, err
+	}
+
+	msg := first
+	if msg == nil {
+		if msg, err = readMessage(conn, maxHandshakeSize); err != nil {
+			return nil, err
+		}
+	}
+	if msg.Command != CmdHello {
+		return nil, fmt.Errorf("expected %s, got %s", CmdHello, msg.Command)
+	}
+	var remote HelloPayload
+	if err := msg.Decode(&remote); err != nil {
+		return nil, err
+	}
+	remoteKey, err := hex.DecodeString(remote.NodeKey)
+	if err != nil || len(remoteKey) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid node key")
+	}
+	remoteEphemeral, err := hex.DecodeString(remote.EphemeralKey)
+	if err != nil {
+		return nil, errors.New("invalid ephemeral key")
+	}
+	peerEphemeral, err := ecdh.X25519().NewPublicKey(remoteEphemeral)
+	if err != nil {
+		return nil, errors.New("invalid ephemeral key")
+	}
+	shared, err := ephemeral.ECDH(peerEphemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	// 握手 Hash 以发起方的 hello 在前, 双方计算的结果相同
+	initiatorHello, responderHello := local, remote
+	if !initiator {
+		initiatorHello, responderHello = remote, local
+	}
+	transcript := sha256.Sum256([]byte(handshakeLabel + "|" + initiatorHello.NodeKey + "|" + initiatorHello.EphemeralKey +
+		"|" + responderHello.NodeKey + "|" + responderHello.EphemeralKey))
+
+	toResponder, err := deriveAEAD(shared, transcript[:], "initiator")
+	if err != nil {
+		return nil, err
+	}
+	toInitiator, err := deriveAEAD(shared, transcript[:], "responder")
+	if err != nil {
+		return nil, err
+	}
+	sc := &SecureConn{Conn: conn, remoteKey: ed25519.PublicKey(remoteKey), send: toResponder, recv: toInitiator}
+	if !initiator {
+		sc.send, sc.recv = toInitiator, toResponder
+	}
+
+	// 证明持有节点私钥: 签名握手 Hash
+	if _, err := sc.Write(ed25519.Sign(key, transcript[:])); err != nil {
+		return nil, err
+	}
+	signature := make([]byte, ed25519.SignatureSize)
+	if _, err := io.ReadFull(sc, signature); err != nil {
+		return nil, err
+	}
+	if !ed25519.Verify(sc.remoteKey, transcript[:], signature) {
+		return nil, errors.New("invalid node key signature")
+	}
+	return sc, nil
+}
+
+// deriveAEAD 从共享密钥和握手 Hash 派生一个方向的 AES-256-GCM
+func deriveAEAD(shared []byte, transcript []byte, direction string) (cipher.AEAD, error) {
+	h := sha256.New()
+	h.Write([]byte(handshakeLabel + "|" + direction + "|"))
+	h.Write(shared)
+	h.Write(transcript)
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,172 @@
+package p2p_test
+
+import (
+	"a10000/p2p"
+	"bytes"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingConn 记录写出的所有数据
+type recordingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.written.Write(b)
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func TestSecureHandshake(t *testing.T) {
+	aliceKey, _ := p2p.GenerateNodeKey()
+	bobKey, _ := p2p.GenerateNodeKey()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	left, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer left.Close()
+	right, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	defer right.Close()
+	recorder := &recordingConn{Conn: left}
+
+	var bob *p2p.SecureConn
+	var bobErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		bob, bobErr = p2p.SecureHandshake(right, bobKey, false)
+	}()
+	alice, err := p2p.SecureHandshake(recorder, aliceKey, true)
+	<-done
+	if err != nil || bobErr != nil {
+		t.Fatalf("Secure handshake failed: %v, %v", err, bobErr)
+	}
+	if !alice.RemoteKey().Equal(bobKey.Public()) || !bob.RemoteKey().Equal(aliceKey.Public()) {
+		t.Fatal("Remote keys are incorrect")
+	}
+
+	secret := []byte("the quick brown fox jumps over the lazy dog")
+	go alice.Write(secret)
+	received := make([]byte, len(secret))
+	bob.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := bob.Read(received); err != nil || !bytes.Equal(received, secret) {
+		t.Fatalf("Failed to receive data: %v %q", err, received)
+	}
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if bytes.Contains(recorder.written.Bytes(), secret) {
+		t.Fatal("Data should be encrypted on the wire")
+	}
+}
+
+func TestPinnedIdentity(t *testing.T) {
+	genesis := newGenesis(t, newTestWallet(t))
+	alice := newTestNode(t, "Alice", genesis)
+
+	// 握手后双方知道对方的节点 ID
+	bob := startNode(t, p2p.Config{Name: "Bob", PinnedIDs: map[string]string{"Alice": alice.ID()}}, newTestChain(t, genesis))
+	peer, err := bob.Connect(alice.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect node with pinned identity: %v", err)
+	}
+	if peer.ID() != alice.ID() {
+		t.Fatalf("Node ID of Alice is incorrect, expected %s, got %s", alice.ID(), peer.ID())
+	}
+
+	// 使用固定名称但持有其他密钥的节点被拒绝
+	other, _ := p2p.GenerateNodeKey()
+	impostor := startNode(t, p2p.Config{Name: "Alice", NodeKey: other}, newTestChain(t, genesis))
+	if _, err := bob.Connect(impostor.Addr().String()); err == nil {
+		t.Fatal("Node with mismatched identity should be rejected")
+	}
+}
+
+func TestNodeKeyPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nodekey")
+	key, err := p2p.LoadOrCreateNodeKey(path)
+	if err != nil {
+		t.Fatalf("Failed to create node key: %v", err)
+	}
+	loaded, err := p2p.LoadOrCreateNodeKey(path)
+	if err != nil {
+		t.Fatalf("Failed to load node key: %v", err)
+	}
+	if !key.Equal(loaded) {
+		t.Fatal("Loaded node key should equal the saved one")
+	}
+}
+
+// tcpPair 返回一对相连的 TCP 连接
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	left, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { left.Close() })
+	right, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	t.Cleanup(func() { right.Close() })
+	return left, right
+}
+
+func TestOversizedFrame(t *testing.T) {
+	aliceKey, _ := p2p.GenerateNodeKey()
+	bobKey, _ := p2p.GenerateNodeKey()
+
+	// 握手前的 hello 声明的长度超过握手消息的上限时立即失败, 不等待读取声明的数据
+	left, right := tcpPair(t)
+	right.SetDeadline(time.Now().Add(5 * time.Second))
+	left.Write([]byte{0x01, 0x00, 0x00, 0x00})
+	if _, err := p2p.SecureHandshake(right, bobKey, false); err == nil || isTimeout(err) {
+		t.Fatalf("Oversized hello should be rejected, got %v", err)
+	}
+
+	// 握手后的加密帧声明的长度超过一帧的上限时同样立即失败
+	left, right = tcpPair(t)
+	var bob *p2p.SecureConn
+	var bobErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		bob, bobErr = p2p.SecureHandshake(right, bobKey, false)
+	}()
+	_, err := p2p.SecureHandshake(left, aliceKey, true)
+	<-done
+	if err != nil || bobErr != nil {
+		t.Fatalf("Secure handshake failed: %v, %v", err, bobErr)
+	}
+	left.Write([]byte{0x01, 0x00, 0x00, 0x00})
+	bob.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := bob.Read(make([]byte, 16)); err == nil || isTimeout(err) {
+		t.Fatalf("Oversized encrypted frame should be rejected, got %v", err)
+	}
+}
+
+// isTimeout 判断 err 是否为读写超时
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
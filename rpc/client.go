@@ -0,0 +1,306 @@
+package rpc
+
+import (
+	"a10000/core"
+	"a10000/p2p"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Client JSON-RPC 客户端
+type Client struct {
+	url      string
+	user     string
+	password string
+	http     *http.Client
+	nextID   atomic.Int64
+}
+
+// NewClient 创建客户端, url 为服务地址, 例如 http://127.0.0.1:6667
+func NewClient(url string, user string, password string) *Client {
+	return &Client{url: url, user: user, password: password, http: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// NewCookieClient 使用数据目录 dir 中的 cookie 认证创建客户端
+func NewCookieClient(url string, dir string) (*Client, error) {
+	user, password, err := ReadCookie(dir)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(url, user, password), nil
+}
+
+// Call 调用方法, 结果解析到 result, result 为 nil 时忽略结果
+// 服务返回的错误类型为 *Error
+func (c *Client) Call(method string, result interface{}, params ...interface{}) error {
+	raw := make([]json.RawMessage, 0, len(params))
+	for _, param := range params {
+		data, err := json.Marshal(param)
+		if err != nil {
+			return err
+		}
+		raw = append(raw, data)
+	}
+	id := strconv.FormatInt(c.nextID.Add(1), 10)
+	body, err := json.Marshal(&Request{JSONRPC: "2.0", ID: json.RawMessage(id), Method: method, Params: raw})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.user, c.password)
+	req.Header.Set("Content-Type", "application/json")
+	httpResp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(httpResp.Body, 1024))
+		return fmt.Errorf("rpc http error %d: %s", httpResp.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	var resp Response
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+// GetBlockCount 区块链的高度
+func (c *Client) GetBlockCount() (int64, error) {
+	var height int64
+	err := c.Call("getblockcount", &height)
+	return height, err
+}
+
+// GetDifficulty 下一个区块需要的工作量证明难度
+func (c *Client) GetDifficulty() (int64, error) {
+	var difficulty int64
+	err := c.Call("getdifficulty", &difficulty)
+	return difficulty, err
+}
+
+// GetBlock 根据 Hash 查询区块
+func (c *Client) GetBlock(hash string) (*core.Block, error) {
+	var b core.Block
+	if err := c.Call("getblock", &b, hash); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// GetBlockByHeight 根据高度查询区块
+func (c *Client) GetBlockByHeight(height int64) (*core.Block, error) {
+	var b core.Block
+	if err := c.Call("getblock", &b, height); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// GetBlockHeader 根据 Hash 查询区块头, 区块体被修剪的区块也能查到
+func (c *Client) GetBlockHeader(hash string) (*core.BlockHeader, error) {
+	var h core.BlockHeader
+	if err := c.Call("getblockheader", &h, hash); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// GetBlockHeaderByHeight 根据高度查询区块头, 区块体被修剪的区块也能查到
+func (c *Client) GetBlockHeaderByHeight(height int64) (*core.BlockHeader, error) {
+	var h core.BlockHeader
+	if err := c.Call("getblockheader", &h, height); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// GetTransaction 查询区块链或交易池中的交易
+func (c *Client) GetTransaction(id string) (*TransactionInfo, error) {
+	var info TransactionInfo
+	if err := c.Call("gettransaction", &info, id); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// GetBalance 查询地址的余额
+func (c *Client) GetBalance(address string) (int64, error) {
+	var balance int64
+	err := c.Call("getbalance", &balance, address)
+	return balance, err
+}
+
+// ListUnspent 查询属于地址的未花费输出
+func (c *Client) ListUnspent(address string) ([]UnspentOutput, error) {
+	unspent := make([]UnspentOutput, 0)
+	err := c.Call("listunspent", &unspent, address)
+	return unspent, err
+}
+
+// ListSpendable 查询属于地址且在下一个区块中可以花费的输出
+func (c *Client) ListSpendable(address string) ([]UnspentOutput, error) {
+	unspent := make([]UnspentOutput, 0)
+	err := c.Call("listspendable", &unspent, address)
+	return unspent, err
+}
+
+// FindUTXO 查询属于地址的未花费输出, 结果与 core.Blockchain.FindUTXO 的格式相同, 可用于创建交易
+func (c *Client) FindUTXO(address string) (map[string]core.TxOutput, error) {
+	unspent, err := c.ListUnspent(address)
+	if err != nil {
+		return nil, err
+	}
+	return utxoMap(unspent), nil
+}
+
+// FindSpendableUTXO 查询属于地址且在下一个区块中可以花费的输出, 结果与 core.Blockchain.FindSpendableUTXO 的格式相同
+func (c *Client) FindSpendableUTXO(address string) (map[string]core.TxOutput, error) {
+	unspent, err := c.ListSpendable(address)
+	if err != nil {
+		return nil, err
+	}
+	return utxoMap(unspent), nil
+}
+
+func utxoMap(unspent []UnspentOutput) map[string]core.TxOutput {
+	utxo := make(map[string]core.TxOutput, len(unspent))
+	for _, output := range unspent {
+		utxo[fmt.Sprintf("%s:%d", output.Txid, output.Vout)] = core.TxOutput{Amount: output.Amount, PubKeyHash: output.PubKeyHash}
+	}
+	return utxo
+}
+
+// SendRawTransaction 提交交易, 返回交易 ID
+func (c *Client) SendRawTransaction(tx *core.Transaction) (string, error) {
+	var id string
+	err := c.Call("sendrawtransaction", &id, tx)
+	return id, err
+}
+
+// SubmitBlock 提交挖出的区块, 返回区块 Hash
+func (c *Client) SubmitBlock(b *core.Block) (string, error) {
+	var hash string
+	err := c.Call("submitblock", &hash, b)
+	return hash, err
+}
+
+// Generate 立即挖出 count 个区块, 区块奖励属于 address, 返回区块 Hash
+// 只能用于 regtest 等允许按需挖矿的网络
+func (c *Client) Generate(count int, address string) ([]string, error) {
+	hashes := make([]string, 0, count)
+	err := c.Call("generate", &hashes, count, address)
+	return hashes, err
+}
+
+// Ban 封禁地址 duration 时长并断开与其的连接, duration 按秒取整
+func (c *Client) Ban(addr string, duration time.Duration, reason string) error {
+	return c.Call("ban", nil, addr, int64(duration/time.Second), reason)
+}
+
+// Unban 解封地址
+func (c *Client) Unban(addr string) error {
+	return c.Call("unban", nil, addr)
+}
+
+// ListBanned 所有未过期的封禁
+func (c *Client) ListBanned() ([]p2p.BanEntry, error) {
+	entries := make([]p2p.BanEntry, 0)
+	err := c.Call("listbanned", &entries)
+	return entries, err
+}
+
+// GetMempool 交易池中的交易
+func (c *Client) GetMempool() ([]*core.Transaction, error) {
+	txs := make([]*core.Transaction, 0)
+	err := c.Call("getmempool", &txs)
+	return txs, err
+}
+
+// EventStream 订阅的事件流
+type EventStream struct {
+	body   io.ReadCloser
+	reader *bufio.Reader
+}
+
+// Subscribe 订阅主题为 topics 的事件, addresses 为关注的地址
+// topics 为空时订阅 block, tx 和 reorg, 设置了 addresses 时还订阅 address
+func (c *Client) Subscribe(topics []string, addresses []string) (*EventStream, error) {
+	query := url.Values{}
+	if len(topics) > 0 {
+		query.Set("topics", strings.Join(topics, ","))
+	}
+	for _, address := range addresses {
+		query.Add("address", address)
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(c.url, "/")+"/events?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(c.user, c.password)
+	req.Header.Set("Accept", "text/event-stream")
+	// 事件流长期保持, 不能使用带超时的 http.Client
+	httpResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		defer httpResp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(httpResp.Body, 1024))
+		return nil, fmt.Errorf("rpc http error %d: %s", httpResp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return &EventStream{body: httpResp.Body, reader: bufio.NewReader(httpResp.Body)}, nil
+}
+
+// Next 阻塞直到收到下一个事件, 服务断开订阅时返回 io.EOF
+func (s *EventStream) Next() (*Event, error) {
+	var event Event
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "":
+			if event.Topic != "" {
+				return &event, nil
+			}
+		case strings.HasPrefix(line, ":"):
+			// 心跳
+		case strings.HasPrefix(line, "id: "):
+			if event.ID, err = strconv.ParseUint(line[len("id: "):], 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid event id: %w", err)
+			}
+		case strings.HasPrefix(line, "event: "):
+			event.Topic = line[len("event: "):]
+		case strings.HasPrefix(line, "data: "):
+			event.Data = append(event.Data, line[len("data: "):]...)
+		}
+	}
+}
+
+// Close 取消订阅
+func (s *EventStream) Close() error {
+	return s.body.Close()
+}
@@ -0,0 +1,329 @@
+package rpc
+
+import (
+	"a10000/core"
+	"a10000/p2p"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 事件订阅:
+//
+// 客户端通过 GET /events 以 server-sent events 的形式订阅节点的事件, 认证方式与 JSON-RPC 相同.
+// 查询参数 topics 为逗号分隔的主题, address 为关注的地址(可以有多个):
+//
+//	block    新连接的区块, 以及从区块链上断开的区块(block_disconnected 事件)
+//	tx       新加入交易池的交易, 以及从交易池中移除的交易(tx_removed 事件)
+//	address  与关注的地址有关的交易, 包括交易池和区块中的交易
+//	reorg    区块链切换分叉
+//
+// 每个订阅者有一个容量为 SubscriberBuffer 的队列. 订阅者处理不及时导致队列已满时, 新的事件被丢弃,
+// 订阅者随后会收到 dropped 事件, 其中包含丢弃的数量, 此时应通过 JSON-RPC 重新同步状态.
+// 累计丢弃超过 MaxDroppedEvents 个事件的订阅者被断开.
+
+// 事件的主题
+const (
+	TopicBlock   = "block"
+	TopicTx      = "tx"
+	TopicAddress = "address"
+	TopicReorg   = "reorg"
+	TopicDropped = "dropped" // 订阅者的事件被丢弃, 总会发送
+)
+
+// 订阅 block 和 tx 主题时收到的其他事件
+const (
+	EventBlockDisconnected = "block_disconnected" // 区块从区块链上断开, 内容为区块
+	EventTxRemoved         = "tx_removed"         // 交易从交易池中移除, 内容为 TxRemovedEvent
+)
+
+// 交易从交易池中移除的原因
+const (
+	RemovedInBlock  = "block"    // 交易已被打包进区块
+	RemovedConflict = "conflict" // 交易与区块中的交易冲突, 或者不再满足入池条件
+)
+
+const (
+	SubscriberBuffer  = 256              // 每个订阅者的事件队列容量
+	MaxDroppedEvents  = 1024             // 累计丢弃超过该数量的事件时断开订阅者
+	KeepAliveInterval = 30 * time.Second // 没有事件时发送心跳的间隔
+)
+
+// Event 订阅的事件
+type Event struct {
+	ID    uint64          `json:"id"`    // 事件序号, 单调递增, 被丢弃的事件也占用序号
+	Topic string          `json:"topic"` // 事件的主题, 或者 block_disconnected 等属于某个主题的事件
+	Data  json.RawMessage `json:"data"`  // 事件的内容
+}
+
+// AddressEvent address 事件的内容
+type AddressEvent struct {
+	Address   string `json:"address"`
+	Txid      string `json:"txid"`
+	BlockHash string `json:"blockhash,omitempty"` // 交易所在的区块, 交易在交易池中时为空
+	Height    int64  `json:"height"`              // 交易所在的区块高度, 交易在交易池中时为 -1
+}
+
+// TxRemovedEvent tx_removed 事件的内容
+type TxRemovedEvent struct {
+	Txid   string `json:"txid"`
+	Reason string `json:"reason"` // RemovedInBlock 或 RemovedConflict
+}
+
+// ReorgEvent reorg 事件的内容
+type ReorgEvent struct {
+	ForkHeight   int64    `json:"fork_height"`  // 两条分叉共同的最后一个区块的高度
+	Disconnected []string `json:"disconnected"` // 断开的区块 Hash, 按高度从高到低
+	Connected    []string `json:"connected"`    // 连接的区块 Hash, 按高度从低到高
+}
+
+// DroppedEvent dropped 事件的内容
+type DroppedEvent struct {
+	Count int `json:"count"` // 自上次 dropped 事件以来丢弃的事件数量
+}
+
+// subscriber 一个事件订阅者
+type subscriber struct {
+	topics    map[string]bool
+	addresses map[string]bool
+	events    chan Event
+
+	mu           sync.Mutex
+	dropped      int // 尚未通知订阅者的丢弃数量
+	totalDropped int
+	gone         chan struct{} // 订阅者被断开时关闭
+}
+
+// takeDropped 返回并清零尚未通知的丢弃数量
+func (s *subscriber) takeDropped() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dropped := s.dropped
+	s.dropped = 0
+	return dropped
+}
+
+// Hub 将节点的通知分发给订阅者
+type Hub struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+	nextID      uint64
+}
+
+// NewHub 创建 Hub
+func NewHub() *Hub {
+	return &Hub{subscribers: make(map[*subscriber]struct{})}
+}
+
+func (h *Hub) subscribe(topics []string, addresses []string) *subscriber {
+	s := &subscriber{
+		topics:    make(map[string]bool),
+		addresses: make(map[string]bool),
+		events:    make(chan Event, SubscriberBuffer),
+		gone:      make(chan struct{}),
+	}
+	for _, topic := range topics {
+		s.topics[topic] = true
+	}
+	for _, address := range addresses {
+		s.addresses[address] = true
+	}
+	h.mu.Lock()
+	h.subscribers[s] = struct{}{}
+	h.mu.Unlock()
+	return s
+}
+
+func (h *Hub) unsubscribe(s *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers, s)
+}
+
+// Publish 将节点的通知转换为事件并分发, 不会阻塞
+func (h *Hub) Publish(n p2p.Notification) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch n.Type {
+	case p2p.NotifyBlockConnected:
+		h.broadcast(TopicBlock, TopicBlock, n.Block)
+		for _, tx := range n.Block.Transactions {
+			h.publishAddresses(tx, n.Block.Hash, n.Block.Index)
+		}
+	case p2p.NotifyBlockDisconnected:
+		h.broadcast(TopicBlock, EventBlockDisconnected, n.Block)
+	case p2p.NotifyTxAccepted:
+		h.broadcast(TopicTx, TopicTx, n.Tx)
+		h.publishAddresses(n.Tx, "", -1)
+	case p2p.NotifyTxRemoved:
+		reason := RemovedConflict
+		if n.Reason == core.RemovedInBlock {
+			reason = RemovedInBlock
+		}
+		h.broadcast(TopicTx, EventTxRemoved, &TxRemovedEvent{Txid: n.Tx.ID, Reason: reason})
+	case p2p.NotifyReorg:
+		reorg := ReorgEvent{ForkHeight: n.Reorg.ForkHeight, Disconnected: make([]string, 0), Connected: make([]string, 0)}
+		for _, b := range n.Reorg.Disconnected {
+			reorg.Disconnected = append(reorg.Disconnected, b.Hash)
+		}
+		for _, b := range n.Reorg.Connected {
+			reorg.Connected = append(reorg.Connected, b.Hash)
+		}
+		h.broadcast(TopicReorg, TopicReorg, &reorg)
+	}
+}
+
+// broadcast 将名称为 name 的事件发送给订阅了 topic 的订阅者, 调用时必须持有 h.mu
+func (h *Hub) broadcast(topic string, name string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	h.nextID++
+	event := Event{ID: h.nextID, Topic: name, Data: data}
+	for s := range h.subscribers {
+		if s.topics[topic] {
+			h.deliver(s, event)
+		}
+	}
+}
+
+// publishAddresses 向关注交易相关地址的订阅者发送 address 事件, 调用时必须持有 h.mu
+func (h *Hub) publishAddresses(tx *core.Transaction, blockHash string, height int64) {
+	for s := range h.subscribers {
+		if !s.topics[TopicAddress] {
+			continue
+		}
+		for address := range s.addresses {
+			if !touches(tx, address) {
+				continue
+			}
+			data, err := json.Marshal(&AddressEvent{Address: address, Txid: tx.ID, BlockHash: blockHash, Height: height})
+			if err != nil {
+				continue
+			}
+			h.nextID++
+			h.deliver(s, Event{ID: h.nextID, Topic: TopicAddress, Data: data})
+		}
+	}
+}
+
+// touches 判断交易是否花费或转入了 address 的输出
+func touches(tx *core.Transaction, address string) bool {
+	for _, input := range tx.Inputs {
+		if input.PubKey == address {
+			return true
+		}
+	}
+	for _, output := range tx.Outputs {
+		if output.IsFor(address) {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver 将事件放入订阅者的队列, 队列已满时丢弃, 调用时必须持有 h.mu
+func (h *Hub) deliver(s *subscriber, event Event) {
+	select {
+	case s.events <- event:
+		return
+	default:
+	}
+	s.mu.Lock()
+	s.dropped++
+	s.totalDropped++
+	tooSlow := s.totalDropped > MaxDroppedEvents
+	s.mu.Unlock()
+	if tooSlow {
+		delete(h.subscribers, s)
+		close(s.gone)
+	}
+}
+
+// serveEvents 处理 GET /events
+func (s *Server) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	query := r.URL.Query()
+	addresses := query["address"]
+	topics := make([]string, 0)
+	for _, topic := range strings.Split(query.Get("topics"), ",") {
+		switch topic = strings.TrimSpace(topic); topic {
+		case "":
+		case TopicBlock, TopicTx, TopicAddress, TopicReorg:
+			topics = append(topics, topic)
+		default:
+			http.Error(w, fmt.Sprintf("unknown topic %q", topic), http.StatusBadRequest)
+			return
+		}
+	}
+	if len(topics) == 0 {
+		topics = []string{TopicBlock, TopicTx, TopicReorg}
+		if len(addresses) > 0 {
+			topics = append(topics, TopicAddress)
+		}
+	}
+
+	sub := s.hub.subscribe(topics, addresses)
+	defer s.hub.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(KeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event := <-sub.events:
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+			if err := writeDropped(w, sub); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-sub.gone:
+			writeDropped(w, sub)
+			return
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeDropped 有事件被丢弃时写出 dropped 事件
+func writeDropped(w http.ResponseWriter, sub *subscriber) error {
+	dropped := sub.takeDropped()
+	if dropped == 0 {
+		return nil
+	}
+	data, err := json.Marshal(&DroppedEvent{Count: dropped})
+	if err != nil {
+		return err
+	}
+	return writeEvent(w, Event{Topic: TopicDropped, Data: data})
+}
+
+// writeEvent 以 server-sent events 的格式写出事件
+func writeEvent(w http.ResponseWriter, event Event) error {
+	if event.ID > 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", event.ID); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Topic, event.Data)
+	return err
+}
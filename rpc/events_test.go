@@ -0,0 +1,290 @@
+package rpc_test
+
+import (
+	"a10000/core"
+	"a10000/p2p"
+	"a10000/rpc"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	tom, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate tom: %v", err)
+	}
+	alice, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate alice: %v", err)
+	}
+	node, server := newTestServer(t, tom)
+	client := rpc.NewClient("http://"+server.Addr().String(), "user", "secret")
+
+	stream, err := client.Subscribe([]string{rpc.TopicBlock, rpc.TopicTx, rpc.TopicAddress}, []string{alice.Address()})
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	defer stream.Close()
+	if _, err := client.Subscribe([]string{"unknown"}, nil); err == nil {
+		t.Fatal("Unknown topic should be rejected")
+	}
+
+	genesis := node.BlockByHeight(0)
+	tx, err := tom.NewTransaction(node.FindUTXO(tom.Address()), alice.Address(), 20, "")
+	if err != nil {
+		t.Fatalf("Failed to create transaction: %v", err)
+	}
+	if err := node.SubmitTransaction(tx); err != nil {
+		t.Fatalf("Failed to submit transaction: %v", err)
+	}
+	b := core.CreateBlock(1, []*core.Transaction{core.NewCoinbaseTX(1, tom.Address(), 50), tx}, genesis.Hash, core.RegtestParams.InitialDifficulty)
+	if err := node.SubmitBlock(b); err != nil {
+		t.Fatalf("Failed to submit block: %v", err)
+	}
+
+	// 交易进入交易池和区块时各产生一个 address 事件
+	expected := []struct {
+		topic string
+		check func(data json.RawMessage) bool
+	}{
+		{rpc.TopicTx, func(data json.RawMessage) bool {
+			var got core.Transaction
+			return json.Unmarshal(data, &got) == nil && got.ID == tx.ID
+		}},
+		{rpc.TopicAddress, func(data json.RawMessage) bool {
+			var got rpc.AddressEvent
+			return json.Unmarshal(data, &got) == nil && got.Txid == tx.ID && got.Height == -1 && got.BlockHash == ""
+		}},
+		{rpc.TopicBlock, func(data json.RawMessage) bool {
+			var got core.Block
+			return json.Unmarshal(data, &got) == nil && got.Hash == b.Hash
+		}},
+		{rpc.TopicAddress, func(data json.RawMessage) bool {
+			var got rpc.AddressEvent
+			return json.Unmarshal(data, &got) == nil && got.Txid == tx.ID && got.Height == 1 && got.BlockHash == b.Hash
+		}},
+	}
+	var lastID uint64
+	for i, want := range expected {
+		event, err := stream.Next()
+		if err != nil {
+			t.Fatalf("Failed to read event %d: %v", i, err)
+		}
+		if event.Topic != want.topic || !want.check(event.Data) {
+			t.Fatalf("Event %d is incorrect: %s %s", i, event.Topic, event.Data)
+		}
+		if event.ID <= lastID {
+			t.Fatalf("Event ids should increase: %d after %d", event.ID, lastID)
+		}
+		lastID = event.ID
+	}
+}
+
+// eventBackend 只用于发送通知的 Backend
+type eventBackend struct {
+	handler p2p.NotificationHandler
+}
+
+func (b *eventBackend) Height() int64                                       { return 0 }
+func (b *eventBackend) NextDifficulty() int64                               { return 0 }
+func (b *eventBackend) BlockByHeight(int64) *core.Block                     { return nil }
+func (b *eventBackend) BlockByHash(string) *core.Block                      { return nil }
+func (b *eventBackend) HeaderByHeight(int64) *core.BlockHeader              { return nil }
+func (b *eventBackend) HeaderByHash(string) *core.BlockHeader               { return nil }
+func (b *eventBackend) Transaction(string) (*core.Transaction, *core.Block) { return nil, nil }
+func (b *eventBackend) FindUTXO(string) map[string]core.TxOutput            { return nil }
+func (b *eventBackend) FindSpendableUTXO(string) map[string]core.TxOutput   { return nil }
+func (b *eventBackend) PendingTransactions() []*core.Transaction            { return nil }
+func (b *eventBackend) SubmitTransaction(*core.Transaction) error           { return nil }
+func (b *eventBackend) SubmitBlock(*core.Block) error                       { return nil }
+func (b *eventBackend) Generate(int, string) ([]*core.Block, error)         { return nil, nil }
+func (b *eventBackend) Subscribe(handler p2p.NotificationHandler)           { b.handler = handler }
+func (b *eventBackend) Ban(string, time.Duration, string) error             { return nil }
+func (b *eventBackend) Unban(string) error                                  { return nil }
+func (b *eventBackend) BanList() *p2p.BanList                               { return nil }
+
+func TestSlowSubscriber(t *testing.T) {
+	backend := &eventBackend{}
+	server := rpc.NewServer(rpc.Config{ListenAddr: "127.0.0.1:0", User: "user", Password: "secret"}, backend)
+	if err := server.Start(); err != nil {
+		t.Fatalf("Failed to start rpc server: %v", err)
+	}
+	defer server.Stop()
+	stream, err := rpc.NewClient("http://"+server.Addr().String(), "user", "secret").Subscribe([]string{rpc.TopicTx}, nil)
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	defer stream.Close()
+
+	// 订阅者不读取时发送远超队列和连接缓冲的事件, 通知不能阻塞
+	tx := &core.Transaction{ID: strings.Repeat("a", 8*1024)}
+	for i := 0; i < 4000; i++ {
+		backend.handler(p2p.Notification{Type: p2p.NotifyTxAccepted, Tx: tx})
+	}
+
+	// 订阅者先收到排队的事件和 dropped 事件, 之后被断开
+	dropped := 0
+	for {
+		event, err := stream.Next()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read event: %v", err)
+		}
+		if event.Topic == rpc.TopicDropped {
+			var got rpc.DroppedEvent
+			if err := json.Unmarshal(event.Data, &got); err != nil || got.Count <= 0 {
+				t.Fatalf("Dropped event is incorrect: %s", event.Data)
+			}
+			dropped += got.Count
+		}
+	}
+	if dropped == 0 {
+		t.Fatal("Slow subscriber should be told about dropped events")
+	}
+}
+
+func TestReorgEvent(t *testing.T) {
+	tom, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate tom: %v", err)
+	}
+	alice, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate alice: %v", err)
+	}
+	ch := core.CreateBlockchain(core.RegtestParams)
+	ch.CoinbaseMaturity = 1
+	if err := ch.GenesisBlock(core.NewCoinbaseTX(0, tom.Address(), 50)); err != nil {
+		t.Fatalf("Failed to create genesis block: %v", err)
+	}
+	if _, err := ch.Generate(3, tom.Address()); err != nil {
+		t.Fatalf("Failed to generate blocks: %v", err)
+	}
+	node, server := startTestServer(t, ch)
+	stream, err := rpc.NewClient("http://"+server.Addr().String(), "user", "secret").Subscribe([]string{rpc.TopicReorg}, nil)
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	defer stream.Close()
+
+	// 另一个节点从创世区块开始挖出工作量更大的分叉, 连接后节点切换到该分叉
+	other := core.CreateBlockchain(core.RegtestParams)
+	other.CoinbaseMaturity = 1
+	if err := other.ConnectGenesis(ch.BlockByHeight(0)); err != nil {
+		t.Fatalf("Failed to connect genesis block: %v", err)
+	}
+	fork, err := other.Generate(4, alice.Address())
+	if err != nil {
+		t.Fatalf("Failed to generate fork: %v", err)
+	}
+	peer := p2p.NewNode(p2p.Config{Name: "Fork", ListenAddr: "127.0.0.1:0"}, other)
+	if err := peer.Start(); err != nil {
+		t.Fatalf("Failed to start node: %v", err)
+	}
+	defer peer.Stop()
+	disconnected := []string{ch.BlockByHeight(3).Hash, ch.BlockByHeight(2).Hash, ch.BlockByHeight(1).Hash}
+	if _, err := node.Connect(peer.Addr().String()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	event, err := stream.Next()
+	if err != nil || event.Topic != rpc.TopicReorg {
+		t.Fatalf("Expected a reorg event: %v", err)
+	}
+	var got rpc.ReorgEvent
+	if err := json.Unmarshal(event.Data, &got); err != nil {
+		t.Fatalf("Failed to decode reorg event: %v", err)
+	}
+	if got.ForkHeight != 0 || !reflect.DeepEqual(got.Disconnected, disconnected) || !reflect.DeepEqual(got.Connected, []string{fork[0].Hash}) {
+		t.Fatalf("Reorg event is incorrect: %s", event.Data)
+	}
+}
+
+func TestRemovedEvents(t *testing.T) {
+	tom, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate tom: %v", err)
+	}
+	alice, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate alice: %v", err)
+	}
+	ch := core.CreateBlockchain(core.RegtestParams)
+	ch.CoinbaseMaturity = 1
+	if err := ch.GenesisBlock(core.NewCoinbaseTX(0, tom.Address(), 50)); err != nil {
+		t.Fatalf("Failed to create genesis block: %v", err)
+	}
+	node, server := startTestServer(t, ch)
+	stream, err := rpc.NewClient("http://"+server.Addr().String(), "user", "secret").Subscribe([]string{rpc.TopicBlock, rpc.TopicTx}, nil)
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	defer stream.Close()
+
+	// 交易池中的交易与区块中花费同一个输出的交易冲突
+	utxo := ch.FindSpendableUTXO(tom.Address())
+	pending, _ := tom.NewTransaction(utxo, alice.Address(), 20, "")
+	if err := node.SubmitTransaction(pending); err != nil {
+		t.Fatalf("Failed to submit transaction: %v", err)
+	}
+	mined, _ := tom.NewTransaction(utxo, alice.Address(), 30, "")
+	b := core.CreateBlock(1, []*core.Transaction{core.NewCoinbaseTX(1, tom.Address(), 50), mined}, ch.Tip().Hash, ch.NextDifficulty())
+	if err := node.SubmitBlock(b); err != nil {
+		t.Fatalf("Failed to submit block: %v", err)
+	}
+	// 断开的区块中的交易回到交易池, 再次打包后移除
+	if _, err := ch.DisconnectTip(); err != nil {
+		t.Fatalf("Failed to disconnect block: %v", err)
+	}
+	if _, err := node.Generate(1, tom.Address()); err != nil {
+		t.Fatalf("Failed to generate block: %v", err)
+	}
+
+	removed := func(txid, reason string) func(data json.RawMessage) bool {
+		return func(data json.RawMessage) bool {
+			var got rpc.TxRemovedEvent
+			return json.Unmarshal(data, &got) == nil && got.Txid == txid && got.Reason == reason
+		}
+	}
+	block := func(data json.RawMessage) bool {
+		var got core.Block
+		return json.Unmarshal(data, &got) == nil && got.Hash == b.Hash
+	}
+	expected := []struct {
+		topic string
+		check func(data json.RawMessage) bool
+	}{
+		{rpc.TopicTx, func(data json.RawMessage) bool {
+			var got core.Transaction
+			return json.Unmarshal(data, &got) == nil && got.ID == pending.ID
+		}},
+		{rpc.TopicBlock, block},
+		{rpc.EventTxRemoved, removed(pending.ID, rpc.RemovedConflict)},
+		{rpc.EventBlockDisconnected, block},
+		{rpc.TopicTx, func(data json.RawMessage) bool {
+			var got core.Transaction
+			return json.Unmarshal(data, &got) == nil && got.ID == mined.ID
+		}},
+		{rpc.TopicBlock, func(data json.RawMessage) bool {
+			var got core.Block
+			return json.Unmarshal(data, &got) == nil && len(got.Transactions) == 2 && got.Transactions[1].ID == mined.ID
+		}},
+		{rpc.EventTxRemoved, removed(mined.ID, rpc.RemovedInBlock)},
+	}
+	for i, want := range expected {
+		event, err := stream.Next()
+		if err != nil {
+			t.Fatalf("Failed to read event %d: %v", i, err)
+		}
+		if event.Topic != want.topic || !want.check(event.Data) {
+			t.Fatalf("Event %d is incorrect: %s %s", i, event.Topic, event.Data)
+		}
+	}
+}
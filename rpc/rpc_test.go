@@ -0,0 +1,209 @@
+package rpc_test
+
+import (
+	"a10000/core"
+	"a10000/p2p"
+	"a10000/rpc"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestServer 启动以 tom 的创世区块为起点的节点和 RPC 服务
+func newTestServer(t *testing.T, tom *core.Wallet) (*p2p.Node, *rpc.Server) {
+	ch := core.CreateBlockchain(core.RegtestParams)
+	ch.CoinbaseMaturity = 1
+	if err := ch.GenesisBlock(core.NewCoinbaseTX(0, tom.Address(), 50)); err != nil {
+		t.Fatalf("Failed to create genesis block: %v", err)
+	}
+	return startTestServer(t, ch)
+}
+
+// startTestServer 为区块链 ch 启动节点和 JSON-RPC 服务
+func startTestServer(t *testing.T, ch *core.Blockchain) (*p2p.Node, *rpc.Server) {
+	node := p2p.NewNode(p2p.Config{Name: "RPC"}, ch)
+	if err := node.Start(); err != nil {
+		t.Fatalf("Failed to start node: %v", err)
+	}
+	t.Cleanup(node.Stop)
+
+	server := rpc.NewServer(rpc.Config{ListenAddr: "127.0.0.1:0", User: "user", Password: "secret"}, node)
+	if err := server.Start(); err != nil {
+		t.Fatalf("Failed to start rpc server: %v", err)
+	}
+	t.Cleanup(server.Stop)
+	return node, server
+}
+
+func TestRPC(t *testing.T) {
+	tom, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate tom: %v", err)
+	}
+	alice, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate alice: %v", err)
+	}
+	_, server := newTestServer(t, tom)
+	client := rpc.NewClient("http://"+server.Addr().String(), "user", "secret")
+
+	height, err := client.GetBlockCount()
+	if err != nil || height != 0 {
+		t.Fatalf("getblockcount is incorrect: %d %v", height, err)
+	}
+	if difficulty, err := client.GetDifficulty(); err != nil || difficulty != core.RegtestParams.InitialDifficulty {
+		t.Fatalf("getdifficulty is incorrect: %d %v", difficulty, err)
+	}
+	genesis, err := client.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatalf("Failed to get block by height: %v", err)
+	}
+	if b, err := client.GetBlock(genesis.Hash); err != nil || b.Hash != genesis.Hash {
+		t.Fatalf("Failed to get block by hash: %v", err)
+	}
+	if h, err := client.GetBlockHeaderByHeight(0); err != nil || h.Hash != genesis.Hash {
+		t.Fatalf("Failed to get block header by height: %v", err)
+	}
+	if h, err := client.GetBlockHeader(genesis.Hash); err != nil || h.Index != 0 {
+		t.Fatalf("Failed to get block header by hash: %v", err)
+	}
+	if _, err := client.GetBlockByHeight(1); !isCode(err, rpc.CodeNotFound) {
+		t.Fatalf("Missing block should return not found, got %v", err)
+	}
+
+	// 通过 RPC 查询未花费输出, 创建并提交交易
+	if balance, err := client.GetBalance(tom.Address()); err != nil || balance != 50 {
+		t.Fatalf("getbalance is incorrect: %d %v", balance, err)
+	}
+	utxo, err := client.FindUTXO(tom.Address())
+	if err != nil || len(utxo) != 1 {
+		t.Fatalf("listunspent is incorrect: %v %v", utxo, err)
+	}
+	tx, err := tom.NewTransaction(utxo, alice.Address(), 20, "")
+	if err != nil {
+		t.Fatalf("Failed to create transaction: %v", err)
+	}
+	id, err := client.SendRawTransaction(tx)
+	if err != nil || id != tx.ID {
+		t.Fatalf("sendrawtransaction failed: %s %v", id, err)
+	}
+	if _, err := client.SendRawTransaction(tx); !isCode(err, rpc.CodeRejected) {
+		t.Fatalf("Double spend should be rejected, got %v", err)
+	}
+	if spendable, err := client.FindSpendableUTXO(tom.Address()); err != nil || len(spendable) != 0 {
+		t.Fatalf("Output spent by pending transaction should not be spendable: %v %v", spendable, err)
+	}
+	mempool, err := client.GetMempool()
+	if err != nil || len(mempool) != 1 || mempool[0].ID != tx.ID {
+		t.Fatalf("getmempool is incorrect: %v %v", mempool, err)
+	}
+	info, err := client.GetTransaction(tx.ID)
+	if err != nil || info.Height != -1 || info.Confirmations != 0 {
+		t.Fatalf("Pending transaction info is incorrect: %+v %v", info, err)
+	}
+
+	// 交易入链后可以查询到所在的区块
+	b := core.CreateBlock(1, []*core.Transaction{core.NewCoinbaseTX(1, alice.Address(), 50), tx}, genesis.Hash, core.RegtestParams.InitialDifficulty)
+	if hash, err := client.SubmitBlock(b); err != nil || hash != b.Hash {
+		t.Fatalf("submitblock failed: %s %v", hash, err)
+	}
+	if _, err := client.SubmitBlock(b); !isCode(err, rpc.CodeRejected) {
+		t.Fatalf("Duplicate block should be rejected, got %v", err)
+	}
+	info, err = client.GetTransaction(tx.ID)
+	if err != nil || info.BlockHash != b.Hash || info.Confirmations != 1 {
+		t.Fatalf("Confirmed transaction info is incorrect: %+v %v", info, err)
+	}
+	if balance, err := client.GetBalance(alice.Address()); err != nil || balance != 70 {
+		t.Fatalf("getbalance is incorrect: %d %v", balance, err)
+	}
+
+	// regtest 可以立即挖出区块
+	hashes, err := client.Generate(3, alice.Address())
+	if err != nil || len(hashes) != 3 {
+		t.Fatalf("generate failed: %v %v", hashes, err)
+	}
+	if height, err := client.GetBlockCount(); err != nil || height != 4 {
+		t.Fatalf("Height after generate is incorrect: %d %v", height, err)
+	}
+	if balance, err := client.GetBalance(alice.Address()); err != nil || balance != 220 {
+		t.Fatalf("Generated rewards are incorrect: %d %v", balance, err)
+	}
+}
+
+func TestRPCErrors(t *testing.T) {
+	tom, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate tom: %v", err)
+	}
+	_, server := newTestServer(t, tom)
+	url := "http://" + server.Addr().String()
+
+	if _, err := rpc.NewClient(url, "user", "wrong").GetBlockCount(); err == nil {
+		t.Fatal("Request with wrong password should fail")
+	}
+	client := rpc.NewClient(url, "user", "secret")
+	if err := client.Call("unknown", nil); !isCode(err, rpc.CodeMethodNotFound) {
+		t.Fatalf("Unknown method should return method not found, got %v", err)
+	}
+	if err := client.Call("getbalance", nil); !isCode(err, rpc.CodeInvalidParams) {
+		t.Fatalf("Missing params should return invalid params, got %v", err)
+	}
+}
+
+func TestBanRPC(t *testing.T) {
+	tom, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate tom: %v", err)
+	}
+	node, server := newTestServer(t, tom)
+	client := rpc.NewClient("http://"+server.Addr().String(), "user", "secret")
+
+	if err := client.Ban("10.0.0.1:6666", time.Hour, "spam"); err != nil {
+		t.Fatalf("Failed to ban address: %v", err)
+	}
+	if !node.BanList().IsBanned(p2p.BanKey("10.0.0.1")) {
+		t.Fatal("Node should ban the address")
+	}
+	entries, err := client.ListBanned()
+	if err != nil || len(entries) != 1 || entries[0].Addr != "10.0.0.1" || entries[0].Reason != "spam" {
+		t.Fatalf("listbanned is incorrect: %v %v", entries, err)
+	}
+	if err := client.Ban("10.0.0.2", 0, "spam"); !isCode(err, rpc.CodeInvalidParams) {
+		t.Fatalf("Ban without duration should return invalid params, got %v", err)
+	}
+	if err := client.Unban("10.0.0.1"); err != nil {
+		t.Fatalf("Failed to unban address: %v", err)
+	}
+	if err := client.Unban("10.0.0.1"); !isCode(err, rpc.CodeNotFound) {
+		t.Fatalf("Unbanning twice should return not found, got %v", err)
+	}
+	if entries, err := client.ListBanned(); err != nil || len(entries) != 0 {
+		t.Fatalf("Ban list should be empty: %v %v", entries, err)
+	}
+}
+
+func TestCookieAuth(t *testing.T) {
+	dir := t.TempDir()
+	server := rpc.NewServer(rpc.Config{ListenAddr: "127.0.0.1:0", DataDir: dir}, nil)
+	if err := server.Start(); err != nil {
+		t.Fatalf("Failed to start rpc server: %v", err)
+	}
+	client, err := rpc.NewCookieClient("http://"+server.Addr().String(), dir)
+	if err != nil {
+		t.Fatalf("Failed to read cookie: %v", err)
+	}
+	if err := client.Call("unknown", nil); !isCode(err, rpc.CodeMethodNotFound) {
+		t.Fatalf("Cookie authentication failed: %v", err)
+	}
+	server.Stop()
+	if _, _, err := rpc.ReadCookie(dir); err == nil {
+		t.Fatal("Cookie should be removed after stop")
+	}
+}
+
+// isCode 判断 err 是否为错误码为 code 的 RPC 错误
+func isCode(err error, code int) bool {
+	var rpcErr *rpc.Error
+	return errors.As(err, &rpcErr) && rpcErr.Code == code
+}
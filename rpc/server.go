@@ -0,0 +1,529 @@
+package rpc
+
+import (
+	"a10000/core"
+	"a10000/p2p"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JSON-RPC:
+//
+// 服务通过 HTTP POST 提供 JSON-RPC 2.0 接口, 请求需要使用 HTTP Basic 认证.
+// 未配置密码时, 启动时生成随机密码并写入数据目录中的 cookie 文件, 同一台机器上的客户端读取该文件认证.
+
+// 错误码
+const (
+	CodeParseError     = -32700 // 请求不是合法的 JSON
+	CodeInvalidRequest = -32600 // 请求格式错误
+	CodeMethodNotFound = -32601 // 方法不存在
+	CodeInvalidParams  = -32602 // 参数错误
+	CodeInternalError  = -32603 // 内部错误
+	CodeNotFound       = -5     // 查询的区块或交易不存在
+	CodeRejected       = -26    // 交易或区块验证失败
+)
+
+// MaxRequestSize 请求的最大字节数
+const MaxRequestSize = 4 * 1024 * 1024
+
+// CookieUser 使用 cookie 认证时的用户名
+const CookieUser = "__cookie__"
+
+// Backend RPC 服务查询和提交数据的节点
+type Backend interface {
+	Height() int64
+	NextDifficulty() int64
+	BlockByHeight(height int64) *core.Block
+	BlockByHash(hash string) *core.Block
+	HeaderByHeight(height int64) *core.BlockHeader
+	HeaderByHash(hash string) *core.BlockHeader
+	Transaction(id string) (*core.Transaction, *core.Block)
+	FindUTXO(address string) map[string]core.TxOutput
+	FindSpendableUTXO(address string) map[string]core.TxOutput
+	PendingTransactions() []*core.Transaction
+	SubmitTransaction(tx *core.Transaction) error
+	SubmitBlock(b *core.Block) error
+	Generate(count int, address string) ([]*core.Block, error)
+	Subscribe(handler p2p.NotificationHandler)
+	Ban(addr string, duration time.Duration, reason string) error
+	Unban(addr string) error
+	BanList() *p2p.BanList
+}
+
+// Request JSON-RPC 请求
+type Request struct {
+	JSONRPC string            `json:"jsonrpc"`
+	ID      json.RawMessage   `json:"id"`
+	Method  string            `json:"method"`
+	Params  []json.RawMessage `json:"params"`
+}
+
+// Response JSON-RPC 响应
+type Response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+// Error JSON-RPC 错误
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// TransactionInfo gettransaction 的结果
+type TransactionInfo struct {
+	Transaction   *core.Transaction `json:"transaction"`
+	BlockHash     string            `json:"blockhash,omitempty"` // 包含交易的区块, 交易在交易池中时为空
+	Height        int64             `json:"height"`              // 包含交易的区块高度, 交易在交易池中时为 -1
+	Confirmations int64             `json:"confirmations"`       // 确认数, 交易在交易池中时为 0
+}
+
+// UnspentOutput listunspent 的结果
+type UnspentOutput struct {
+	Txid       string `json:"txid"`
+	Vout       int    `json:"vout"`
+	Amount     int64  `json:"value"`
+	PubKeyHash string `json:"pubkeyhash"`
+}
+
+// Config RPC 服务的配置
+type Config struct {
+	ListenAddr string // 监听地址
+	User       string // 认证的用户名
+	Password   string // 认证的密码, 为空时使用 cookie 认证
+	DataDir    string // 保存 cookie 文件的数据目录, 使用 cookie 认证时必须设置
+}
+
+// handlerFunc 方法的处理函数
+type handlerFunc func(params []json.RawMessage) (interface{}, error)
+
+// Server JSON-RPC 服务
+type Server struct {
+	cfg      Config
+	backend  Backend
+	handlers map[string]handlerFunc
+	hub      *Hub
+	listener net.Listener
+	server   *http.Server
+}
+
+// NewServer 创建 RPC 服务
+// 服务通过 backend.Subscribe 接收事件, 因此必须在节点 Start 之前创建
+func NewServer(cfg Config, backend Backend) *Server {
+	s := &Server{cfg: cfg, backend: backend, handlers: make(map[string]handlerFunc), hub: NewHub()}
+	if backend != nil {
+		backend.Subscribe(s.hub.Publish)
+	}
+	s.Handle("getblockcount", s.getBlockCount)
+	s.Handle("getdifficulty", s.getDifficulty)
+	s.Handle("getblock", s.getBlock)
+	s.Handle("getblockheader", s.getBlockHeader)
+	s.Handle("gettransaction", s.getTransaction)
+	s.Handle("getbalance", s.getBalance)
+	s.Handle("listunspent", s.listUnspent)
+	s.Handle("listspendable", s.listSpendable)
+	s.Handle("sendrawtransaction", s.sendRawTransaction)
+	s.Handle("getmempool", s.getMempool)
+	s.Handle("submitblock", s.submitBlock)
+	s.Handle("generate", s.generate)
+	s.Handle("ban", s.ban)
+	s.Handle("unban", s.unban)
+	s.Handle("listbanned", s.listBanned)
+	return s
+}
+
+// Handle 注册方法
+// 必须在 Start 之前调用
+func (s *Server) Handle(method string, handler func(params []json.RawMessage) (interface{}, error)) {
+	s.handlers[method] = handler
+}
+
+// CookiePath 数据目录 dir 中 cookie 文件的路径
+func CookiePath(dir string) string {
+	return filepath.Join(dir, ".cookie")
+}
+
+// ReadCookie 读取数据目录 dir 中的 cookie, 返回用户名和密码
+func ReadCookie(dir string) (string, string, error) {
+	data, err := os.ReadFile(CookiePath(dir))
+	if err != nil {
+		return "", "", err
+	}
+	user, password, ok := strings.Cut(strings.TrimSpace(string(data)), ":")
+	if !ok {
+		return "", "", errors.New("invalid cookie file")
+	}
+	return user, password, nil
+}
+
+// Start 开始监听
+func (s *Server) Start() error {
+	if s.cfg.Password == "" {
+		if s.cfg.DataDir == "" {
+			return errors.New("rpc password or data directory is required")
+		}
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		s.cfg.User, s.cfg.Password = CookieUser, hex.EncodeToString(secret)
+		if err := os.WriteFile(CookiePath(s.cfg.DataDir), []byte(s.cfg.User+":"+s.cfg.Password), 0o600); err != nil {
+			return err
+		}
+	}
+
+	listener, err := net.Listen("tcp", s.cfg.ListenAddr)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	s.server = &http.Server{Handler: s, ReadHeaderTimeout: 10 * time.Second}
+	go s.server.Serve(listener)
+	log.Printf("rpc listening on %s", listener.Addr())
+	return nil
+}
+
+// Stop 停止服务, 删除 cookie 文件
+func (s *Server) Stop() {
+	if s.server != nil {
+		s.server.Close()
+	}
+	if s.cfg.User == CookieUser {
+		os.Remove(CookiePath(s.cfg.DataDir))
+	}
+}
+
+// Addr 监听地址, 未监听时返回 nil
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// authorized 检查 HTTP Basic 认证
+func (s *Server) authorized(r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(s.cfg.User)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(s.cfg.Password)) == 1
+	return userOK && passwordOK
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="a10000"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path == "/events" && r.Method == http.MethodGet {
+		s.serveEvents(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req Request
+	resp := Response{JSONRPC: "2.0"}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxRequestSize)).Decode(&req); err != nil {
+		resp.Error = &Error{Code: CodeParseError, Message: err.Error()}
+	} else {
+		resp.ID = req.ID
+		resp.Result, resp.Error = s.call(&req)
+	}
+	if resp.ID == nil {
+		resp.ID = json.RawMessage("null")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&resp)
+}
+
+// call 调用请求的方法
+func (s *Server) call(req *Request) (json.RawMessage, *Error) {
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return nil, &Error{Code: CodeInvalidRequest, Message: "invalid request"}
+	}
+	handler, ok := s.handlers[req.Method]
+	if !ok {
+		return nil, &Error{Code: CodeMethodNotFound, Message: fmt.Sprintf("method %s not found", req.Method)}
+	}
+	result, err := handler(req.Params)
+	if err != nil {
+		var rpcErr *Error
+		if errors.As(err, &rpcErr) {
+			return nil, rpcErr
+		}
+		return nil, &Error{Code: CodeInternalError, Message: err.Error()}
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return nil, &Error{Code: CodeInternalError, Message: err.Error()}
+	}
+	return data, nil
+}
+
+// parseParams 将参数依次解析到 args, 参数数量必须一致
+func parseParams(params []json.RawMessage, args ...interface{}) error {
+	if len(params) != len(args) {
+		return &Error{Code: CodeInvalidParams, Message: fmt.Sprintf("expected %d params, got %d", len(args), len(params))}
+	}
+	for i, arg := range args {
+		if err := json.Unmarshal(params[i], arg); err != nil {
+			return &Error{Code: CodeInvalidParams, Message: fmt.Sprintf("invalid param %d: %v", i, err)}
+		}
+	}
+	return nil
+}
+
+func (s *Server) getBlockCount(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params); err != nil {
+		return nil, err
+	}
+	return s.backend.Height(), nil
+}
+
+// getDifficulty 下一个区块需要的工作量证明难度
+func (s *Server) getDifficulty(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params); err != nil {
+		return nil, err
+	}
+	return s.backend.NextDifficulty(), nil
+}
+
+// getBlock 参数为区块 Hash 或高度
+func (s *Server) getBlock(params []json.RawMessage) (interface{}, error) {
+	var id json.RawMessage
+	if err := parseParams(params, &id); err != nil {
+		return nil, err
+	}
+	var b *core.Block
+	var height int64
+	var hash string
+	if err := json.Unmarshal(id, &height); err == nil {
+		b = s.backend.BlockByHeight(height)
+	} else if err := json.Unmarshal(id, &hash); err == nil {
+		b = s.backend.BlockByHash(hash)
+	} else {
+		return nil, &Error{Code: CodeInvalidParams, Message: "block hash or height expected"}
+	}
+	if b == nil {
+		return nil, &Error{Code: CodeNotFound, Message: "block not found"}
+	}
+	return b, nil
+}
+
+// getBlockHeader 根据 Hash 或高度查询区块头, 区块体被修剪的区块也能查到
+func (s *Server) getBlockHeader(params []json.RawMessage) (interface{}, error) {
+	var id json.RawMessage
+	if err := parseParams(params, &id); err != nil {
+		return nil, err
+	}
+	var h *core.BlockHeader
+	var height int64
+	var hash string
+	if err := json.Unmarshal(id, &height); err == nil {
+		h = s.backend.HeaderByHeight(height)
+	} else if err := json.Unmarshal(id, &hash); err == nil {
+		h = s.backend.HeaderByHash(hash)
+	} else {
+		return nil, &Error{Code: CodeInvalidParams, Message: "block hash or height expected"}
+	}
+	if h == nil {
+		return nil, &Error{Code: CodeNotFound, Message: "block not found"}
+	}
+	return h, nil
+}
+
+func (s *Server) getTransaction(params []json.RawMessage) (interface{}, error) {
+	var id string
+	if err := parseParams(params, &id); err != nil {
+		return nil, err
+	}
+	tx, b := s.backend.Transaction(id)
+	if tx == nil {
+		return nil, &Error{Code: CodeNotFound, Message: "transaction not found"}
+	}
+	info := &TransactionInfo{Transaction: tx, Height: -1}
+	if b != nil {
+		info.BlockHash = b.Hash
+		info.Height = b.Index
+		info.Confirmations = s.backend.Height() - b.Index + 1
+	}
+	return info, nil
+}
+
+func (s *Server) getBalance(params []json.RawMessage) (interface{}, error) {
+	var address string
+	if err := parseParams(params, &address); err != nil {
+		return nil, err
+	}
+	balance := int64(0)
+	for _, output := range s.backend.FindUTXO(address) {
+		balance += output.Amount
+	}
+	return balance, nil
+}
+
+func (s *Server) listUnspent(params []json.RawMessage) (interface{}, error) {
+	var address string
+	if err := parseParams(params, &address); err != nil {
+		return nil, err
+	}
+	return unspentOutputs(s.backend.FindUTXO(address)), nil
+}
+
+// listSpendable 与 listunspent 相同, 但排除未成熟的 coinbase 输出和已被交易池中的交易花费的输出
+func (s *Server) listSpendable(params []json.RawMessage) (interface{}, error) {
+	var address string
+	if err := parseParams(params, &address); err != nil {
+		return nil, err
+	}
+	return unspentOutputs(s.backend.FindSpendableUTXO(address)), nil
+}
+
+// unspentOutputs 将 FindUTXO 的结果转换为按 txid 和 vout 排序的列表
+func unspentOutputs(utxo map[string]core.TxOutput) []UnspentOutput {
+	unspent := make([]UnspentOutput, 0)
+	for key, output := range utxo {
+		// key 的格式为 txid:index
+		i := strings.LastIndex(key, ":")
+		if i < 0 {
+			continue
+		}
+		vout, err := strconv.Atoi(key[i+1:])
+		if err != nil {
+			continue
+		}
+		unspent = append(unspent, UnspentOutput{Txid: key[:i], Vout: vout, Amount: output.Amount, PubKeyHash: output.PubKeyHash})
+	}
+	sort.Slice(unspent, func(i, j int) bool {
+		if unspent[i].Txid != unspent[j].Txid {
+			return unspent[i].Txid < unspent[j].Txid
+		}
+		return unspent[i].Vout < unspent[j].Vout
+	})
+	return unspent
+}
+
+func (s *Server) sendRawTransaction(params []json.RawMessage) (interface{}, error) {
+	var tx core.Transaction
+	if err := parseParams(params, &tx); err != nil {
+		return nil, err
+	}
+	if err := s.backend.SubmitTransaction(&tx); err != nil {
+		return nil, &Error{Code: CodeRejected, Message: err.Error()}
+	}
+	return tx.ID, nil
+}
+
+func (s *Server) getMempool(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params); err != nil {
+		return nil, err
+	}
+	return s.backend.PendingTransactions(), nil
+}
+
+func (s *Server) submitBlock(params []json.RawMessage) (interface{}, error) {
+	var b core.Block
+	if err := parseParams(params, &b); err != nil {
+		return nil, err
+	}
+	if err := s.backend.SubmitBlock(&b); err != nil {
+		return nil, &Error{Code: CodeRejected, Message: err.Error()}
+	}
+	return b.Hash, nil
+}
+
+// generate 立即挖出 N 个区块, 返回区块 Hash. 参数为 [N] 或 [N, 地址], 未指定地址时区块奖励无人可以花费
+// 只能用于 regtest 等允许按需挖矿的网络
+func (s *Server) generate(params []json.RawMessage) (interface{}, error) {
+	var count int
+	var address string
+	args := []interface{}{&count}
+	if len(params) == 2 {
+		args = append(args, &address)
+	}
+	if err := parseParams(params, args...); err != nil {
+		return nil, err
+	}
+	if count < 1 {
+		return nil, &Error{Code: CodeInvalidParams, Message: "block count must be positive"}
+	}
+	blocks, err := s.backend.Generate(count, address)
+	if err != nil {
+		return nil, &Error{Code: CodeRejected, Message: err.Error()}
+	}
+	hashes := make([]string, 0, len(blocks))
+	for _, b := range blocks {
+		hashes = append(hashes, b.Hash)
+	}
+	return hashes, nil
+}
+
+// ban 封禁地址并断开与其的连接, 返回封禁的单位(IP 或中继地址)
+// 参数为 [地址], [地址, 秒数] 或 [地址, 秒数, 原因], 地址可以是 IP, host:port 或中继地址
+func (s *Server) ban(params []json.RawMessage) (interface{}, error) {
+	var addr string
+	seconds := int64(p2p.DefaultBanDuration / time.Second)
+	reason := "manual"
+	args := []interface{}{&addr, &seconds, &reason}
+	if len(params) < len(args) {
+		args = args[:len(params)]
+	}
+	if err := parseParams(params, args...); err != nil {
+		return nil, err
+	}
+	if addr == "" || seconds <= 0 {
+		return nil, &Error{Code: CodeInvalidParams, Message: "address and positive ban duration expected"}
+	}
+	if err := s.backend.Ban(addr, time.Duration(seconds)*time.Second, reason); err != nil {
+		return nil, err
+	}
+	return p2p.BanKey(addr), nil
+}
+
+// unban 解封地址, 返回解封的单位
+func (s *Server) unban(params []json.RawMessage) (interface{}, error) {
+	var addr string
+	if err := parseParams(params, &addr); err != nil {
+		return nil, err
+	}
+	if !s.backend.BanList().IsBanned(p2p.BanKey(addr)) {
+		return nil, &Error{Code: CodeNotFound, Message: "address is not banned"}
+	}
+	if err := s.backend.Unban(addr); err != nil {
+		return nil, err
+	}
+	return p2p.BanKey(addr), nil
+}
+
+// listBanned 所有未过期的封禁, 按地址排序
+func (s *Server) listBanned(params []json.RawMessage) (interface{}, error) {
+	if err := parseParams(params); err != nil {
+		return nil, err
+	}
+	return s.backend.BanList().Entries(), nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"a10000/core"
+	"a10000/store"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// snapshotDump 将高度 height 的 UTXO 快照写入文件 path, height 小于 0 时使用最新的区块
+// 只能操作数据目录, 节点需要停止
+func snapshotDump(opts *cliOptions, height int64, path string) error {
+	if *opts.dataDir == "" {
+		return errors.New("-datadir is required")
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+	_, ch, err := openChain(*opts.dataDir, opts.params())
+	if err != nil {
+		return err
+	}
+	if height < 0 {
+		height = ch.Height()
+	}
+	state, err := ch.StateAt(height)
+	if err != nil {
+		return err
+	}
+	hash, err := store.WriteSnapshot(path, state)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("snapshot at height %d, block %s\n", height, state.Tip().Hash)
+	fmt.Printf("utxo hash %s (%d utxos)\n", hash, len(state.UTXO))
+	return nil
+}
+
+// snapshotLoad 以文件 path 中的 UTXO 快照作为空数据目录的起点
+// 快照必须是网络参数中的可信快照, 或者 UTXO 哈希与 trusted 一致. 节点启动后在后台验证快照
+func snapshotLoad(opts *cliOptions, trusted string, path string) error {
+	if *opts.dataDir == "" {
+		return errors.New("-datadir is required")
+	}
+	params := opts.params()
+	if err := params.CheckGenesis(); err != nil {
+		return err
+	}
+	state, err := store.ReadSnapshot(path)
+	if err != nil {
+		return err
+	}
+	hash := state.UTXOHash()
+	if !params.AssumedUTXO(state) && hash != trusted {
+		return fmt.Errorf("snapshot utxo hash %s is not trusted, pass it with -hash after checking it with a trusted source", hash)
+	}
+
+	s, err := store.Open(*opts.dataDir)
+	if err != nil {
+		return err
+	}
+	if err := s.Lock(); err != nil {
+		return err
+	}
+	ch := core.CreateBlockchain(params)
+	if err := s.LoadSnapshot(ch, params.GenesisBlock(), state); err != nil {
+		return err
+	}
+	fmt.Printf("loaded snapshot at height %d, block %s\n", state.Height(), state.Tip().Hash)
+	fmt.Println("start the node to sync new blocks, the snapshot is validated in the background")
+	return nil
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"a10000/core"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 引导文件:
+//
+// 新节点可以从引导文件导入区块, 而不必从网络下载. 文件的第一行是 BootstrapHeader,
+// 之后每行一个区块, 按高度连续排列. 区块的编码与区块存储和 block 消息相同.
+
+// BootstrapHeader 引导文件的文件头
+type BootstrapHeader struct {
+	Network string `json:"network"` // 网络名称
+	Genesis string `json:"genesis"` // 创世区块的 Hash, 只能导入到同一条区块链
+	From    int64  `json:"from"`    // 第一个区块的高度
+	To      int64  `json:"to"`      // 最后一个区块的高度
+}
+
+// BootstrapWriter 写入引导文件
+type BootstrapWriter struct {
+	enc  *json.Encoder
+	next int64 // 下一个区块的高度
+	to   int64
+}
+
+// NewBootstrapWriter 写入文件头, 之后依次写入高度从 header.From 到 header.To 的区块
+func NewBootstrapWriter(w io.Writer, header BootstrapHeader) (*BootstrapWriter, error) {
+	if header.From < 0 || header.From > header.To {
+		return nil, fmt.Errorf("invalid block range %d-%d", header.From, header.To)
+	}
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(&header); err != nil {
+		return nil, err
+	}
+	return &BootstrapWriter{enc: enc, next: header.From, to: header.To}, nil
+}
+
+// WriteBlock 写入下一个区块
+func (bw *BootstrapWriter) WriteBlock(b *core.Block) error {
+	if b.Index != bw.next || b.Index > bw.to {
+		return fmt.Errorf("expected block %d, got %d", bw.next, b.Index)
+	}
+	if err := bw.enc.Encode(b); err != nil {
+		return err
+	}
+	bw.next++
+	return nil
+}
+
+// BootstrapReader 读取引导文件
+type BootstrapReader struct {
+	Header BootstrapHeader
+	dec    *json.Decoder
+	next   int64 // 下一个区块的高度
+}
+
+// NewBootstrapReader 读取文件头
+func NewBootstrapReader(r io.Reader) (*BootstrapReader, error) {
+	br := &BootstrapReader{dec: json.NewDecoder(r)}
+	if err := br.dec.Decode(&br.Header); err != nil {
+		return nil, fmt.Errorf("invalid bootstrap header: %v", err)
+	}
+	if br.Header.Genesis == "" || br.Header.From < 0 || br.Header.From > br.Header.To {
+		return nil, errors.New("invalid bootstrap header")
+	}
+	br.next = br.Header.From
+	return br, nil
+}
+
+// Next 读取下一个区块, 全部读取后返回 io.EOF
+// 文件在最后一个区块之前结束时返回 io.ErrUnexpectedEOF
+func (br *BootstrapReader) Next() (*core.Block, error) {
+	if br.next > br.Header.To {
+		return nil, io.EOF
+	}
+	var b core.Block
+	if err := br.dec.Decode(&b); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("block %d: %v", br.next, err)
+	}
+	if b.Index != br.next {
+		return nil, fmt.Errorf("expected block %d, got %d", br.next, b.Index)
+	}
+	br.next++
+	return &b, nil
+}
@@ -0,0 +1,75 @@
+package store_test
+
+import (
+	"a10000/core"
+	"a10000/store"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestBootstrap(t *testing.T) {
+	tom, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate tom: %v", err)
+	}
+	ch := core.CreateBlockchain(core.RegtestParams)
+	if err := ch.ConnectGenesis(core.RegtestParams.GenesisBlock()); err != nil {
+		t.Fatalf("Failed to connect genesis block: %v", err)
+	}
+	if _, err := ch.Generate(10, tom.Address()); err != nil {
+		t.Fatalf("Failed to generate blocks: %v", err)
+	}
+
+	var buf bytes.Buffer
+	header := store.BootstrapHeader{Network: "regtest", Genesis: ch.BlockByHeight(0).Hash, From: 0, To: 10}
+	bw, err := store.NewBootstrapWriter(&buf, header)
+	if err != nil {
+		t.Fatalf("Failed to create bootstrap writer: %v", err)
+	}
+	if err := bw.WriteBlock(ch.BlockByHeight(1)); err == nil {
+		t.Fatal("Blocks should be written in order")
+	}
+	for height := int64(0); height <= 10; height++ {
+		if err := bw.WriteBlock(ch.BlockByHeight(height)); err != nil {
+			t.Fatalf("Failed to write block: %v", err)
+		}
+	}
+	data := buf.Bytes()
+
+	// 导入的区块通过 AddBlock 连接
+	br, err := store.NewBootstrapReader(bytes.NewReader(data))
+	if err != nil || br.Header != header {
+		t.Fatalf("Failed to read bootstrap header: %v", err)
+	}
+	imported := core.CreateBlockchain(core.RegtestParams)
+	for {
+		b, err := br.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read block: %v", err)
+		}
+		if b.Index == 0 {
+			err = imported.ConnectGenesis(b)
+		} else {
+			err = imported.AddBlock(b)
+		}
+		if err != nil {
+			t.Fatalf("Failed to connect block %d: %v", b.Index, err)
+		}
+	}
+	if imported.Tip().Hash != ch.Tip().Hash {
+		t.Fatal("Imported chain does not match")
+	}
+
+	// 不完整的文件
+	br, _ = store.NewBootstrapReader(bytes.NewReader(data[:len(data)/2]))
+	for err = nil; err == nil; _, err = br.Next() {
+	}
+	if errors.Is(err, io.EOF) {
+		t.Fatal("Truncated file should not end with io.EOF")
+	}
+}
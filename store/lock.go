@@ -0,0 +1,28 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// ErrLocked 数据目录正在被其他进程使用, 例如运行中的节点
+var ErrLocked = errors.New("data directory is in use by another process")
+
+// Lock 锁定数据目录, 其他进程再锁定时返回 ErrLocked. 锁在进程退出时释放
+// 节点和直接读写数据目录的命令持有锁, 避免同时修改数据目录中的文件
+func (s *BlockStore) Lock() error {
+	if s.lock != nil {
+		return nil
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, "LOCK"), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return err
+	}
+	s.lock = f
+	return nil
+}
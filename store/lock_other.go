@@ -0,0 +1,10 @@
+//go:build !unix
+
+package store
+
+import "os"
+
+// lockFile 不支持 flock 的平台不检查数据目录是否正在使用
+func lockFile(f *os.File) error {
+	return nil
+}
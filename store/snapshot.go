@@ -0,0 +1,106 @@
+package store
+
+import (
+	"a10000/core"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// UTXO 快照:
+//
+// 快照文件包含区块链在某一高度的状态(全部区块头和 UTXO)以及 UTXO 哈希, 读取时重新计算哈希检查内容是否一致.
+// 从快照启动的数据目录记录快照信息(snapshot.json), 节点在后台重放快照之前的区块, 验证通过后标记为已验证.
+// 验证失败的数据目录不能再使用, 需要删除后重新同步.
+
+// snapshotFile 快照文件的内容
+type snapshotFile struct {
+	UTXOHash string           `json:"utxo_hash"`
+	State    *core.ChainState `json:"state"`
+}
+
+// WriteSnapshot 将状态 state 写入快照文件, 返回 UTXO 哈希
+func WriteSnapshot(path string, state *core.ChainState) (string, error) {
+	hash := state.UTXOHash()
+	return hash, WriteJSON(path, &snapshotFile{UTXOHash: hash, State: state})
+}
+
+// ReadSnapshot 读取快照文件, 文件中的 UTXO 哈希与内容不符时返回错误
+func ReadSnapshot(path string) (*core.ChainState, error) {
+	var f snapshotFile
+	if err := ReadJSON(path, &f); err != nil {
+		return nil, err
+	}
+	if f.State == nil || len(f.State.Headers) == 0 {
+		return nil, errors.New("snapshot has no state")
+	}
+	if hash := f.State.UTXOHash(); hash != f.UTXOHash {
+		return nil, fmt.Errorf("snapshot utxo hash %s does not match its content %s", f.UTXOHash, hash)
+	}
+	return f.State, nil
+}
+
+// SnapshotBase 数据目录的起点快照
+type SnapshotBase struct {
+	Height    int64  `json:"height"`          // 快照所在的高度
+	Hash      string `json:"hash"`            // 快照所在区块的 Hash
+	UTXOHash  string `json:"utxo_hash"`       // 快照的 UTXO 哈希
+	Validated bool   `json:"validated"`       // 是否已从创世区块重放区块验证过
+	Error     string `json:"error,omitempty"` // 验证失败的原因
+}
+
+func (s *BlockStore) snapshotPath() string {
+	return filepath.Join(s.dir, "snapshot.json")
+}
+
+// PutSnapshotBase 保存起点快照的信息
+func (s *BlockStore) PutSnapshotBase(base *SnapshotBase) error {
+	return WriteJSON(s.snapshotPath(), base)
+}
+
+// SnapshotBase 读取起点快照的信息, 数据目录不是从快照启动时返回 nil
+func (s *BlockStore) SnapshotBase() (*SnapshotBase, error) {
+	var base SnapshotBase
+	if err := ReadJSON(s.snapshotPath(), &base); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &base, nil
+}
+
+// CheckSnapshot 数据目录从验证失败的快照启动时返回错误, 这样的数据目录需要删除后重新同步
+func (s *BlockStore) CheckSnapshot() error {
+	base, err := s.SnapshotBase()
+	if err != nil || base == nil || base.Error == "" {
+		return err
+	}
+	return fmt.Errorf("data directory was loaded from an invalid snapshot at height %d (%s), remove it and sync again", base.Height, base.Error)
+}
+
+// LoadSnapshot 以快照 state 作为空数据目录的起点: 在空的区块链 ch 上恢复状态,
+// 保存创世区块, 状态, 区块头链和快照信息. 之后的区块从快照所在高度继续连接
+func (s *BlockStore) LoadSnapshot(ch *core.Blockchain, genesis *core.Block, state *core.ChainState) error {
+	if s.HasBlock(1) {
+		return errors.New("data directory already has blocks")
+	}
+	if existing, err := s.State(); err != nil || existing != nil {
+		return errors.New("data directory already has a chain state")
+	}
+	if err := ch.RestoreState(genesis, state); err != nil {
+		return err
+	}
+	if err := s.SaveBlock(ch, genesis); err != nil {
+		return err
+	}
+	// 先记录快照信息, 保存状态之后数据目录才会从快照加载
+	if err := s.PutSnapshotBase(&SnapshotBase{Height: state.Height(), Hash: state.Tip().Hash, UTXOHash: state.UTXOHash()}); err != nil {
+		return err
+	}
+	if err := s.PutHeaders(state.Headers); err != nil {
+		return err
+	}
+	return s.PutState(state)
+}
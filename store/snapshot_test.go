@@ -0,0 +1,113 @@
+package store_test
+
+import (
+	"a10000/core"
+	"a10000/store"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	tom, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate tom: %v", err)
+	}
+	ch := core.CreateBlockchain(core.RegtestParams)
+	if err := ch.ConnectGenesis(core.RegtestParams.GenesisBlock()); err != nil {
+		t.Fatalf("Failed to connect genesis block: %v", err)
+	}
+	if _, err := ch.Generate(20, tom.Address()); err != nil {
+		t.Fatalf("Failed to generate blocks: %v", err)
+	}
+	state, err := ch.StateAt(15)
+	if err != nil {
+		t.Fatalf("Failed to get state: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "utxo.json")
+	hash, err := store.WriteSnapshot(path, state)
+	if err != nil || hash != state.UTXOHash() {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	read, err := store.ReadSnapshot(path)
+	if err != nil || read.UTXOHash() != hash || read.Tip().Hash != ch.BlockByHeight(15).Hash {
+		t.Fatalf("Failed to read snapshot: %v", err)
+	}
+
+	// 修改过的快照
+	data, _ := os.ReadFile(path)
+	tampered := filepath.Join(t.TempDir(), "tampered.json")
+	os.WriteFile(tampered, []byte(strings.Replace(string(data), `"value":50,`, `"value":5000,`, 1)), 0o644)
+	if _, err := store.ReadSnapshot(tampered); err == nil {
+		t.Fatal("Tampered snapshot should be rejected")
+	}
+
+	// 从快照启动的数据目录
+	s, _ := store.Open(t.TempDir())
+	if base, err := s.SnapshotBase(); err != nil || base != nil {
+		t.Fatal("New data directory should have no snapshot")
+	}
+	restored := core.CreateBlockchain(core.RegtestParams)
+	if err := s.LoadSnapshot(restored, core.RegtestParams.GenesisBlock(), read); err != nil {
+		t.Fatalf("Failed to load snapshot: %v", err)
+	}
+	if err := s.LoadSnapshot(core.CreateBlockchain(core.RegtestParams), core.RegtestParams.GenesisBlock(), read); err == nil {
+		t.Fatal("Snapshot should only be loaded into an empty data directory")
+	}
+	base, err := s.SnapshotBase()
+	if err != nil || base == nil || base.Height != 15 || base.UTXOHash != hash || base.Validated {
+		t.Fatalf("Unexpected snapshot base %+v: %v", base, err)
+	}
+	if err := s.CheckSnapshot(); err != nil {
+		t.Fatalf("Snapshot that is not validated yet should be usable: %v", err)
+	}
+
+	for h := int64(16); h <= 20; h++ {
+		b := ch.BlockByHeight(h)
+		if err := restored.AddBlock(b); err != nil {
+			t.Fatalf("Failed to connect block %d: %v", h, err)
+		}
+		s.SaveBlock(restored, b)
+	}
+	loaded := core.CreateBlockchain(core.RegtestParams)
+	if _, err := s.Load(loaded); err != nil {
+		t.Fatalf("Failed to load store: %v", err)
+	}
+	if loaded.Tip().Hash != ch.Tip().Hash || loaded.Pruned() != 15 || tom.Balance(loaded.FindUTXO(tom.Address())) != 20*50 {
+		t.Fatal("Snapshot store should load the same chain")
+	}
+
+	// 从快照启动后最新的区块只有区块头, 可以直接在其后挖出新的区块
+	mined := core.CreateBlockchain(core.RegtestParams)
+	minedStore, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	if err := minedStore.LoadSnapshot(mined, core.RegtestParams.GenesisBlock(), read); err != nil {
+		t.Fatalf("Failed to load snapshot: %v", err)
+	}
+	tip := mined.HeaderByHeight(mined.Height())
+	if tip == nil || tip.Hash != read.Tip().Hash {
+		t.Fatal("Header of the snapshot block should be available")
+	}
+	next := core.CreateBlock(16, []*core.Transaction{core.NewCoinbaseTX(16, tom.Address(), 50)}, tip.Hash, mined.NextDifficulty())
+	if err := mined.AddBlock(next); err != nil {
+		t.Fatalf("Failed to mine on the snapshot: %v", err)
+	}
+	if err := minedStore.SaveBlock(mined, next); err != nil {
+		t.Fatalf("Failed to save mined block: %v", err)
+	}
+	reloaded := core.CreateBlockchain(core.RegtestParams)
+	if _, err := minedStore.Load(reloaded); err != nil || reloaded.Tip().Hash != next.Hash {
+		t.Fatalf("Mined block should be loaded after the snapshot: %v", err)
+	}
+
+	// 验证失败的快照
+	base.Error = "utxo hash mismatch"
+	s.PutSnapshotBase(base)
+	if err := s.CheckSnapshot(); err == nil {
+		t.Fatal("Data directory with an invalid snapshot should be refused")
+	}
+}
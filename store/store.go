@@ -0,0 +1,424 @@
+package store
+
+import (
+	"a10000/core"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MinPruneWindow 修剪时至少保留的最近区块数量, 其他节点同步最新的区块时需要从修剪节点下载
+const MinPruneWindow = 10
+
+// BlockStore 区块存储
+//
+// 数据目录的结构:
+//
+//	blocks/<高度>.json  已连接到区块链的区块
+//	undo/<高度>.json    区块的撤销记录, 断开区块时用于恢复 UTXO
+//	chainstate.json     修剪后被删除的最高区块处的区块链状态, 加载时从该状态开始连接之后的区块
+//	snapshot.json       从 UTXO 快照启动时记录的快照信息和后台验证的结果
+//	headers.json        已下载的区块头链, 用于同步中断后继续同步
+//	mempool.json        交易池中尚未入链的交易, 节点停止时保存, 启动时重新加入交易池
+//	LOCK                使用数据目录的进程持有的锁, 见 Lock
+type BlockStore struct {
+	dir     string
+	pruneMu sync.Mutex // 保证修剪按顺序执行, 保存的状态不会回退
+	lock    *os.File   // 持有的数据目录锁, 未锁定时为 nil
+}
+
+// Open 打开数据目录, 目录不存在时创建
+func Open(dir string) (*BlockStore, error) {
+	for _, sub := range []string{"blocks", "undo"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &BlockStore{dir: dir}, nil
+}
+
+// Dir 数据目录
+func (s *BlockStore) Dir() string {
+	return s.dir
+}
+
+func (s *BlockStore) blockPath(height int64) string {
+	return filepath.Join(s.dir, "blocks", fmt.Sprintf("%d.json", height))
+}
+
+// PutBlock 保存区块
+func (s *BlockStore) PutBlock(b *core.Block) error {
+	return WriteJSON(s.blockPath(b.Index), b)
+}
+
+// GetBlock 读取高度为 height 的区块
+func (s *BlockStore) GetBlock(height int64) (*core.Block, error) {
+	var b core.Block
+	if err := ReadJSON(s.blockPath(height), &b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// HasBlock 判断是否保存了高度为 height 的区块
+func (s *BlockStore) HasBlock(height int64) bool {
+	_, err := os.Stat(s.blockPath(height))
+	return err == nil
+}
+
+// Heights 所有已保存区块的高度, 按从小到大排列
+func (s *BlockStore) Heights() ([]int64, error) {
+	return s.heights("blocks")
+}
+
+// heights 子目录 sub 中以高度命名的文件的高度, 按从小到大排列
+func (s *BlockStore) heights(sub string) ([]int64, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, sub))
+	if err != nil {
+		return nil, err
+	}
+	heights := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		height, err := strconv.ParseInt(strings.TrimSuffix(name, ".json"), 10, 64)
+		if err != nil {
+			continue
+		}
+		heights = append(heights, height)
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+	return heights, nil
+}
+
+func (s *BlockStore) undoPath(height int64) string {
+	return filepath.Join(s.dir, "undo", fmt.Sprintf("%d.json", height))
+}
+
+// PutUndo 保存高度为 height 的区块的撤销记录
+func (s *BlockStore) PutUndo(height int64, undo *core.BlockUndo) error {
+	return WriteJSON(s.undoPath(height), undo)
+}
+
+// GetUndo 读取高度为 height 的区块的撤销记录
+func (s *BlockStore) GetUndo(height int64) (*core.BlockUndo, error) {
+	var undo core.BlockUndo
+	if err := ReadJSON(s.undoPath(height), &undo); err != nil {
+		return nil, err
+	}
+	return &undo, nil
+}
+
+// SaveBlock 保存已连接到区块链 ch 的区块及其撤销记录
+func (s *BlockStore) SaveBlock(ch *core.Blockchain, b *core.Block) error {
+	undo := ch.Undo(b.Index)
+	if undo == nil || undo.Hash != b.Hash {
+		return fmt.Errorf("block %d is not connected", b.Index)
+	}
+	if err := s.PutUndo(b.Index, undo); err != nil {
+		return err
+	}
+	return s.PutBlock(b)
+}
+
+// Load 从创世区块开始, 将保存的区块依次连接到空的区块链 ch 上
+// 数据目录已被修剪时, 先恢复保存的状态, 再连接之后的区块. 返回连接的区块数量
+func (s *BlockStore) Load(ch *core.Blockchain) (int, error) {
+	if ch.Tip() != nil {
+		return 0, errors.New("blockchain is not empty")
+	}
+	count := 0
+	start := int64(0)
+	state, err := s.State()
+	if err != nil {
+		return 0, err
+	}
+	if state != nil {
+		genesis, err := s.GetBlock(0)
+		if err != nil {
+			return 0, err
+		}
+		if err := ch.RestoreState(genesis, state); err != nil {
+			return 0, fmt.Errorf("chain state: %v", err)
+		}
+		start = state.Height() + 1
+	}
+	for height := start; s.HasBlock(height); height++ {
+		b, err := s.GetBlock(height)
+		if err != nil {
+			return count, err
+		}
+		if height == 0 {
+			err = ch.ConnectGenesis(b)
+		} else {
+			err = ch.AddBlock(b)
+		}
+		if err != nil {
+			return count, fmt.Errorf("block %d: %v", height, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Check 比较数据目录中保存的数据与从区块重建的区块链 ch 是否一致, 返回发现的所有问题:
+// 保存的区块都已连接, 每个未修剪的区块都有与重建结果相同的撤销记录, 区块头链与已连接的区块一致
+func (s *BlockStore) Check(ch *core.Blockchain) ([]string, error) {
+	problems := make([]string, 0)
+	tip := ch.Height()
+	pruned := ch.Pruned()
+	chainHeaders := ch.Headers(0, int(tip)+1)
+	heights, err := s.Heights()
+	if err != nil {
+		return nil, err
+	}
+	for _, height := range heights {
+		if height > tip {
+			problems = append(problems, fmt.Sprintf("block %d is not connected", height))
+		}
+	}
+
+	for height := int64(0); height <= tip; height++ {
+		if height > 0 && height <= pruned {
+			continue
+		}
+		undo, err := s.GetUndo(height)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("block %d: missing undo record: %v", height, err))
+			continue
+		}
+		if !reflect.DeepEqual(undo, ch.Undo(height)) {
+			problems = append(problems, fmt.Sprintf("block %d: undo record does not match", height))
+		}
+	}
+	undoHeights, err := s.heights("undo")
+	if err != nil {
+		return nil, err
+	}
+	for _, height := range undoHeights {
+		if height > tip {
+			problems = append(problems, fmt.Sprintf("undo record %d has no connected block", height))
+		}
+	}
+
+	headers, err := s.Headers()
+	if err != nil {
+		return nil, err
+	}
+	for i, h := range headers {
+		if h.Index != int64(i) {
+			problems = append(problems, fmt.Sprintf("header %d has index %d", i, h.Index))
+			break
+		}
+		if h.Index <= tip && chainHeaders[h.Index].Hash != h.Hash {
+			problems = append(problems, fmt.Sprintf("header %d does not match block", h.Index))
+			break
+		}
+	}
+
+	state, err := s.State()
+	if err != nil {
+		return nil, err
+	}
+	if state != nil && (state.Height() != pruned || state.Headers[pruned].Hash != chainHeaders[pruned].Hash) {
+		problems = append(problems, fmt.Sprintf("chain state at height %d does not match pruned height %d", state.Height(), pruned))
+	}
+	return problems, nil
+}
+
+// Reindex 根据已连接到 ch 的区块重新生成派生的数据:
+// 重写所有未修剪区块的撤销记录, 删除没有对应区块的撤销记录和应当已被修剪的文件, 区块头链重置为已连接区块的区块头
+func (s *BlockStore) Reindex(ch *core.Blockchain) error {
+	tip := ch.Height()
+	pruned := ch.Pruned()
+	if _, err := s.removePruned(pruned); err != nil {
+		return err
+	}
+	for height := int64(0); height <= tip; height++ {
+		if height > 0 && height <= pruned {
+			continue
+		}
+		if err := s.PutUndo(height, ch.Undo(height)); err != nil {
+			return err
+		}
+	}
+	undoHeights, err := s.heights("undo")
+	if err != nil {
+		return err
+	}
+	for _, height := range undoHeights {
+		if height > tip {
+			if err := os.Remove(s.undoPath(height)); err != nil {
+				return err
+			}
+		}
+	}
+	return s.PutHeaders(ch.Headers(0, int(tip)+1))
+}
+
+func (s *BlockStore) statePath() string {
+	return filepath.Join(s.dir, "chainstate.json")
+}
+
+// PutState 保存区块链状态
+func (s *BlockStore) PutState(state *core.ChainState) error {
+	return WriteJSON(s.statePath(), state)
+}
+
+// State 读取保存的区块链状态, 数据目录没有被修剪时返回 nil
+func (s *BlockStore) State() (*core.ChainState, error) {
+	var state core.ChainState
+	if err := ReadJSON(s.statePath(), &state); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &state, nil
+}
+
+// Prune 只保留最近 window 个区块的区块体和撤销记录, 删除更早的区块文件(创世区块除外)
+// 删除之前先保存被修剪的最高区块处的状态. 返回删除的区块数量
+// 保存状态需要写入全部区块头和 UTXO, 因此超出 window 的区块累计达到 window/2 个时才修剪,
+// 实际保留 window 到 window*3/2 个区块
+func (s *BlockStore) Prune(ch *core.Blockchain, window int64) (int, error) {
+	if window < MinPruneWindow {
+		return 0, fmt.Errorf("prune window must be at least %d blocks", MinPruneWindow)
+	}
+	s.pruneMu.Lock()
+	defer s.pruneMu.Unlock()
+	height := ch.Height() - window
+	if height-ch.Pruned() < window/2 {
+		return 0, nil
+	}
+	state, err := ch.StateAt(height)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.PutState(state); err != nil {
+		return 0, err
+	}
+	if err := ch.Prune(height); err != nil {
+		return 0, err
+	}
+	return s.removePruned(height)
+}
+
+// RemoveBlock 删除高度为 height 的区块文件和撤销记录, 区块从区块链上断开后调用
+func (s *BlockStore) RemoveBlock(height int64) error {
+	for _, path := range []string{s.blockPath(height), s.undoPath(height)} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removePruned 删除高度不超过 height 的区块文件和撤销记录(创世区块除外), 返回删除的区块数量
+func (s *BlockStore) removePruned(height int64) (int, error) {
+	count := 0
+	for _, sub := range []string{"blocks", "undo"} {
+		heights, err := s.heights(sub)
+		if err != nil {
+			return count, err
+		}
+		for _, h := range heights {
+			if h == 0 || h > height {
+				continue
+			}
+			if err := os.Remove(filepath.Join(s.dir, sub, fmt.Sprintf("%d.json", h))); err != nil {
+				return count, err
+			}
+			if sub == "blocks" {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+func (s *BlockStore) headersPath() string {
+	return filepath.Join(s.dir, "headers.json")
+}
+
+// PutHeaders 保存区块头链
+func (s *BlockStore) PutHeaders(headers []*core.BlockHeader) error {
+	return WriteJSON(s.headersPath(), headers)
+}
+
+// Headers 读取保存的区块头链, 不存在时返回空
+func (s *BlockStore) Headers() ([]*core.BlockHeader, error) {
+	headers := make([]*core.BlockHeader, 0)
+	if err := ReadJSON(s.headersPath(), &headers); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return headers, nil
+		}
+		return nil, err
+	}
+	return headers, nil
+}
+
+func (s *BlockStore) mempoolPath() string {
+	return filepath.Join(s.dir, "mempool.json")
+}
+
+// PutMempool 保存交易池中的交易
+func (s *BlockStore) PutMempool(txs []*core.Transaction) error {
+	return WriteJSON(s.mempoolPath(), txs)
+}
+
+// Mempool 读取保存的交易池, 不存在时返回空
+func (s *BlockStore) Mempool() ([]*core.Transaction, error) {
+	txs := make([]*core.Transaction, 0)
+	if err := ReadJSON(s.mempoolPath(), &txs); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return txs, nil
+		}
+		return nil, err
+	}
+	return txs, nil
+}
+
+// WriteJSON 将 v 以 JSON 格式写入文件
+// 先写入临时文件再重命名, 避免写入中断导致文件损坏. 每次写入使用不同的临时文件, 同一个文件可以被并发写入
+func WriteJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	// 重命名后临时文件已不存在, 删除失败可以忽略
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o644)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ReadJSON 读取 JSON 格式的文件到 v
+func ReadJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
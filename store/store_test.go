@@ -0,0 +1,236 @@
+package store_test
+
+import (
+	"a10000/core"
+	"a10000/store"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestBlockStore(t *testing.T) {
+	tom, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate tom: %v", err)
+	}
+	ch := core.CreateBlockchain(core.RegtestParams)
+	if err = ch.GenesisBlock(core.NewCoinbaseTX(0, tom.Address(), 50)); err != nil {
+		t.Fatalf("Failed to create genesis block: %v", err)
+	}
+	for height := int64(1); height <= 11; height++ {
+		b := core.CreateBlock(height, []*core.Transaction{core.NewCoinbaseTX(height, tom.Address(), 50)}, ch.BlockByHeight(height-1).Hash, ch.NextDifficulty())
+		if err = ch.AddBlock(b); err != nil {
+			t.Fatalf("Failed to add block: %v", err)
+		}
+	}
+
+	s, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	for height := int64(0); height <= ch.Height(); height++ {
+		if err = s.SaveBlock(ch, ch.BlockByHeight(height)); err != nil {
+			t.Fatalf("Failed to save block: %v", err)
+		}
+	}
+	if undo, err := s.GetUndo(11); err != nil || undo.Hash != ch.BlockByHeight(11).Hash {
+		t.Fatalf("Failed to load undo record: %v", err)
+	}
+
+	heights, err := s.Heights()
+	if err != nil {
+		t.Fatalf("Failed to list heights: %v", err)
+	}
+	for i, height := range heights {
+		if height != int64(i) {
+			t.Fatalf("Heights should be sorted, got %v", heights)
+		}
+	}
+
+	loaded := core.CreateBlockchain(core.RegtestParams)
+	count, err := s.Load(loaded)
+	if err != nil {
+		t.Fatalf("Failed to load blocks: %v", err)
+	}
+	if int64(count) != ch.Height()+1 || loaded.BlockByHeight(11).Hash != ch.BlockByHeight(11).Hash {
+		t.Fatalf("Loaded chain is incorrect, loaded %d blocks", count)
+	}
+	if tom.Balance(loaded.FindUTXO(tom.Address())) != 600 {
+		t.Fatal("UTXO set should be rebuilt when loading blocks")
+	}
+
+	if txs, err := s.Mempool(); err != nil || len(txs) != 0 {
+		t.Fatalf("Missing mempool should be empty: %v %v", txs, err)
+	}
+	pending := []*core.Transaction{core.NewCoinbaseTX(12, tom.Address(), 50)}
+	if err := s.PutMempool(pending); err != nil {
+		t.Fatalf("Failed to save mempool: %v", err)
+	}
+	if txs, err := s.Mempool(); err != nil || len(txs) != 1 || txs[0].ID != pending[0].ID {
+		t.Fatalf("Loaded mempool is incorrect: %v %v", txs, err)
+	}
+}
+
+func TestCheckAndReindex(t *testing.T) {
+	tom, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate tom: %v", err)
+	}
+	ch := core.CreateBlockchain(core.RegtestParams)
+	if err := ch.ConnectGenesis(core.RegtestParams.GenesisBlock()); err != nil {
+		t.Fatalf("Failed to connect genesis block: %v", err)
+	}
+	blocks, err := ch.Generate(5, tom.Address())
+	if err != nil {
+		t.Fatalf("Failed to generate blocks: %v", err)
+	}
+
+	s, _ := store.Open(t.TempDir())
+	s.SaveBlock(ch, ch.BlockByHeight(0))
+	for _, b := range blocks {
+		if err := s.SaveBlock(ch, b); err != nil {
+			t.Fatalf("Failed to save block: %v", err)
+		}
+	}
+	if problems, err := s.Check(ch); err != nil || len(problems) != 0 {
+		t.Fatalf("Consistent store should have no problems: %v %v", problems, err)
+	}
+
+	// 多余的撤销记录, 区块头链与区块不一致, 撤销记录与区块不一致
+	s.PutUndo(9, ch.Undo(5))
+	headers := ch.Headers(0, 6)
+	headers[3] = headers[4]
+	s.PutHeaders(headers)
+	s.PutUndo(2, ch.Undo(1))
+	problems, err := s.Check(ch)
+	if err != nil || len(problems) != 3 {
+		t.Fatalf("Expected 3 problems, got %v %v", problems, err)
+	}
+
+	if err := s.Reindex(ch); err != nil {
+		t.Fatalf("Failed to reindex: %v", err)
+	}
+	if problems, err := s.Check(ch); err != nil || len(problems) != 0 {
+		t.Fatalf("Reindexed store should have no problems: %v %v", problems, err)
+	}
+	if stored, _ := s.Headers(); len(stored) != 6 || stored[5].Hash != ch.Tip().Hash {
+		t.Fatal("Header chain should be rebuilt from blocks")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	tom, err := core.NewWallet()
+	if err != nil {
+		t.Fatalf("Failed to generate tom: %v", err)
+	}
+	ch := core.CreateBlockchain(core.RegtestParams)
+	if err := ch.ConnectGenesis(core.RegtestParams.GenesisBlock()); err != nil {
+		t.Fatalf("Failed to connect genesis block: %v", err)
+	}
+	s, _ := store.Open(t.TempDir())
+	s.SaveBlock(ch, ch.BlockByHeight(0))
+	blocks, err := ch.Generate(25, tom.Address())
+	if err != nil {
+		t.Fatalf("Failed to generate blocks: %v", err)
+	}
+	for _, b := range blocks {
+		s.SaveBlock(ch, b)
+	}
+
+	if _, err := s.Prune(ch, store.MinPruneWindow-1); err == nil {
+		t.Fatal("Prune window below the minimum should be rejected")
+	}
+	count, err := s.Prune(ch, store.MinPruneWindow)
+	if err != nil || count != 15 {
+		t.Fatalf("Expected 15 pruned blocks, got %d: %v", count, err)
+	}
+	if heights, _ := s.Heights(); len(heights) != 11 || heights[0] != 0 || heights[1] != 16 {
+		t.Fatalf("Expected genesis and the last 10 blocks, got %v", heights)
+	}
+	if problems, err := s.Check(ch); err != nil || len(problems) != 0 {
+		t.Fatalf("Pruned store should have no problems: %v %v", problems, err)
+	}
+
+	loaded := core.CreateBlockchain(core.RegtestParams)
+	if count, err := s.Load(loaded); err != nil || count != 10 {
+		t.Fatalf("Expected to load 10 blocks, got %d: %v", count, err)
+	}
+	if loaded.Tip().Hash != ch.Tip().Hash || loaded.Pruned() != 15 || tom.Balance(loaded.FindUTXO(tom.Address())) != 25*50 {
+		t.Fatal("Pruned store should load the same chain")
+	}
+
+	// 超出 window 的区块达到 window/2 个时才再次修剪
+	generate := func(n int) {
+		blocks, err := ch.Generate(n, tom.Address())
+		if err != nil {
+			t.Fatalf("Failed to generate blocks: %v", err)
+		}
+		for _, b := range blocks {
+			s.SaveBlock(ch, b)
+		}
+	}
+	generate(store.MinPruneWindow/2 - 1)
+	if count, err := s.Prune(ch, store.MinPruneWindow); err != nil || count != 0 || ch.Pruned() != 15 {
+		t.Fatalf("Expected no pruning before a full batch, pruned %d blocks to %d: %v", count, ch.Pruned(), err)
+	}
+	generate(1)
+	if count, err := s.Prune(ch, store.MinPruneWindow); err != nil || count != store.MinPruneWindow/2 || ch.Pruned() != 20 {
+		t.Fatalf("Expected a batch of %d pruned blocks, pruned %d to %d: %v", store.MinPruneWindow/2, count, ch.Pruned(), err)
+	}
+	if state, err := s.State(); err != nil || state.Height() != 20 {
+		t.Fatalf("Chain state should be saved with the batch: %v", err)
+	}
+}
+
+func TestConcurrentWriteJSON(t *testing.T) {
+	// 多个节点的区块头可能同时保存到同一个文件
+	dir := t.TempDir()
+	path := filepath.Join(dir, "headers.json")
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- store.WriteJSON(path, []int{i, i, i})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Concurrent write failed: %v", err)
+		}
+	}
+
+	var v []int
+	if err := store.ReadJSON(path, &v); err != nil || len(v) != 3 || v[0] != v[1] || v[1] != v[2] {
+		t.Fatalf("File should hold one complete write: %v %v", v, err)
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 1 {
+		t.Fatalf("Temporary files should be removed: %v", err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	dir := t.TempDir()
+	s, err := store.Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	if err := s.Lock(); err != nil {
+		t.Fatalf("Failed to lock data directory: %v", err)
+	}
+	if err := s.Lock(); err != nil {
+		t.Fatalf("Locking twice should succeed: %v", err)
+	}
+	other, err := store.Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	if err := other.Lock(); !errors.Is(err, store.ErrLocked) {
+		t.Fatalf("Locked data directory should be refused, got %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"a10000/core"
+	"a10000/store"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// verifyCommand 检查数据目录中保存的数据是否一致, 节点需要停止.
+// 从创世区块开始重放所有区块, 重新验证区块和全部交易, 重建 UTXO 和撤销记录, 再与保存的数据比较.
+// 设置 -reindex 时先根据区块重新生成撤销记录和区块头链
+//
+//	verify -datadir DIR [-network NET] [-reindex]
+func verifyCommand(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	network := fs.String("network", core.MainNetParams.Name, "网络: mainnet, testnet, regtest 或私有网络的参数文件")
+	dataDir := fs.String("datadir", "", "数据目录")
+	reindex := fs.Bool("reindex", false, "根据区块重新生成撤销记录和区块头链")
+	fs.Parse(args)
+	if *dataDir == "" {
+		log.Fatal("-datadir is required")
+	}
+
+	params, err := loadParams(*network)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := params.CheckGenesis(); err != nil {
+		log.Fatal(err)
+	}
+	blockStore, err := store.Open(*dataDir)
+	if err == nil {
+		err = blockStore.Lock()
+	}
+	if err != nil {
+		log.Fatalf("failed to open data directory: %v", err)
+	}
+
+	problems := make([]string, 0)
+	// 加载区块时完整验证每个区块, 无效的区块及其后的区块不会被连接
+	ch := core.CreateBlockchain(params)
+	if _, err := blockStore.Load(ch); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if ch.Tip() == nil {
+		log.Fatalf("%s has no genesis block", *dataDir)
+	}
+	if ch.BlockByHeight(0).Hash != params.GenesisBlock().Hash {
+		log.Fatalf("%s does not belong to network %s", *dataDir, params.Name)
+	}
+	if err := ch.VerifyState(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if *reindex {
+		if err := blockStore.Reindex(ch); err != nil {
+			log.Fatalf("failed to reindex: %v", err)
+		}
+		fmt.Printf("reindexed %d blocks\n", ch.Height()+1)
+	}
+	stored, err := blockStore.Check(ch)
+	if err != nil {
+		log.Fatalf("failed to check data directory: %v", err)
+	}
+	problems = append(problems, stored...)
+
+	snapshot := ch.Snapshot()
+	total := int64(0)
+	for _, entry := range snapshot.UTXO {
+		total += entry.Amount
+	}
+	fmt.Printf("height %d, tip %s, %d utxos, total amount %d\n", snapshot.Height, snapshot.Tip.Hash, len(snapshot.UTXO), total)
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("found %d problems\n", len(problems))
+		os.Exit(1)
+	}
+	fmt.Println("ok")
+}